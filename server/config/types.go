@@ -1,5 +1,15 @@
 package config
 
+import (
+	"context"
+	"game-3-card-poker/server/limiter"
+	"game-3-card-poker/server/service"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
 // Configuration object extracted from YAML configuration file.
 type Configuration struct {
 	Server Server              `mapstructure:"server"`
@@ -7,10 +17,96 @@ type Configuration struct {
 	Smtp   SMTPConfiguration   `mapstructure:"smtp"`
 	Redis  *RedisConfiguration `mapstructure:"redis"`
 	Argon2 Argon2Password      `mapstructure:"argon2"`
+
+	RateLimit RateLimitConfiguration `mapstructure:"rate_limit"`
+
+	Achievements []service.AchievementRule `mapstructure:"achievements"` // 成就规则
 }
 
 type Server struct {
-	Port int `mapstructure:"port"`
+	Port         int                    `mapstructure:"port"`
+	WebSocket    WebSocketConfiguration `mapstructure:"websocket"`
+	DrainTimeout time.Duration          `mapstructure:"drain_timeout"` // 服务关闭时等待进行中的当局结束的最长时间
+	GameStore    string                 `mapstructure:"game_store"`    // 房间状态存储: redis(默认), memory(仅单机开发)
+	Admins       []string               `mapstructure:"admins"`        // 管理员钱包地址,可访问/api/admin接口
+	RepairEvery  time.Duration          `mapstructure:"repair_every"`  // 以数据库为准修复房间状态的周期
+
+	LeaderboardArchive string `mapstructure:"leaderboard_archive"` // 归档日榜、周榜的cron表达式
+
+	// 可信的反向代理IP或CIDR,仅这些地址转发的 X-Forwarded-For、X-Real-IP 请求头用于获取客户端IP
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	trustedProxies []*net.IPNet
+}
+
+// ShutdownMargin 服务关闭时等待当局结束后,保存房间状态、关闭连接及HTTP服务预留的时间
+const ShutdownMargin = 15 * time.Second
+
+// StopTimeout returns the longest time the application may take to stop, draining included.
+func (s Server) StopTimeout() time.Duration {
+	return s.DrainTimeout + ShutdownMargin
+}
+
+// DrainTimeoutWithin returns the drain timeout that leaves ShutdownMargin before the ctx deadline.
+func (s Server) DrainTimeoutWithin(ctx context.Context) time.Duration {
+	timeout := s.DrainTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remain := time.Until(deadline) - ShutdownMargin; remain < timeout {
+			timeout = remain
+		}
+	}
+	return timeout
+}
+
+// setDefaults fills the server settings that are missing in the YAML configuration file.
+func (s *Server) setDefaults() {
+	if s.DrainTimeout <= 0 {
+		s.DrainTimeout = 30 * time.Second
+	}
+	if s.RepairEvery < time.Second {
+		s.RepairEvery = time.Minute
+	}
+	if len(s.LeaderboardArchive) == 0 {
+		s.LeaderboardArchive = "@daily"
+	}
+	s.trustedProxies = make([]*net.IPNet, 0, len(s.TrustedProxies))
+	for _, proxy := range s.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Printf("trusted proxy %q invalid: %s", proxy, err)
+			continue
+		}
+		s.trustedProxies = append(s.trustedProxies, ipNet)
+	}
+	s.WebSocket.setDefaults()
+}
+
+// IsTrustedProxy reports whether the ip is one of the trusted reverse proxies.
+func (s Server) IsTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range s.trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebSocketConfiguration represents the heartbeat and presence settings of game connections.
+type WebSocketConfiguration struct {
+	PingInterval time.Duration `mapstructure:"ping_interval"` // 心跳发送间隔
+	PongWait     time.Duration `mapstructure:"pong_wait"`     // 等待心跳响应超时(读超时)
+	WriteWait    time.Duration `mapstructure:"write_wait"`    // 写消息超时
+	AwayTimeout  time.Duration `mapstructure:"away_timeout"`  // 离开状态多久后判定离线
 }
 
 type User struct {
@@ -23,6 +119,41 @@ type User struct {
 	DefaultBalance      int64    `mapstructure:"defaultBalance"`
 }
 
+// IsAdmin reports whether the wallet address is allowed to access the admin api.
+func (s Server) IsAdmin(address string) bool {
+	for _, admin := range s.Admins {
+		if len(address) > 0 && admin == address {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitConfiguration represents the token bucket limits of http routes and websocket actions.
+// Buckets are kept per IP and per login user, the "default" key applies to routes or actions not listed.
+type RateLimitConfiguration struct {
+	Routes  map[string]limiter.Limit `mapstructure:"routes"`
+	Actions map[string]limiter.Limit `mapstructure:"actions"`
+}
+
+// RouteLimit returns the limit of the http route path.
+func (r RateLimitConfiguration) RouteLimit(path string) limiter.Limit {
+	return r.getLimit(r.Routes, path)
+}
+
+// ActionLimit returns the limit of the websocket action name.
+func (r RateLimitConfiguration) ActionLimit(action string) limiter.Limit {
+	return r.getLimit(r.Actions, action)
+}
+
+func (r RateLimitConfiguration) getLimit(limits map[string]limiter.Limit, name string) limiter.Limit {
+	// viper的配置key不区分大小写
+	if limit, ok := limits[strings.ToLower(name)]; ok {
+		return limit
+	}
+	return limits["default"]
+}
+
 // Argon2Password represents the argon2 hashing settings.
 type Argon2Password struct {
 	Variant     string `mapstructure:"variant"`
@@ -53,3 +184,20 @@ type SMTPConfiguration struct {
 	Sender     string `mapstructure:"sender"`
 	Subject    string `mapstructure:"subject"`
 }
+
+// setDefaults fills the websocket settings that are missing in the YAML configuration file.
+func (w *WebSocketConfiguration) setDefaults() {
+	if w.PongWait <= 0 {
+		w.PongWait = 60 * time.Second
+	}
+	if w.PingInterval <= 0 || w.PingInterval >= w.PongWait {
+		// 心跳间隔必须小于读超时
+		w.PingInterval = w.PongWait * 9 / 10
+	}
+	if w.WriteWait <= 0 {
+		w.WriteWait = 10 * time.Second
+	}
+	if w.AwayTimeout <= 0 {
+		w.AwayTimeout = 60 * time.Second
+	}
+}
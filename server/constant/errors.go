@@ -1,6 +1,10 @@
 package constant
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	RoundError = errors.New("不在当前游戏中-或者加入旁观者")
@@ -40,4 +44,84 @@ var (
 	UserSetAutoBettingError = errors.New("用户设置自动下注操作")
 
 	DelayOperateExpiredError = errors.New("延续消息处理过期")
+
+	RequestTooFrequentError = errors.New("请求过于频繁,请稍后再试")
+
+	GameBusyError = errors.New("游戏操作繁忙,请稍后再试")
+
+	GameStoppedError = errors.New("游戏房间已停止")
+
+	GameNotExistError = errors.New("游戏房间不存在或已过期")
+
+	ServerShuttingDownError = errors.New("服务正在关闭,请稍后重新连接")
+
+	GameVersionConflictError = errors.New("游戏状态已变更,请重试")
+
+	LedgerUnbalancedError = errors.New("记账分录借贷不平衡")
+
+	BuyInOutOfRangeError = errors.New("买入筹码超出房间限制")
+
+	StackChangePlayingError = errors.New("游戏中不能买入或兑出筹码")
+
+	DuplicateActionError = errors.New("重复的操作请求")
 )
+
+// actionErrors 客户端操作返回的业务错误,重复提交的操作按错误信息还原首次执行的错误
+var actionErrors = []error{
+	RoundError,
+	RoundNotCurrentError,
+	GameNotOperateError,
+	GameEndError,
+	GameNotAuthorityStartError,
+	GameStartNotReachedNumberError,
+	GamePayingError,
+	GameNotInJoinError,
+	GamePayingJoinError,
+	GamePkUserInvalidError,
+	GamePkUserMySelfError,
+	GameRaisBetNotEnoughError,
+	NotCurrentOperateError,
+	UserNotExistError,
+	UserNotEnoughBetError,
+	UserSetAutoBettingError,
+	BuyInOutOfRangeError,
+	StackChangePlayingError,
+}
+
+// IsActionError 是否为客户端操作的业务错误,其他错误(服务异常)重新提交时再次执行
+func IsActionError(err error) bool {
+	for _, actionError := range actionErrors {
+		if errors.Is(err, actionError) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseActionError 由错误信息还原客户端操作的错误,带有详细信息的错误(如 InsufficientFundsError)包装为对应的错误
+func ParseActionError(msg string) error {
+	for _, err := range actionErrors {
+		if msg == err.Error() {
+			return err
+		}
+		if strings.HasPrefix(msg, err.Error()) {
+			return fmt.Errorf("%w%s", err, strings.TrimPrefix(msg, err.Error()))
+		}
+	}
+	return errors.New(msg)
+}
+
+// InsufficientFundsError 用户余额不足以扣除,errors.Is 判断等同于 UserNotEnoughBetError
+type InsufficientFundsError struct {
+	UserId  int64
+	Balance int64 // 扣除时的余额
+	Amount  int64 // 需要扣除的筹码
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("%s,余额%d,需要%d", UserNotEnoughBetError.Error(), e.Balance, e.Amount)
+}
+
+func (e *InsufficientFundsError) Is(target error) bool {
+	return target == UserNotEnoughBetError
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"log"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -14,18 +13,26 @@ import (
 // DelayQueue is a message queue supporting delayed/scheduled delivery based on redis https://github.com/lhzptg/DelayQueue/blob/main/delayqueue.go
 type DelayQueue struct {
 	// name for this Queue. Make sure the name is unique in redis database
-	name          string
-	redisCli      *redis.Client
-	cb            func(msg, idStr string) bool
-	pendingKey    string // sorted set: message id -> delivery time
-	readyKey      string // list
-	unAckKey      string // sorted set: message id -> retry time
-	retryKey      string // list
-	retryCountKey string // hash: message id -> remain retry count
-	garbageKey    string // set: message id
-	ticker        *time.Ticker
-	logger        *log.Logger
-	close         chan struct{}
+	name            string
+	redisCli        *redis.Client
+	cb              func(msg, idStr string) bool
+	pendingKey      string // sorted set: message id -> delivery time in milliseconds
+	readyKey        string // list
+	unAckKey        string // sorted set: message id -> retry time in milliseconds
+	retryKey        string // list
+	retryCountKey   string // hash: message id -> remain retry count
+	garbageKey      string // set: message id
+	failCountKey    string // hash: message id -> failure count
+	lastErrorKey    string // hash: message id -> error of the last delivery
+	deadKey         string // hash: message id -> dead letter json
+	scheduleKey     string // hash: schedule name -> schedule json
+	idempotencyKey  string // hash: message id -> idempotency key of message
+	msgOptionKey    string // hash: message id -> "retryCount:ttl milliseconds" the message was sent with, restored by requeue
+	scheduleNextKey string // sorted set: schedule name -> next run time in milliseconds
+	notifyKey       string // pub/sub channel: published when a message is sent, wakes up consumers of all instances
+	wakeup          chan struct{}
+	logger          *log.Logger
+	close           chan struct{}
 
 	maxConsumeDuration time.Duration
 	msgTTL             time.Duration
@@ -60,6 +67,15 @@ func NewQueue(name string, cli *redis.Client, callback DelayCallbackFunc) *Delay
 		retryKey:           "dp:" + name + ":retry",
 		retryCountKey:      "dp:" + name + ":retry:cnt",
 		garbageKey:         "dp:" + name + ":garbage",
+		failCountKey:       "dp:" + name + ":fail:cnt",
+		lastErrorKey:       "dp:" + name + ":error",
+		deadKey:            "dp:" + name + ":dead",
+		scheduleKey:        "dp:" + name + ":schedule",
+		idempotencyKey:     "dp:" + name + ":idempotency",
+		msgOptionKey:       "dp:" + name + ":option",
+		scheduleNextKey:    "dp:" + name + ":schedule:next",
+		notifyKey:          "dp:" + name + ":notify",
+		wakeup:             make(chan struct{}, 1),
 		close:              make(chan struct{}, 1),
 		maxConsumeDuration: 5 * time.Second,
 		msgTTL:             time.Hour,
@@ -76,7 +92,8 @@ func (q *DelayQueue) WithLogger(logger *log.Logger) *DelayQueue {
 	return q
 }
 
-// WithFetchInterval customizes the interval at which consumer fetch message from redis
+// WithFetchInterval customizes the max interval at which consumer fetch message from redis
+// consumer wakes up earlier at the deadline of the earliest pending message or when a new message is sent
 func (q *DelayQueue) WithFetchInterval(d time.Duration) *DelayQueue {
 	q.fetchInterval = d
 	return q
@@ -115,6 +132,10 @@ func (q *DelayQueue) genMsgKey(idStr string) string {
 	return "dp:" + q.name + ":msg:" + idStr
 }
 
+func (q *DelayQueue) genIdempotencyKey(key string) string {
+	return "dp:" + q.name + ":idempotency:" + key
+}
+
 type retryCountOpt int
 
 // WithRetryCount set retry count for a msg
@@ -131,37 +152,98 @@ func WithMsgTTL(d time.Duration) interface{} {
 	return msgTTLOpt(d)
 }
 
-// SendScheduleMsg submits a message delivered at given time
-func (q *DelayQueue) SendScheduleMsg(payload string, t time.Time, opts ...interface{}) (string, error) {
-	// parse options
-	retryCount := q.defaultRetryCount
+type idempotencyKeyOpt string
+
+// WithIdempotencyKey deduplicates a msg, sending a msg with the same key again returns the id of the existing msg
+// the key is kept until the msg expires (delivery + msg ttl) or is cancelled
+// example: queue.SendDelayMsg(payload, duration, delayqueue.WithIdempotencyKey(key))
+func WithIdempotencyKey(key string) interface{} {
+	return idempotencyKeyOpt(key)
+}
+
+// msgOptions are the options of a particular message
+type msgOptions struct {
+	retryCount     uint
+	msgTTL         time.Duration
+	idempotencyKey string
+}
+
+// parseMsgOptions overrides defaults with opts, opts of other types are ignored
+func parseMsgOptions(defaults msgOptions, opts []interface{}) msgOptions {
 	for _, opt := range opts {
 		switch o := opt.(type) {
 		case retryCountOpt:
-			retryCount = uint(o)
+			defaults.retryCount = uint(o)
 		case msgTTLOpt:
-			q.msgTTL = time.Duration(o)
+			defaults.msgTTL = time.Duration(o)
+		case idempotencyKeyOpt:
+			defaults.idempotencyKey = string(o)
 		}
 	}
+	return defaults
+}
+
+// SendScheduleMsg submits a message delivered at given time
+func (q *DelayQueue) SendScheduleMsg(payload string, t time.Time, opts ...interface{}) (string, error) {
+	options := parseMsgOptions(msgOptions{retryCount: q.defaultRetryCount, msgTTL: q.msgTTL}, opts)
+	return q.sendScheduleMsg(payload, t, options)
+}
+
+// sendMsgScript atomically stores the payload, retry count and options, and puts the message to pending
+// returns the id of the existing message if the idempotency key exists
+// keys: msgKey, retryCountKey, pendingKey, msgOptionKey, idempotencyHashKey, idempotencyKey(optional)
+// argv: idStr, payload, msg ttl milliseconds, retryCount, delivery time milliseconds, msg option
+const sendMsgScript = `
+if #KEYS == 6 then
+	local existing = redis.call('Get', KEYS[6])
+	if existing then return existing end
+	redis.call('Set', KEYS[6], ARGV[1], 'PX', ARGV[3])
+	redis.call('HSet', KEYS[5], ARGV[1], KEYS[6])
+end
+redis.call('Set', KEYS[1], ARGV[2], 'PX', ARGV[3])
+redis.call('HSet', KEYS[2], ARGV[1], ARGV[4])
+redis.call('HSet', KEYS[4], ARGV[1], ARGV[6])
+redis.call('ZAdd', KEYS[3], ARGV[5], ARGV[1])
+return ARGV[1]
+`
+
+// msgOption encodes the retry count and ttl of a message
+func msgOption(retryCount uint, msgTTL time.Duration) string {
+	return fmt.Sprintf("%d:%d", retryCount, msgTTL.Milliseconds())
+}
+
+// parseMsgOption decodes the value of msgOptionKey, ok is false for messages sent by older versions
+func parseMsgOption(value string) (retryCount uint, msgTTL time.Duration, ok bool) {
+	var ttl int64
+	if _, err := fmt.Sscanf(value, "%d:%d", &retryCount, &ttl); err != nil || ttl <= 0 {
+		return 0, 0, false
+	}
+	return retryCount, time.Duration(ttl) * time.Millisecond, true
+}
+
+// sendScheduleMsg stores the payload which expires ttl after delivery time, and puts it to pending
+func (q *DelayQueue) sendScheduleMsg(payload string, t time.Time, options msgOptions) (string, error) {
 	// generate id
 	idStr := uuid.Must(uuid.NewRandom()).String()
 	ctx := context.Background()
 	now := time.Now()
 	// store msg
-	msgTTL := t.Sub(now) + q.msgTTL // delivery + q.msgTTL
-	err := q.redisCli.Set(ctx, q.genMsgKey(idStr), payload, msgTTL).Err()
-	if err != nil {
-		return "", fmt.Errorf("store msg failed: %v", err)
+	msgTTL := t.Sub(now) + options.msgTTL // delivery + ttl
+	if msgTTL < time.Millisecond {
+		msgTTL = time.Millisecond
 	}
-	// store retry count
-	err = q.redisCli.HSet(ctx, q.retryCountKey, idStr, retryCount).Err()
-	if err != nil {
-		return "", fmt.Errorf("store retry count failed: %v", err)
+	keys := []string{q.genMsgKey(idStr), q.retryCountKey, q.pendingKey, q.msgOptionKey, q.idempotencyKey}
+	if options.idempotencyKey != "" {
+		keys = append(keys, q.genIdempotencyKey(options.idempotencyKey))
 	}
-	// put to pending
-	err = q.redisCli.ZAdd(ctx, q.pendingKey, redis.Z{Score: float64(t.Unix()), Member: idStr}).Err()
+	idStr, err := q.redisCli.Eval(ctx, sendMsgScript, keys, idStr, payload, msgTTL.Milliseconds(), options.retryCount, t.UnixMilli(), msgOption(options.retryCount, options.msgTTL)).Text()
 	if err != nil {
-		return "", fmt.Errorf("push to pending failed: %v", err)
+		return "", fmt.Errorf("store msg failed: %v", err)
+	}
+	// wake up consumers to reschedule, the message may be earlier than their next fetch
+	q.notify()
+	if err = q.redisCli.Publish(ctx, q.notifyKey, idStr).Err(); err != nil {
+		q.logger.Printf("notify consumers failed: %v", err)
 	}
 	return idStr, nil
 }
@@ -172,32 +254,41 @@ func (q *DelayQueue) SendDelayMsg(payload string, duration time.Duration, opts .
 	return q.SendScheduleMsg(payload, t, opts...)
 }
 
-// Delete2PendingScript atomically delete messages from pending, readycnt, msg
-// keys: pendingKey, readyKey, genMsgKey
-// argv: durationTime, idStr
-const delete2PendingScript = `
-local msgs = redis.call('ZRangeByScore', KEYS[1], '0', ARGV[1])  -- get ready msg
-if (#msgs == 0) then return '-1' end 
-for _,v in ipairs(msgs) do 
-    if v ~= nil and v == ARGV[2] then 
-        redis.call('ZREM', KEYS[1], ARGV[2]) -- remove msgs from pending
-        redis.call('HDEL', KEYS[2], ARGV[2]) -- remove msgs from ready:cnt
-        redis.call('DEL', KEYS[3])  -- remove from msg
-        return '1' 
-    end 
-end 
-return '0' 
+// cancelScript atomically removes a message from pending, ready, retry and unack, and deletes its payload, retry count, options and failures
+// the idempotency key is released if it still belongs to this message
+// keys: pendingKey, readyKey, retryKey, unAckKey, retryCountKey, msgKey, failCountKey, lastErrorKey, msgOptionKey, idempotencyHashKey, idempotencyKey(optional)
+// argv: idStr
+const cancelScript = `
+local removed = redis.call('ZRem', KEYS[1], ARGV[1])
+removed = removed + redis.call('LRem', KEYS[2], 0, ARGV[1])
+removed = removed + redis.call('LRem', KEYS[3], 0, ARGV[1])
+removed = removed + redis.call('ZRem', KEYS[4], ARGV[1])
+redis.call('HDel', KEYS[5], ARGV[1])
+redis.call('Del', KEYS[6])
+redis.call('HDel', KEYS[7], ARGV[1])
+redis.call('HDel', KEYS[8], ARGV[1])
+redis.call('HDel', KEYS[9], ARGV[1])
+redis.call('HDel', KEYS[10], ARGV[1])
+if #KEYS == 11 and redis.call('Get', KEYS[11]) == ARGV[1] then
+	redis.call('Del', KEYS[11])
+end
+return removed
 `
 
-func (q *DelayQueue) Delete2PendingScript(idStr string, duration time.Duration) (int, error) {
-	now := time.Now().Add(duration).Unix()
+// Cancel removes a message which is pending, ready or waiting for retry, so that it will not be delivered.
+// A message being consumed (unack) can not be interrupted, but it will not be re-delivered.
+// Returns false if the message has been consumed or does not exist
+func (q *DelayQueue) Cancel(idStr string) (bool, error) {
 	ctx := context.Background()
-	keys := []string{q.pendingKey, q.retryCountKey, q.genMsgKey(idStr)}
-	ret, err := q.redisCli.Eval(ctx, delete2PendingScript, keys, now, idStr).Result()
-	if err != nil && err != redis.Nil {
-		return -1, fmt.Errorf("delete2PendingScript failed: %v", err)
+	keys := []string{q.pendingKey, q.readyKey, q.retryKey, q.unAckKey, q.retryCountKey, q.genMsgKey(idStr), q.failCountKey, q.lastErrorKey, q.msgOptionKey, q.idempotencyKey}
+	if key, err := q.redisCli.HGet(ctx, q.idempotencyKey, idStr).Result(); err == nil {
+		keys = append(keys, key)
+	}
+	removed, err := q.redisCli.Eval(ctx, cancelScript, keys, idStr).Int()
+	if err != nil {
+		return false, fmt.Errorf("cancel msg failed: %v", err)
 	}
-	return strconv.Atoi(ret.(string))
+	return removed > 0, nil
 }
 
 // pending2ReadyScript atomically moves messages from pending to ready
@@ -221,7 +312,7 @@ redis.call('ZRemRangeByScore', KEYS[1], '0', ARGV[1])  -- remove msgs from pendi
 `
 
 func (q *DelayQueue) pending2Ready() error {
-	now := time.Now().Unix()
+	now := time.Now().UnixMilli()
 	ctx := context.Background()
 	keys := []string{q.pendingKey, q.readyKey}
 	err := q.redisCli.Eval(ctx, pending2ReadyScript, keys, now).Err()
@@ -231,20 +322,21 @@ func (q *DelayQueue) pending2Ready() error {
 	return nil
 }
 
-// ready2UnackScript atomically moves messages from ready to unack
-// keys: readyKey/retryKey, unackKey
+// ready2UnackScript atomically moves messages from ready to unack, and clears the error of the previous delivery
+// keys: readyKey/retryKey, unackKey, lastErrorKey
 // argv: retryTime
 const ready2UnackScript = `
 local msg = redis.call('RPop', KEYS[1])
 if (not msg) then return end
 redis.call('ZAdd', KEYS[2], ARGV[1], msg)
+redis.call('HDel', KEYS[3], msg)
 return msg
 `
 
 func (q *DelayQueue) ready2Unack() (string, error) {
-	retryTime := time.Now().Add(q.maxConsumeDuration).Unix()
+	retryTime := time.Now().Add(q.maxConsumeDuration).UnixMilli()
 	ctx := context.Background()
-	keys := []string{q.readyKey, q.unAckKey}
+	keys := []string{q.readyKey, q.unAckKey, q.lastErrorKey}
 	ret, err := q.redisCli.Eval(ctx, ready2UnackScript, keys, retryTime).Result()
 	if err == redis.Nil {
 		return "", err
@@ -260,10 +352,10 @@ func (q *DelayQueue) ready2Unack() (string, error) {
 }
 
 func (q *DelayQueue) retry2Unack() (string, error) {
-	retryTime := time.Now().Add(q.maxConsumeDuration).Unix()
+	retryTime := time.Now().Add(q.maxConsumeDuration).UnixMilli()
 	ctx := context.Background()
-	keys := []string{q.retryKey, q.unAckKey}
-	ret, err := q.redisCli.Eval(ctx, ready2UnackScript, keys, retryTime, q.retryKey, q.unAckKey).Result()
+	keys := []string{q.retryKey, q.unAckKey, q.lastErrorKey}
+	ret, err := q.redisCli.Eval(ctx, ready2UnackScript, keys, retryTime).Result()
 	if err == redis.Nil {
 		return "", redis.Nil
 	}
@@ -285,13 +377,15 @@ func (q *DelayQueue) callback(idStr string) error {
 	}
 	if err != nil {
 		// Is an IO error?
-		return fmt.Errorf("get message payload failed: %v", err)
+		err = fmt.Errorf("get message payload failed: %v", err)
+		_ = q.nack(idStr, err.Error())
+		return err
 	}
 	ack := q.cb(payload, idStr)
 	if ack {
 		err = q.ack(idStr)
 	} else {
-		err = q.nack(idStr)
+		err = q.nack(idStr, "callback returned false")
 	}
 	return err
 }
@@ -342,15 +436,23 @@ func (q *DelayQueue) ack(idStr string) error {
 	// msg key has ttl, ignore result of delete
 	_ = q.redisCli.Del(ctx, q.genMsgKey(idStr)).Err()
 	q.redisCli.HDel(ctx, q.retryCountKey, idStr)
+	q.redisCli.HDel(ctx, q.failCountKey, idStr)
+	q.redisCli.HDel(ctx, q.msgOptionKey, idStr)
+	// idempotency key is kept until expired, so that a consumed msg is not sent again
+	q.redisCli.HDel(ctx, q.idempotencyKey, idStr)
 	return nil
 }
 
-func (q *DelayQueue) nack(idStr string) error {
+// nack records the reason of failure, the message will be retried or moved to dead letters
+func (q *DelayQueue) nack(idStr string, reason string) error {
 	ctx := context.Background()
+	if err := q.redisCli.HSet(ctx, q.lastErrorKey, idStr, reason).Err(); err != nil {
+		return fmt.Errorf("store last error failed: %v", err)
+	}
 	// update retry time as now, unack2Retry will move it to retry immediately
 	err := q.redisCli.ZAdd(ctx, q.unAckKey, redis.Z{
 		Member: idStr,
-		Score:  float64(time.Now().Unix()),
+		Score:  float64(time.Now().UnixMilli()),
 	}).Err()
 	if err != nil {
 		return fmt.Errorf("negative ack failed: %v", err)
@@ -361,14 +463,17 @@ func (q *DelayQueue) nack(idStr string) error {
 // unack2RetryScript atomically moves messages from unack to retry which remaining retry count greater than 0,
 // and moves messages from unack to garbage which  retry count is 0
 // Because DelayQueue cannot determine garbage message before eval unack2RetryScript, so it cannot pass keys parameter to redisCli.Eval
-// Therefore unack2RetryScript moves garbage message to garbageKey instead of deleting directly
-// keys: unackKey, retryCountKey, retryKey, garbageKey
+// Therefore unack2RetryScript moves garbage message to garbageKey, and garbageCollect moves them to dead letters
+// Every message moved out of unack is a failure: nack with a reason, or consume timeout if no reason recorded
+// keys: unackKey, retryCountKey, retryKey, garbageKey, failCountKey, lastErrorKey
 // argv: currentTime
 const unack2RetryScript = `
 local unack2retry = function(msgs)
 	local retryCounts = redis.call('HMGet', KEYS[2], unpack(msgs)) -- get retry count
 	for i,v in ipairs(retryCounts) do
 		local k = msgs[i]
+		redis.call("HIncrBy", KEYS[5], k, 1) -- add failure count
+		redis.call("HSetNX", KEYS[6], k, 'consume timeout')
 		if v ~= nil and v ~= '' and tonumber(v) > 0 then
 			redis.call("HIncrBy", KEYS[2], k, -1) -- reduce retry count
 			redis.call("LPush", KEYS[3], k) -- add to retry
@@ -400,43 +505,23 @@ redis.call('ZRemRangeByScore', KEYS[1], '0', ARGV[1])  -- remove msgs from unack
 
 func (q *DelayQueue) unack2Retry() error {
 	ctx := context.Background()
-	keys := []string{q.unAckKey, q.retryCountKey, q.retryKey, q.garbageKey}
+	keys := []string{q.unAckKey, q.retryCountKey, q.retryKey, q.garbageKey, q.failCountKey, q.lastErrorKey}
 	now := time.Now()
-	err := q.redisCli.Eval(ctx, unack2RetryScript, keys, now.Unix()).Err()
+	err := q.redisCli.Eval(ctx, unack2RetryScript, keys, now.UnixMilli()).Err()
 	if err != nil && err != redis.Nil {
 		return fmt.Errorf("unack to retry script failed: %v", err)
 	}
 	return nil
 }
 
-func (q *DelayQueue) garbageCollect() error {
-	ctx := context.Background()
-	msgIds, err := q.redisCli.SMembers(ctx, q.garbageKey).Result()
+func (q *DelayQueue) consume() error {
+	// due schedules to pending
+	err := q.fireSchedules()
 	if err != nil {
-		return fmt.Errorf("smembers failed: %v", err)
-	}
-	if len(msgIds) == 0 {
-		return nil
-	}
-	// allow concurrent clean
-	msgKeys := make([]string, 0, len(msgIds))
-	for _, idStr := range msgIds {
-		msgKeys = append(msgKeys, q.genMsgKey(idStr))
-	}
-	err = q.redisCli.Del(ctx, msgKeys...).Err()
-	if err != nil && err != redis.Nil {
-		return fmt.Errorf("del msgs failed: %v", err)
-	}
-	err = q.redisCli.SRem(ctx, q.garbageKey, msgIds).Err()
-	if err != nil && err != redis.Nil {
-		return fmt.Errorf("remove from garbage key failed: %v", err)
+		return err
 	}
-	return nil
-}
-
-func (q *DelayQueue) consume() error {
 	// pending to ready
-	err := q.pending2Ready()
+	err = q.pending2Ready()
 	if err != nil {
 		return err
 	}
@@ -488,23 +573,97 @@ func (q *DelayQueue) consume() error {
 	return nil
 }
 
+// legacyScoreScript converts delivery and retry times written in seconds by older versions to milliseconds,
+// so that in-flight messages are not retried at once after upgrade. The retry list has no scores
+// scores lower than 1e11 milliseconds (1973) can only be seconds
+// keys: pendingKey, unAckKey
+const legacyScoreScript = `
+local count = 0
+for _, key in ipairs(KEYS) do
+	local msgs = redis.call('ZRangeByScore', key, '0', '100000000000', 'WITHSCORES')
+	for i = 1, #msgs, 2 do
+		redis.call('ZAdd', key, tonumber(msgs[i + 1]) * 1000, msgs[i])
+	end
+	count = count + #msgs / 2
+end
+return count
+`
+
+func (q *DelayQueue) migrateLegacyScore() error {
+	ctx := context.Background()
+	err := q.redisCli.Eval(ctx, legacyScoreScript, []string{q.pendingKey, q.unAckKey}).Err()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("legacyScoreScript failed: %v", err)
+	}
+	return nil
+}
+
+// notify wakes up the local consumer without blocking
+func (q *DelayQueue) notify() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// nextFetchDelay returns the duration until the earliest pending, unack message or schedule is due, at most fetchInterval
+func (q *DelayQueue) nextFetchDelay() time.Duration {
+	ctx := context.Background()
+	delay := q.fetchInterval
+	for _, key := range []string{q.pendingKey, q.unAckKey, q.scheduleNextKey} {
+		earliest, err := q.redisCli.ZRangeWithScores(ctx, key, 0, 0).Result()
+		if err != nil || len(earliest) == 0 {
+			continue
+		}
+		d := time.Until(time.UnixMilli(int64(earliest[0].Score)))
+		if d < delay {
+			delay = d
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
 // StartConsume creates a goroutine to consume message from DelayQueue
+// consumer sleeps until the earliest pending deadline instead of polling, and is woken up when a message is sent
 // use `<-done` to wait consumer stopping
 func (q *DelayQueue) StartConsume() (done <-chan struct{}) {
-	q.ticker = time.NewTicker(q.fetchInterval)
+	if err := q.migrateLegacyScore(); err != nil {
+		q.logger.Print(err)
+	}
+	pubSub := q.redisCli.Subscribe(context.Background(), q.notifyKey)
+	go func() {
+		for range pubSub.Channel() {
+			q.notify()
+		}
+	}()
+
 	done0 := make(chan struct{})
 	go func() {
-	tickerLoop:
+		defer pubSub.Close()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+	consumeLoop:
 		for {
 			select {
-			case <-q.ticker.C:
+			case <-timer.C:
 				err := q.consume()
 				if err != nil {
 					log.Printf("consume error: %v", err)
 				}
+			case <-q.wakeup:
 			case <-q.close:
-				break tickerLoop
+				break consumeLoop
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
 			}
+			timer.Reset(q.nextFetchDelay())
 		}
 		close(done0)
 	}()
@@ -514,7 +673,4 @@ func (q *DelayQueue) StartConsume() (done <-chan struct{}) {
 // StopConsume stops consumer goroutine
 func (q *DelayQueue) StopConsume() {
 	close(q.close)
-	if q.ticker != nil {
-		q.ticker.Stop()
-	}
 }
@@ -0,0 +1,352 @@
+package daley
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T) *DelayQueue {
+	t.Helper()
+	cli := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	return NewQueue("test", cli, func(string, string) bool { return false })
+}
+
+func TestDelayQueue_Cancel(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t)
+
+	assertCancel := func(idStr string, want bool) {
+		t.Helper()
+		ok, err := queue.Cancel(idStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("Cancel(%s) = %v, want %v", idStr, ok, want)
+		}
+		if n, _ := queue.redisCli.Exists(ctx, queue.genMsgKey(idStr)).Result(); n != 0 {
+			t.Fatalf("payload of %s not deleted", idStr)
+		}
+	}
+
+	// pending
+	pendingId, _ := queue.SendDelayMsg("pending", time.Hour)
+	assertCancel(pendingId, true)
+
+	// ready
+	readyId, _ := queue.SendDelayMsg("ready", 0)
+	if err := queue.pending2Ready(); err != nil {
+		t.Fatal(err)
+	}
+	assertCancel(readyId, true)
+
+	// retry
+	retryId, _ := queue.SendDelayMsg("retry", 0)
+	queue.pending2Ready()
+	if _, err := queue.ready2Unack(); err != nil {
+		t.Fatal(err)
+	}
+	queue.nack(retryId, "test")
+	if err := queue.unack2Retry(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := queue.redisCli.LLen(ctx, queue.retryKey).Result(); n != 1 {
+		t.Fatalf("retry length = %d, want 1", n)
+	}
+	assertCancel(retryId, true)
+
+	// 已取消或不存在
+	assertCancel(pendingId, false)
+
+	for _, key := range []string{queue.pendingKey, queue.readyKey, queue.retryKey, queue.unAckKey} {
+		if n, _ := queue.redisCli.Exists(ctx, key).Result(); n != 0 {
+			t.Fatalf("%s is not empty", key)
+		}
+	}
+	if n, _ := queue.redisCli.HLen(ctx, queue.retryCountKey).Result(); n != 0 {
+		t.Fatalf("retry count length = %d, want 0", n)
+	}
+}
+
+func TestDelayQueue_ConsumeOnDeadline(t *testing.T) {
+	cli := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	delivered := make(chan time.Time, 2)
+	consumer := NewQueue("test", cli, func(string, string) bool {
+		delivered <- time.Now()
+		return true
+	}).WithFetchInterval(time.Hour)
+	done := consumer.StartConsume()
+	defer func() {
+		consumer.StopConsume()
+		<-done
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// 同一实例及其他实例发送的消息均按截止时间投递,不等待轮询间隔
+	producer := NewQueue("test", cli, func(string, string) bool { return true })
+	for _, queue := range []*DelayQueue{consumer, producer} {
+		deadline := time.Now().Add(200 * time.Millisecond)
+		if _, err := queue.SendScheduleMsg("deadline", deadline); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case at := <-delivered:
+			if late := at.Sub(deadline); late < 0 || late > 100*time.Millisecond {
+				t.Fatalf("delivered %v after deadline", late)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+}
+
+func TestDelayQueue_MigrateLegacyScore(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t)
+
+	// 旧版本按秒保存的投递时间及消费中消息的重试时间
+	deliverAt := time.Now().Add(time.Minute)
+	queue.redisCli.ZAdd(ctx, queue.pendingKey, redis.Z{Score: float64(deliverAt.Unix()), Member: "legacy"})
+	queue.redisCli.ZAdd(ctx, queue.unAckKey, redis.Z{Score: float64(deliverAt.Unix()), Member: "legacy-unack"})
+	queue.redisCli.HSet(ctx, queue.retryCountKey, "legacy-unack", 3)
+	if err := queue.migrateLegacyScore(); err != nil {
+		t.Fatal(err)
+	}
+	for key, member := range map[string]string{queue.pendingKey: "legacy", queue.unAckKey: "legacy-unack"} {
+		score, err := queue.redisCli.ZScore(ctx, key, member).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(score) != deliverAt.Unix()*1000 {
+			t.Fatalf("%s score = %v, want %d", key, score, deliverAt.Unix()*1000)
+		}
+	}
+
+	// 未到期,不会被提前投递或重试
+	queue.pending2Ready()
+	if n, _ := queue.redisCli.LLen(ctx, queue.readyKey).Result(); n != 0 {
+		t.Fatalf("ready length = %d, want 0", n)
+	}
+	queue.unack2Retry()
+	if n, _ := queue.redisCli.LLen(ctx, queue.retryKey).Result(); n != 0 {
+		t.Fatalf("retry length = %d, want 0", n)
+	}
+}
+
+func TestDelayQueue_DeadLetter(t *testing.T) {
+	ctx := context.Background()
+	cli := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	deliveries := 0
+	queue := NewQueue("test", cli, func(string, string) bool {
+		deliveries++
+		return false
+	}).WithDefaultRetryCount(1)
+
+	idStr, _ := queue.SendDelayMsg("dead", 0)
+	// 首次投递及1次重试均失败
+	for i := 0; i < 2; i++ {
+		if err := queue.consume(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deliveries != 2 {
+		t.Fatalf("deliveries = %d, want 2", deliveries)
+	}
+
+	deadLetters, err := queue.DeadLetters(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 {
+		t.Fatalf("dead letters = %+v, want 1", deadLetters)
+	}
+	deadLetter := deadLetters[0]
+	if deadLetter.Id != idStr || deadLetter.Payload != "dead" || deadLetter.Failures != 2 || deadLetter.LastError != "callback returned false" {
+		t.Fatalf("dead letter = %+v", deadLetter)
+	}
+
+	stats, err := queue.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (QueueStats{Name: "test", Dead: 1}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	// 重新投递
+	if result, _ := queue.Requeue(idStr, "not-exist"); result.Requeued != 1 || len(result.Lost) != 0 {
+		t.Fatalf("requeue result = %+v, want 1 requeued", result)
+	}
+	if stats, _ = queue.Stats(); stats.Pending != 1 || stats.Dead != 0 {
+		t.Fatalf("stats after requeue = %+v", stats)
+	}
+	if payload, _ := cli.Get(ctx, queue.genMsgKey(idStr)).Result(); payload != "dead" {
+		t.Fatalf("payload = %s after requeue", payload)
+	}
+	// 重新投递使用默认重试次数
+	for i := 0; i < 2; i++ {
+		queue.consume()
+	}
+	if deliveries != 4 {
+		t.Fatalf("deliveries = %d after requeue, want 4", deliveries)
+	}
+
+	// 清除
+	if count, _ := queue.Purge(); count != 1 {
+		t.Fatalf("purge count = %d, want 1", count)
+	}
+	if stats, _ = queue.Stats(); stats != (QueueStats{Name: "test"}) {
+		t.Fatalf("stats after purge = %+v", stats)
+	}
+}
+
+func TestDelayQueue_DeadLetterTimeout(t *testing.T) {
+	queue := newTestQueue(t).WithDefaultRetryCount(0).WithMaxConsumeDuration(-time.Second)
+
+	// 未确认且超过最长消费时间
+	idStr, _ := queue.SendDelayMsg("timeout", 0)
+	queue.pending2Ready()
+	queue.ready2Unack()
+	queue.unack2Retry()
+	queue.garbageCollect()
+
+	deadLetters, _ := queue.DeadLetters(0, 0)
+	if len(deadLetters) != 1 || deadLetters[0].Id != idStr || deadLetters[0].Failures != 1 || deadLetters[0].LastError != "consume timeout" {
+		t.Fatalf("dead letters = %+v", deadLetters)
+	}
+}
+
+func TestDelayQueue_RequeueLostPayload(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t).WithDefaultRetryCount(0).WithMaxConsumeDuration(-time.Second)
+
+	// 消息内容在进入死信前已过期
+	idStr, _ := queue.SendDelayMsg("lost", 0)
+	queue.pending2Ready()
+	queue.ready2Unack()
+	queue.redisCli.Del(ctx, queue.genMsgKey(idStr))
+	queue.unack2Retry()
+	queue.garbageCollect()
+
+	deadLetters, _ := queue.DeadLetters(0, 0)
+	if len(deadLetters) != 1 || !deadLetters[0].PayloadLost {
+		t.Fatalf("dead letters = %+v, want payload lost", deadLetters)
+	}
+
+	// 拒绝重新投递并保留死信
+	result, err := queue.Requeue(idStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Requeued != 0 || len(result.Lost) != 1 || result.Lost[0] != idStr {
+		t.Fatalf("requeue result = %+v, want lost %s", result, idStr)
+	}
+	if stats, _ := queue.Stats(); stats.Pending != 0 || stats.Dead != 1 {
+		t.Fatalf("stats after requeue = %+v", stats)
+	}
+}
+
+func TestDelayQueue_RequeueMsgOptions(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t).WithMaxConsumeDuration(-time.Second)
+
+	// 消息按发送时的重试次数及过期时间重新投递,不使用队列默认值
+	idStr, _ := queue.SendDelayMsg("options", 0, WithRetryCount(0), WithMsgTTL(time.Minute))
+	queue.pending2Ready()
+	queue.ready2Unack()
+	queue.unack2Retry()
+	queue.garbageCollect()
+
+	deadLetters, _ := queue.DeadLetters(0, 0)
+	if len(deadLetters) != 1 || deadLetters[0].RetryCount != 0 || deadLetters[0].MsgTTL != time.Minute {
+		t.Fatalf("dead letters = %+v, want retry count 0 and ttl 1 minute", deadLetters)
+	}
+	if n, _ := queue.redisCli.HLen(ctx, queue.msgOptionKey).Result(); n != 0 {
+		t.Fatalf("msg options = %d after moved to dead letters", n)
+	}
+
+	if result, err := queue.Requeue(idStr); err != nil || result.Requeued != 1 {
+		t.Fatalf("requeue result = %+v, err = %v", result, err)
+	}
+	if count, _ := queue.redisCli.HGet(ctx, queue.retryCountKey, idStr).Int(); count != 0 {
+		t.Fatalf("retry count = %d after requeue, want 0", count)
+	}
+	if ttl := queue.redisCli.TTL(ctx, queue.genMsgKey(idStr)).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("ttl = %v after requeue, want at most 1 minute", ttl)
+	}
+	if option, _ := queue.redisCli.HGet(ctx, queue.msgOptionKey, idStr).Result(); option != msgOption(0, time.Minute) {
+		t.Fatalf("msg option = %q after requeue", option)
+	}
+
+	// 重复重新投递不会再次加入队列
+	if result, _ := queue.Requeue(idStr); result.Requeued != 0 {
+		t.Fatalf("requeue again result = %+v", result)
+	}
+	if stats, _ := queue.Stats(); stats.Pending != 1 || stats.Dead != 0 {
+		t.Fatalf("stats after requeue = %+v", stats)
+	}
+}
+
+func TestDelayQueue_MsgTTL(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t)
+
+	// 单条消息的过期时间不影响之后的消息
+	shortId, _ := queue.SendDelayMsg("short", 0, WithMsgTTL(time.Minute))
+	defaultId, _ := queue.SendDelayMsg("default", 0)
+	if ttl := queue.redisCli.TTL(ctx, queue.genMsgKey(shortId)).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("ttl = %v, want at most 1 minute", ttl)
+	}
+	if ttl := queue.redisCli.TTL(ctx, queue.genMsgKey(defaultId)).Val(); ttl <= time.Minute {
+		t.Fatalf("ttl = %v, want the default 1 hour", ttl)
+	}
+	if queue.msgTTL != time.Hour {
+		t.Fatalf("queue msg ttl = %v after sending", queue.msgTTL)
+	}
+}
+
+func TestDelayQueue_IdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t)
+
+	idStr, err := queue.SendDelayMsg("timeout", time.Minute, WithIdempotencyKey("turn-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重试发送返回已存在的消息
+	retryId, err := queue.SendDelayMsg("timeout", time.Minute, WithIdempotencyKey("turn-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retryId != idStr {
+		t.Fatalf("id = %s, want existing %s", retryId, idStr)
+	}
+	otherId, _ := queue.SendDelayMsg("timeout", time.Minute, WithIdempotencyKey("turn-2"))
+	if otherId == idStr {
+		t.Fatal("different keys got the same id")
+	}
+	if n, _ := queue.redisCli.ZCard(ctx, queue.pendingKey).Result(); n != 2 {
+		t.Fatalf("pending = %d, want 2", n)
+	}
+
+	// 取消后可以重新发送
+	if ok, _ := queue.Cancel(idStr); !ok {
+		t.Fatal("cancel failed")
+	}
+	resendId, _ := queue.SendDelayMsg("timeout", time.Minute, WithIdempotencyKey("turn-1"))
+	if resendId == idStr {
+		t.Fatal("cancelled msg returned")
+	}
+
+	// 消费后在过期前不会重复发送
+	consumedId, _ := queue.SendDelayMsg("consumed", 0, WithIdempotencyKey("turn-3"))
+	if err = queue.consume(); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := queue.SendDelayMsg("consumed", 0, WithIdempotencyKey("turn-3")); id != consumedId {
+		t.Fatalf("id = %s after consumed, want %s", id, consumedId)
+	}
+}
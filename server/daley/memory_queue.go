@@ -0,0 +1,311 @@
+package daley
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryMsg is a message of MemoryQueue
+type memoryMsg struct {
+	id             string
+	payload        string
+	deliverAt      time.Time
+	expireAt       time.Time // payload expires msgTTL after the delivery time, same as DelayQueue
+	retryCount     uint
+	idempotencyKey string
+}
+
+// memorySchedule is a recurring schedule of MemoryQueue
+type memorySchedule struct {
+	Schedule
+	spec scheduleSpec
+}
+
+// MemoryQueue is a Scheduler keeping messages in process memory, messages are lost when the process exits.
+// Time is read from the Clock, use ManualClock and RunDue to deliver messages deterministically in tests
+type MemoryQueue struct {
+	mutex     sync.Mutex
+	clock     Clock
+	cb        DelayCallbackFunc
+	logger    *log.Logger
+	msgs      map[string]*memoryMsg
+	keys      map[string]string // idempotency key -> message id
+	schedules map[string]*memorySchedule
+	wakeup    chan struct{}
+	close     chan struct{}
+
+	msgTTL            time.Duration
+	defaultRetryCount uint
+	fetchInterval     time.Duration
+}
+
+// NewMemoryQueue creates a MemoryQueue, callback is the same as NewQueue
+func NewMemoryQueue(clock Clock, callback DelayCallbackFunc) *MemoryQueue {
+	if clock == nil {
+		clock = SystemClock()
+	}
+	if callback == nil {
+		panic("callback is required")
+	}
+	return &MemoryQueue{
+		clock:             clock,
+		cb:                callback,
+		logger:            log.Default(),
+		msgs:              make(map[string]*memoryMsg),
+		keys:              make(map[string]string),
+		schedules:         make(map[string]*memorySchedule),
+		wakeup:            make(chan struct{}, 1),
+		close:             make(chan struct{}),
+		msgTTL:            time.Hour,
+		defaultRetryCount: 3,
+		fetchInterval:     time.Second,
+	}
+}
+
+// WithDefaultRetryCount customizes the max number of retry
+func (q *MemoryQueue) WithDefaultRetryCount(count uint) *MemoryQueue {
+	q.defaultRetryCount = count
+	return q
+}
+
+func (q *MemoryQueue) SendScheduleMsg(payload string, t time.Time, opts ...interface{}) (string, error) {
+	options := parseMsgOptions(msgOptions{retryCount: q.defaultRetryCount, msgTTL: q.msgTTL}, opts)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if options.idempotencyKey != "" {
+		if idStr, ok := q.keys[options.idempotencyKey]; ok {
+			return idStr, nil
+		}
+	}
+	idStr := uuid.Must(uuid.NewRandom()).String()
+	q.msgs[idStr] = &memoryMsg{id: idStr, payload: payload, deliverAt: t, expireAt: t.Add(options.msgTTL), retryCount: options.retryCount, idempotencyKey: options.idempotencyKey}
+	if options.idempotencyKey != "" {
+		q.keys[options.idempotencyKey] = idStr
+	}
+	q.notify()
+	return idStr, nil
+}
+
+func (q *MemoryQueue) SendDelayMsg(payload string, duration time.Duration, opts ...interface{}) (string, error) {
+	return q.SendScheduleMsg(payload, q.clock.Now().Add(duration), opts...)
+}
+
+func (q *MemoryQueue) Cancel(idStr string) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	msg, ok := q.msgs[idStr]
+	if !ok {
+		return false, nil
+	}
+	delete(q.msgs, idStr)
+	q.deleteKey(msg)
+	return true, nil
+}
+
+// deleteKey removes the idempotency key of a delivered or canceled message, must be called with mutex held
+func (q *MemoryQueue) deleteKey(msg *memoryMsg) {
+	if msg.idempotencyKey != "" && q.keys[msg.idempotencyKey] == msg.id {
+		delete(q.keys, msg.idempotencyKey)
+	}
+}
+
+func (q *MemoryQueue) AddSchedule(name string, spec string, payload string, opts ...interface{}) error {
+	schedule := Schedule{Name: name, Spec: spec, Missed: MissedSkip, Payload: payload, RetryCount: q.defaultRetryCount, MsgTTL: q.msgTTL}
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case retryCountOpt:
+			schedule.RetryCount = uint(o)
+		case msgTTLOpt:
+			schedule.MsgTTL = time.Duration(o)
+		case missedPolicyOpt:
+			schedule.Missed = MissedPolicy(o)
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("schedule name is required")
+	}
+	if schedule.Missed != MissedSkip && schedule.Missed != MissedCatchUp {
+		return fmt.Errorf("invalid missed policy %q", schedule.Missed)
+	}
+	parsed, err := parseSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if existing, ok := q.schedules[name]; ok && existing.Spec == spec {
+		schedule.NextRun, schedule.LastRun = existing.NextRun, existing.LastRun
+	} else {
+		next := parsed.Next(q.clock.Now())
+		if next.IsZero() {
+			return fmt.Errorf("schedule %q never fires", spec)
+		}
+		schedule.NextRun = next.UnixMilli()
+	}
+	q.schedules[name] = &memorySchedule{Schedule: schedule, spec: parsed}
+	q.notify()
+	return nil
+}
+
+// Schedules returns all recurring schedules ordered by next run
+func (q *MemoryQueue) Schedules() []Schedule {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	schedules := make([]Schedule, 0, len(q.schedules))
+	for _, schedule := range q.schedules {
+		schedules = append(schedules, schedule.Schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].NextRun < schedules[j].NextRun
+	})
+	return schedules
+}
+
+// Pending returns the number of messages which are not delivered
+func (q *MemoryQueue) Pending() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.msgs)
+}
+
+// RunDue delivers the messages and schedules due at the current time of clock in the calling goroutine,
+// failed messages are retried in the next run and messages whose payload expired are dropped. Returns the number of delivered messages
+func (q *MemoryQueue) RunDue() int {
+	now := q.clock.Now()
+
+	q.mutex.Lock()
+	q.fireSchedules(now)
+	due := make([]*memoryMsg, 0)
+	for _, msg := range q.msgs {
+		if !msg.expireAt.After(now) {
+			q.logger.Printf("msg %s dropped, payload expired", msg.id)
+			delete(q.msgs, msg.id)
+			q.deleteKey(msg)
+			continue
+		}
+		if !msg.deliverAt.After(now) {
+			due = append(due, msg)
+		}
+	}
+	for _, msg := range due {
+		delete(q.msgs, msg.id)
+	}
+	q.mutex.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].deliverAt.Before(due[j].deliverAt)
+	})
+	for _, msg := range due {
+		delivered := q.cb(msg.payload, msg.id)
+		if !delivered && msg.retryCount == 0 {
+			q.logger.Printf("msg %s dropped after all retries", msg.id)
+		}
+
+		// the idempotency key is kept until the message is delivered or dropped
+		q.mutex.Lock()
+		if delivered || msg.retryCount == 0 {
+			q.deleteKey(msg)
+		} else {
+			msg.retryCount--
+			q.msgs[msg.id] = msg
+		}
+		q.mutex.Unlock()
+	}
+	return len(due)
+}
+
+// fireSchedules adds the messages of due schedules, must be called with mutex held
+func (q *MemoryQueue) fireSchedules(now time.Time) {
+	for _, schedule := range q.schedules {
+		if schedule.NextRun > now.UnixMilli() {
+			continue
+		}
+		runs := []time.Time{time.UnixMilli(schedule.NextRun)}
+		next := schedule.spec.Next(runs[0])
+		for !next.IsZero() && !next.After(now) {
+			runs = append(runs, next)
+			next = schedule.spec.Next(next)
+		}
+		if schedule.Missed == MissedSkip {
+			runs = runs[len(runs)-1:]
+		} else if len(runs) > maxCatchUpRuns {
+			runs = runs[len(runs)-maxCatchUpRuns:]
+		}
+		for range runs {
+			idStr := uuid.Must(uuid.NewRandom()).String()
+			q.msgs[idStr] = &memoryMsg{id: idStr, payload: schedule.Payload, deliverAt: now, expireAt: now.Add(schedule.MsgTTL), retryCount: schedule.RetryCount}
+		}
+		schedule.LastRun = runs[len(runs)-1].UnixMilli()
+		if next.IsZero() {
+			delete(q.schedules, schedule.Name)
+			continue
+		}
+		schedule.NextRun = next.UnixMilli()
+	}
+}
+
+// nextDelay returns the duration until the earliest message or schedule is due, at most fetchInterval
+func (q *MemoryQueue) nextDelay() time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := q.clock.Now()
+	delay := q.fetchInterval
+	for _, msg := range q.msgs {
+		if d := msg.deliverAt.Sub(now); d < delay {
+			delay = d
+		}
+	}
+	for _, schedule := range q.schedules {
+		if d := time.UnixMilli(schedule.NextRun).Sub(now); d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+func (q *MemoryQueue) notify() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (q *MemoryQueue) StartConsume() (done <-chan struct{}) {
+	done0 := make(chan struct{})
+	go func() {
+		defer close(done0)
+		// one timer for the earliest deadline, replaced only when woken up for an earlier deadline
+		var timer <-chan time.Time
+		var deadline time.Time
+		stop := func() {}
+		defer func() { stop() }()
+		for {
+			delay := q.nextDelay()
+			if next := q.clock.Now().Add(delay); timer == nil || next.Before(deadline) {
+				stop()
+				deadline = next
+				timer, stop = q.clock.NewTimer(delay)
+			}
+
+			select {
+			case <-timer:
+				timer, stop = nil, func() {}
+				q.RunDue()
+			case <-q.wakeup:
+			case <-q.close:
+				return
+			}
+		}
+	}()
+	return done0
+}
+
+func (q *MemoryQueue) StopConsume() {
+	close(q.close)
+}
@@ -0,0 +1,208 @@
+package daley
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryQueue_ManualClock(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local))
+	delivered := make([]string, 0)
+	queue := NewMemoryQueue(clock, func(payload, idStr string) bool {
+		delivered = append(delivered, payload)
+		return true
+	})
+
+	if _, err := queue.SendDelayMsg("second", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.SendDelayMsg("first", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	canceled, _ := queue.SendDelayMsg("canceled", time.Second)
+	if ok, _ := queue.Cancel(canceled); !ok {
+		t.Fatal("cancel pending msg failed")
+	}
+
+	if count := queue.RunDue(); count != 0 {
+		t.Fatalf("delivered %d msgs before deadline", count)
+	}
+	clock.Advance(2 * time.Second)
+	if count := queue.RunDue(); count != 2 {
+		t.Fatalf("delivered %d msgs, want 2", count)
+	}
+	if len(delivered) != 2 || delivered[0] != "first" || delivered[1] != "second" {
+		t.Fatalf("delivered = %v, want [first second]", delivered)
+	}
+	if ok, _ := queue.Cancel(canceled); ok {
+		t.Fatal("cancel canceled msg succeeded")
+	}
+}
+
+func TestMemoryQueue_RetryAndIdempotency(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	deliveries := 0
+	queue := NewMemoryQueue(clock, func(payload, idStr string) bool {
+		deliveries++
+		return false
+	}).WithDefaultRetryCount(2)
+
+	id1, _ := queue.SendDelayMsg("job", time.Second, WithIdempotencyKey("job"))
+	id2, _ := queue.SendDelayMsg("job", time.Second, WithIdempotencyKey("job"))
+	if id1 != id2 {
+		t.Fatalf("idempotent send returned %s and %s", id1, id2)
+	}
+
+	clock.Advance(time.Second)
+	for i := 0; i < 5; i++ {
+		queue.RunDue()
+	}
+	if deliveries != 3 {
+		t.Fatalf("deliveries = %d, want 3", deliveries)
+	}
+	if queue.Pending() != 0 {
+		t.Fatalf("pending = %d after all retries", queue.Pending())
+	}
+
+	// the idempotency key is released after the message is dropped
+	id3, _ := queue.SendDelayMsg("job", time.Second, WithIdempotencyKey("job"))
+	if id3 == id1 || queue.Pending() != 1 {
+		t.Fatalf("send after drop returned %s, pending = %d", id3, queue.Pending())
+	}
+	if ok, _ := queue.Cancel(id3); !ok || len(queue.keys) != 0 {
+		t.Fatalf("keys = %v after cancel", queue.keys)
+	}
+}
+
+func TestMemoryQueue_ReleaseKeyAfterDelivery(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	queue := NewMemoryQueue(clock, func(payload, idStr string) bool {
+		return true
+	})
+
+	id1, _ := queue.SendDelayMsg("job", time.Second, WithIdempotencyKey("job"))
+	clock.Advance(time.Second)
+	if count := queue.RunDue(); count != 1 {
+		t.Fatalf("delivered %d msgs, want 1", count)
+	}
+	if len(queue.keys) != 0 {
+		t.Fatalf("keys = %v after delivery", queue.keys)
+	}
+
+	// a new message with the same key is scheduled again
+	id2, _ := queue.SendDelayMsg("job", time.Second, WithIdempotencyKey("job"))
+	if id2 == id1 || queue.Pending() != 1 {
+		t.Fatalf("send after delivery returned %s, pending = %d", id2, queue.Pending())
+	}
+}
+
+func TestMemoryQueue_Schedule(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 30, 0, time.Local))
+	delivered := 0
+	queue := NewMemoryQueue(clock, func(payload, idStr string) bool {
+		delivered++
+		return true
+	})
+	if err := queue.AddSchedule("tick", "@every 1m", "tick", WithMissedPolicy(MissedCatchUp)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(3 * time.Minute)
+	queue.RunDue()
+	if delivered != 3 {
+		t.Fatalf("delivered = %d, want 3", delivered)
+	}
+	schedules := queue.Schedules()
+	if len(schedules) != 1 || schedules[0].NextRun != clock.Now().Add(time.Minute).UnixMilli() {
+		t.Fatalf("schedules = %+v", schedules)
+	}
+}
+
+func TestMemoryQueue_StartConsume(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	delivered := make(chan string, 1)
+	queue := NewMemoryQueue(clock, func(payload, idStr string) bool {
+		delivered <- payload
+		return true
+	})
+	done := queue.StartConsume()
+	defer func() {
+		queue.StopConsume()
+		<-done
+	}()
+
+	if _, err := queue.SendDelayMsg("job", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the consumer keeps the timer of the fetch interval, which is earlier than the msg
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Second)
+	if payload := <-delivered; payload != "job" {
+		t.Fatalf("payload = %s", payload)
+	}
+}
+
+func TestMemoryQueue_StartConsumeSingleTimer(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	delivered := make(chan string, 1)
+	queue := NewMemoryQueue(clock, func(payload, idStr string) bool {
+		delivered <- payload
+		return true
+	})
+	queue.fetchInterval = time.Hour
+	done := queue.StartConsume()
+	defer func() {
+		queue.StopConsume()
+		<-done
+	}()
+
+	// every wakeup for an earlier msg replaces the timer instead of adding one
+	clock.BlockUntil(1)
+	for i := 10; i > 0; i-- {
+		if _, err := queue.SendDelayMsg("job", time.Duration(i)*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		for len(queue.wakeup) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if waiters := clock.Waiters(); waiters != 1 {
+		t.Fatalf("waiters = %d, want 1", waiters)
+	}
+
+	clock.Advance(time.Second)
+	if payload := <-delivered; payload != "job" {
+		t.Fatalf("payload = %s", payload)
+	}
+}
+
+func TestMemoryQueue_MsgTTL(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	delivered := 0
+	queue := NewMemoryQueue(clock, func(string, string) bool {
+		delivered++
+		return false
+	})
+
+	// the payload expires msgTTL after the delivery time even if retries remain, same as DelayQueue
+	if _, err := queue.SendDelayMsg("short", time.Second, WithMsgTTL(time.Minute), WithRetryCount(10), WithIdempotencyKey("short")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	if count := queue.RunDue(); count != 1 || delivered != 1 {
+		t.Fatalf("delivered %d, callback %d, want 1", count, delivered)
+	}
+	clock.Advance(time.Minute)
+	if count := queue.RunDue(); count != 0 || delivered != 1 || queue.Pending() != 0 {
+		t.Fatalf("delivered %d after expired, pending %d", count, queue.Pending())
+	}
+
+	// the idempotency key is released with the expired msg
+	if _, err := queue.SendDelayMsg("short", 0, WithIdempotencyKey("short")); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Pending() != 1 {
+		t.Fatalf("pending = %d, want the msg sent again", queue.Pending())
+	}
+}
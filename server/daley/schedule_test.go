@@ -0,0 +1,139 @@
+package daley
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+func TestParseSpec(t *testing.T) {
+	from := time.Date(2024, 2, 28, 10, 30, 15, 0, time.Local)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"@every 90s", from.Add(90 * time.Second)},
+		{"* * * * *", time.Date(2024, 2, 28, 10, 31, 0, 0, time.Local)},
+		{"*/15 * * * *", time.Date(2024, 2, 28, 10, 45, 0, 0, time.Local)},
+		{"@hourly", time.Date(2024, 2, 28, 11, 0, 0, 0, time.Local)},
+		{"@daily", time.Date(2024, 2, 29, 0, 0, 0, 0, time.Local)},
+		{"0 9-17/4 * * *", time.Date(2024, 2, 28, 13, 0, 0, 0, time.Local)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.Local)},
+		{"0 0 1,15 * *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		// 2024-02-28 是周三,周日可以写作7
+		{"0 0 * * 7", time.Date(2024, 3, 3, 0, 0, 0, 0, time.Local)},
+		// 同时限制日期和星期时满足其一即可
+		{"0 0 15 * 5", time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		spec, err := parseSpec(test.spec)
+		if err != nil {
+			t.Fatalf("parseSpec(%q) error: %v", test.spec, err)
+		}
+		if next := spec.Next(from); !next.Equal(test.want) {
+			t.Errorf("%q next = %v, want %v", test.spec, next, test.want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@every 1ms", "@every x"} {
+		if _, err := parseSpec(spec); err == nil {
+			t.Errorf("parseSpec(%q) want error", spec)
+		}
+	}
+}
+
+func TestDelayQueue_Schedule(t *testing.T) {
+	ctx := context.Background()
+	cli := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	deliveries := make(map[string]int)
+	callback := func(payload string, idStr string) bool {
+		deliveries[payload]++
+		return true
+	}
+	// 两个实例消费同一个队列
+	queues := []*DelayQueue{NewQueue("test", cli, callback), NewQueue("test", cli, callback)}
+
+	if err := queues[0].AddSchedule("skip", "@every 1m", "skip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queues[0].AddSchedule("catchup", "@every 1m", "catchup", WithMissedPolicy(MissedCatchUp)); err != nil {
+		t.Fatal(err)
+	}
+	if err := queues[0].AddSchedule("invalid", "@every 1m", "invalid", WithMissedPolicy("all")); err == nil {
+		t.Fatal("invalid missed policy want error")
+	}
+
+	// 服务停止期间错过了3次执行
+	missedFrom := time.Now().Add(-150 * time.Second).UnixMilli()
+	for _, name := range []string{"skip", "catchup"} {
+		cli.ZAdd(ctx, queues[0].scheduleNextKey, redis.Z{Score: float64(missedFrom), Member: name})
+	}
+	for _, queue := range queues {
+		if err := queue.consume(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deliveries["skip"] != 1 || deliveries["catchup"] != 3 {
+		t.Fatalf("deliveries = %v, want skip 1 and catchup 3", deliveries)
+	}
+
+	schedules, err := queues[1].Schedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules) != 2 {
+		t.Fatalf("schedules = %+v", schedules)
+	}
+	for _, schedule := range schedules {
+		if schedule.LastRun != missedFrom+120000 || schedule.NextRun != missedFrom+180000 {
+			t.Fatalf("schedule = %+v, want last run %d", schedule, missedFrom+120000)
+		}
+	}
+
+	// 重新添加相同的周期任务不改变下次执行时间
+	queues[1].AddSchedule("skip", "@every 1m", "skip")
+	if schedules, _ = queues[0].Schedules(); schedules[0].NextRun != missedFrom+180000 {
+		t.Fatalf("next run = %d after adding again", schedules[0].NextRun)
+	}
+
+	if removed, _ := queues[0].RemoveSchedule("skip"); !removed {
+		t.Fatal("remove schedule failed")
+	}
+	if schedules, _ = queues[0].Schedules(); len(schedules) != 1 || schedules[0].Name != "catchup" {
+		t.Fatalf("schedules after remove = %+v", schedules)
+	}
+}
+
+func TestRegistry_Schedule(t *testing.T) {
+	registry := NewRegistry("test", redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}))
+	received := make(chan testJob, 10)
+	job := Register(registry, "job", func(payload testJob, idStr string) bool {
+		received <- payload
+		return true
+	}, WithRetryCount(5))
+
+	if err := job.Schedule("every-second", "@every 1s", testJob{GameId: "schedule"}); err != nil {
+		t.Fatal(err)
+	}
+	schedules, _ := registry.Queue().Schedules()
+	if len(schedules) != 1 || schedules[0].RetryCount != 5 {
+		t.Fatalf("schedules = %+v", schedules)
+	}
+
+	done := registry.Queue().StartConsume()
+	defer func() {
+		registry.Queue().StopConsume()
+		<-done
+	}()
+	select {
+	case payload := <-received:
+		if payload.GameId != "schedule" {
+			t.Fatalf("payload = %+v", payload)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("schedule not fired")
+	}
+}
@@ -0,0 +1,139 @@
+package daley
+
+import (
+	"sync"
+	"time"
+)
+
+// Scheduler delivers delayed, scheduled and recurring messages to a callback.
+// DelayQueue is the redis implementation shared by all instances, MemoryQueue keeps messages in process memory
+type Scheduler interface {
+	// SendScheduleMsg submits a message delivered at given time, WithRetryCount, WithMsgTTL and WithIdempotencyKey are supported
+	SendScheduleMsg(payload string, t time.Time, opts ...interface{}) (string, error)
+	// SendDelayMsg submits a message delivered after given duration
+	SendDelayMsg(payload string, duration time.Duration, opts ...interface{}) (string, error)
+	// Cancel removes a message which is not delivered, returns false if the message has been consumed or does not exist
+	Cancel(idStr string) (bool, error)
+	// AddSchedule creates or updates a recurring schedule
+	AddSchedule(name string, spec string, payload string, opts ...interface{}) error
+	// StartConsume creates a goroutine to consume messages, use `<-done` to wait consumer stopping
+	StartConsume() (done <-chan struct{})
+	// StopConsume stops consumer goroutine
+	StopConsume()
+}
+
+var _ Scheduler = (*DelayQueue)(nil)
+var _ Scheduler = (*MemoryQueue)(nil)
+
+// Clock provides the current time and timers of a Scheduler
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// NewTimer is the same as After, stop releases the timer if it has not fired
+	NewTimer(d time.Duration) (c <-chan time.Time, stop func())
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
+
+// SystemClock returns the wall clock
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// ManualClock is a Clock which only moves forward when Advance is called, for deterministic tests
+type ManualClock struct {
+	mutex   sync.Mutex
+	changed *sync.Cond // signaled when a timer is added
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewManualClock creates a ManualClock starting at now
+func NewManualClock(now time.Time) *ManualClock {
+	clock := &ManualClock{now: now}
+	clock.changed = sync.NewCond(&clock.mutex)
+	return clock
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{deadline: c.now.Add(d), ch: ch})
+	c.changed.Broadcast()
+	return ch
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) (<-chan time.Time, func()) {
+	ch := c.After(d)
+	return ch, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for index, waiter := range c.waiters {
+			if waiter.ch == ch {
+				c.waiters = append(c.waiters[:index], c.waiters[index+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Waiters returns the number of timers which are waiting
+func (c *ManualClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n timers are waiting, so a goroutine waiting on the clock is ready before Advance
+func (c *ManualClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
+
+// Advance moves the clock forward and fires the timers which are due
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			waiters = append(waiters, waiter)
+			continue
+		}
+		waiter.ch <- c.now
+	}
+	c.waiters = waiters
+}
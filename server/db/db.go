@@ -34,9 +34,51 @@ func NewGameDB() *gorm.DB {
 		panic(err)
 	}
 
-	if err = db.AutoMigrate(User{}, UserHistory{}); err != nil {
-		log.Println("AutoMigrate error: ", err)
+	if err = Migrate(db); err != nil {
+		log.Println("migrate error: ", err)
 	}
 
 	return db
 }
+
+// Migrate 创建缺少的表及索引,已有的表只补充缺少的索引,失败的表不影响其它表的创建,返回第一个错误。
+// 已有的表不使用 AutoMigrate: sqlite 解析 default:(datetime('now', 'localtime')) 的表结构失败,
+// AutoMigrate 返回错误并丢失表的索引,之后的表也不再创建
+func Migrate(db *gorm.DB) error {
+	var first error
+	if err := MigrateSnapshot(db); err != nil {
+		log.Println("migrate leaderboard snapshot error: ", err)
+		first = err
+	}
+	for _, model := range []interface{}{&User{}, &UserHistory{}, &LedgerJournal{}, &LedgerEntry{}, &GameOutbox{}, &Game{}, &GameRound{}, &RoundSeat{}, &UserStats{}, &LeaderboardSnapshot{}, &UserAchievement{}} {
+		if err := migrateModel(db, model); err != nil {
+			log.Printf("migrate %T error: %s", model, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// migrateModel 表不存在时创建表(包括索引),否则创建缺少的索引
+func migrateModel(db *gorm.DB, model interface{}) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(model) {
+		return migrator.CreateTable(model)
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	for name := range stmt.Schema.ParseIndexes() {
+		if migrator.HasIndex(model, name) {
+			continue
+		}
+		if err := migrator.CreateIndex(model, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
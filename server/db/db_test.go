@@ -2,6 +2,10 @@ package db
 
 import (
 	"fmt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -15,3 +19,79 @@ func TestInitSQLite3(t *testing.T) {
 	diffTimeStamp := time.Now().Unix() - unix
 	fmt.Println(diffTimeStamp)
 }
+
+// baselineUser 升级前的 user 表结构
+type baselineUser struct {
+	ID       int64     `gorm:"primaryKey;autoIncrement;not null"`
+	Address  string
+	HeadPic  string
+	Balance  int64
+	CreateAt time.Time `gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+	UpdateAt time.Time `gorm:"not null; default:(datetime('now', 'localtime'))"`
+}
+
+func (baselineUser) TableName() string { return "user" }
+
+// baselineUserHistory 升级前的 user_history 表结构
+type baselineUserHistory struct {
+	ID            int64 `gorm:"primaryKey;autoIncrement;not null"`
+	UserId        int64
+	Address       string
+	GameId        string
+	RoundID       int
+	State         int
+	Amount        int64
+	BalanceBefore int64
+	CreateAt      time.Time `gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+func (baselineUserHistory) TableName() string { return "user_history" }
+
+func TestMigrate_BaselineDatabase(t *testing.T) {
+	gormDB, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "baseline.db")), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{SingularTable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gormDB.AutoMigrate(baselineUser{}, baselineUserHistory{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = gormDB.Create(&baselineUser{Address: "aleo-baseline", Balance: 1000}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 重复启动时同样成功,已有的索引不丢失
+	for i := 0; i < 2; i++ {
+		if err = Migrate(gormDB); err != nil {
+			t.Fatalf("migrate %d: %s", i, err)
+		}
+	}
+
+	migrator := gormDB.Migrator()
+	for _, model := range []interface{}{&LedgerJournal{}, &LedgerEntry{}, &GameOutbox{}, &Game{}, &GameRound{}, &RoundSeat{}, &UserStats{}, &LeaderboardSnapshot{}, &UserAchievement{}} {
+		if !migrator.HasTable(model) {
+			t.Fatalf("table of %T not created", model)
+		}
+	}
+	for _, name := range []string{"idx_user_history_user", "idx_user_history_round"} {
+		if !migrator.HasIndex(&UserHistory{}, name) {
+			t.Fatalf("index %s not created", name)
+		}
+	}
+	if !migrator.HasIndex(&LeaderboardSnapshot{}, "idx_snapshot_board_user") {
+		t.Fatal("index idx_snapshot_board_user not created")
+	}
+
+	// 升级后已有的用户可以继续记账
+	user, err := NewUserDB(gormDB).GetByAddress("aleo-baseline")
+	if err != nil || user.Balance != 1000 {
+		t.Fatalf("user = %+v, err = %v", user, err)
+	}
+	err = NewLedgerDB(gormDB).Post(gormDB, LedgerJournal{Kind: JournalBuyIn, GameId: "baseline", IdempotencyKey: IdempotencyKey("baseline-buy-in")},
+		Posting{Account: UserAccount(user.ID), Amount: -100},
+		Posting{Account: StackAccount("baseline", user.ID), Amount: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 账户,筹码只在账户之间转移,所有分录合计恒为0
+const (
+	HouseAccount  = "house"  // 庄家: 奖池剩余筹码及补足
+	FaucetAccount = "faucet" // 发放: 注册赠送、领取金币、成就奖励,余额为已发放筹码的负数
+)
+
+// 记账类型
+const (
+	JournalOpening = "opening" // 启用账本前的用户余额
+	JournalSignup  = "signup"  // 注册赠送
+	JournalReceive = "receive" // 领取金币
+	JournalBuyIn   = "buyin"   // 买入桌上筹码
+	JournalCashOut = "cashout" // 兑出桌上筹码
+	JournalAnte    = "ante"    // 底注
+	JournalRaise   = "raise"   // 下注
+	JournalWin     = "win"     // 获胜结算
+	JournalBonus   = "bonus"   // 成就奖励
+)
+
+// LedgerJournal 记账凭证,一次筹码变动对应一个凭证
+type LedgerJournal struct {
+	ID             int64     `json:"id" gorm:"primaryKey;autoIncrement;not null"`
+	Kind           string    `json:"kind" gorm:"index"`
+	GameId         string    `json:"gameId" gorm:"index"`
+	RoundID        int       `json:"roundID"`
+	IdempotencyKey *string   `json:"idempotencyKey,omitempty" gorm:"uniqueIndex"` // 客户端操作、当局结算的幂等key,为空表示不去重
+	CreateAt       time.Time `json:"createTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+// LedgerEntry 记账分录,正数转入账户,负数转出账户
+type LedgerEntry struct {
+	ID        int64     `json:"id" gorm:"primaryKey;autoIncrement;not null"`
+	JournalId int64     `json:"journalId" gorm:"index"`
+	Account   string    `json:"account" gorm:"index"`
+	Amount    int64     `json:"amount"`
+	CreateAt  time.Time `json:"createTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+// Posting 凭证中一个账户的金额
+type Posting struct {
+	Account string
+	Amount  int64
+}
+
+// UserAccount 用户账户
+func UserAccount(userId int64) string {
+	return fmt.Sprintf("user:%d", userId)
+}
+
+// StackAccount 用户在房间中的桌上筹码账户,当局下注在结算时转入奖池
+func StackAccount(gameId string, userId int64) string {
+	return fmt.Sprintf("stack:%s:%d", gameId, userId)
+}
+
+// PotAccount 房间当局奖池账户
+func PotAccount(gameId string, currRound int) string {
+	return fmt.Sprintf("pot:%s:%d", gameId, currRound)
+}
+
+// SettleKey 当局结算凭证的幂等key,每局只结算一次
+func SettleKey(gameId string, currRound int) string {
+	return fmt.Sprintf("settle:%s:%d", gameId, currRound)
+}
+
+// AchievementKey 成就奖励凭证的幂等key,每个用户每个成就只奖励一次
+func AchievementKey(userId int64, achievementId string) string {
+	return fmt.Sprintf("achievement:%d:%s", userId, achievementId)
+}
+
+// ReturnStackKey 已过期或已结束房间的桌上筹码兑回凭证的幂等key,每个用户每个房间只兑回一次
+func ReturnStackKey(gameId string, userId int64) string {
+	return fmt.Sprintf("return:%s:%d", gameId, userId)
+}
+
+// BalanceMismatch 用户余额与账本不一致
+type BalanceMismatch struct {
+	UserId        int64 `json:"userId"`
+	Balance       int64 `json:"balance"`
+	LedgerBalance int64 `json:"ledgerBalance"`
+}
+
+// LedgerReport 账本校验结果
+type LedgerReport struct {
+	Journals   int64             `json:"journals"`
+	Entries    int64             `json:"entries"`
+	Total      int64             `json:"total"`      // 所有分录合计,必须为0
+	Users      int64             `json:"users"`      // 用户账户合计
+	Stacks     int64             `json:"stacks"`     // 桌上筹码合计(含当局未结算下注)
+	Pots       int64             `json:"pots"`       // 未结算奖池合计
+	House      int64             `json:"house"`      // 庄家账户
+	Faucet     int64             `json:"faucet"`     // 发放账户
+	Unbalanced []int64           `json:"unbalanced"` // 分录合计不为0的凭证
+	Mismatches []BalanceMismatch `json:"mismatches"`
+}
+
+// OK 所有筹码均有记录
+func (r LedgerReport) OK() bool {
+	return r.Total == 0 && len(r.Unbalanced) == 0 && len(r.Mismatches) == 0
+}
+
+type LedgerDB struct {
+	db *gorm.DB
+}
+
+func NewLedgerDB(db *gorm.DB) *LedgerDB {
+	return &LedgerDB{db: db}
+}
+
+// Posted 是否已记录过幂等key对应的凭证,key为空返回false
+func (l *LedgerDB) Posted(tx *gorm.DB, idempotencyKey string) (bool, error) {
+	if len(idempotencyKey) <= 0 {
+		return false, nil
+	}
+
+	var count int64
+	err := tx.Model(&LedgerJournal{}).Where("idempotency_key = ?", idempotencyKey).Count(&count).Error
+	return count > 0, err
+}
+
+// IdempotencyKey 凭证的幂等key,空字符串表示不去重
+func IdempotencyKey(key string) *string {
+	if len(key) <= 0 {
+		return nil
+	}
+	return &key
+}
+
+// Post 记账,分录金额合计必须为0,金额为0的分录忽略。需在修改余额的同一事务中调用。
+// 幂等key已记录过返回 constant.DuplicateActionError,事务回滚后余额修改一并撤销
+func (l *LedgerDB) Post(tx *gorm.DB, journal LedgerJournal, postings ...Posting) error {
+	total := int64(0)
+	entries := make([]LedgerEntry, 0, len(postings))
+	for _, posting := range postings {
+		total += posting.Amount
+		if posting.Amount != 0 {
+			entries = append(entries, LedgerEntry{Account: posting.Account, Amount: posting.Amount})
+		}
+	}
+	if total != 0 {
+		return constant.LedgerUnbalancedError
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// 幂等key已记录过,不重复记账
+	if journal.IdempotencyKey != nil {
+		posted, err := l.Posted(tx, *journal.IdempotencyKey)
+		if err != nil {
+			return err
+		}
+		if posted {
+			return constant.DuplicateActionError
+		}
+	}
+
+	if err := tx.Model(&LedgerJournal{}).Create(&journal).Error; err != nil {
+		return err
+	}
+	for index := range entries {
+		entries[index].JournalId = journal.ID
+	}
+	return tx.Model(&LedgerEntry{}).Create(&entries).Error
+}
+
+// Balance 账户余额
+func (l *LedgerDB) Balance(tx *gorm.DB, account string) (int64, error) {
+	var balance int64
+	err := tx.Model(&LedgerEntry{}).Where("account = ?", account).Select("COALESCE(SUM(amount), 0)").Scan(&balance).Error
+	return balance, err
+}
+
+// StackBalances 房间所有用户的桌上筹码账户余额(含当局未结算下注)
+func (l *LedgerDB) StackBalances(gameId string) (map[int64]int64, error) {
+	prefix := StackAccount(gameId, 0)
+	prefix = prefix[:len(prefix)-1]
+
+	accounts := make([]Posting, 0)
+	if err := l.db.Model(&LedgerEntry{}).Where("account LIKE ?", prefix+"%").
+		Group("account").Select("account, SUM(amount) as amount").Scan(&accounts).Error; err != nil {
+		return nil, err
+	}
+
+	balances := make(map[int64]int64, len(accounts))
+	for _, account := range accounts {
+		userId, err := strconv.ParseInt(strings.TrimPrefix(account.Account, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		balances[userId] = account.Amount
+	}
+	return balances, nil
+}
+
+// OpenStacks 所有余额不为0的桌上筹码账户,key为房间ID
+func (l *LedgerDB) OpenStacks() (map[string]map[int64]int64, error) {
+	prefix := StackAccount("", 0)
+	prefix = prefix[:strings.Index(prefix, ":")+1]
+
+	accounts := make([]Posting, 0)
+	if err := l.db.Model(&LedgerEntry{}).Where("account LIKE ?", prefix+"%").
+		Group("account").Having("SUM(amount) <> 0").Select("account, SUM(amount) as amount").Scan(&accounts).Error; err != nil {
+		return nil, err
+	}
+
+	stacks := make(map[string]map[int64]int64, 0)
+	for _, account := range accounts {
+		name := strings.TrimPrefix(account.Account, prefix)
+		index := strings.LastIndex(name, ":")
+		if index < 0 {
+			continue
+		}
+		userId, err := strconv.ParseInt(name[index+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		gameId := name[:index]
+		if stacks[gameId] == nil {
+			stacks[gameId] = make(map[int64]int64, 0)
+		}
+		stacks[gameId][userId] = account.Amount
+	}
+	return stacks, nil
+}
+
+// OpenBalances 为没有账本记录且余额不为0的用户记录期初余额,返回记录的用户数
+func (l *LedgerDB) OpenBalances() (int, error) {
+	users := make([]User, 0)
+	if err := l.db.Model(&User{}).Where("balance <> 0").Find(&users).Error; err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for index := range users {
+		user := users[index]
+		err := l.db.Transaction(func(tx *gorm.DB) error {
+			var entries int64
+			if err := tx.Model(&LedgerEntry{}).Where("account = ?", UserAccount(user.ID)).Count(&entries).Error; err != nil {
+				return err
+			}
+			if entries > 0 {
+				return nil
+			}
+			count++
+			return l.Post(tx, LedgerJournal{Kind: JournalOpening},
+				Posting{Account: FaucetAccount, Amount: -user.Balance},
+				Posting{Account: UserAccount(user.ID), Amount: user.Balance})
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Verify 校验账本: 所有分录合计为0、每个凭证平衡、用户余额与账本一致
+func (l *LedgerDB) Verify() (LedgerReport, error) {
+	report := LedgerReport{Unbalanced: make([]int64, 0), Mismatches: make([]BalanceMismatch, 0)}
+	if err := l.db.Model(&LedgerJournal{}).Count(&report.Journals).Error; err != nil {
+		return report, err
+	}
+	if err := l.db.Model(&LedgerEntry{}).Count(&report.Entries).Error; err != nil {
+		return report, err
+	}
+	if err := l.db.Model(&LedgerEntry{}).Group("journal_id").Having("SUM(amount) <> 0").Pluck("journal_id", &report.Unbalanced).Error; err != nil {
+		return report, err
+	}
+
+	accounts := make([]Posting, 0)
+	if err := l.db.Model(&LedgerEntry{}).Group("account").Select("account, SUM(amount) as amount").Scan(&accounts).Error; err != nil {
+		return report, err
+	}
+	ledgerBalances := make(map[int64]int64, 0)
+	for _, account := range accounts {
+		report.Total += account.Amount
+		switch {
+		case account.Account == HouseAccount:
+			report.House += account.Amount
+		case account.Account == FaucetAccount:
+			report.Faucet += account.Amount
+		case strings.HasPrefix(account.Account, "stack:"):
+			report.Stacks += account.Amount
+		case strings.HasPrefix(account.Account, "pot:"):
+			report.Pots += account.Amount
+		case strings.HasPrefix(account.Account, "user:"):
+			report.Users += account.Amount
+			userId, _ := strconv.ParseInt(strings.TrimPrefix(account.Account, "user:"), 10, 64)
+			ledgerBalances[userId] = account.Amount
+		}
+	}
+
+	users := make([]User, 0)
+	if err := l.db.Model(&User{}).Select("id, balance").Find(&users).Error; err != nil {
+		return report, err
+	}
+	for _, user := range users {
+		if ledgerBalance := ledgerBalances[user.ID]; ledgerBalance != user.Balance {
+			report.Mismatches = append(report.Mismatches, BalanceMismatch{UserId: user.ID, Balance: user.Balance, LedgerBalance: ledgerBalance})
+		}
+		delete(ledgerBalances, user.ID)
+	}
+	// 账本中存在但用户已不存在
+	for userId, ledgerBalance := range ledgerBalances {
+		report.Mismatches = append(report.Mismatches, BalanceMismatch{UserId: userId, LedgerBalance: ledgerBalance})
+	}
+	return report, nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// 待同步类型,与账本凭证一一对应
+const (
+	OutboxBuyIn   = "buyin"   // 买入桌上筹码
+	OutboxCashOut = "cashout" // 兑出桌上筹码
+	OutboxSettle  = "settle"  // 当局结算
+)
+
+// 同步状态
+const (
+	OutboxPending = 0 // 数据库已提交,房间状态尚未更新
+	OutboxApplied = 1 // 房间状态已更新或已修复
+)
+
+// GameOutbox 与账本在同一事务中写入的房间状态变更,事务提交后更新房间(redis)并标记为已同步。
+// 房间更新失败或服务宕机时保持待同步,由修复任务以数据库为准恢复房间状态
+type GameOutbox struct {
+	ID        int64      `json:"id" gorm:"primaryKey;autoIncrement;not null"`
+	GameId    string     `json:"gameId" gorm:"index"`
+	RoundID   int        `json:"roundID"`
+	Kind      string     `json:"kind"`
+	UserId    int64      `json:"userId"` // 买入/兑出用户,结算时为赢家
+	Amount    int64      `json:"amount"` // 买入/兑出筹码,结算时为赢家获得的筹码
+	State     int        `json:"state" gorm:"index"`
+	CreateAt  time.Time  `json:"createTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+	AppliedAt *time.Time `json:"appliedTime,omitempty"`
+}
+
+type OutboxDB struct {
+	db *gorm.DB
+}
+
+func NewOutboxDB(db *gorm.DB) *OutboxDB {
+	return &OutboxDB{db: db}
+}
+
+// Add 记录待同步的房间状态变更,需在记账的同一事务中调用
+func (o *OutboxDB) Add(tx *gorm.DB, outbox *GameOutbox) error {
+	outbox.State = OutboxPending
+	return tx.Model(&GameOutbox{}).Create(outbox).Error
+}
+
+// MarkApplied 标记房间已同步
+func (o *OutboxDB) MarkApplied(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return o.db.Model(&GameOutbox{}).
+		Where("id IN (?) and state = ?", ids, OutboxPending).
+		Updates(map[string]interface{}{"state": OutboxApplied, "applied_at": time.Now()}).Error
+}
+
+// Pending 创建时间早于 before 的待同步记录,按ID升序
+func (o *OutboxDB) Pending(before time.Time, limit int) ([]GameOutbox, error) {
+	outboxes := make([]GameOutbox, 0)
+	err := o.db.Model(&GameOutbox{}).
+		Where("state = ? and create_at < ?", OutboxPending, before).
+		Order("id").Limit(limit).Find(&outboxes).Error
+	return outboxes, err
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"encoding/json"
+	"game-3-card-poker/server/constant"
 	"gorm.io/gorm"
 	"time"
 )
@@ -60,6 +61,47 @@ func (u *UserDB) Transaction(next func(tx *gorm.DB) error) error {
 	})
 }
 
+// GetBalance 查询用户余额,需在事务中调用以读取同一事务内的修改
+func (u *UserDB) GetBalance(tx *gorm.DB, userId int64) (int64, error) {
+	var users []User
+	if err := tx.Model(&User{}).Select("id, balance").Where("id = ?", userId).Find(&users).Error; err != nil {
+		return 0, err
+	}
+	if len(users) == 0 {
+		return 0, constant.UserNotExistError
+	}
+	return users[0].Balance, nil
+}
+
+// DeductBalance 余额充足时原子扣除筹码,返回扣除后余额。余额不足返回 *constant.InsufficientFundsError
+func (u *UserDB) DeductBalance(tx *gorm.DB, userId int64, amount int64) (int64, error) {
+	result := tx.Model(&User{}).Where("id = ? AND balance >= ?", userId, amount).UpdateColumn("balance", gorm.Expr("balance - ?", amount))
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	balance, err := u.GetBalance(tx, userId)
+	if err != nil {
+		return 0, err
+	}
+	if result.RowsAffected == 0 {
+		return balance, &constant.InsufficientFundsError{UserId: userId, Balance: balance, Amount: amount}
+	}
+	return balance, nil
+}
+
+// AddBalance 原子增加筹码(amount可为负数),返回修改后余额
+func (u *UserDB) AddBalance(tx *gorm.DB, userId int64, amount int64) (int64, error) {
+	result := tx.Model(&User{}).Where("id = ?", userId).UpdateColumn("balance", gorm.Expr("balance + ?", amount))
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, constant.UserNotExistError
+	}
+	return u.GetBalance(tx, userId)
+}
+
 func (u *UserDB) GetByAddress(address string) (User, error) {
 	var user User
 	tx := u.db.Where("address = ?", address).Find(&user)
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// UserStats 用户对局统计,每局结算时在同一事务中累加
+type UserStats struct {
+	UserId         int64     `json:"userId" gorm:"primaryKey;autoIncrement:false"`
+	HandsPlayed    int       `json:"handsPlayed"`    // 参与局数
+	HandsWon       int       `json:"handsWon"`       // 获胜局数
+	NetChips       int64     `json:"netChips"`       // 输赢筹码合计
+	BiggestPot     int64     `json:"biggestPot"`     // 赢得的最大奖池
+	BlindHands     int       `json:"blindHands"`     // 未看牌(闷牌)结算的局数
+	Compares       int       `json:"compares"`       // 比牌次数
+	CompareWins    int       `json:"compareWins"`    // 比牌获胜次数
+	Singles        int       `json:"singles"`        // 散牌
+	Doubles        int       `json:"doubles"`        // 对子
+	Straights      int       `json:"straights"`      // 顺子
+	Flushes        int       `json:"flushes"`        // 同花
+	FlushStraights int       `json:"flushStraights"` // 同花顺
+	Triples        int       `json:"triples"`        // 豹子
+	WinStreak      int       `json:"winStreak"`      // 当前连胜局数,由当局记录重新汇总时为0
+	UpdateAt       time.Time `json:"updateTime"`
+}
+
+type UserStatsDB struct {
+	db *gorm.DB
+}
+
+func NewUserStatsDB(db *gorm.DB) *UserStatsDB {
+	return &UserStatsDB{db: db}
+}
+
+// AddStats 累加当局统计,需在结算记账的同一事务中调用
+func (u *UserStatsDB) AddStats(tx *gorm.DB, stats []UserStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for index := range stats {
+		stats[index].UpdateAt = now
+	}
+
+	assignments := map[string]interface{}{
+		"biggest_pot": gorm.Expr("MAX(user_stats.biggest_pot, excluded.biggest_pot)"),
+		"update_at":   gorm.Expr("excluded.update_at"),
+		"win_streak":  gorm.Expr("CASE WHEN excluded.hands_won > 0 THEN user_stats.win_streak + excluded.win_streak ELSE 0 END"),
+	}
+	for _, column := range []string{"hands_played", "hands_won", "net_chips", "blind_hands", "compares", "compare_wins",
+		"singles", "doubles", "straights", "flushes", "flush_straights", "triples"} {
+		assignments[column] = gorm.Expr("user_stats." + column + " + excluded." + column)
+	}
+	return tx.Model(&UserStats{}).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(assignments),
+	}).Create(&stats).Error
+}
+
+// WinStreaks 用户当前连胜局数,需在累加统计的同一事务中调用
+func (u *UserStatsDB) WinStreaks(tx *gorm.DB, userIds []int64) (map[int64]int, error) {
+	stats := make([]UserStats, 0)
+	if err := tx.Model(&UserStats{}).Where("user_id IN (?)", userIds).Select("user_id, win_streak").Find(&stats).Error; err != nil {
+		return nil, err
+	}
+	streaks := make(map[int64]int, len(stats))
+	for index := range stats {
+		streaks[stats[index].UserId] = stats[index].WinStreak
+	}
+	return streaks, nil
+}
+
+// GetStats 用户对局统计,没有对局记录时返回空统计
+func (u *UserStatsDB) GetStats(userId int64) (UserStats, error) {
+	stats := make([]UserStats, 0)
+	if err := u.db.Model(&UserStats{}).Where("user_id = ?", userId).Limit(1).Find(&stats).Error; err != nil {
+		return UserStats{}, err
+	}
+	if len(stats) == 0 {
+		return UserStats{UserId: userId}, nil
+	}
+	return stats[0], nil
+}
+
+// Rebuild 统计为空时由已保存的当局记录(round_seat)重新汇总,牌型取值与 service.PokerSingle...PokerTriple 一致。
+// 返回汇总的用户数
+func (u *UserStatsDB) Rebuild() (int, error) {
+	count := int64(0)
+	if err := u.db.Model(&UserStats{}).Count(&count).Error; err != nil || count > 0 {
+		return 0, err
+	}
+
+	stats := make([]UserStats, 0)
+	err := u.db.Table("round_seat s").
+		Joins("JOIN game_round r ON r.game_id = s.game_id AND r.round_id = s.round_id").
+		Group("s.user_id").
+		Select("s.user_id, COUNT(s.id) as hands_played, " +
+			"SUM(CASE WHEN r.win_user_id = s.user_id THEN 1 ELSE 0 END) as hands_won, " +
+			"SUM(s.win_chips) as net_chips, " +
+			"MAX(CASE WHEN r.win_user_id = s.user_id THEN r.win_chips ELSE 0 END) as biggest_pot, " +
+			"SUM(CASE WHEN s.is_look_card THEN 0 ELSE 1 END) as blind_hands, " +
+			"SUM(s.compares) as compares, SUM(s.compare_wins) as compare_wins, " +
+			"SUM(CASE WHEN s.poker_type = 1 THEN 1 ELSE 0 END) as singles, " +
+			"SUM(CASE WHEN s.poker_type = 2 THEN 1 ELSE 0 END) as doubles, " +
+			"SUM(CASE WHEN s.poker_type = 3 THEN 1 ELSE 0 END) as straights, " +
+			"SUM(CASE WHEN s.poker_type = 4 THEN 1 ELSE 0 END) as flushes, " +
+			"SUM(CASE WHEN s.poker_type = 5 THEN 1 ELSE 0 END) as flush_straights, " +
+			"SUM(CASE WHEN s.poker_type = 6 THEN 1 ELSE 0 END) as triples").
+		Scan(&stats).Error
+	if err != nil || len(stats) == 0 {
+		return 0, err
+	}
+
+	err = u.db.Transaction(func(tx *gorm.DB) error {
+		return u.AddStats(tx, stats)
+	})
+	return len(stats), err
+}
@@ -18,11 +18,26 @@ import (
 )
 
 type ReceiveMsg struct {
-	Type      int   `json:"type"`      // 消息类型
-	CurrRound int   `json:"currRound"` // 当前第几局
-	BetChips  int64 `json:"betChips"`  // 下注筹码(跟注/加注)
-	CompareId int64 `json:"compareId"` // 比牌的用户ID
-	IsAutoBet bool  `json:"isAutoBet"` // 是否配置自动下注
+	Type      int    `json:"type"`      // 消息类型
+	CurrRound int    `json:"currRound"` // 当前第几局
+	BetChips  int64  `json:"betChips"`  // 下注筹码(跟注/加注)
+	CompareId int64  `json:"compareId"` // 比牌的用户ID
+	IsAutoBet bool   `json:"isAutoBet"` // 是否配置自动下注
+	BuyIn     int64  `json:"buyIn"`     // 买入筹码(准备/补充筹码),为空时补足到最低买入
+	ActionId  string `json:"actionId"`  // 客户端生成的操作ID,重发时不变,当局重复的操作只处理一次
+}
+
+// actionNames 游戏请求事件类型对应的限流配置名称
+var actionNames = map[int]string{
+	constant.POKER_READY:     "ready",
+	constant.POKER_START:     "start",
+	constant.POKER_LOOK_CARD: "look_card",
+	constant.POKER_GIVE_UP:   "give_up",
+	constant.POKER_BET:       "bet",
+	constant.POKER_COMPARE:   "compare",
+	constant.POKER_AUTOBET:   "auto_bet",
+	constant.POKER_TOP_UP:    "top_up",
+	constant.POKER_CASH_OUT:  "cash_out",
 }
 
 type CreateGameReq struct {
@@ -30,47 +45,75 @@ type CreateGameReq struct {
 	LowBetChips int64 `json:"lowBetChips"` // 最低下注筹码
 	TopBetChips int64 `json:"topBetChips"` // 封顶下注筹码
 	TotalRounds int   `json:"totalRounds"` // 总游戏局数
+	MinBuyIn    int64 `json:"minBuyIn"`    // 最低买入筹码,为空时为底注
+	MaxBuyIn    int64 `json:"maxBuyIn"`    // 最高买入筹码,为空时不限制
 }
 
 func handlerSocketConnection(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	// 服务关闭中,客户端需连接其他实例
+	if c.Game.IsDraining() {
+		response.Fail(constant.Code10015, constant.ServerShuttingDown, w)
+		return
+	}
+
 	// 完成和Client HTTP >>> WebSocket的协议升级
 	conn, err := c.WebSocket.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
-	defer conn.Close()
+
+	// 连接的所有写操作由写协程串行,定时发送ping心跳
+	wsConfig := c.Config.Server.WebSocket
+	client := service.NewClient(conn, wsConfig.WriteWait, wsConfig.PingInterval)
+	defer client.Close(websocket.CloseNormalClosure, "")
 
 	// Error send message
 	errMsgFunc := func(errMsg error) {
 		errMessage := service.ErrorMessage{ErrorMsg: errMsg.Error()}
-		conn.WriteMessage(websocket.TextMessage, errMessage.ToJsonStr(constant.EVENT_ERROR))
+		if errors.Is(errMsg, constant.RequestTooFrequentError) {
+			errMessage.Code = constant.Code10014
+		} else if errors.Is(errMsg, constant.ServerShuttingDownError) {
+			errMessage.Code = constant.Code10015
+		} else if errors.Is(errMsg, constant.BuyInOutOfRangeError) {
+			errMessage.Code = constant.Code10017
+		} else if errors.Is(errMsg, constant.UserNotEnoughBetError) {
+			errMessage.Code = constant.Code10018
+		}
+		client.Send(errMessage.ToJsonStr(constant.EVENT_ERROR))
 	}
 
 	// Header json string to db.User
 	user := db.User{}
 	if errs := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); errs != nil {
-		defer func() {
-			time.Sleep(time.Second)
-			conn.Close()
-		}()
-
+		// 关闭连接前发送队列中的错误消息
 		errMsgFunc(constant.UserNotExistError)
 		return
 	}
 
+	// 心跳检测->超过PongWait未收到任何消息(包括pong)则判定连接已断开
+	conn.SetReadDeadline(time.Now().Add(wsConfig.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsConfig.PongWait))
+	})
+
+	ip := clientIP(c, r)
 	token := conn.RemoteAddr().String()
 	gameId := r.Header.Get(constant.HeaderCurrentGameId)
 
-	// Register game Room
-	Game, err := c.Game.ConnOnline(gameId, user.ID, token, conn)
-	if err == nil {
-		// UserJoinRoom 加入游戏
-		if errs := Game.UserJoinRoom(user, false, nil, nil); errs != nil {
-			// Error send message
-			errMsgFunc(errs)
-			return
-		}
+	// Register game Room,房间已过期或被回收时通知客户端后关闭连接
+	Game, err := c.Game.ConnOnline(gameId, user.ID, token, client)
+	if err != nil {
+		errMsgFunc(err)
+		return
+	}
+
+	// UserJoinRoom 加入游戏
+	if errs := Game.UserJoinRoom(user, false, nil, nil); errs != nil {
+		// Error send message
+		errMsgFunc(errs)
+		c.Game.ConnOffline(gameId, user.ID, token)
+		return
 	}
 
 	for {
@@ -82,6 +125,9 @@ func handlerSocketConnection(c *config.ServerConfig, w http.ResponseWriter, r *h
 			break
 		}
 
+		// 收到客户端消息同样视为连接存活
+		conn.SetReadDeadline(time.Now().Add(wsConfig.PongWait))
+
 		if msg != nil && len(msg) > 0 {
 			var receiveMsg ReceiveMsg
 			errors := json.Unmarshal(msg, &receiveMsg)
@@ -90,35 +136,53 @@ func handlerSocketConnection(c *config.ServerConfig, w http.ResponseWriter, r *h
 				continue
 			}
 
+			// 限制用户操作频率
+			action := actionNames[receiveMsg.Type]
+			if !allowRequest(c, "action:"+action, ip, user.ID, c.Config.RateLimit.ActionLimit(action)) {
+				errMsgFunc(constant.RequestTooFrequentError)
+				continue
+			}
+
+			// 当局重复提交的操作直接返回首次处理结果
+			actionOpt := service.WithActionId(user.ID, receiveMsg.Type, receiveMsg.ActionId)
+
 			var handlerErr error
 			switch receiveMsg.Type {
 			case constant.POKER_READY:
 				// 0、开始游戏
-				handlerErr = handlerUserJoinRoom(Game, user)
+				handlerErr = handlerUserJoinRoom(Game, user, receiveMsg)
 				break
 			case constant.POKER_START:
 				// 1、开始游戏->仅庄家操作
-				handlerErr = handlerStartGame(Game, user.ID)
+				handlerErr = handlerStartGame(Game, user.ID, actionOpt)
 				break
 			case constant.POKER_LOOK_CARD:
 				// 2、看牌
-				handlerErr = handlerLookCardGame(Game, user.ID, receiveMsg)
+				handlerErr = handlerLookCardGame(Game, user.ID, receiveMsg, actionOpt)
 				break
 			case constant.POKER_GIVE_UP:
 				// 3、弃牌
-				handlerErr = handlerGiveUpGame(Game, user.ID, receiveMsg)
+				handlerErr = handlerGiveUpGame(Game, user.ID, receiveMsg, actionOpt)
 				break
 			case constant.POKER_BET:
 				// 4、跟注/加注
-				handlerErr = handlerBettingGame(Game, user.ID, false, receiveMsg)
+				handlerErr = handlerBettingGame(Game, user.ID, false, receiveMsg, actionOpt)
 				break
 			case constant.POKER_COMPARE:
 				// 5、下注比牌
-				handlerErr = handlerBettingGame(Game, user.ID, true, receiveMsg)
+				handlerErr = handlerBettingGame(Game, user.ID, true, receiveMsg, actionOpt)
 				break
 			case constant.POKER_AUTOBET:
 				// 6、自动下注
-				handlerErr = handlerAutoBetGame(Game, user.ID, receiveMsg)
+				handlerErr = handlerAutoBetGame(Game, user.ID, receiveMsg, actionOpt)
+				break
+			case constant.POKER_TOP_UP:
+				// 7、买入/补充桌上筹码
+				handlerErr = Game.UserBuyIn(user.ID, receiveMsg.BuyIn, actionOpt)
+				break
+			case constant.POKER_CASH_OUT:
+				// 8、兑出桌上筹码
+				handlerErr = Game.UserCashOut(user.ID, actionOpt)
 				break
 			}
 
@@ -130,25 +194,18 @@ func handlerSocketConnection(c *config.ServerConfig, w http.ResponseWriter, r *h
 	}
 }
 
-func handlerUserJoinRoom(game *service.Game, user db.User) error {
-	// 用户已准备好开始
-	return game.UserJoinRoom(user, true, nil, func(gameRoom *service.GameRoom) error {
-		dbUser, err := game.UserService.GetById(user.ID)
-		if err != nil {
-			log.Print("Query user error", err)
-			return constant.UserNotExistError
-		}
-
-		// 用户筹码不足
-		if dbUser.Balance < gameRoom.LowBetChips {
-			return constant.UserNotEnoughBetError
-		}
+func handlerUserJoinRoom(game *service.Game, user db.User, receiveMsg ReceiveMsg) error {
+	// 准备前买入桌上筹码(桌上筹码已足够且未指定买入筹码时不操作数据库)
+	buyIn := service.WithActionId(user.ID, constant.POKER_TOP_UP, receiveMsg.ActionId)
+	if err := game.UserBuyIn(user.ID, receiveMsg.BuyIn, buyIn); err != nil && !errors.Is(err, constant.StackChangePlayingError) {
+		return err
+	}
 
-		return nil
-	})
+	// 用户已准备好开始
+	return game.UserJoinRoom(user, true, nil, nil, service.WithActionId(user.ID, receiveMsg.Type, receiveMsg.ActionId))
 }
 
-func handlerStartGame(game *service.Game, userId int64) error {
+func handlerStartGame(game *service.Game, userId int64, action service.ActionOption) error {
 	// 设置游戏开始
 	return game.StartGame(userId, func(gameRoom *service.GameRoom, joinUsers map[int64]*service.JoinUser, next func(map[int64]service.UserPoker) error) error {
 
@@ -164,26 +221,11 @@ func handlerStartGame(game *service.Game, userId int64) error {
 		userPokers := cardPoker.LicenseCardPoker(userIds)
 		// todo 合约
 		// game.SaveUserPoker(gameRoom, userPokers)
-		// 整体放入同一个事物中
-		return game.UserService.DeductAnteBetting(gameRoom.GameId, gameRoom.CurrRound, userIds, gameRoom.LowBetChips, func(balanceMap map[int64]int64) error {
-			totalBetChips := int64(0)
-			for id, betChips := range balanceMap {
-				totalBetChips += betChips
-				joinUsers[id].TotalBetChips += betChips
-
-				// 下注筹码记录
-				gameRoom.BetChips = append(gameRoom.BetChips, betChips)
-			}
-
-			gameRoom.TotalBetChips = totalBetChips
-			gameRoom.ExposedBetChips = gameRoom.LowBetChips
-			gameRoom.ConcealedBetChips = gameRoom.LowBetChips
-			return next(userPokers)
-		})
-	})
+		return next(userPokers)
+	}, action)
 }
 
-func handlerLookCardGame(game *service.Game, userId int64, receiveMsg ReceiveMsg) error {
+func handlerLookCardGame(game *service.Game, userId int64, receiveMsg ReceiveMsg, action service.ActionOption) error {
 	// 设置链已查看状态
 	return game.UserLookCard(userId, receiveMsg.CurrRound, func(gameRoom *service.GameRoom) (string, error) {
 		// 获取链上3张牌值
@@ -192,15 +234,15 @@ func handlerLookCardGame(game *service.Game, userId int64, receiveMsg ReceiveMsg
 			return "", err
 		}
 		return userPoker.ToString(), nil
-	})
+	}, action)
 }
 
-func handlerGiveUpGame(game *service.Game, userId int64, receiveMsg ReceiveMsg) error {
-	return game.UserGiveUpCard(userId, receiveMsg.CurrRound, nil)
+func handlerGiveUpGame(game *service.Game, userId int64, receiveMsg ReceiveMsg, action service.ActionOption) error {
+	return game.UserGiveUpCard(userId, receiveMsg.CurrRound, nil, action)
 }
 
 // handlerBettingGame (仅跟注/加注)或者(下注并与其他人Pk)
-func handlerBettingGame(game *service.Game, userId int64, isPkCompare bool, receiveMsg ReceiveMsg) error {
+func handlerBettingGame(game *service.Game, userId int64, isPkCompare bool, receiveMsg ReceiveMsg, action service.ActionOption) error {
 	return game.UserBetting(userId, receiveMsg.CompareId, receiveMsg.CurrRound, receiveMsg.BetChips, nil, func(gameRoom *service.GameRoom, joinUser *service.JoinUser, callUpdateFunc func(bool, *service.UserPoker) error) error {
 
 		isPkSuccess := false
@@ -230,36 +272,19 @@ func handlerBettingGame(game *service.Game, userId int64, isPkCompare bool, rece
 			}
 		}
 
-		// 整体放入同一个事物中
-		// 扣除用户的跟注/加注筹码-操作数据库
-		return game.UserService.DeductRaiseBetting(gameRoom.GameId, gameRoom.CurrRound, joinUser.UserId, receiveMsg.BetChips, func(betChips int64) error {
-			// 记录全局下注最大值
-			if joinUser.IsLookCard {
-				// 明牌下注筹码
-				gameRoom.ExposedBetChips = betChips
-			} else {
-				// 隐藏下注筹码
-				gameRoom.ConcealedBetChips = betChips
-			}
-
-			// 游戏过程中PK记录(每局结束时，所有玩家只能看见自己比过或跟自己比过的玩家的手牌)
-			if isPkCompare {
-				gameRoom.Records = game.GetGamePkCompareRecord(gameRoom.Records, []int64{userId, receiveMsg.CompareId})
-			}
-
-			// 下注筹码记录
-			gameRoom.BetChips = append(gameRoom.BetChips, betChips)
+		// 游戏过程中PK记录(每局结束时，所有玩家只能看见自己比过或跟自己比过的玩家的手牌)
+		if isPkCompare {
+			gameRoom.Records = game.GetGamePkCompareRecord(gameRoom.Records, []int64{userId, receiveMsg.CompareId})
+		}
 
-			joinUser.TotalBetChips += betChips
-			gameRoom.TotalBetChips += betChips
-			return callUpdateFunc(isPkSuccess, pkSuccPoker)
-		})
-	})
+		// 下注从桌上筹码扣除,结算时统一记账
+		return callUpdateFunc(isPkSuccess, pkSuccPoker)
+	}, action)
 }
 
 // handlerCompareGame 自动下注
-func handlerAutoBetGame(game *service.Game, userId int64, receiveMsg ReceiveMsg) error {
-	return game.UserSetAutoBetting(userId, receiveMsg.IsAutoBet, receiveMsg.CurrRound)
+func handlerAutoBetGame(game *service.Game, userId int64, receiveMsg ReceiveMsg, action service.ActionOption) error {
+	return game.UserSetAutoBetting(userId, receiveMsg.IsAutoBet, receiveMsg.CurrRound, action)
 }
 
 // handlerCreateGame 创建一个游戏房间
@@ -276,6 +301,18 @@ func handlerCreateGame(c *config.ServerConfig, w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// 最高买入不能低于最低买入及底注
+	if bodyJSON.MaxBuyIn > 0 && (bodyJSON.MaxBuyIn < bodyJSON.MinBuyIn || bodyJSON.MaxBuyIn < bodyJSON.LowBetChips) {
+		response.Fail(constant.Code10017, constant.BuyInOutOfRange, w)
+		return
+	}
+
+	// 服务关闭中不允许创建房间
+	if c.Game.IsDraining() {
+		response.Fail(constant.Code10015, constant.ServerShuttingDown, w)
+		return
+	}
+
 	gameRoom := &service.GameRoom{
 		GameId:        strings.ReplaceAll(uuid.New().String(), "-", ""),
 		JoinUsers:     make(map[int64]int, 0),
@@ -292,19 +329,14 @@ func handlerCreateGame(c *config.ServerConfig, w http.ResponseWriter, r *http.Re
 		TotalBetChips: 0,
 		LowBetChips:   bodyJSON.LowBetChips,
 		TopBetChips:   bodyJSON.TopBetChips,
+		MinBuyIn:      bodyJSON.MinBuyIn,
+		MaxBuyIn:      bodyJSON.MaxBuyIn,
 		CreateUser:    user.ID,
 		CreateAt:      time.Now(),
 	}
 
-	conns, errs := c.Game.GetGame(gameRoom.GameId, true)
-	if errs != nil && !errors.Is(errs, constant.CacheGetInfoError) && !errors.Is(errs, constant.GamePareError) {
-		log.Println("CreateGame error:", errs)
-		response.SystemError(w)
-		return
-	}
-
 	// 创建游戏房间
-	if errs = conns.CreateGames(gameRoom, user, nil); errs != nil {
+	if _, errs := c.Game.CreateGame(gameRoom, user); errs != nil {
 		log.Println("CreateGame error:", errs)
 		response.SystemError(w)
 		return
@@ -10,6 +10,7 @@ import (
 	"go.uber.org/fx"
 	"go.uber.org/fx/fxevent"
 	"io"
+	"log"
 	"net/http"
 )
 
@@ -18,22 +19,35 @@ var staticFiles embed.FS
 
 func main() {
 
+	// 关闭超时由配置的 server.drain_timeout 决定,需在创建应用前读取配置
+	configuration := config.NewConfiguration()
+
 	app := fx.New(
+		fx.Supply(configuration),
 		fx.Provide(
 			http.NewServeMux,
-			config.NewConfiguration,
 			db2.NewGameDB,
 			db2.NewUserDB,
 			db2.NewUserHistoryDB,
+			db2.NewLedgerDB,
+			db2.NewOutboxDB,
+			db2.NewRoundDB,
+			db2.NewUserStatsDB,
+			db2.NewLeaderboardDB,
+			db2.NewAchievementDB,
 			config.NewRedisClient,
 			config.NewEmailSmtpAuth,
 			config.NewArgon2Password,
 			config.NewLogger,
 			config.NewWebSocket,
+			service.NewLeaderboard,
 			service.NewUserService,
 			config.NewServerConfig),
 		fx.Invoke(src.NewHTTPServer, src.NewServeMux, NewTestStaticFile),
 
+		// 服务关闭时需等待进行中的当局结束(server.drain_timeout),并预留保存房间及关闭HTTP服务的时间
+		fx.StopTimeout(configuration.Server.StopTimeout()),
+
 		// This is optional. With this, you can control where Fx logs
 		// its events. In this case, we're using a NopLogger to keep
 		// our test silent. Normally, you'll want to use an
@@ -52,6 +66,13 @@ func main() {
 
 	// 等待应用程序关闭
 	<-app.Done()
+
+	// 停止应用程序,等待游戏房间进行中的当局结束
+	stopCtx, cancel := context.WithTimeout(context.Background(), app.StopTimeout())
+	defer cancel()
+	if err := app.Stop(stopCtx); err != nil {
+		log.Println(err)
+	}
 }
 
 // NewTestStaticFile 测试静态文件
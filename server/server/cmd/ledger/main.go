@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	db2 "game-3-card-poker/server/db"
+	"log"
+	"os"
+)
+
+// 账本校验: 所有分录合计为0、每个凭证平衡、用户余额与账本一致,校验失败时退出码为1
+func main() {
+	ledgerDB := db2.NewLedgerDB(db2.NewGameDB())
+	report, err := ledgerDB.Verify()
+	if err != nil {
+		log.Fatalln("verify ledger error: ", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if !report.OK() {
+		log.Println("ledger verify failed, chips are not accounted for")
+		os.Exit(1)
+	}
+	log.Println("ledger verify ok")
+}
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"game-3-card-poker/server/daley"
+	"game-3-card-poker/server/limiter"
 	"game-3-card-poker/server/service"
 	"github.com/go-crypt/crypt/algorithm"
 	"github.com/go-crypt/crypt/algorithm/argon2"
@@ -25,6 +27,7 @@ type ServerConfig struct {
 	WebSocket   websocket.Upgrader
 	RedisClient *redis.Client
 	UserService *service.UserService
+	Limiter     *limiter.Limiter
 }
 
 func NewConfiguration() Configuration {
@@ -56,32 +59,70 @@ func NewConfiguration() Configuration {
 		panic(err)
 	}
 
+	// websocket心跳默认值
+	config.Server.setDefaults()
+
 	return config
 }
 
 func NewServerConfig(config Configuration, webSocket websocket.Upgrader, smtpAuth smtp.Auth, hasher *argon2.Hasher, redisClient *redis.Client, userService *service.UserService) *ServerConfig {
 
-	connects := &service.GamePool{
-		RedisClient: redisClient,
-		UserService: userService,
-		Conns:       make(map[string]*service.Game, 0),
+	// 房间状态存储,memory不在实例间共享,仅用于单机开发环境
+	var store service.GameStore = service.NewRedisGameStore(redisClient)
+	if config.Server.GameStore == "memory" {
+		store = service.NewMemoryGameStore()
 	}
 
-	// DelayQueue init
-	connects.DelayQueue = daley.NewQueue("delay-queue", redisClient, func(message, idStr string) bool {
-		if connects.Conns != nil {
-			delayMsg := service.DelayMsg{}
-			if err := delayMsg.ToDelayMsg(message); err != nil {
-				log.Println("delay-queue error:", err)
-			}
-
-			Game, ok := connects.Conns[delayMsg.GameId]
-			if ok {
-				return Game.DelayCallback(delayMsg)
-			}
-		}
-		return false
-	})
+	connects := service.NewGamePool(redisClient, store, userService, config.Server.WebSocket.AwayTimeout)
+
+	// DelayQueue init,延迟消息按任务类型分发
+	connects.RegisterDelayJobs(daley.NewRegistry("delay-queue", redisClient))
+
+	// 成就规则,结算时解锁
+	if err := userService.SetAchievementRules(config.Achievements); err != nil {
+		log.Println("achievement rules error:", err)
+	}
+
+	// 启用账本前已有余额的用户记录期初余额
+	if count, err := userService.OpenLedgerBalances(); err != nil {
+		log.Println("open ledger balances error:", err)
+	} else if count > 0 {
+		log.Printf("open ledger balances of %d users", count)
+	}
+
+	// 启用统计前已结算的当局汇总玩家统计
+	if count, err := userService.RebuildStats(); err != nil {
+		log.Println("rebuild user stats error:", err)
+	} else if count > 0 {
+		log.Printf("rebuild stats of %d users", count)
+	}
+
+	// 恢复服务重启前进行中的游戏房间
+	if count, err := connects.Recover(context.Background()); err != nil {
+		log.Println("recover game rooms error:", err)
+	} else {
+		log.Printf("recover %d game rooms", count)
+	}
+
+	// 以数据库为准修复服务宕机前未同步的房间状态,之后周期修复
+	if report, err := connects.Repair(context.Background(), true); err != nil {
+		log.Println("repair game rooms error:", err)
+	} else {
+		log.Printf("repair game rooms: %+v", report)
+	}
+	if err := connects.ScheduleRepair(config.Server.RepairEvery); err != nil {
+		log.Println("schedule repair game rooms error:", err)
+	}
+
+	// 归档服务停止期间结束的排行榜,之后按周期归档
+	if count, err := userService.ArchiveLeaderboards(context.Background()); err != nil {
+		log.Println("archive leaderboards error:", err)
+	} else if count > 0 {
+		log.Printf("archive %d leaderboards", count)
+	}
+	if err := connects.ScheduleLeaderboardArchive(config.Server.LeaderboardArchive); err != nil {
+		log.Println("schedule archive leaderboards error:", err)
+	}
 
 	// 延迟队列初始化
 	go func() {
@@ -90,6 +131,15 @@ func NewServerConfig(config Configuration, webSocket websocket.Upgrader, smtpAut
 		<-done
 	}()
 
+	// 订阅所有实例发布的房间事件
+	go func() {
+		done := connects.StartSubscribe()
+		<-done
+	}()
+
+	// 周期移除本实例已过期、已结束的房间协程
+	connects.StartEvict()
+
 	return &ServerConfig{
 		Game:        connects,
 		Config:      config,
@@ -98,6 +148,7 @@ func NewServerConfig(config Configuration, webSocket websocket.Upgrader, smtpAut
 		WebSocket:   webSocket,
 		RedisClient: redisClient,
 		UserService: userService,
+		Limiter:     limiter.NewLimiter("rate-limit", redisClient),
 	}
 }
 
@@ -17,6 +17,14 @@ const (
 const (
 	DELAY_AUTOBET = iota + 1 // 1、用户设置自动跟注
 	DELAY_GIVEUP             // 2、超时用户自动放弃
+	DELAY_OFFLINE            // 3、离开超时用户判定离线
+)
+
+// 用户在线状态
+const (
+	PRESENCE_ONLINE  = iota + 1 // 1、在线
+	PRESENCE_AWAY               // 2、离开(连接断开,等待重连)
+	PRESENCE_OFFLINE            // 3、离线
 )
 
 // 游戏请求事件类型
@@ -28,6 +36,8 @@ const (
 	POKER_BET                  // 4、跟注/加注
 	POKER_COMPARE              // 5、下注比牌
 	POKER_AUTOBET              // 6、自动下注
+	POKER_TOP_UP               // 7、买入/补充桌上筹码(局间)
+	POKER_CASH_OUT             // 8、兑出桌上筹码离座(局间)
 )
 
 // 游戏响应事件类型
@@ -44,13 +54,19 @@ const (
 	EVENT_CURRENT_USER                 // 9、当前活动用户
 	EVENT_ERROR                        // 10、错误请求
 	EVENT_OVER                         // 11、游戏结束
+	EVENT_PRESENCE                     // 12、用户在线状态变更
+	EVENT_SHUTDOWN                     // 13、服务关闭(客户端需重新连接)
+	EVENT_STACK                        // 14、桌上筹码变更(买入/兑出)
+	EVENT_ACHIEVEMENT                  // 15、用户解锁成就
 )
 
 // 筹码历史记录状态
 const (
-	BET_STATE_ANTE  = iota + 0 // 1、底注
-	BET_STATE_RAISE            // 2、下注
-	BET_STATE_WIN              // 3、获胜
+	BET_STATE_ANTE   = iota + 0 // 1、底注
+	BET_STATE_RAISE             // 2、下注
+	BET_STATE_WIN               // 3、获胜
+	BET_STATE_FAUCET            // 4、注册赠送、领取金币
+	BET_STATE_BONUS             // 5、奖励
 )
 
 // 合约相关常量
@@ -89,7 +105,13 @@ const (
 	Code10011 = 10011 // 验证码发送异常
 	Code10012 = 10012 // 用户未登录
 	Code10013 = 10013 // 金币大于1000不允许领取
+	Code10014 = 10014 // 请求过于频繁
+	Code10015 = 10015 // 服务正在关闭
+	Code10016 = 10016 // 无管理员权限
+	Code10017 = 10017 // 买入筹码超出房间限制
+	Code10018 = 10018 // 账户余额不足
 	Code20001 = 20001 // 游戏链接不存在
+	Code20002 = 20002 // 当局记录不存在
 	Code99999 = 99999 // 系统异常
 )
 
@@ -109,6 +131,12 @@ const (
 	VerifyCodeSendError = "验证码发送异常"
 	UserNotLogin        = "用户未登录"
 	BalanceThan1000     = "金币大于1000不允许领取"
+	RequestTooFrequent  = "请求过于频繁,请稍后再试"
+	ServerShuttingDown  = "服务正在关闭,请稍后重新连接"
+	NoAdminPermission   = "无管理员权限"
+	BuyInOutOfRange     = "买入筹码超出房间限制"
+	BalanceNotEnough    = "账户余额不足"
 	GameNotExist        = "游戏链接不存在"
+	RoundNotExist       = "当局记录不存在"
 	Error               = "系统异常"
 )
@@ -0,0 +1,224 @@
+package daley
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"time"
+)
+
+// DeadLetter is a message which failed after all retries, kept until it is requeued or purged
+type DeadLetter struct {
+	Id          string `json:"id"`
+	Payload     string `json:"payload"`
+	PayloadLost bool   `json:"payloadLost"` // payload expired before the message died, it can not be requeued
+	Failures    int64  `json:"failures"`    // number of failed deliveries
+	LastError   string `json:"lastError"`   // error of the last delivery
+	DeadAt      int64  `json:"deadAt"`      // milliseconds
+
+	// retry count and ttl the message was sent with, restored by requeue.
+	// MsgTTL is 0 for messages sent by older versions, they are requeued with the queue defaults
+	RetryCount uint          `json:"retryCount"`
+	MsgTTL     time.Duration `json:"msgTTL"`
+}
+
+// RequeueResult is the result of requeueing dead letters
+type RequeueResult struct {
+	Requeued int      `json:"requeued"`
+	Lost     []string `json:"lost"` // dead letters whose payload is lost, they are kept and not requeued
+}
+
+// QueueStats is the number of messages in each stage of a queue
+type QueueStats struct {
+	Name    string `json:"name"`
+	Pending int64  `json:"pending"`
+	Ready   int64  `json:"ready"`
+	Unack   int64  `json:"unack"`
+	Retry   int64  `json:"retry"`
+	Dead    int64  `json:"dead"`
+}
+
+// garbageCollect moves messages which run out of retries from garbage to dead letters with their payload and failures
+func (q *DelayQueue) garbageCollect() error {
+	ctx := context.Background()
+	msgIds, err := q.redisCli.SMembers(ctx, q.garbageKey).Result()
+	if err != nil {
+		return fmt.Errorf("smembers failed: %v", err)
+	}
+	if len(msgIds) == 0 {
+		return nil
+	}
+	for _, idStr := range msgIds {
+		deadLetter := DeadLetter{Id: idStr, DeadAt: time.Now().UnixMilli()}
+		// payload may be expired, dead letter is kept anyway
+		payload, errs := q.redisCli.Get(ctx, q.genMsgKey(idStr)).Result()
+		if errs != nil && errs != redis.Nil {
+			return fmt.Errorf("get payload failed: %v", errs)
+		}
+		deadLetter.Payload, deadLetter.PayloadLost = payload, errs == redis.Nil
+		deadLetter.Failures, _ = q.redisCli.HGet(ctx, q.failCountKey, idStr).Int64()
+		deadLetter.LastError, _ = q.redisCli.HGet(ctx, q.lastErrorKey, idStr).Result()
+		option, _ := q.redisCli.HGet(ctx, q.msgOptionKey, idStr).Result()
+		if retryCount, msgTTL, ok := parseMsgOption(option); ok {
+			deadLetter.RetryCount, deadLetter.MsgTTL = retryCount, msgTTL
+		}
+		value, errs := json.Marshal(deadLetter)
+		if errs != nil {
+			return fmt.Errorf("marshal dead letter failed: %v", errs)
+		}
+		// allow concurrent clean, HSetNX keeps the dead letter stored by the first consumer
+		_, err = q.redisCli.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSetNX(ctx, q.deadKey, idStr, value)
+			pipe.Del(ctx, q.genMsgKey(idStr))
+			pipe.HDel(ctx, q.failCountKey, idStr)
+			pipe.HDel(ctx, q.lastErrorKey, idStr)
+			pipe.HDel(ctx, q.msgOptionKey, idStr)
+			pipe.HDel(ctx, q.idempotencyKey, idStr)
+			pipe.SRem(ctx, q.garbageKey, idStr)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("move to dead letter failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// DeadLetters returns dead letters ordered by the time of death, latest first
+func (q *DelayQueue) DeadLetters(offset, limit int) ([]DeadLetter, error) {
+	ctx := context.Background()
+	values, err := q.redisCli.HVals(ctx, q.deadKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get dead letters failed: %v", err)
+	}
+	deadLetters := make([]DeadLetter, 0, len(values))
+	for _, value := range values {
+		var deadLetter DeadLetter
+		if err = json.Unmarshal([]byte(value), &deadLetter); err != nil {
+			q.logger.Printf("parse dead letter failed: %v", err)
+			continue
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].DeadAt > deadLetters[j].DeadAt
+	})
+
+	if offset < 0 || offset >= len(deadLetters) {
+		return []DeadLetter{}, nil
+	}
+	deadLetters = deadLetters[offset:]
+	if limit > 0 && limit < len(deadLetters) {
+		deadLetters = deadLetters[:limit]
+	}
+	return deadLetters, nil
+}
+
+// requeueScript atomically claims a dead letter and puts it back to pending with its payload, retry count and options,
+// so that the message is never lost between the dead letters and pending. Returns 0 if the dead letter is claimed by another requeue or purged
+// keys: deadKey, msgKey, retryCountKey, msgOptionKey, pendingKey
+// argv: idStr, payload, msg ttl milliseconds, retryCount, msg option, delivery time milliseconds
+const requeueScript = `
+if redis.call('HDel', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('Set', KEYS[2], ARGV[2], 'PX', ARGV[3])
+redis.call('HSet', KEYS[3], ARGV[1], ARGV[4])
+redis.call('HSet', KEYS[4], ARGV[1], ARGV[5])
+redis.call('ZAdd', KEYS[5], ARGV[6], ARGV[1])
+return 1
+`
+
+// Requeue delivers dead letters again immediately with the retry count and ttl they were sent with.
+// Dead letters whose payload is lost are refused and reported in RequeueResult.Lost
+func (q *DelayQueue) Requeue(ids ...string) (RequeueResult, error) {
+	ctx := context.Background()
+	result := RequeueResult{Lost: []string{}}
+	for _, idStr := range ids {
+		value, err := q.redisCli.HGet(ctx, q.deadKey, idStr).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("get dead letter failed: %v", err)
+		}
+		var deadLetter DeadLetter
+		if err = json.Unmarshal([]byte(value), &deadLetter); err != nil {
+			return result, fmt.Errorf("parse dead letter failed: %v", err)
+		}
+		// dead letters stored by older versions have no PayloadLost flag, their lost payload is empty
+		if deadLetter.PayloadLost || len(deadLetter.Payload) == 0 {
+			q.logger.Printf("dead letter %s payload is lost, refuse to requeue", idStr)
+			result.Lost = append(result.Lost, idStr)
+			continue
+		}
+
+		retryCount, msgTTL := deadLetter.RetryCount, deadLetter.MsgTTL
+		if msgTTL <= 0 {
+			retryCount, msgTTL = q.defaultRetryCount, q.msgTTL
+		}
+
+		// only one of concurrent requeue succeeds
+		keys := []string{q.deadKey, q.genMsgKey(idStr), q.retryCountKey, q.msgOptionKey, q.pendingKey}
+		requeued, err := q.redisCli.Eval(ctx, requeueScript, keys, idStr, deadLetter.Payload, msgTTL.Milliseconds(), retryCount, msgOption(retryCount, msgTTL), time.Now().UnixMilli()).Int()
+		if err != nil {
+			return result, fmt.Errorf("requeue dead letter failed: %v", err)
+		}
+		result.Requeued += requeued
+	}
+	if result.Requeued > 0 {
+		q.notify()
+		q.redisCli.Publish(ctx, q.notifyKey, "requeue")
+	}
+	return result, nil
+}
+
+// Purge deletes dead letters, all dead letters are deleted if no id given. Returns the number of deleted messages
+func (q *DelayQueue) Purge(ids ...string) (int64, error) {
+	ctx := context.Background()
+	if len(ids) == 0 {
+		var count *redis.IntCmd
+		_, err := q.redisCli.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			count = pipe.HLen(ctx, q.deadKey)
+			pipe.Del(ctx, q.deadKey)
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("purge dead letters failed: %v", err)
+		}
+		return count.Val(), nil
+	}
+
+	count, err := q.redisCli.HDel(ctx, q.deadKey, ids...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("purge dead letters failed: %v", err)
+	}
+	return count, nil
+}
+
+// Stats returns the number of pending, ready, unack, retry and dead messages
+func (q *DelayQueue) Stats() (QueueStats, error) {
+	ctx := context.Background()
+	var pending, ready, unack, retry, dead *redis.IntCmd
+	_, err := q.redisCli.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pending = pipe.ZCard(ctx, q.pendingKey)
+		ready = pipe.LLen(ctx, q.readyKey)
+		unack = pipe.ZCard(ctx, q.unAckKey)
+		retry = pipe.LLen(ctx, q.retryKey)
+		dead = pipe.HLen(ctx, q.deadKey)
+		return nil
+	})
+	if err != nil {
+		return QueueStats{}, fmt.Errorf("get queue stats failed: %v", err)
+	}
+	return QueueStats{
+		Name:    q.name,
+		Pending: pending.Val(),
+		Ready:   ready.Val(),
+		Unack:   unack.Val(),
+		Retry:   retry.Val(),
+		Dead:    dead.Val(),
+	}, nil
+}
@@ -0,0 +1,232 @@
+package daley
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// envelope is the message stored in queue, the payload is decoded by the handler registered for kind
+type envelope struct {
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// kindHandler is a registered message kind with its defaults and metrics
+type kindHandler struct {
+	name       string
+	handle     func(payload []byte, idStr string) bool
+	retryCount uint
+	msgTTL     time.Duration
+
+	sent           int64
+	sendFailed     int64
+	acked          int64
+	nacked         int64
+	invalid        int64
+	handleDuration int64 // nanoseconds
+}
+
+// KindMetrics is the number of messages sent and consumed of a message kind
+type KindMetrics struct {
+	Kind        string  `json:"kind"`
+	Sent        int64   `json:"sent"`
+	SendFailed  int64   `json:"sendFailed"`
+	Acked       int64   `json:"acked"`
+	Nacked      int64   `json:"nacked"`
+	Invalid     int64   `json:"invalid"` // payload can not be decoded
+	AvgHandleMs float64 `json:"avgHandleMs"`
+}
+
+// Registry dispatches messages of a Scheduler to the handlers registered for their kind
+// use Register to add a typed handler, and Kind.SendDelay or Kind.SendSchedule to publish message
+type Registry struct {
+	scheduler  Scheduler
+	clock      Clock
+	logger     *log.Logger
+	retryCount uint
+	msgTTL     time.Duration
+	mutex      sync.RWMutex
+	kinds      map[string]*kindHandler
+	legacyKind func(message string) string
+	unknown    int64
+}
+
+// NewRegistry creates a DelayQueue whose messages are dispatched by kind
+func NewRegistry(name string, cli *redis.Client) *Registry {
+	r := &Registry{kinds: make(map[string]*kindHandler), clock: SystemClock()}
+	queue := NewQueue(name, cli, r.dispatch)
+	r.scheduler, r.logger, r.retryCount, r.msgTTL = queue, queue.logger, queue.defaultRetryCount, queue.msgTTL
+	return r
+}
+
+// NewMemoryRegistry creates a MemoryQueue whose messages are dispatched by kind, delay is measured by clock
+func NewMemoryRegistry(clock Clock) *Registry {
+	if clock == nil {
+		clock = SystemClock()
+	}
+	r := &Registry{kinds: make(map[string]*kindHandler), clock: clock}
+	queue := NewMemoryQueue(clock, r.dispatch)
+	r.scheduler, r.logger, r.retryCount, r.msgTTL = queue, queue.logger, queue.defaultRetryCount, queue.msgTTL
+	return r
+}
+
+// Scheduler returns the underlying Scheduler, use it to consume or cancel messages
+func (r *Registry) Scheduler() Scheduler {
+	return r.scheduler
+}
+
+// Queue returns the underlying DelayQueue to inspect messages, nil if the registry is not backed by redis
+func (r *Registry) Queue() *DelayQueue {
+	queue, _ := r.scheduler.(*DelayQueue)
+	return queue
+}
+
+// WithLegacyKind resolves the kind of messages sent without envelope, the whole message is used as payload
+func (r *Registry) WithLegacyKind(fn func(message string) string) *Registry {
+	r.legacyKind = fn
+	return r
+}
+
+// Kind is a message kind registered in Registry with payload type T
+type Kind[T any] struct {
+	registry *Registry
+	handler  *kindHandler
+}
+
+// Register adds the handler of a message kind, payload is encoded as json.
+// opts are the defaults of messages of this kind, WithRetryCount and WithMsgTTL are supported.
+// handler returns true to confirm successful consumption, see NewQueue
+func Register[T any](r *Registry, name string, handler func(payload T, idStr string) bool, opts ...interface{}) Kind[T] {
+	if name == "" {
+		panic("name is required")
+	}
+	if handler == nil {
+		panic("handler is required")
+	}
+
+	options := parseMsgOptions(msgOptions{retryCount: r.retryCount, msgTTL: r.msgTTL}, opts)
+	h := &kindHandler{name: name, retryCount: options.retryCount, msgTTL: options.msgTTL}
+	h.handle = func(payload []byte, idStr string) bool {
+		var value T
+		if err := json.Unmarshal(payload, &value); err != nil {
+			atomic.AddInt64(&h.invalid, 1)
+			r.logger.Printf("decode %s msg %s failed: %v", name, idStr, err)
+			return false
+		}
+		return handler(value, idStr)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.kinds[name]; ok {
+		panic(fmt.Sprintf("kind %s is registered", name))
+	}
+	r.kinds[name] = h
+	return Kind[T]{registry: r, handler: h}
+}
+
+// Name returns the name of kind
+func (k Kind[T]) Name() string {
+	return k.handler.name
+}
+
+// SendDelay submits a message of this kind delivered after given duration
+func (k Kind[T]) SendDelay(payload T, duration time.Duration, opts ...interface{}) (string, error) {
+	return k.SendSchedule(payload, k.registry.clock.Now().Add(duration), opts...)
+}
+
+// SendSchedule submits a message of this kind delivered at given time, opts override the defaults of kind
+func (k Kind[T]) SendSchedule(payload T, t time.Time, opts ...interface{}) (string, error) {
+	value, err := json.Marshal(payload)
+	if err != nil {
+		atomic.AddInt64(&k.handler.sendFailed, 1)
+		return "", fmt.Errorf("encode %s msg failed: %v", k.handler.name, err)
+	}
+	message, _ := json.Marshal(envelope{Kind: k.handler.name, Payload: value})
+
+	defaults := []interface{}{retryCountOpt(k.handler.retryCount), msgTTLOpt(k.handler.msgTTL)}
+	idStr, err := k.registry.scheduler.SendScheduleMsg(string(message), t, append(defaults, opts...)...)
+	if err != nil {
+		atomic.AddInt64(&k.handler.sendFailed, 1)
+		return "", err
+	}
+	atomic.AddInt64(&k.handler.sent, 1)
+	return idStr, nil
+}
+
+// Schedule creates or updates a recurring schedule of this kind, see Scheduler.AddSchedule.
+// opts override the defaults of kind, WithMissedPolicy is supported as well
+func (k Kind[T]) Schedule(name string, spec string, payload T, opts ...interface{}) error {
+	value, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode %s msg failed: %v", k.handler.name, err)
+	}
+	message, _ := json.Marshal(envelope{Kind: k.handler.name, Payload: value})
+
+	defaults := []interface{}{retryCountOpt(k.handler.retryCount), msgTTLOpt(k.handler.msgTTL)}
+	return k.registry.scheduler.AddSchedule(name, spec, string(message), append(defaults, opts...)...)
+}
+
+// dispatch is the callback of queue, calls the handler of message kind
+func (r *Registry) dispatch(message, idStr string) bool {
+	var msg envelope
+	if err := json.Unmarshal([]byte(message), &msg); err != nil || msg.Kind == "" {
+		msg = envelope{Payload: json.RawMessage(message)}
+		if r.legacyKind != nil {
+			msg.Kind = r.legacyKind(message)
+		}
+	}
+
+	r.mutex.RLock()
+	h := r.kinds[msg.Kind]
+	r.mutex.RUnlock()
+	if h == nil {
+		// keep the message in dead letters, it can be requeued after the handler is deployed
+		atomic.AddInt64(&r.unknown, 1)
+		r.logger.Printf("no handler for msg %s of kind %q", idStr, msg.Kind)
+		return false
+	}
+
+	start := time.Now()
+	ack := h.handle(msg.Payload, idStr)
+	atomic.AddInt64(&h.handleDuration, int64(time.Since(start)))
+	if ack {
+		atomic.AddInt64(&h.acked, 1)
+	} else {
+		atomic.AddInt64(&h.nacked, 1)
+	}
+	return ack
+}
+
+// Metrics returns the metrics of registered kinds in this instance ordered by name,
+// messages without handler are counted as kind "unknown"
+func (r *Registry) Metrics() []KindMetrics {
+	r.mutex.RLock()
+	metrics := make([]KindMetrics, 0, len(r.kinds)+1)
+	for _, h := range r.kinds {
+		m := KindMetrics{
+			Kind:       h.name,
+			Sent:       atomic.LoadInt64(&h.sent),
+			SendFailed: atomic.LoadInt64(&h.sendFailed),
+			Acked:      atomic.LoadInt64(&h.acked),
+			Nacked:     atomic.LoadInt64(&h.nacked),
+			Invalid:    atomic.LoadInt64(&h.invalid),
+		}
+		if handled := m.Acked + m.Nacked; handled > 0 {
+			m.AvgHandleMs = float64(atomic.LoadInt64(&h.handleDuration)) / float64(handled) / float64(time.Millisecond)
+		}
+		metrics = append(metrics, m)
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Kind < metrics[j].Kind
+	})
+	return append(metrics, KindMetrics{Kind: "unknown", Nacked: atomic.LoadInt64(&r.unknown)})
+}
@@ -0,0 +1,100 @@
+package daley
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+type testJob struct {
+	GameId string `json:"gameId"`
+	UserId int64  `json:"userId"`
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	cli := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	registry := NewRegistry("test", cli).WithLegacyKind(func(message string) string {
+		return "legacy"
+	})
+
+	received := make([]testJob, 0)
+	job := Register(registry, "job", func(payload testJob, idStr string) bool {
+		received = append(received, payload)
+		return true
+	}, WithRetryCount(5), WithMsgTTL(time.Minute))
+	Register(registry, "legacy", func(payload testJob, idStr string) bool {
+		received = append(received, payload)
+		return payload.UserId > 0
+	})
+
+	// 任务类型的默认重试次数及过期时间,发送时可覆盖
+	idStr, err := job.SendDelay(testJob{GameId: "game", UserId: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := cli.HGet(ctx, registry.Queue().retryCountKey, idStr).Int(); count != 5 {
+		t.Fatalf("retry count = %d, want 5", count)
+	}
+	if ttl := cli.TTL(ctx, registry.Queue().genMsgKey(idStr)).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("ttl = %v, want at most 1 minute", ttl)
+	}
+	idStr, _ = job.SendDelay(testJob{GameId: "game", UserId: 2}, 0, WithRetryCount(1))
+	if count, _ := cli.HGet(ctx, registry.Queue().retryCountKey, idStr).Int(); count != 1 {
+		t.Fatalf("retry count = %d, want 1", count)
+	}
+
+	// 旧版本消息及未注册的任务类型
+	registry.Queue().SendDelayMsg(`{"gameId":"legacy","userId":3}`, 0)
+	registry.Queue().SendDelayMsg(`{"kind":"not-exist","payload":{}}`, 0)
+	if err = registry.Queue().consume(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[testJob]bool{{"game", 1}: true, {"game", 2}: true, {"legacy", 3}: true}
+	if len(received) != len(want) {
+		t.Fatalf("received = %v", received)
+	}
+	for _, payload := range received {
+		if !want[payload] {
+			t.Fatalf("received unexpected %v", payload)
+		}
+	}
+
+	metrics := registry.Metrics()
+	wantMetrics := []KindMetrics{
+		{Kind: "job", Sent: 2, Acked: 2},
+		{Kind: "legacy", Acked: 1},
+		{Kind: "unknown", Nacked: 2}, // 首次投递及重试
+	}
+	if len(metrics) != len(wantMetrics) {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+	for i := range metrics {
+		metrics[i].AvgHandleMs = 0
+		if metrics[i] != wantMetrics[i] {
+			t.Fatalf("metrics[%d] = %+v, want %+v", i, metrics[i], wantMetrics[i])
+		}
+	}
+}
+
+func TestRegistry_InvalidPayload(t *testing.T) {
+	registry := NewRegistry("test", redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}))
+	job := Register(registry, "job", func(payload testJob, idStr string) bool { return true })
+
+	if registry.dispatch(`{"kind":"job","payload":{"userId":"1"}}`, "invalid") {
+		t.Fatal("invalid payload acked")
+	}
+	if metrics := registry.Metrics(); metrics[0].Kind != job.Name() || metrics[0].Invalid != 1 || metrics[0].Nacked != 1 {
+		t.Fatalf("metrics = %+v", metrics)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("register duplicate kind want panic")
+		}
+	}()
+	Register(registry, "job", func(payload testJob, idStr string) bool { return true })
+}
@@ -0,0 +1,230 @@
+package daley
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"time"
+)
+
+// maxCatchUpRuns limits the number of missed occurrences delivered at once
+const maxCatchUpRuns = 100
+
+// MissedPolicy decides what to do with occurrences missed while no consumer is running
+type MissedPolicy string
+
+const (
+	// MissedSkip delivers only the latest missed occurrence
+	MissedSkip MissedPolicy = "skip"
+	// MissedCatchUp delivers every missed occurrence, at most maxCatchUpRuns
+	MissedCatchUp MissedPolicy = "catchup"
+)
+
+type missedPolicyOpt MissedPolicy
+
+// WithMissedPolicy set missed-run policy for a schedule, default is MissedSkip
+// example: queue.AddSchedule(name, "@daily", payload, delayqueue.WithMissedPolicy(delayqueue.MissedCatchUp))
+func WithMissedPolicy(policy MissedPolicy) interface{} {
+	return missedPolicyOpt(policy)
+}
+
+// Schedule is a recurring message stored in redis, each occurrence is delivered as a message by only one consumer
+type Schedule struct {
+	Name       string        `json:"name"`
+	Spec       string        `json:"spec"` // cron expression, shortcut such as @daily, or @every <duration>
+	Missed     MissedPolicy  `json:"missed"`
+	Payload    string        `json:"payload"`
+	RetryCount uint          `json:"retryCount"`
+	MsgTTL     time.Duration `json:"msgTTL"`
+	NextRun    int64         `json:"nextRun"` // milliseconds
+	LastRun    int64         `json:"lastRun"` // milliseconds, time of the last delivered occurrence
+}
+
+// fireScheduleScript atomically claims the occurrence of a schedule and puts its messages to pending
+// the claim fails if another consumer has fired this occurrence or the schedule is removed
+// keys: scheduleNextKey, scheduleKey, pendingKey, retryCountKey, msgOptionKey, msgKey...
+// argv: name, claimed nextRun, new nextRun, schedule json, payload, retryCount, msg ttl milliseconds, now milliseconds, msg option, msgId...
+const fireScheduleScript = `
+local current = redis.call('ZScore', KEYS[1], ARGV[1])
+if (not current) or tonumber(current) ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZAdd', KEYS[1], ARGV[3], ARGV[1])
+redis.call('HSet', KEYS[2], ARGV[1], ARGV[4])
+for i = 6, #KEYS do
+	local id = ARGV[i + 4]
+	redis.call('Set', KEYS[i], ARGV[5], 'PX', ARGV[7])
+	redis.call('HSet', KEYS[4], id, ARGV[6])
+	redis.call('HSet', KEYS[5], id, ARGV[9])
+	redis.call('ZAdd', KEYS[3], ARGV[8], id)
+end
+return 1
+`
+
+// AddSchedule creates or updates a recurring schedule, WithRetryCount, WithMsgTTL and WithMissedPolicy are supported.
+// The next run is kept if the schedule exists with the same spec, so it is safe to call on every startup
+func (q *DelayQueue) AddSchedule(name string, spec string, payload string, opts ...interface{}) error {
+	schedule := Schedule{Name: name, Spec: spec, Missed: MissedSkip, Payload: payload, RetryCount: q.defaultRetryCount, MsgTTL: q.msgTTL}
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case retryCountOpt:
+			schedule.RetryCount = uint(o)
+		case msgTTLOpt:
+			schedule.MsgTTL = time.Duration(o)
+		case missedPolicyOpt:
+			schedule.Missed = MissedPolicy(o)
+		}
+	}
+	return q.addSchedule(schedule)
+}
+
+func (q *DelayQueue) addSchedule(schedule Schedule) error {
+	if schedule.Name == "" {
+		return fmt.Errorf("schedule name is required")
+	}
+	if schedule.Missed != MissedSkip && schedule.Missed != MissedCatchUp {
+		return fmt.Errorf("invalid missed policy %q", schedule.Missed)
+	}
+	spec, err := parseSpec(schedule.Spec)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if existing, errs := q.getSchedule(ctx, schedule.Name); errs == nil && existing.Spec == schedule.Spec {
+		schedule.NextRun, schedule.LastRun = existing.NextRun, existing.LastRun
+	} else {
+		next := spec.Next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("schedule %q never fires", schedule.Spec)
+		}
+		schedule.NextRun = next.UnixMilli()
+	}
+
+	value, err := json.Marshal(schedule)
+	if err != nil {
+		return fmt.Errorf("marshal schedule failed: %v", err)
+	}
+	_, err = q.redisCli.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.scheduleKey, schedule.Name, value)
+		pipe.ZAdd(ctx, q.scheduleNextKey, redis.Z{Score: float64(schedule.NextRun), Member: schedule.Name})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("store schedule failed: %v", err)
+	}
+	q.notify()
+	q.redisCli.Publish(ctx, q.notifyKey, schedule.Name)
+	return nil
+}
+
+// RemoveSchedule deletes a recurring schedule, messages already delivered are not affected
+func (q *DelayQueue) RemoveSchedule(name string) (bool, error) {
+	ctx := context.Background()
+	var removed *redis.IntCmd
+	_, err := q.redisCli.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.HDel(ctx, q.scheduleKey, name)
+		pipe.ZRem(ctx, q.scheduleNextKey, name)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("remove schedule failed: %v", err)
+	}
+	return removed.Val() > 0, nil
+}
+
+// Schedules returns all recurring schedules ordered by next run
+func (q *DelayQueue) Schedules() ([]Schedule, error) {
+	ctx := context.Background()
+	values, err := q.redisCli.HVals(ctx, q.scheduleKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get schedules failed: %v", err)
+	}
+	schedules := make([]Schedule, 0, len(values))
+	for _, value := range values {
+		var schedule Schedule
+		if err = json.Unmarshal([]byte(value), &schedule); err != nil {
+			q.logger.Printf("parse schedule failed: %v", err)
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].NextRun < schedules[j].NextRun
+	})
+	return schedules, nil
+}
+
+func (q *DelayQueue) getSchedule(ctx context.Context, name string) (Schedule, error) {
+	var schedule Schedule
+	value, err := q.redisCli.HGet(ctx, q.scheduleKey, name).Result()
+	if err != nil {
+		return schedule, err
+	}
+	err = json.Unmarshal([]byte(value), &schedule)
+	return schedule, err
+}
+
+// fireSchedules puts the messages of due schedules to pending
+func (q *DelayQueue) fireSchedules() error {
+	ctx := context.Background()
+	now := time.Now()
+	due, err := q.redisCli.ZRangeByScoreWithScores(ctx, q.scheduleNextKey, &redis.ZRangeBy{Min: "0", Max: fmt.Sprint(now.UnixMilli())}).Result()
+	if err != nil {
+		return fmt.Errorf("get due schedules failed: %v", err)
+	}
+	for _, z := range due {
+		name := z.Member.(string)
+		if err = q.fireSchedule(ctx, name, int64(z.Score), now); err != nil {
+			q.logger.Printf("fire schedule %s failed: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (q *DelayQueue) fireSchedule(ctx context.Context, name string, claimed int64, now time.Time) error {
+	schedule, err := q.getSchedule(ctx, name)
+	if err != nil {
+		return err
+	}
+	spec, err := parseSpec(schedule.Spec)
+	if err != nil {
+		return err
+	}
+
+	// occurrences missed until now
+	runs := []time.Time{time.UnixMilli(claimed)}
+	next := spec.Next(runs[0])
+	for !next.IsZero() && !next.After(now) {
+		runs = append(runs, next)
+		next = spec.Next(next)
+	}
+	if schedule.Missed == MissedSkip {
+		runs = runs[len(runs)-1:]
+	} else if len(runs) > maxCatchUpRuns {
+		runs = runs[len(runs)-maxCatchUpRuns:]
+	}
+	if next.IsZero() {
+		// never fires again
+		next = time.UnixMilli(1<<62 - 1)
+	}
+
+	schedule.NextRun = next.UnixMilli()
+	schedule.LastRun = runs[len(runs)-1].UnixMilli()
+	value, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{q.scheduleNextKey, q.scheduleKey, q.pendingKey, q.retryCountKey, q.msgOptionKey}
+	args := []interface{}{name, claimed, schedule.NextRun, value, schedule.Payload, schedule.RetryCount, schedule.MsgTTL.Milliseconds(), now.UnixMilli(), msgOption(schedule.RetryCount, schedule.MsgTTL)}
+	for range runs {
+		idStr := uuid.Must(uuid.NewRandom()).String()
+		keys = append(keys, q.genMsgKey(idStr))
+		args = append(args, idStr)
+	}
+	return q.redisCli.Eval(ctx, fireScheduleScript, keys, args...).Err()
+}
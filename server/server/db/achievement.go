@@ -0,0 +1,40 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// UserAchievement 用户已解锁的成就,每个成就只解锁一次
+type UserAchievement struct {
+	ID            int64     `json:"-" gorm:"primaryKey;autoIncrement;not null"`
+	UserId        int64     `json:"userId" gorm:"uniqueIndex:idx_user_achievement,priority:1"`
+	AchievementId string    `json:"achievementId" gorm:"uniqueIndex:idx_user_achievement,priority:2"`
+	Name          string    `json:"name"`   // 解锁时的成就名称
+	GameId        string    `json:"gameId"` // 解锁的当局
+	RoundID       int       `json:"roundID"`
+	Reward        int64     `json:"reward"` // 奖励筹码
+	CreateAt      time.Time `json:"unlockTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+type AchievementDB struct {
+	db *gorm.DB
+}
+
+func NewAchievementDB(db *gorm.DB) *AchievementDB {
+	return &AchievementDB{db: db}
+}
+
+// Unlock 解锁成就,已解锁时返回 false,需在结算记账的同一事务中调用
+func (a *AchievementDB) Unlock(tx *gorm.DB, achievement *UserAchievement) (bool, error) {
+	result := tx.Model(&UserAchievement{}).Clauses(clause.OnConflict{DoNothing: true}).Create(achievement)
+	return result.RowsAffected > 0, result.Error
+}
+
+// ListByUser 用户已解锁的成就,按解锁时间排序
+func (a *AchievementDB) ListByUser(userId int64) ([]UserAchievement, error) {
+	achievements := make([]UserAchievement, 0)
+	err := a.db.Model(&UserAchievement{}).Where("user_id = ?", userId).Order("id").Find(&achievements).Error
+	return achievements, err
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Game 房间配置,每局结算时更新已完成局数
+type Game struct {
+	GameId      string    `json:"gameId" gorm:"primaryKey"`
+	CreateUser  int64     `json:"createUser"`
+	Minimum     int       `json:"minimum"`
+	TotalRounds int       `json:"totalRounds"`
+	Rounds      int       `json:"rounds"` // 已完成局数
+	LowBetChips int64     `json:"lowBetChips"`
+	TopBetChips int64     `json:"topBetChips"`
+	MinBuyIn    int64     `json:"minBuyIn"`
+	MaxBuyIn    int64     `json:"maxBuyIn"`
+	CreateAt    time.Time `json:"createTime"`
+	UpdateAt    time.Time `json:"updateTime"`
+}
+
+// GameRound 已结算的当局
+type GameRound struct {
+	ID            int64     `json:"id" gorm:"primaryKey;autoIncrement;not null"`
+	GameId        string    `json:"gameId" gorm:"uniqueIndex:idx_game_round"`
+	RoundID       int       `json:"roundID" gorm:"uniqueIndex:idx_game_round"`
+	BankerId      int64     `json:"bankerId"`
+	WinUserId     int64     `json:"winUserId"`
+	LowBetChips   int64     `json:"lowBetChips"`
+	TotalBetChips int64     `json:"totalBetChips"` // 奖池
+	WinChips      int64     `json:"winChips"`      // 赢家获得的筹码
+	Players       int       `json:"players"`
+	Records       string    `json:"-"` // PK记录(json),决定结算后玩家可见的底牌
+	Actions       string    `json:"-"` // 当局操作记录(json)
+	CreateAt      time.Time `json:"createTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+// RoundSeat 玩家在已结算当局的底牌、下注及结果
+type RoundSeat struct {
+	ID            int64     `json:"id" gorm:"primaryKey;autoIncrement;not null"`
+	GameId        string    `json:"gameId" gorm:"index:idx_seat_round"`
+	RoundID       int       `json:"roundID" gorm:"index:idx_seat_round"`
+	UserId        int64     `json:"userId" gorm:"index"`
+	Address       string    `json:"address"`
+	HeadPic       string    `json:"headPic"`
+	Location      int       `json:"location"`
+	IsBanker      bool      `json:"isBanker"`
+	IsLookCard    bool      `json:"isLookCard"`
+	State         int       `json:"state"`               // 结算时的用户状态
+	Cards         string    `json:"cards,omitempty"`     // 底牌,按可见规则返回
+	PokerType     int       `json:"pokerType,omitempty"` // 牌型,与底牌一同可见
+	TotalBetChips int64     `json:"totalBetChips"`
+	WinChips      int64     `json:"winChips"`    // 当局输赢筹码
+	Stack         int64     `json:"stack"`       // 结算后桌上筹码
+	Compares      int       `json:"compares"`    // 当局比牌次数(发起或被比)
+	CompareWins   int       `json:"compareWins"` // 当局比牌获胜次数
+	CreateAt      time.Time `json:"createTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+// RoundArchive 当局结算时保存的房间、当局及玩家记录
+type RoundArchive struct {
+	Game  Game
+	Round GameRound
+	Seats []RoundSeat
+
+	Achievements []UserAchievement // 结算时解锁的成就
+}
+
+// UserGame 用户参与过的游戏
+type UserGame struct {
+	Game
+	PlayRounds int   `json:"playRounds"` // 参与局数
+	WinRounds  int   `json:"winRounds"`  // 获胜局数
+	NetChips   int64 `json:"netChips"`   // 输赢筹码合计
+}
+
+type RoundDB struct {
+	db *gorm.DB
+}
+
+func NewRoundDB(db *gorm.DB) *RoundDB {
+	return &RoundDB{db: db}
+}
+
+// SaveRound 保存当局结算记录,需在结算记账的同一事务中调用
+func (r *RoundDB) SaveRound(tx *gorm.DB, archive *RoundArchive) error {
+	archive.Game.UpdateAt = time.Now()
+	if err := tx.Model(&Game{}).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "game_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rounds", "update_at"}),
+	}).Create(&archive.Game).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&GameRound{}).Create(&archive.Round).Error; err != nil {
+		return err
+	}
+	if len(archive.Seats) == 0 {
+		return nil
+	}
+	return tx.Model(&RoundSeat{}).Create(&archive.Seats).Error
+}
+
+// ListUserGames 用户参与过的游戏,按最近参与时间倒序
+func (r *RoundDB) ListUserGames(userId int64, offset int, limit int) ([]UserGame, error) {
+	games := make([]UserGame, 0)
+	err := r.db.Table("round_seat s").
+		Joins("JOIN game g ON g.game_id = s.game_id").
+		Where("s.user_id = ?", userId).
+		Group("s.game_id").
+		Select("g.*, COUNT(s.id) as play_rounds, SUM(CASE WHEN s.win_chips > 0 THEN 1 ELSE 0 END) as win_rounds, " +
+			"SUM(s.win_chips) as net_chips, MAX(s.id) as last_seat_id").
+		Order("last_seat_id desc").
+		Offset(offset).Limit(limit).
+		Scan(&games).Error
+	return games, err
+}
+
+// GetRound 已结算当局及所有玩家,按位置排序
+func (r *RoundDB) GetRound(gameId string, roundId int) (GameRound, []RoundSeat, error) {
+	round := GameRound{}
+	seats := make([]RoundSeat, 0)
+	if err := r.db.Model(&GameRound{}).Where("game_id = ? and round_id = ?", gameId, roundId).First(&round).Error; err != nil {
+		return round, seats, err
+	}
+	err := r.db.Model(&RoundSeat{}).Where("game_id = ? and round_id = ?", gameId, roundId).Order("location").Find(&seats).Error
+	return round, seats, err
+}
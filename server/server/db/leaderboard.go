@@ -0,0 +1,81 @@
+package db
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// LeaderboardSnapshot 已结束周期(日榜、周榜)的排行榜快照,周期结束后由redis归档。
+// 每个用户在同一排行榜周期中只有一条快照,重复归档时更新名次及分数
+type LeaderboardSnapshot struct {
+	ID       int64     `json:"-" gorm:"primaryKey;autoIncrement;not null"`
+	Board    string    `json:"board" gorm:"index:idx_snapshot_ranking,priority:1;uniqueIndex:idx_snapshot_board_user,priority:1"`
+	Period   string    `json:"period" gorm:"index:idx_snapshot_ranking,priority:2;uniqueIndex:idx_snapshot_board_user,priority:2"`
+	PeriodId string    `json:"periodId" gorm:"index:idx_snapshot_ranking,priority:3;uniqueIndex:idx_snapshot_board_user,priority:3"`
+	Ranking  int       `json:"rank" gorm:"index:idx_snapshot_ranking,priority:4"`
+	UserId   int64     `json:"userId" gorm:"uniqueIndex:idx_snapshot_board_user,priority:4"`
+	Score    int64     `json:"score"`
+	CreateAt time.Time `json:"createTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+type LeaderboardDB struct {
+	db *gorm.DB
+}
+
+func NewLeaderboardDB(db *gorm.DB) *LeaderboardDB {
+	return &LeaderboardDB{db: db}
+}
+
+// SaveSnapshot 保存排行榜快照,重复归档(删除redis排行榜失败、周期结束后补记的当局)时更新用户的名次及分数
+func (l *LeaderboardDB) SaveSnapshot(snapshots []LeaderboardSnapshot) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	return l.db.Model(&LeaderboardSnapshot{}).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "board"}, {Name: "period"}, {Name: "period_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"ranking", "score"}),
+	}).CreateInBatches(&snapshots, 500).Error
+}
+
+// MigrateSnapshot 升级已有的快照表: 删除旧的名次唯一索引,重复归档的快照只保留每个用户最后一次归档的记录,
+// 需在 Migrate 创建用户唯一索引前调用
+func MigrateSnapshot(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&LeaderboardSnapshot{}) {
+		return nil
+	}
+	for _, name := range []string{"idx_snapshot_rank", "idx_snapshot_user"} {
+		if migrator.HasIndex(&LeaderboardSnapshot{}, name) {
+			if err := migrator.DropIndex(&LeaderboardSnapshot{}, name); err != nil {
+				return err
+			}
+		}
+	}
+	latest := db.Model(&LeaderboardSnapshot{}).Select("MAX(id)").Group("board, period, period_id, user_id")
+	return db.Where("id NOT IN (?)", latest).Delete(&LeaderboardSnapshot{}).Error
+}
+
+// ListSnapshot 排行榜快照,按名次排序。返回快照总人数
+func (l *LeaderboardDB) ListSnapshot(board string, period string, periodId string, offset int, limit int) ([]LeaderboardSnapshot, int64, error) {
+	total := int64(0)
+	snapshots := make([]LeaderboardSnapshot, 0)
+	query := l.db.Model(&LeaderboardSnapshot{}).Where("board = ? and period = ? and period_id = ?", board, period, periodId)
+	if err := query.Count(&total).Error; err != nil {
+		return snapshots, 0, err
+	}
+	err := query.Order("ranking").Offset(offset).Limit(limit).Find(&snapshots).Error
+	return snapshots, total, err
+}
+
+// GetSnapshotRank 用户在排行榜快照中的名次,未上榜返回 ok=false
+func (l *LeaderboardDB) GetSnapshotRank(board string, period string, periodId string, userId int64) (snapshot LeaderboardSnapshot, ok bool, err error) {
+	snapshots := make([]LeaderboardSnapshot, 0)
+	err = l.db.Model(&LeaderboardSnapshot{}).
+		Where("board = ? and period = ? and period_id = ? and user_id = ?", board, period, periodId, userId).
+		Limit(1).Find(&snapshots).Error
+	if err != nil || len(snapshots) == 0 {
+		return snapshot, false, err
+	}
+	return snapshots[0], true, nil
+}
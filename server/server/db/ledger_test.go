@@ -0,0 +1,177 @@
+package db
+
+import (
+	"errors"
+	"game-3-card-poker/server/constant"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestLedgerDB(t *testing.T) (*gorm.DB, *LedgerDB) {
+	t.Helper()
+
+	// 文件数据库多连接,并发事务与真实数据库一样在不同连接上执行
+	dsn := filepath.Join(t.TempDir(), "ledger.db") + "?_journal_mode=WAL&_busy_timeout=10000&_sync=OFF"
+	gormDB, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{SingularTable: true},
+		Logger:         logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := gormDB.DB()
+	sqlDB.SetMaxOpenConns(8)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err = gormDB.AutoMigrate(User{}, LedgerJournal{}, LedgerEntry{}); err != nil {
+		t.Fatal(err)
+	}
+	return gormDB, NewLedgerDB(gormDB)
+}
+
+func TestLedgerDB_PostUnbalanced(t *testing.T) {
+	gormDB, ledgerDB := newTestLedgerDB(t)
+
+	err := ledgerDB.Post(gormDB, LedgerJournal{Kind: JournalRaise},
+		Posting{Account: UserAccount(1), Amount: -10},
+		Posting{Account: PotAccount("game", 1), Amount: 9})
+	if err != constant.LedgerUnbalancedError {
+		t.Fatalf("post unbalanced error = %v, want %v", err, constant.LedgerUnbalancedError)
+	}
+
+	report, err := ledgerDB.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Journals != 0 || report.Entries != 0 {
+		t.Fatalf("unbalanced journal stored, report = %+v", report)
+	}
+}
+
+func TestLedgerDB_OpenBalancesAndVerify(t *testing.T) {
+	gormDB, ledgerDB := newTestLedgerDB(t)
+
+	users := []User{{Address: "a", Balance: 100}, {Address: "b", Balance: 50}, {Address: "c"}}
+	if err := gormDB.Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 未记录期初余额时用户余额与账本不一致
+	report, err := ledgerDB.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || len(report.Mismatches) != 2 {
+		t.Fatalf("report = %+v, want 2 mismatches", report)
+	}
+
+	for _, want := range []int{2, 0} {
+		count, errs := ledgerDB.OpenBalances()
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if count != want {
+			t.Fatalf("opened %d balances, want %d", count, want)
+		}
+	}
+
+	report, err = ledgerDB.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Users != 150 || report.Faucet != -150 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// 绕过账本修改余额
+	gormDB.Model(&User{}).Where("id = ?", users[0].ID).UpdateColumn("balance", 200)
+	if report, _ = ledgerDB.Verify(); report.OK() || len(report.Mismatches) != 1 || report.Mismatches[0].LedgerBalance != 100 {
+		t.Fatalf("report = %+v, want mismatch of user %d", report, users[0].ID)
+	}
+}
+
+func TestLedgerDB_PostIdempotent(t *testing.T) {
+	gormDB, ledgerDB := newTestLedgerDB(t)
+
+	// 相同幂等key只记账一次,空key不去重
+	for i, want := range []error{nil, constant.DuplicateActionError, nil, nil} {
+		key := "game-1-buyin"
+		if i >= 2 {
+			key = ""
+		}
+		err := ledgerDB.Post(gormDB, LedgerJournal{Kind: JournalBuyIn, GameId: "game", IdempotencyKey: IdempotencyKey(key)},
+			Posting{Account: UserAccount(1), Amount: -10},
+			Posting{Account: StackAccount("game", 1), Amount: 10})
+		if err != want {
+			t.Fatalf("post %d error = %v, want %v", i, err, want)
+		}
+	}
+
+	balance, err := ledgerDB.Balance(gormDB, StackAccount("game", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 30 {
+		t.Fatalf("stack balance = %d, want 30", balance)
+	}
+}
+
+func TestLedgerDB_ConcurrentDeduct(t *testing.T) {
+	gormDB, ledgerDB := newTestLedgerDB(t)
+	userDB := NewUserDB(gormDB)
+
+	user := User{Address: "concurrent", Balance: 1000}
+	if err := gormDB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledgerDB.OpenBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 多个连接同时扣减余额并记账,余额不能为负且不能丢失更新
+	var succeeded, insufficient int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := gormDB.Transaction(func(tx *gorm.DB) error {
+				balance, errs := userDB.DeductBalance(tx, user.ID, 30)
+				if errs != nil {
+					return errs
+				}
+				if balance < 0 {
+					t.Errorf("balance = %d after deduct", balance)
+				}
+				return ledgerDB.Post(tx, LedgerJournal{Kind: JournalBuyIn, GameId: "game"},
+					Posting{Account: UserAccount(user.ID), Amount: -30},
+					Posting{Account: StackAccount("game", user.ID), Amount: 30})
+			})
+			switch {
+			case err == nil:
+				atomic.AddInt64(&succeeded, 1)
+			case errors.Is(err, constant.UserNotEnoughBetError):
+				atomic.AddInt64(&insufficient, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 33 || insufficient != 17 {
+		t.Fatalf("succeeded = %d, insufficient = %d, want 33 and 17", succeeded, insufficient)
+	}
+	report, err := ledgerDB.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Users != 10 || report.Stacks != 990 {
+		t.Fatalf("report = %+v, want 10 of users and 990 of stacks", report)
+	}
+}
@@ -7,14 +7,25 @@ import (
 
 type UserHistory struct {
 	ID            int64     `json:"id" gorm:"primaryKey;autoIncrement;not null"`
-	UserId        int64     `json:"userId"`
+	UserId        int64     `json:"userId" gorm:"index:idx_user_history_user,priority:1"`
 	Address       string    `json:"address"`
-	GameId        string    `json:"gameId"`
-	RoundID       int       `json:"roundID"`
+	GameId        string    `json:"gameId" gorm:"index:idx_user_history_round,priority:1"`
+	RoundID       int       `json:"roundID" gorm:"index:idx_user_history_round,priority:2"`
 	State         int       `json:"state"`
 	Amount        int64     `json:"amount"`
 	BalanceBefore int64     `json:"balanceBefore"`
-	CreateAt      time.Time `json:"createTime" gorm:"autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+	CreateAt      time.Time `json:"createTime" gorm:"index:idx_user_history_user,priority:2;autoCreateTime:milli; not null; default:(datetime('now', 'localtime'))"`
+}
+
+// UserHistoryFilter 用户筹码记录查询条件,按ID倒序分页
+type UserHistoryFilter struct {
+	UserId    int64
+	States    []int     // 记录类型,为空表示全部
+	GameId    string    // 为空表示全部
+	StartTime time.Time // 包含,零值表示不限制
+	EndTime   time.Time // 不包含,零值表示不限制
+	Cursor    int64     // 上一页最后一条记录的ID,0表示第一页
+	Limit     int
 }
 
 type UserHistoryDB struct {
@@ -30,8 +41,33 @@ func (u *UserHistoryDB) CreateUserHistory(userHistory UserHistory) (UserHistory,
 	return userHistory, result.Error
 }
 
-func (u *UserHistoryDB) List(userId string) ([]UserHistoryDB, error) {
-	historys := make([]UserHistoryDB, 0, 16)
-	result := u.db.Model(&UserHistory{}).Select(&historys).Where("userId = ?", userId)
-	return historys, result.Error
+// List 按条件查询用户筹码记录,返回下一页游标,没有下一页时为0
+func (u *UserHistoryDB) List(filter UserHistoryFilter) ([]UserHistory, int64, error) {
+	query := u.db.Model(&UserHistory{}).Where("user_id = ?", filter.UserId)
+	if len(filter.States) > 0 {
+		query = query.Where("state IN (?)", filter.States)
+	}
+	if len(filter.GameId) > 0 {
+		query = query.Where("game_id = ?", filter.GameId)
+	}
+	if !filter.StartTime.IsZero() {
+		query = query.Where("create_at >= ?", filter.StartTime)
+	}
+	if !filter.EndTime.IsZero() {
+		query = query.Where("create_at < ?", filter.EndTime)
+	}
+	if filter.Cursor > 0 {
+		query = query.Where("id < ?", filter.Cursor)
+	}
+
+	historys := make([]UserHistory, 0, filter.Limit)
+	if err := query.Order("id desc").Limit(filter.Limit).Find(&historys).Error; err != nil {
+		return nil, 0, err
+	}
+
+	nextCursor := int64(0)
+	if len(historys) == filter.Limit && filter.Limit > 0 {
+		nextCursor = historys[len(historys)-1].ID
+	}
+	return historys, nextCursor, nil
 }
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"game-3-card-poker/server/config"
 	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"game-3-card-poker/server/limiter"
 	"game-3-card-poker/server/response"
 	"game-3-card-poker/server/service"
 	"game-3-card-poker/server/utils"
@@ -17,10 +19,10 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"time"
+	"strings"
 )
 
-func NewHTTPServer(lifecycle fx.Lifecycle, mux *http.ServeMux, c config.Configuration) {
+func NewHTTPServer(lifecycle fx.Lifecycle, mux *http.ServeMux, c config.Configuration, serverConfig *config.ServerConfig) {
 	// 配置允许跨域请求
 	options := cors.New(cors.Options{
 		AllowCredentials: true,
@@ -42,6 +44,8 @@ func NewHTTPServer(lifecycle fx.Lifecycle, mux *http.ServeMux, c config.Configur
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
+			// 拒绝创建房间并等待进行中的当局结束,超时后保存房间状态。等待时间不超过关闭期限,预留保存房间及关闭HTTP服务的时间
+			serverConfig.Game.Drain(ctx, c.Server.DrainTimeoutWithin(ctx))
 			return srv.Shutdown(ctx)
 		},
 	})
@@ -92,13 +96,13 @@ func RequireWebSocketAuth(next RequestHandler) RequestHandler {
 			return
 		}
 
-		defer func() {
-			time.Sleep(time.Second)
-			conn.Close()
-		}()
+		// 发送错误消息后关闭连接
+		wsConfig := c.Config.Server.WebSocket
+		client := service.NewClient(conn, wsConfig.WriteWait, wsConfig.PingInterval)
+		defer client.Close(websocket.CloseNormalClosure, "")
 
 		marshal, _ := json.Marshal(response)
-		conn.WriteMessage(websocket.TextMessage, marshal)
+		client.Send(marshal)
 	}
 
 	return func(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
@@ -154,11 +158,104 @@ func RequireWebSocketAuth(next RequestHandler) RequestHandler {
 	}
 }
 
+// RequireAdmin 拦截器验证登录用户是否为管理员,需在RequireAuth之后
+func RequireAdmin(next RequestHandler) RequestHandler {
+	return func(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+		user := db.User{}
+		if err := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); err != nil || !c.Config.Server.IsAdmin(user.Address) {
+			response.Fail(constant.Code10016, constant.NoAdminPermission, w)
+			return
+		}
+
+		next(c, w, r)
+	}
+}
+
+// RequireRateLimit 拦截器限制请求频率(按IP及登录用户)
+func RequireRateLimit(next RequestHandler) RequestHandler {
+	return func(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+		// 登录拦截器之后才能获取到登录用户
+		user := db.User{}
+		if userJson := r.Header.Get(constant.HeaderCustomUser); len(userJson) > 0 {
+			user.JsonStrToUser(userJson)
+		}
+
+		path := strings.ToLower(r.URL.Path)
+		if !allowRequest(c, "route:"+path, clientIP(c, r), user.ID, c.Config.RateLimit.RouteLimit(path)) {
+			response.Fail(constant.Code10014, constant.RequestTooFrequent, w)
+			return
+		}
+
+		next(c, w, r)
+	}
+}
+
+// allowRequest 按IP及登录用户分别检查令牌桶,redis异常时不做限制
+func allowRequest(c *config.ServerConfig, name string, ip string, userId int64, limit limiter.Limit) bool {
+	if c.Limiter == nil || limit.IsZero() {
+		return true
+	}
+
+	keys := []string{fmt.Sprintf("%s:ip:%s", name, ip)}
+	if userId > 0 {
+		keys = append(keys, fmt.Sprintf("%s:user:%d", name, userId))
+	}
+
+	ctx := context.Background()
+	for _, key := range keys {
+		allowed, err := c.Limiter.Allow(ctx, key, limit)
+		if err != nil {
+			log.Println("rate limit error:", err)
+			continue
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// clientIP 获取客户端IP。仅请求来自可信代理时使用代理转发的请求头,
+// X-Forwarded-For 从右向左跳过可信代理,取第一个不可信的地址(客户端可伪造左侧的地址)
+func clientIP(c *config.ServerConfig, r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !c.Config.Server.IsTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := make([]string, 0)
+	for _, forwarded := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(forwarded, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); len(realIP) > 0 {
+			return realIP
+		}
+		return ip
+	}
+	for index := len(hops) - 1; index >= 0; index-- {
+		hop := strings.TrimSpace(hops[index])
+		if len(hop) == 0 {
+			continue
+		}
+		ip = hop
+		if !c.Config.Server.IsTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
 func NewServeMux(mux *http.ServeMux, c *config.ServerConfig) {
 
-	middlewareAPI := NewBridgeBuilder(c).Build()
-	middlewareAuth := NewBridgeBuilder(c).WithPostMiddlewares(RequireAuth).Build()
-	middlewareSocketAuth := NewBridgeBuilder(c).WithPostMiddlewares(RequireWebSocketAuth).Build()
+	middlewareAPI := NewBridgeBuilder(c).WithPostMiddlewares(RequireRateLimit).Build()
+	middlewareAuth := NewBridgeBuilder(c).WithPostMiddlewares(RequireAuth, RequireRateLimit).Build()
+	middlewareSocketAuth := NewBridgeBuilder(c).WithPostMiddlewares(RequireRateLimit, RequireWebSocketAuth).Build()
+	middlewareAdmin := NewBridgeBuilder(c).WithPostMiddlewares(RequireAuth, RequireAdmin).Build()
 
 	mux.HandleFunc("/ws", middlewareSocketAuth(handlerSocketConnection))
 	mux.HandleFunc("/api/game/create", middlewareAuth(handlerCreateGame))
@@ -170,6 +267,20 @@ func NewServeMux(mux *http.ServeMux, c *config.ServerConfig) {
 	mux.HandleFunc("/api/user/receiveCoin", middlewareAuth(handlerReceiveCoin))
 	mux.HandleFunc("/api/user/headList", middlewareAuth(handlerHeadList))
 	mux.HandleFunc("/api/user/historyList", middlewareAuth(handlerHistoryList))
+	mux.HandleFunc("/api/user/transactionList", middlewareAuth(handlerTransactionList))
+	mux.HandleFunc("/api/user/stats", middlewareAuth(handlerUserStats))
+	mux.HandleFunc("/api/user/profile", middlewareAuth(handlerUserProfile))
+	mux.HandleFunc("/api/user/leaderboard", middlewareAuth(handlerLeaderboard))
+	mux.HandleFunc("/api/user/achievements", middlewareAuth(handlerAchievements))
+	mux.HandleFunc("/api/user/gameList", middlewareAuth(handlerGameList))
+	mux.HandleFunc("/api/user/roundDetail", middlewareAuth(handlerRoundDetail))
+
+	mux.HandleFunc("/api/admin/delayQueue/stats", middlewareAdmin(handlerDelayQueueStats))
+	mux.HandleFunc("/api/admin/delayQueue/metrics", middlewareAdmin(handlerDelayJobMetrics))
+	mux.HandleFunc("/api/admin/delayQueue/schedules", middlewareAdmin(handlerScheduleList))
+	mux.HandleFunc("/api/admin/delayQueue/deadLetters", middlewareAdmin(handlerDeadLetterList))
+	mux.HandleFunc("/api/admin/delayQueue/requeue", middlewareAdmin(handlerDeadLetterRequeue))
+	mux.HandleFunc("/api/admin/delayQueue/purge", middlewareAdmin(handlerDeadLetterPurge))
 }
 
 // ParseBody parse the request body into the type of value.
@@ -0,0 +1,122 @@
+package src
+
+import (
+	"game-3-card-poker/server/config"
+	"game-3-card-poker/server/daley"
+	"game-3-card-poker/server/response"
+	"game-3-card-poker/server/service"
+	"log"
+	"net/http"
+)
+
+// adminDelayQueue 管理接口仅支持redis延迟队列
+func adminDelayQueue(c *config.ServerConfig, w http.ResponseWriter) *daley.DelayQueue {
+	queue := c.Game.DelayJobs.Queue()
+	if queue == nil {
+		log.Println("delay queue is not backed by redis")
+		response.SystemError(w)
+	}
+	return queue
+}
+
+// handlerDelayQueueStats 延迟队列各阶段消息数量
+func handlerDelayQueueStats(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	queue := adminDelayQueue(c, w)
+	if queue == nil {
+		return
+	}
+	stats, err := queue.Stats()
+	if err != nil {
+		log.Println("delay queue stats error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData([]daley.QueueStats{stats}, w)
+}
+
+// handlerDelayJobMetrics 延迟任务各类型消息发送及消费统计(当前实例)
+func handlerDelayJobMetrics(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	response.SuccessWithData(c.Game.DelayJobs.Metrics(), w)
+}
+
+// handlerScheduleList 延迟队列周期任务列表,按下次执行时间排序
+func handlerScheduleList(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	queue := adminDelayQueue(c, w)
+	if queue == nil {
+		return
+	}
+	schedules, err := queue.Schedules()
+	if err != nil {
+		log.Println("schedule list error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(schedules, w)
+}
+
+// handlerDeadLetterList 延迟队列死信列表,按失败时间倒序
+func handlerDeadLetterList(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.DeadLetterReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+
+	if jsonBody.Limit <= 0 || jsonBody.Limit > 100 {
+		jsonBody.Limit = 100
+	}
+	queue := adminDelayQueue(c, w)
+	if queue == nil {
+		return
+	}
+	deadLetters, err := queue.DeadLetters(jsonBody.Offset, jsonBody.Limit)
+	if err != nil {
+		log.Println("dead letter list error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(deadLetters, w)
+}
+
+// handlerDeadLetterRequeue 死信重新投递
+func handlerDeadLetterRequeue(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.DeadLetterReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil || len(jsonBody.Ids) == 0 {
+		response.ParamError(w)
+		return
+	}
+
+	queue := adminDelayQueue(c, w)
+	if queue == nil {
+		return
+	}
+	// 消息内容已过期的死信不能重新投递,返回给管理员处理
+	result, err := queue.Requeue(jsonBody.Ids...)
+	if err != nil {
+		log.Println("dead letter requeue error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(result, w)
+}
+
+// handlerDeadLetterPurge 清除死信,未指定Ids时清除全部
+func handlerDeadLetterPurge(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.DeadLetterReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+
+	queue := adminDelayQueue(c, w)
+	if queue == nil {
+		return
+	}
+	count, err := queue.Purge(jsonBody.Ids...)
+	if err != nil {
+		log.Println("dead letter purge error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(count, w)
+}
@@ -2,6 +2,7 @@ package src
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"game-3-card-poker/server/config"
 	"game-3-card-poker/server/constant"
@@ -9,6 +10,7 @@ import (
 	"game-3-card-poker/server/response"
 	"game-3-card-poker/server/service"
 	"game-3-card-poker/server/utils"
+	"gorm.io/gorm"
 	"io"
 	"log"
 	"math/rand"
@@ -208,6 +210,177 @@ func handlerHeadList(c *config.ServerConfig, w http.ResponseWriter, r *http.Requ
 	return
 }
 
+// handlerTransactionList 用户筹码记录,支持类型、游戏、时间范围筛选及游标分页
+func handlerTransactionList(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.TransactionListReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+	if jsonBody.Cursor < 0 || (jsonBody.EndTime > 0 && jsonBody.EndTime <= jsonBody.StartTime) {
+		response.ParamError(w)
+		return
+	}
+
+	user := db.User{}
+	if err := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); err != nil {
+		log.Println("json to user error: ", err)
+	}
+
+	if jsonBody.Limit <= 0 || jsonBody.Limit > 100 {
+		jsonBody.Limit = 20
+	}
+	list, err := c.UserService.ListTransactions(user.ID, jsonBody)
+	if err != nil {
+		log.Println("transaction list error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(list, w)
+}
+
+// handlerUserStats 当前用户的对局统计
+func handlerUserStats(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	user := db.User{}
+	if err := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); err != nil {
+		log.Println("json to user error: ", err)
+	}
+
+	stats, err := c.UserService.GetStats(user.ID)
+	if err != nil {
+		log.Println("user stats error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(stats, w)
+}
+
+// handlerUserProfile 其他玩家的公开资料及对局统计
+func handlerUserProfile(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.ProfileReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+
+	profile, err := c.UserService.GetProfile(jsonBody.UserId)
+	if errors.Is(err, constant.UserNotExistError) {
+		response.Fail(constant.Code10010, constant.UserNotExist, w)
+		return
+	}
+	if err != nil {
+		log.Println("user profile error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(profile, w)
+}
+
+// handlerLeaderboard 日榜、周榜及总榜分页,包含当前用户的名次
+func handlerLeaderboard(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.LeaderboardReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+	if !service.ValidLeaderboard(jsonBody.Board, jsonBody.Period) || jsonBody.Offset < 0 {
+		response.ParamError(w)
+		return
+	}
+
+	user := db.User{}
+	if err := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); err != nil {
+		log.Println("json to user error: ", err)
+	}
+
+	if jsonBody.Limit <= 0 || jsonBody.Limit > 100 {
+		jsonBody.Limit = 20
+	}
+	page, err := c.UserService.ListLeaderboard(context.Background(), jsonBody, user.ID)
+	if err != nil {
+		log.Println("leaderboard error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(page, w)
+}
+
+// handlerAchievements 所有成就及用户的解锁状态,userId 为空表示当前用户
+func handlerAchievements(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.AchievementsReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+
+	if jsonBody.UserId == 0 {
+		user := db.User{}
+		if err := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); err != nil {
+			log.Println("json to user error: ", err)
+		}
+		jsonBody.UserId = user.ID
+	}
+
+	achievements, err := c.UserService.ListAchievements(jsonBody.UserId)
+	if err != nil {
+		log.Println("achievements error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(achievements, w)
+}
+
+// handlerGameList 用户参与过的游戏,按最近参与倒序
+func handlerGameList(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.GameListReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+
+	user := db.User{}
+	if err := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); err != nil {
+		log.Println("json to user error: ", err)
+	}
+
+	if jsonBody.Limit <= 0 || jsonBody.Limit > 100 {
+		jsonBody.Limit = 20
+	}
+	games, err := c.UserService.ListUserGames(user.ID, jsonBody.Offset, jsonBody.Limit)
+	if err != nil {
+		log.Println("game list error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(games, w)
+}
+
+// handlerRoundDetail 已结算当局详情,只能看见自己比过或跟自己比过的玩家的底牌
+func handlerRoundDetail(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
+	var jsonBody service.RoundDetailReq
+	if err := ParseBody(r.Body, &jsonBody); err != nil {
+		response.ParamError(w)
+		return
+	}
+
+	user := db.User{}
+	if err := user.JsonStrToUser(r.Header.Get(constant.HeaderCustomUser)); err != nil {
+		log.Println("json to user error: ", err)
+	}
+
+	detail, err := c.UserService.GetRoundDetail(user.ID, jsonBody.GameId, jsonBody.RoundID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Fail(constant.Code20002, constant.RoundNotExist, w)
+		return
+	}
+	if err != nil {
+		log.Println("round detail error:", err)
+		response.SystemError(w)
+		return
+	}
+	response.SuccessWithData(detail, w)
+}
+
 func handlerHistoryList(c *config.ServerConfig, w http.ResponseWriter, r *http.Request) {
 	var jsonBody service.RequestHistory
 	if err := ParseBody(r.Body, &jsonBody); err != nil {
@@ -0,0 +1,87 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"time"
+)
+
+// Limit describes a token bucket: Burst tokens at most, refilled at Rate tokens per second
+type Limit struct {
+	Rate  float64 `mapstructure:"rate"`  // 每秒生成令牌数
+	Burst int     `mapstructure:"burst"` // 令牌桶容量
+}
+
+// IsZero reports whether the limit is not configured, a zero limit never rejects requests
+func (l Limit) IsZero() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Limiter is a token bucket rate limiter based on redis, buckets are shared by all server instances
+type Limiter struct {
+	// name for this Limiter. Make sure the name is unique in redis database
+	name     string
+	redisCli *redis.Client
+}
+
+// NewLimiter creates a new limiter, use Limiter.Allow to take a token from the bucket of key
+func NewLimiter(name string, cli *redis.Client) *Limiter {
+	if name == "" {
+		panic("name is required")
+	}
+	if cli == nil {
+		panic("cli is required")
+	}
+	return &Limiter{
+		name:     name,
+		redisCli: cli,
+	}
+}
+
+func (l *Limiter) genBucketKey(key string) string {
+	return "rl:" + l.name + ":" + key
+}
+
+// allowScript atomically refills the bucket according to elapsed time and takes one token
+// keys: bucketKey
+// argv: rate, burst, currentTime(ms)
+const allowScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGet', KEYS[1], 'tokens', 'timestamp')
+local tokens = tonumber(bucket[1])
+local timestamp = tonumber(bucket[2])
+if tokens == nil or timestamp == nil then
+	tokens = burst
+	timestamp = now
+end
+local elapsed = now - timestamp
+if elapsed < 0 then elapsed = 0 end
+tokens = math.min(burst, tokens + elapsed * rate / 1000)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSet', KEYS[1], 'tokens', tostring(tokens), 'timestamp', now)
+redis.call('PExpire', KEYS[1], ARGV[4]) -- full bucket equals to no bucket
+return allowed
+`
+
+// Allow takes one token from the bucket of key, returns false if the bucket is empty
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (bool, error) {
+	if limit.IsZero() {
+		return true, nil
+	}
+	now := time.Now().UnixMilli()
+	ttl := int64(math.Ceil(float64(limit.Burst)/limit.Rate*1000)) + 1000
+	keys := []string{l.genBucketKey(key)}
+	ret, err := l.redisCli.Eval(ctx, allowScript, keys, limit.Rate, limit.Burst, now, ttl).Int()
+	if err != nil {
+		return false, fmt.Errorf("allowScript failed: %v", err)
+	}
+	return ret == 1, nil
+}
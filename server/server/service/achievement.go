@@ -0,0 +1,305 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"gorm.io/gorm"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 成就触发事件
+const (
+	AchievementDealt      = "dealt"       // 当局发牌(结算时参与的玩家)
+	AchievementWin        = "win"         // 当局获胜
+	AchievementCompareWin = "compare_win" // 比牌获胜
+)
+
+// AchievementRule 成就规则,在配置文件 achievements 中定义,条件为空表示不限制
+type AchievementRule struct {
+	Id          string `json:"id" mapstructure:"id"`
+	Name        string `json:"name" mapstructure:"name"`
+	Description string `json:"description" mapstructure:"description"`
+	Event       string `json:"event" mapstructure:"event"`            // 触发事件: dealt, win, compare_win
+	PokerTypes  []int  `json:"pokerTypes" mapstructure:"poker_types"` // 牌型: 6-豹子，5-同花顺，4-同花，3-顺子，2-对子，1-散牌
+	Ranks       []int  `json:"ranks" mapstructure:"ranks"`            // 三张牌的点数(2-14),花色不限,如A23为[14, 2, 3]
+	Blind       bool   `json:"blind" mapstructure:"blind"`            // 未看牌(闷牌),比牌获胜时为比牌时未看牌
+	Streak      int    `json:"streak" mapstructure:"streak"`          // 连续获胜局数,仅 win 事件
+	Reward      int64  `json:"reward" mapstructure:"reward"`          // 奖励筹码,转入用户余额
+}
+
+// AchievementsReq 成就列表请求,userId 为空表示当前用户
+type AchievementsReq struct {
+	UserId int64 `json:"userId"`
+}
+
+// AchievementView 成就及用户解锁状态
+type AchievementView struct {
+	AchievementRule
+	Unlocked   bool       `json:"unlocked"`
+	UnlockTime *time.Time `json:"unlockTime,omitempty"`
+}
+
+// achievementEvent 当局玩家的一次成就触发事件
+type achievementEvent struct {
+	Event     string
+	Blind     bool
+	PokerType int
+	Ranks     []int
+	Streak    int
+}
+
+// SetAchievementRules 设置成就规则,需在房间开始结算前调用
+func (u *UserService) SetAchievementRules(rules []AchievementRule) error {
+	ids := make(map[string]bool, 0)
+	for index := range rules {
+		rule := &rules[index]
+		if len(rule.Id) == 0 || ids[rule.Id] {
+			return fmt.Errorf("achievement %d: id %q is empty or duplicated", index, rule.Id)
+		}
+		ids[rule.Id] = true
+
+		if rule.Event != AchievementDealt && rule.Event != AchievementWin && rule.Event != AchievementCompareWin {
+			return fmt.Errorf("achievement %s: invalid event %q", rule.Id, rule.Event)
+		}
+		if rule.Streak > 0 && rule.Event != AchievementWin {
+			return fmt.Errorf("achievement %s: streak requires the win event", rule.Id)
+		}
+		if len(rule.Ranks) != 0 && len(rule.Ranks) != 3 {
+			return fmt.Errorf("achievement %s: ranks must be 3 cards", rule.Id)
+		}
+		if rule.Reward < 0 {
+			return fmt.Errorf("achievement %s: reward must not be negative", rule.Id)
+		}
+		if len(rule.Name) == 0 {
+			rule.Name = rule.Id
+		}
+	}
+	u.achievementRules = rules
+	return nil
+}
+
+// match 事件是否满足成就条件
+func (r AchievementRule) match(event achievementEvent) bool {
+	if r.Event != event.Event || (r.Blind && !event.Blind) || event.Streak < r.Streak {
+		return false
+	}
+	if len(r.PokerTypes) > 0 {
+		matched := false
+		for _, pokerType := range r.PokerTypes {
+			matched = matched || pokerType == event.PokerType
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Ranks) > 0 {
+		if len(event.Ranks) != len(r.Ranks) {
+			return false
+		}
+		ranks := append([]int{}, r.Ranks...)
+		sort.Ints(ranks)
+		for index := range ranks {
+			if ranks[index] != event.Ranks[index] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cardRanks 底牌(点数*10+花色)的点数,升序
+func cardRanks(cards string) []int {
+	if len(cards) == 0 {
+		return nil
+	}
+	ranks := make([]int, 0, 3)
+	for _, card := range strings.Split(cards, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(card))
+		if err != nil {
+			return nil
+		}
+		ranks = append(ranks, value/10)
+	}
+	sort.Ints(ranks)
+	return ranks
+}
+
+// achievementEvents 由当局记录及操作记录生成玩家的成就触发事件
+func achievementEvents(archive *db.RoundArchive, actions []RoundAction, streaks map[int64]int) map[int64][]achievementEvent {
+	// 比牌获胜时是否未看牌
+	looked := make(map[int64]bool, 0)
+	compareWins := make(map[int64][]bool, 0)
+	for _, action := range actions {
+		switch action.Type {
+		case constant.EVENT_LOOK_CARD:
+			looked[action.UserId] = true
+		case constant.EVENT_COMPARE_LOSE_USER:
+			compareWins[action.WinUserId] = append(compareWins[action.WinUserId], !looked[action.WinUserId])
+		}
+	}
+
+	events := make(map[int64][]achievementEvent, 0)
+	for index := range archive.Seats {
+		seat := archive.Seats[index]
+		event := achievementEvent{
+			Event:     AchievementDealt,
+			Blind:     !seat.IsLookCard,
+			PokerType: seat.PokerType,
+			Ranks:     cardRanks(seat.Cards),
+		}
+		events[seat.UserId] = append(events[seat.UserId], event)
+
+		if seat.UserId == archive.Round.WinUserId {
+			event.Event = AchievementWin
+			event.Streak = streaks[seat.UserId]
+			events[seat.UserId] = append(events[seat.UserId], event)
+		}
+		for _, blind := range compareWins[seat.UserId] {
+			event.Event = AchievementCompareWin
+			event.Blind = blind
+			event.Streak = 0
+			events[seat.UserId] = append(events[seat.UserId], event)
+		}
+	}
+	return events
+}
+
+// unlockAchievements 当局结算时解锁成就并发放奖励,需在结算记账的同一事务中调用
+func (u *UserService) unlockAchievements(tx *gorm.DB, archive *db.RoundArchive) ([]db.UserAchievement, error) {
+	if len(u.achievementRules) == 0 || len(archive.Seats) == 0 {
+		return nil, nil
+	}
+
+	actions := make([]RoundAction, 0)
+	if len(archive.Round.Actions) > 0 {
+		if err := json.Unmarshal([]byte(archive.Round.Actions), &actions); err != nil {
+			log.Printf("gameId=%s round=%d parse actions error: %s", archive.Round.GameId, archive.Round.RoundID, err)
+		}
+	}
+	userIds := make([]int64, 0, len(archive.Seats))
+	for index := range archive.Seats {
+		userIds = append(userIds, archive.Seats[index].UserId)
+	}
+	streaks, err := u.userStatsDB.WinStreaks(tx, userIds)
+	if err != nil {
+		return nil, err
+	}
+
+	unlocks := make([]db.UserAchievement, 0)
+	events := achievementEvents(archive, actions, streaks)
+	for index := range archive.Seats {
+		seat := archive.Seats[index]
+		for _, rule := range u.achievementRules {
+			matched := false
+			for _, event := range events[seat.UserId] {
+				matched = matched || rule.match(event)
+			}
+			if !matched {
+				continue
+			}
+
+			achievement := db.UserAchievement{
+				UserId:        seat.UserId,
+				AchievementId: rule.Id,
+				Name:          rule.Name,
+				GameId:        archive.Round.GameId,
+				RoundID:       archive.Round.RoundID,
+				Reward:        rule.Reward,
+			}
+			unlocked, errs := u.achievementDB.Unlock(tx, &achievement)
+			if errs != nil {
+				return nil, errs
+			}
+			if !unlocked {
+				continue
+			}
+			if errs = u.grantReward(tx, seat, achievement); errs != nil {
+				return nil, errs
+			}
+			unlocks = append(unlocks, achievement)
+		}
+	}
+	return unlocks, nil
+}
+
+// grantReward 成就奖励筹码转入用户余额
+func (u *UserService) grantReward(tx *gorm.DB, seat db.RoundSeat, achievement db.UserAchievement) error {
+	if achievement.Reward <= 0 {
+		return nil
+	}
+	balance, err := u.userDB.AddBalance(tx, seat.UserId, achievement.Reward)
+	if err != nil {
+		return err
+	}
+	history := db.UserHistory{
+		UserId:        seat.UserId,
+		Address:       seat.Address,
+		GameId:        achievement.GameId,
+		RoundID:       achievement.RoundID,
+		State:         constant.BET_STATE_BONUS,
+		Amount:        achievement.Reward,
+		BalanceBefore: balance - achievement.Reward,
+	}
+	if err = tx.Model(&db.UserHistory{}).Create(&history).Error; err != nil {
+		return err
+	}
+
+	achievementKey := db.AchievementKey(seat.UserId, achievement.AchievementId)
+	return u.ledgerDB.Post(tx, db.LedgerJournal{Kind: db.JournalBonus, GameId: achievement.GameId, RoundID: achievement.RoundID, IdempotencyKey: &achievementKey},
+		db.Posting{Account: db.FaucetAccount, Amount: -achievement.Reward},
+		db.Posting{Account: db.UserAccount(seat.UserId), Amount: achievement.Reward})
+}
+
+// ListAchievements 所有成就及用户的解锁状态,已下线的成就保留在已解锁列表之后
+func (u *UserService) ListAchievements(userId int64) ([]AchievementView, error) {
+	unlocks, err := u.achievementDB.ListByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	unlocked := make(map[string]db.UserAchievement, len(unlocks))
+	for index := range unlocks {
+		unlocked[unlocks[index].AchievementId] = unlocks[index]
+	}
+
+	views := make([]AchievementView, 0, len(u.achievementRules))
+	for _, rule := range u.achievementRules {
+		view := AchievementView{AchievementRule: rule}
+		if achievement, ok := unlocked[rule.Id]; ok {
+			view.Unlocked = true
+			view.UnlockTime = &achievement.CreateAt
+			delete(unlocked, rule.Id)
+		}
+		views = append(views, view)
+	}
+	for index := range unlocks {
+		achievement := unlocks[index]
+		if _, ok := unlocked[achievement.AchievementId]; ok {
+			views = append(views, AchievementView{
+				AchievementRule: AchievementRule{Id: achievement.AchievementId, Name: achievement.Name, Reward: achievement.Reward},
+				Unlocked:        true,
+				UnlockTime:      &achievement.CreateAt,
+			})
+		}
+	}
+	return views, nil
+}
+
+// broadcastAchievements 通知房间所有用户当局解锁的成就
+func (c *Game) broadcastAchievements(ctx context.Context, gameRoom *GameRoom, achievements []db.UserAchievement) {
+	for index := range achievements {
+		achievement := achievements[index]
+		c.BroadcastMsg(ctx, gameRoom, &EventMsg{
+			Type:        constant.EVENT_ACHIEVEMENT,
+			UserId:      achievement.UserId,
+			BetChips:    achievement.Reward,
+			Achievement: &achievement,
+		})
+	}
+}
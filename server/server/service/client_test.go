@@ -0,0 +1,62 @@
+package service
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_ConcurrentSend(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// 房间事件、错误消息等多个协程同时写同一连接
+		client := NewClient(conn, time.Second, 10*time.Millisecond)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					client.Send([]byte("event"))
+				}
+			}()
+		}
+		wg.Wait()
+		client.Close(websocket.CloseServiceRestart, "server shutting down")
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	count := 0
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, errs := conn.ReadMessage()
+		if errs != nil {
+			if !websocket.IsCloseError(errs, websocket.CloseServiceRestart) {
+				t.Fatalf("read error = %v, want close %d", errs, websocket.CloseServiceRestart)
+			}
+			break
+		}
+		count++
+	}
+
+	// 关闭前发送队列中的消息全部送达
+	if count != 200 {
+		t.Fatalf("received %d messages, want 200", count)
+	}
+}
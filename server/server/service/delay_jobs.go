@@ -0,0 +1,72 @@
+package service
+
+import (
+	"errors"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/daley"
+	"log"
+)
+
+// delayJobs 房间的延迟任务
+type delayJobs struct {
+	autoBet daley.Kind[DelayMsg]  // 用户设置自动跟注
+	giveUp  daley.Kind[DelayMsg]  // 超时用户自动放弃
+	offline daley.Kind[DelayMsg]  // 离开超时用户判定离线
+	repair  daley.Kind[RepairMsg] // 以数据库为准修复房间状态(周期任务)
+
+	leaderboard daley.Kind[LeaderboardMsg] // 归档已结束周期的排行榜(周期任务)
+}
+
+// legacyDelayKinds 旧版本延迟消息类型对应的任务
+var legacyDelayKinds = map[int]string{
+	constant.DELAY_AUTOBET: "game.autobet",
+	constant.DELAY_GIVEUP:  "game.giveup",
+	constant.DELAY_OFFLINE: "game.offline",
+}
+
+// RegisterDelayJobs registers the delay jobs of game rooms, must be called before any game is created
+func (c *GamePool) RegisterDelayJobs(registry *daley.Registry) {
+	c.DelayJobs = registry
+	c.DelayQueue = registry.Scheduler()
+
+	// 兼容升级前按DelayType发送的延迟消息
+	registry.WithLegacyKind(func(message string) string {
+		delayMsg := DelayMsg{}
+		if err := delayMsg.ToDelayMsg(message); err != nil {
+			return ""
+		}
+		return legacyDelayKinds[delayMsg.DelayType]
+	})
+
+	c.jobs = &delayJobs{
+		autoBet: daley.Register(registry, legacyDelayKinds[constant.DELAY_AUTOBET], c.delayHandler((*Game).autoBetTimeout), daley.WithRetryCount(5)),
+		giveUp:  daley.Register(registry, legacyDelayKinds[constant.DELAY_GIVEUP], c.delayHandler((*Game).giveUpTimeout), daley.WithRetryCount(5)),
+		offline: daley.Register(registry, legacyDelayKinds[constant.DELAY_OFFLINE], c.delayHandler((*Game).offlineTimeout)),
+		repair:  daley.Register(registry, "game.repair", c.repairHandler),
+
+		leaderboard: daley.Register(registry, "leaderboard.archive", c.leaderboardHandler),
+	}
+}
+
+// delayHandler 延迟消息同样由房间协程串行执行
+func (c *GamePool) delayHandler(handler func(*Game, DelayMsg) error) func(DelayMsg, string) bool {
+	return func(delayMsg DelayMsg, idStr string) bool {
+		// 多实例部署时,消费延迟消息的实例不一定有该游戏的连接
+		game, release, err := c.borrowGame(delayMsg.GameId)
+		if errors.Is(err, constant.GameNotExistError) {
+			// 房间已过期,消息不再处理
+			log.Printf("delay-queue gameId=%s error: %s", delayMsg.GameId, err)
+			return true
+		}
+		if err != nil {
+			log.Println("delay-queue error:", err)
+			return false
+		}
+		defer release()
+
+		if err = game.Do(func() error { return handler(game, delayMsg) }); err != nil {
+			log.Printf("operate delay gameId=%s error: %s", game.GameId, err)
+		}
+		return true
+	}
+}
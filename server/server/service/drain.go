@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"game-3-card-poker/server/constant"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// drainCheckInterval 服务关闭时检查进行中当局的间隔
+const drainCheckInterval = 500 * time.Millisecond
+
+// IsDraining 服务是否正在关闭
+func (c *GamePool) IsDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// Drain 服务关闭:拒绝创建房间和开始新的一局并通知本实例的用户,等待进行中的当局结束。
+// 超过timeout后停止延迟队列和房间协程,未结束的当局保留在Redis中,由重启后的 GamePool.Recover 恢复
+func (c *GamePool) Drain(ctx context.Context, timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c.Mutex.Lock()
+	games := make([]*Game, 0, len(c.Conns))
+	for gameId := range c.Conns {
+		games = append(games, c.Conns[gameId])
+	}
+	c.Mutex.Unlock()
+
+	// 通知本实例的用户服务正在关闭
+	for index := range games {
+		games[index].notifyShutdown(ctx, c.InstanceId)
+	}
+
+	// 等待进行中的当局结束(期间延迟队列继续处理超时操作)
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	playing := c.countPlaying(games)
+waitLoop:
+	for playing > 0 {
+		select {
+		case <-ticker.C:
+			playing = c.countPlaying(games)
+		case <-ctx.Done():
+			break waitLoop
+		}
+	}
+
+	if c.DelayQueue != nil {
+		c.DelayQueue.StopConsume()
+	}
+
+	// 等待房间内正在执行的命令完成后保存房间并停止房间协程
+	for index := range games {
+		if err := games[index].checkpoint(); err != nil && err != constant.GameStoppedError {
+			log.Printf("checkpoint gameId=%s error: %s", games[index].GameId, err)
+		}
+		games[index].Stop()
+	}
+	if playing > 0 {
+		log.Printf("drain timeout, %d playing game rooms saved for recovery", playing)
+	}
+
+	c.StopSubscribe()
+
+	// 关闭本实例的所有连接
+	c.Mutex.Lock()
+	for index := range games {
+		for userId := range games[index].Clients {
+			for token := range games[index].Clients[userId] {
+				games[index].Clients[userId][token].Close(websocket.CloseServiceRestart, "server shutting down")
+			}
+		}
+	}
+	c.Mutex.Unlock()
+}
+
+// countPlaying 统计游戏中的房间数
+func (c *GamePool) countPlaying(games []*Game) int {
+	playing := 0
+	for index := range games {
+		gameRoom, err := games[index].GetGameRoom(context.Background())
+		if err == nil && gameRoom.State == constant.GAME_PAYING {
+			playing++
+		}
+	}
+	return playing
+}
+
+// notifyShutdown 通知本实例连接的用户服务正在关闭
+func (c *Game) notifyShutdown(ctx context.Context, instanceId string) {
+	gameRoom, err := c.GetGameRoom(ctx)
+	if err != nil {
+		return
+	}
+
+	message := ErrorMessage{ErrorMsg: constant.ServerShuttingDown, Code: constant.Code10015}
+	c.publishEvent(ctx, RoomEvent{
+		GameId:    gameRoom.GameId,
+		Instance:  instanceId,
+		State:     gameRoom.State,
+		CurrRound: gameRoom.CurrRound,
+		Payload:   message.ToJsonStr(constant.EVENT_SHUTDOWN),
+	})
+}
+
+// checkpoint 由房间协程保存房间状态,刷新过期时间以便重启后恢复
+func (c *Game) checkpoint() error {
+	return c.Do(func() error {
+		ctx := context.Background()
+		gameRoom, err := c.GetGameRoom(ctx)
+		if err != nil {
+			return err
+		}
+		return c.setGameRoomCache(ctx, gameRoom)
+	})
+}
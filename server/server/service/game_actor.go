@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"log"
+	"time"
+)
+
+// commandBufferSize 房间命令队列长度
+const commandBufferSize = 64
+
+// conflictRetryCount 房间版本号冲突时命令重试次数
+const conflictRetryCount = 3
+
+// command 房间命令,由房间协程串行执行
+type command struct {
+	handler func() error
+	result  chan error
+	action  *clientAction // 客户端操作,为空表示非客户端操作(延迟队列、回合切换)
+}
+
+// newGame 创建游戏房间并启动房间协程
+func newGame(gameId string, pool *GamePool) *Game {
+	game := &Game{
+		GameId:      gameId,
+		RedisClient: pool.RedisClient,
+		Store:       pool.Store,
+		DelayQueue:  pool.DelayQueue,
+		UserService: pool.UserService,
+		AwayTimeout: pool.AwayTimeout,
+		jobs:        pool.jobs,
+		clock:       pool.Clock,
+		isDraining:  pool.IsDraining,
+		deliver:     pool.deliverEvent,
+		Clients:     make(map[int64]map[string]*Client, 0),
+		commands:    make(chan command, commandBufferSize),
+		stopped:     make(chan struct{}),
+	}
+	go game.run()
+	return game
+}
+
+// run 房间协程,房间内所有操作(玩家操作、延迟队列超时、回合切换)均在此串行执行
+func (c *Game) run() {
+	for {
+		select {
+		case cmd := <-c.commands:
+			cmd.result <- c.execute(cmd.handler)
+		case <-c.stopped:
+			return
+		}
+	}
+}
+
+// execute 执行房间命令,多实例间通过分布式锁串行
+func (c *Game) execute(handler func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("gameId=%s command panic: %v", c.GameId, r)
+			err = fmt.Errorf("command panic: %v", r)
+		}
+	}()
+
+	unlock, err := c.lockGame(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for retry := 0; ; retry++ {
+		c.written = false
+		err = handler()
+
+		// 版本号冲突且命令尚未保存任何状态(数据库事务已回滚),重新执行命令
+		if errors.Is(err, constant.GameVersionConflictError) && !c.written && retry < conflictRetryCount {
+			log.Printf("gameId=%s version conflict, retry %d", c.GameId, retry+1)
+			continue
+		}
+		return err
+	}
+}
+
+// Do 提交命令到房间协程并等待执行结果,不能在房间协程内调用
+func (c *Game) Do(handler func() error, opts ...ActionOption) error {
+	cmd := command{handler: handler, result: make(chan error, 1)}
+	for _, opt := range opts {
+		opt(&cmd)
+	}
+	if action := cmd.action; action != nil {
+		cmd.handler = func() error { return c.doAction(action, handler) }
+	}
+	select {
+	case c.commands <- cmd:
+	case <-c.stopped:
+		return constant.GameStoppedError
+	}
+
+	select {
+	case err := <-cmd.result:
+		return err
+	case <-c.stopped:
+		return constant.GameStoppedError
+	}
+}
+
+// after 延迟提交命令到房间协程
+func (c *Game) after(d time.Duration, handler func() error) {
+	timer := c.clock.After(d)
+	c.pending.Add(1)
+	go func() {
+		defer c.pending.Done()
+		select {
+		case <-timer:
+		case <-c.stopped:
+			return
+		}
+		if err := c.Do(handler); err != nil && err != constant.GameStoppedError {
+			log.Printf("gameId=%s delay command error: %s", c.GameId, err)
+		}
+	}()
+}
+
+// noClients 本实例没有该房间的连接,需持有 GamePool.Mutex
+func (c *Game) noClients() bool {
+	for userId := range c.Clients {
+		if len(c.Clients[userId]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stopAfterPending 延迟命令均执行后停止房间协程,用于未加入房间协程池的房间协程
+func (c *Game) stopAfterPending() {
+	go func() {
+		c.pending.Wait()
+		c.Stop()
+	}()
+}
+
+// Stop 停止房间协程,之后提交的命令均返回 constant.GameStoppedError
+func (c *Game) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+}
@@ -2,11 +2,18 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"game-3-card-poker/server/constant"
 	"game-3-card-poker/server/daley"
-	"github.com/gorilla/websocket"
+	"game-3-card-poker/server/db"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"log"
+	"strings"
 	"sync"
+	"time"
 )
 
 // GamePool key is gameID
@@ -15,25 +22,47 @@ type GamePool struct {
 
 	Mutex       sync.Mutex
 	RedisClient *redis.Client
-	DelayQueue  *daley.DelayQueue
+	Store       GameStore
+	DelayQueue  daley.Scheduler
+	DelayJobs   *daley.Registry
+	Clock       daley.Clock // 房间延迟命令时钟,测试中替换为 daley.ManualClock
 	UserService *UserService
+	AwayTimeout time.Duration
+	InstanceId  string // 当前服务实例ID,多实例部署时区分连接
+
+	jobs     *delayJobs
+	pubSub   *redis.PubSub
+	draining int32 // 服务关闭中,拒绝创建房间和开始新的一局
 }
 
-func (c GamePool) GetGame(gameId string, isNotExistAdd bool) (*Game, error) {
+// NewGamePool creates a new GamePool, use GamePool.StartSubscribe to receive room events of all instances
+func NewGamePool(redisClient *redis.Client, store GameStore, userService *UserService, awayTimeout time.Duration) *GamePool {
+	return &GamePool{
+		RedisClient: redisClient,
+		Store:       store,
+		Clock:       daley.SystemClock(),
+		UserService: userService,
+		Conns:       make(map[string]*Game, 0),
+		AwayTimeout: awayTimeout,
+		InstanceId:  strings.ReplaceAll(uuid.New().String(), "-", ""),
+	}
+}
+
+// evictInterval 本实例移除空闲房间协程的检查间隔
+const evictInterval = time.Minute
+
+// GetGame 获取房间协程,isNotExistAdd 为 true 时仅为存储中存在的房间创建房间协程
+func (c *GamePool) GetGame(gameId string, isNotExistAdd bool) (*Game, error) {
+	c.Mutex.Lock()
 	conns := c.Conns[gameId]
+	c.Mutex.Unlock()
+
 	if conns == nil && isNotExistAdd {
-		c.Mutex.Lock()
-		defer c.Mutex.Unlock()
-
-		// 初始化
-		conns = &Game{
-			GameId:      gameId,
-			RedisClient: c.RedisClient,
-			DelayQueue:  c.DelayQueue,
-			UserService: c.UserService,
-			Clients:     make(map[int64]map[string]*websocket.Conn, 0),
+		// 房间不存在(客户端传入的无效ID、已过期的房间)不创建房间协程
+		if _, err := c.Store.LoadRoom(context.Background(), gameId); err != nil {
+			return nil, err
 		}
-		c.Conns[gameId] = conns
+		conns = c.addGame(gameId)
 	}
 
 	if conns == nil {
@@ -44,41 +73,276 @@ func (c GamePool) GetGame(gameId string, isNotExistAdd bool) (*Game, error) {
 	return conns, err
 }
 
-func (c GamePool) ConnOnline(gameId string, userId int64, token string, conn *websocket.Conn) (*Game, error) {
-	conns, err := c.GetGame(gameId, true)
-	if err != nil {
+// addGame 初始化并启动房间协程,已存在时返回已有的房间协程
+func (c *GamePool) addGame(gameId string) *Game {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	conns := c.Conns[gameId]
+	if conns == nil {
+		conns = newGame(gameId, c)
+		c.Conns[gameId] = conns
+	}
+	return conns
+}
+
+// CreateGame 创建游戏房间,房间保存成功后才加入房间协程池
+func (c *GamePool) CreateGame(gameRoom *GameRoom, user db.User) (*Game, error) {
+	conns := newGame(gameRoom.GameId, c)
+	if err := conns.CreateGames(gameRoom, user, nil); err != nil {
+		conns.Stop()
 		return nil, err
 	}
 
-	if conns.Clients[userId] == nil {
-		c.Mutex.Lock()
-		defer c.Mutex.Unlock()
+	c.Mutex.Lock()
+	c.Conns[gameRoom.GameId] = conns
+	c.Mutex.Unlock()
+	return conns, nil
+}
+
+// borrowGame 获取房间协程但不加入房间协程池,用于延迟消息、修复等本实例可能没有连接的房间,
+// 使用后调用 release(房间已有协程时为空操作)
+func (c *GamePool) borrowGame(gameId string) (conns *Game, release func(), err error) {
+	c.Mutex.Lock()
+	conns = c.Conns[gameId]
+	c.Mutex.Unlock()
+	if conns != nil {
+		return conns, func() {}, nil
+	}
+
+	if _, err = c.Store.LoadRoom(context.Background(), gameId); err != nil {
+		return nil, nil, err
+	}
+	// 与其他实例的房间协程之间通过分布式锁和版本号串行
+	conns = newGame(gameId, c)
+	return conns, conns.stopAfterPending, nil
+}
+
+// evictGame 停止并移除房间协程,remove 在持有锁时再次确认是否可以移除
+func (c *GamePool) evictGame(gameId string, conns *Game, remove func() bool) bool {
+	c.Mutex.Lock()
+	if c.Conns[gameId] != conns || !remove() {
+		c.Mutex.Unlock()
+		return false
+	}
+	delete(c.Conns, gameId)
+	c.Mutex.Unlock()
+
+	conns.Stop()
+	return true
+}
+
+// EvictIdle 移除本实例的空闲房间协程:房间数据已过期(24小时),或游戏已结束且本实例没有连接,返回移除的房间数
+func (c *GamePool) EvictIdle(ctx context.Context) int {
+	c.Mutex.Lock()
+	games := make(map[string]*Game, len(c.Conns))
+	for gameId := range c.Conns {
+		games[gameId] = c.Conns[gameId]
+	}
+	c.Mutex.Unlock()
+
+	count := 0
+	for gameId, conns := range games {
+		gameRoom, err := c.Store.LoadRoom(ctx, gameId)
+		switch {
+		case errors.Is(err, constant.GameNotExistError):
+			// 房间数据已过期,断开的连接不再需要房间协程
+			if c.evictGame(gameId, conns, func() bool { return true }) {
+				count++
+			}
+		case err == nil && gameRoom.IsOver():
+			if c.evictGame(gameId, conns, conns.noClients) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// StartEvict creates a goroutine to evict idle games periodically, use `stop()` to stop it
+func (c *GamePool) StartEvict() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(evictInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if count := c.EvictIdle(context.Background()); count > 0 {
+					log.Printf("evict %d idle game rooms", count)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (c *GamePool) ConnOnline(gameId string, userId int64, token string, client *Client) (*Game, error) {
+	var conns *Game
+	for {
+		game, err := c.GetGame(gameId, true)
+		if err != nil {
+			return nil, err
+		}
 
-		conns.Clients[userId] = map[string]*websocket.Conn{token: conn}
-	} else if conns.Clients[userId][token] == nil {
 		c.Mutex.Lock()
-		defer c.Mutex.Unlock()
+		// 获取后房间协程已被移除,重新获取
+		registered := c.Conns[gameId] == game
+		if registered {
+			if game.Clients[userId] == nil {
+				game.Clients[userId] = map[string]*Client{token: client}
+			} else if game.Clients[userId][token] == nil {
+				game.Clients[userId][token] = client
+			}
+		}
+		c.Mutex.Unlock()
+
+		if registered {
+			conns = game
+			break
+		}
+	}
 
-		conns.Clients[userId][token] = conn
+	// 单机部署不记录连接和在线状态
+	if c.RedisClient == nil {
+		return conns, nil
 	}
-	return c.Conns[gameId], nil
+
+	// 记录用户在所有实例上的连接
+	ctx := context.Background()
+	connKey := fmt.Sprintf("user-conns:%s-%d", gameId, userId)
+	pipeline := c.RedisClient.TxPipeline()
+	pipeline.SAdd(ctx, connKey, c.InstanceId+"-"+token)
+	pipeline.Expire(ctx, connKey, 24*time.Hour)
+	if _, errs := pipeline.Exec(ctx); errs != nil {
+		log.Printf("save userId=%d connection error: %s", userId, errs)
+	}
+
+	// 设置用户在线状态
+	conns.UserOnline(ctx, userId)
+	return conns, nil
 }
 
-func (c GamePool) ConnOffline(gameId string, userId int64, token string) {
+func (c *GamePool) ConnOffline(gameId string, userId int64, token string) {
 	conns, _ := c.GetGame(gameId, false)
-	if conns != nil && conns.Clients != nil && conns.Clients[userId] != nil {
-		c.Mutex.Lock()
-		defer c.Mutex.Unlock()
+	if conns == nil {
+		return
+	}
 
+	c.Mutex.Lock()
+	if conns.Clients != nil && conns.Clients[userId] != nil {
 		delete(conns.Clients[userId], token)
+		if len(conns.Clients[userId]) == 0 {
+			delete(conns.Clients, userId)
+		}
+	}
+	c.Mutex.Unlock()
+
+	ctx := context.Background()
+	defer func() {
+		// 游戏已结束且本实例最后一个连接断开->移除房间协程
+		if gameRoom, err := c.Store.LoadRoom(ctx, gameId); err == nil && gameRoom.IsOver() {
+			c.evictGame(gameId, conns, conns.noClients)
+		}
+	}()
+
+	if c.RedisClient == nil {
+		return
+	}
+
+	// 用户在所有实例上的连接均已断开->离开状态
+	connKey := fmt.Sprintf("user-conns:%s-%d", gameId, userId)
+	c.RedisClient.SRem(ctx, connKey, c.InstanceId+"-"+token)
+	if count, err := c.RedisClient.SCard(ctx, connKey).Result(); err == nil && count <= 0 {
+		conns.UserAway(ctx, userId)
 	}
 }
 
-func (c GamePool) CheckGameAvailability(gameId string) error {
-	_, err := c.GetGame(gameId, true)
-	if err != nil {
-		return err
+// CheckGameAvailability 房间是否存在,不创建房间协程
+func (c *GamePool) CheckGameAvailability(gameId string) error {
+	_, err := c.Store.LoadRoom(context.Background(), gameId)
+	return err
+}
+
+// StartSubscribe creates a goroutine to receive room events published by all instances
+// and deliver them to the connections of this instance, use `<-done` to wait subscriber stopping
+func (c *GamePool) StartSubscribe() (done <-chan struct{}) {
+	if c.RedisClient == nil {
+		// 单机部署直接投递,无需订阅
+		done0 := make(chan struct{})
+		close(done0)
+		return done0
+	}
+
+	c.pubSub = c.RedisClient.PSubscribe(context.Background(), fmt.Sprintf(roomEventChannel, "*"))
+	done0 := make(chan struct{})
+	go func() {
+		for msg := range c.pubSub.Channel() {
+			var event RoomEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Println("room event parse json error:", err)
+				continue
+			}
+			c.deliverEvent(context.Background(), event)
+		}
+		close(done0)
+	}()
+	return done0
+}
+
+// StopSubscribe stops subscriber goroutine
+func (c *GamePool) StopSubscribe() {
+	if c.pubSub != nil {
+		c.pubSub.Close()
+	}
+}
+
+// deliverEvent 房间事件投递到本实例的连接
+func (c *GamePool) deliverEvent(ctx context.Context, event RoomEvent) {
+	if len(event.Instance) > 0 && event.Instance != c.InstanceId {
+		return
 	}
-	return nil
 
+	c.Mutex.Lock()
+	game := c.Conns[event.GameId]
+	clients := make(map[int64][]*Client, 0)
+	if game != nil {
+		for userId := range game.Clients {
+			if event.UserId > 0 && event.UserId != userId {
+				continue
+			}
+			for token := range game.Clients[userId] {
+				clients[userId] = append(clients[userId], game.Clients[userId][token])
+			}
+		}
+	}
+	c.Mutex.Unlock()
+
+	for userId := range clients {
+		joinUser := game.GetJoinUser(ctx, userId, event.CurrRound)
+		if joinUser == nil {
+			continue
+		}
+
+		// 游戏等待中(没ready状态不主动推送广播消息)
+		if event.UserId <= 0 && event.State == constant.GAME_WAIT && event.CurrRound > 1 {
+			if joinUser.State == constant.EVENT_JOIN_USER {
+				// 上局加入过游戏
+				lastJoinUser := game.GetJoinUser(ctx, userId, event.CurrRound-1)
+				if lastJoinUser != nil && lastJoinUser.State > constant.EVENT_JOIN_USER {
+					continue
+				}
+			}
+		}
+
+		for index := range clients[userId] {
+			clients[userId][index].Send(event.Payload)
+		}
+	}
 }
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gameCacheExpiration 房间数据过期时间
+const gameCacheExpiration = 24 * time.Hour
+
+// GameStore 游戏房间状态存储(房间、座位即每局加入的用户、用户底牌)。
+// 房间带有版本号,保存时版本号与读取时不一致返回 constant.GameVersionConflictError,成功后版本号加1
+type GameStore interface {
+	// LoadRoom 获取房间
+	LoadRoom(ctx context.Context, gameId string) (*GameRoom, error)
+
+	// ListRooms 获取所有房间(服务重启恢复使用)
+	ListRooms(ctx context.Context) ([]*GameRoom, error)
+
+	// SaveRoom 原子保存房间及当局座位,joinUsers可为空
+	SaveRoom(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser) error
+
+	// LoadSeat 获取某局的座位
+	LoadSeat(ctx context.Context, gameId string, userId int64, currRound int) (*JoinUser, error)
+
+	// LoadCards 获取用户某局的底牌
+	LoadCards(ctx context.Context, gameId string, userId int64, currRound int) (*UserPoker, error)
+
+	// SaveCards 发牌时原子保存房间、当局座位及用户底牌
+	SaveCards(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser, userPokers map[int64]UserPoker) error
+}
+
+// saveRoomScript 比较房间版本号后保存房间、座位及底牌
+// keys: roomKey, seatKey/cardsKey...
+// argv: version, roomJson, expiration seconds, seatJson/cardsJson...
+// 返回新版本号,版本号冲突返回-1
+const saveRoomScript = `
+local current = 0
+local keyType = redis.call('TYPE', KEYS[1])['ok']
+if keyType == 'hash' then
+    current = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+elseif keyType ~= 'none' then
+    -- 旧版本的json字符串格式
+    redis.call('DEL', KEYS[1])
+end
+if current ~= tonumber(ARGV[1]) then
+    return -1
+end
+redis.call('HSET', KEYS[1], 'version', current + 1, 'data', ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+for i = 2, #KEYS do
+    redis.call('SET', KEYS[i], ARGV[i + 2], 'EX', ARGV[3])
+end
+return current + 1
+`
+
+func roomKey(gameId string) string {
+	return fmt.Sprintf("game-room:%s", gameId)
+}
+
+func seatKey(gameId string, userId int64, currRound int) string {
+	return fmt.Sprintf("join-user:%s-%d-%d", gameId, userId, currRound)
+}
+
+func cardsKey(gameId string, userId int64, currRound int) string {
+	return fmt.Sprintf("user-poker:%s-%d-%d", gameId, userId, currRound)
+}
+
+// RedisGameStore 基于Redis的房间状态存储,多实例共享
+type RedisGameStore struct {
+	redisCli *redis.Client
+}
+
+// NewRedisGameStore creates a GameStore backed by redis, all keys expire after 24 hours
+func NewRedisGameStore(redisCli *redis.Client) *RedisGameStore {
+	return &RedisGameStore{redisCli: redisCli}
+}
+
+func (s *RedisGameStore) LoadRoom(ctx context.Context, gameId string) (*GameRoom, error) {
+	values, err := s.redisCli.HMGet(ctx, roomKey(gameId), "version", "data").Result()
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		// 旧版本的json字符串格式,版本号为0
+		value, errs := s.redisCli.Get(ctx, roomKey(gameId)).Result()
+		if errs != nil {
+			return nil, constant.CacheGetInfoError
+		}
+		return parseGameRoom(value, 0)
+	}
+	if err != nil {
+		log.Print(err)
+		// 获取服务数据内部异常
+		return nil, constant.CacheGetInfoError
+	}
+
+	data, ok := values[1].(string)
+	if !ok {
+		// 房间不存在
+		return nil, constant.GameNotExistError
+	}
+	version, _ := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+	return parseGameRoom(data, version)
+}
+
+func (s *RedisGameStore) ListRooms(ctx context.Context) ([]*GameRoom, error) {
+	gameRooms := make([]*GameRoom, 0)
+	iter := s.redisCli.Scan(ctx, 0, roomKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		gameRoom, err := s.LoadRoom(ctx, strings.TrimPrefix(iter.Val(), roomKey("")))
+		if err != nil {
+			continue
+		}
+		gameRooms = append(gameRooms, gameRoom)
+	}
+	return gameRooms, iter.Err()
+}
+
+func (s *RedisGameStore) SaveRoom(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser) error {
+	return s.SaveCards(ctx, gameRoom, joinUsers, nil)
+}
+
+func (s *RedisGameStore) LoadSeat(ctx context.Context, gameId string, userId int64, currRound int) (*JoinUser, error) {
+	value, err := s.redisCli.Get(ctx, seatKey(gameId, userId, currRound)).Result()
+	if err != nil {
+		return nil, constant.CacheGetInfoError
+	}
+	return parseJoinUser(value)
+}
+
+func (s *RedisGameStore) LoadCards(ctx context.Context, gameId string, userId int64, currRound int) (*UserPoker, error) {
+	value, err := s.redisCli.Get(ctx, cardsKey(gameId, userId, currRound)).Result()
+	if err != nil {
+		log.Print(err)
+		// 获取服务数据内部异常
+		return nil, constant.CacheGetInfoError
+	}
+	return parseUserPoker(value)
+}
+
+func (s *RedisGameStore) SaveCards(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser, userPokers map[int64]UserPoker) error {
+	roomJson, values, err := marshalGameRoom(gameRoom, joinUsers, userPokers)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{roomKey(gameRoom.GameId)}
+	args := []interface{}{gameRoom.Version, roomJson, int64(gameCacheExpiration / time.Second)}
+	for key := range values {
+		keys = append(keys, key)
+		args = append(args, values[key])
+	}
+
+	version, err := s.redisCli.Eval(ctx, saveRoomScript, keys, args...).Int64()
+	if err != nil {
+		return err
+	}
+	if version < 0 {
+		return constant.GameVersionConflictError
+	}
+	gameRoom.Version = version
+	return nil
+}
+
+// marshalGameRoom 房间转换为json,座位、底牌转换为存储的key->json
+func marshalGameRoom(gameRoom *GameRoom, joinUsers map[int64]*JoinUser, userPokers map[int64]UserPoker) ([]byte, map[string][]byte, error) {
+	gameJson, err := json.Marshal(gameRoom)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string][]byte, 0)
+	for userId := range joinUsers {
+		userJson, errs := json.Marshal(joinUsers[userId])
+		if errs != nil {
+			return nil, nil, errs
+		}
+		values[seatKey(gameRoom.GameId, userId, gameRoom.CurrRound)] = userJson
+	}
+
+	for userId := range userPokers {
+		pokerJson, errs := json.Marshal(userPokers[userId])
+		if errs != nil {
+			return nil, nil, errs
+		}
+		values[cardsKey(gameRoom.GameId, userId, gameRoom.CurrRound)] = pokerJson
+	}
+	return gameJson, values, nil
+}
+
+func parseGameRoom(value string, version int64) (*GameRoom, error) {
+	// 获取游戏数据不存在
+	if len(value) <= 0 {
+		return nil, constant.GamePareError
+	}
+
+	var gameRoom GameRoom
+	if err := json.Unmarshal([]byte(value), &gameRoom); err != nil {
+		return nil, constant.GamePareError
+	}
+	gameRoom.Version = version
+	return &gameRoom, nil
+}
+
+func parseJoinUser(value string) (*JoinUser, error) {
+	if len(value) <= 0 {
+		return nil, constant.GamePareError
+	}
+
+	var joinUser JoinUser
+	if err := json.Unmarshal([]byte(value), &joinUser); err != nil {
+		return nil, constant.GamePareError
+	}
+	return &joinUser, nil
+}
+
+func parseUserPoker(value string) (*UserPoker, error) {
+	if len(value) <= 0 {
+		return nil, constant.GamePareError
+	}
+
+	var userPoker UserPoker
+	if err := json.Unmarshal([]byte(value), &userPoker); err != nil {
+		return nil, constant.GamePareError
+	}
+	return &userPoker, nil
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"game-3-card-poker/server/constant"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+func testGameStores(t *testing.T) map[string]GameStore {
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	return map[string]GameStore{
+		"redis":  NewRedisGameStore(rdb),
+		"memory": NewMemoryGameStore(),
+	}
+}
+
+func TestGameStore(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testGameStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.LoadRoom(ctx, "not-exist"); err != constant.GameNotExistError {
+				t.Fatalf("LoadRoom not exist error = %v, want %v", err, constant.GameNotExistError)
+			}
+
+			gameRoom := &GameRoom{GameId: "store-test", State: constant.GAME_PAYING, CurrRound: 2, JoinUsers: map[int64]int{1: 2, 2: 2}}
+			joinUsers := map[int64]*JoinUser{
+				1: {UserId: 1, State: constant.EVENT_PLAYING_USER, Location: 0},
+				2: {UserId: 2, State: constant.EVENT_PLAYING_USER, Location: 1},
+			}
+			cardPoker := CardPoker{}
+			cardPoker.InitShufflePoker()
+			userPokers := cardPoker.LicenseCardPoker([]int64{1, 2})
+			if err := store.SaveCards(ctx, gameRoom, joinUsers, userPokers); err != nil {
+				t.Fatal(err)
+			}
+
+			// 保存房间和座位
+			gameRoom.CurrLocation = 1
+			joinUsers[2].TotalBetChips = 20
+			if err := store.SaveRoom(ctx, gameRoom, map[int64]*JoinUser{2: joinUsers[2]}); err != nil {
+				t.Fatal(err)
+			}
+			joinUsers[1].IsLookCard = true
+			if err := store.SaveRoom(ctx, gameRoom, map[int64]*JoinUser{1: joinUsers[1]}); err != nil {
+				t.Fatal(err)
+			}
+
+			room, err := store.LoadRoom(ctx, gameRoom.GameId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if room.CurrLocation != 1 || room.State != constant.GAME_PAYING || len(room.JoinUsers) != 2 {
+				t.Fatalf("LoadRoom = %+v", room)
+			}
+
+			seat, err := store.LoadSeat(ctx, gameRoom.GameId, 2, gameRoom.CurrRound)
+			if err != nil || seat.TotalBetChips != 20 {
+				t.Fatalf("LoadSeat = %+v, %v", seat, err)
+			}
+			seat, err = store.LoadSeat(ctx, gameRoom.GameId, 1, gameRoom.CurrRound)
+			if err != nil || !seat.IsLookCard {
+				t.Fatalf("LoadSeat = %+v, %v", seat, err)
+			}
+			if _, err = store.LoadSeat(ctx, gameRoom.GameId, 1, gameRoom.CurrRound-1); err == nil {
+				t.Fatal("LoadSeat of other round want error")
+			}
+
+			userPoker, err := store.LoadCards(ctx, gameRoom.GameId, 2, gameRoom.CurrRound)
+			if err != nil || userPoker.ToString() != userPokers[2].ToString() {
+				t.Fatalf("LoadCards = %+v, %v", userPoker, err)
+			}
+
+			// 修改返回值不影响存储
+			room.State = constant.GAME_ENDED
+			if room, _ = store.LoadRoom(ctx, gameRoom.GameId); room.State != constant.GAME_PAYING {
+				t.Fatalf("state = %d after modifying loaded room", room.State)
+			}
+
+			if room.Version != 3 {
+				t.Fatalf("version = %d after 3 saves, want 3", room.Version)
+			}
+
+			gameRooms, err := store.ListRooms(ctx)
+			if err != nil || len(gameRooms) != 1 || gameRooms[0].GameId != gameRoom.GameId {
+				t.Fatalf("ListRooms = %v, %v", gameRooms, err)
+			}
+		})
+	}
+}
+
+func TestGame_MemoryStoreWithoutRedis(t *testing.T) {
+	pool := NewGamePool(nil, NewMemoryGameStore(), newTestUserService(t), time.Minute)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 非庄家下注后弃牌,庄家获胜
+	if err := testBetting(game, users[1].ID, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := game.UserGiveUpCard(users[1].ID, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	gameRoom, err := game.GetGameRoom(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gameRoom.State != constant.GAME_ENDED {
+		t.Fatalf("state = %d, want %d", gameRoom.State, constant.GAME_ENDED)
+	}
+	winUser := game.GetJoinUser(context.Background(), users[0].ID, 1)
+	if winUser == nil || winUser.State != constant.EVENT_WIN_USER {
+		t.Fatalf("banker = %+v, want winner", winUser)
+	}
+}
+
+func TestGameStore_VersionConflict(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testGameStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.SaveRoom(ctx, &GameRoom{GameId: "conflict-test", State: constant.GAME_WAIT}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// 延迟超时与玩家操作同时读取房间
+			timeoutRoom, _ := store.LoadRoom(ctx, "conflict-test")
+			actionRoom, _ := store.LoadRoom(ctx, "conflict-test")
+
+			actionRoom.TotalBetChips = 20
+			if err := store.SaveRoom(ctx, actionRoom, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			timeoutRoom.State = constant.GAME_ENDED
+			joinUser := &JoinUser{UserId: 1, State: constant.EVENT_GIVE_UP_USER}
+			if err := store.SaveRoom(ctx, timeoutRoom, map[int64]*JoinUser{1: joinUser}); err != constant.GameVersionConflictError {
+				t.Fatalf("SaveRoom with stale version error = %v, want %v", err, constant.GameVersionConflictError)
+			}
+
+			// 冲突时房间和座位均未保存
+			room, _ := store.LoadRoom(ctx, "conflict-test")
+			if room.TotalBetChips != 20 || room.State != constant.GAME_WAIT {
+				t.Fatalf("room = %+v, want the first update only", room)
+			}
+			if _, err := store.LoadSeat(ctx, "conflict-test", 1, 0); err == nil {
+				t.Fatal("seat saved with stale room version")
+			}
+		})
+	}
+}
+
+func TestRedisGameStore_LegacyRoom(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	store := NewRedisGameStore(rdb)
+
+	// 旧版本保存的json字符串
+	rdb.Set(ctx, roomKey("legacy-test"), `{"gameId":"legacy-test","state":1}`, time.Hour)
+	room, err := store.LoadRoom(ctx, "legacy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.Version != 0 || room.State != constant.GAME_PAYING {
+		t.Fatalf("legacy room = %+v", room)
+	}
+
+	if err = store.SaveRoom(ctx, room, nil); err != nil {
+		t.Fatal(err)
+	}
+	if room, err = store.LoadRoom(ctx, "legacy-test"); err != nil || room.Version != 1 {
+		t.Fatalf("room = %+v, %v, want version 1", room, err)
+	}
+}
@@ -0,0 +1,306 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"game-3-card-poker/server/daley"
+	"game-3-card-poker/server/db"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 排行榜类型
+const (
+	BoardNet  = "net"  // 净赢筹码
+	BoardPot  = "pot"  // 赢得的最大奖池
+	BoardWins = "wins" // 获胜局数
+)
+
+// 排行榜周期,日榜、周榜在周期结束后归档并重置
+const (
+	PeriodDaily  = "daily"
+	PeriodWeekly = "weekly"
+	PeriodAll    = "all"
+)
+
+var leaderboardBoards = []string{BoardNet, BoardPot, BoardWins}
+
+// leaderboardExpiration 日榜、周榜的过期时间,归档任务未执行时避免长期占用redis
+var leaderboardExpiration = map[string]time.Duration{
+	PeriodDaily:  8 * 24 * time.Hour,
+	PeriodWeekly: 5 * 7 * 24 * time.Hour,
+}
+
+// LeaderboardMsg 排行榜归档任务消息
+type LeaderboardMsg struct{}
+
+// LeaderboardReq 排行榜请求,periodId 为空表示当前周期,早于当前周期时查询归档快照
+type LeaderboardReq struct {
+	Board    string `json:"board" valid:"required"`
+	Period   string `json:"period" valid:"required"`
+	PeriodId string `json:"periodId"`
+	Offset   int    `json:"offset"`
+	Limit    int    `json:"limit"`
+}
+
+// LeaderboardEntry 排行榜名次
+type LeaderboardEntry struct {
+	Rank    int    `json:"rank"`
+	UserId  int64  `json:"userId"`
+	Address string `json:"address"`
+	HeadPic string `json:"headPic"`
+	Score   int64  `json:"score"`
+}
+
+// LeaderboardPage 排行榜分页,mine 为当前用户的名次(未上榜为空),不受分页限制
+type LeaderboardPage struct {
+	Board    string             `json:"board"`
+	Period   string             `json:"period"`
+	PeriodId string             `json:"periodId"`
+	Total    int64              `json:"total"`
+	List     []LeaderboardEntry `json:"list"`
+	Mine     *LeaderboardEntry  `json:"mine"`
+}
+
+// Leaderboard 排行榜,当前周期保存在redis有序集合中,结算时更新
+type Leaderboard struct {
+	redisCli *redis.Client
+	boardDB  *db.LeaderboardDB
+	Clock    daley.Clock // 周期计算时钟,测试中替换为 daley.ManualClock
+}
+
+func NewLeaderboard(redisCli *redis.Client, boardDB *db.LeaderboardDB) *Leaderboard {
+	return &Leaderboard{redisCli: redisCli, boardDB: boardDB, Clock: daley.SystemClock()}
+}
+
+// ValidLeaderboard 排行榜类型及周期是否有效
+func ValidLeaderboard(board string, period string) bool {
+	validBoard := false
+	for _, name := range leaderboardBoards {
+		validBoard = validBoard || name == board
+	}
+	return validBoard && (period == PeriodDaily || period == PeriodWeekly || period == PeriodAll)
+}
+
+// periodId 时间所在周期: 日榜20261019,周榜2026W42(ISO周),总榜all
+func periodId(period string, t time.Time) string {
+	switch period {
+	case PeriodDaily:
+		return t.Format("20060102")
+	case PeriodWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%dW%02d", year, week)
+	}
+	return PeriodAll
+}
+
+func leaderboardKey(board string, period string, periodId string) string {
+	if period == PeriodAll {
+		return fmt.Sprintf("leaderboard:%s:%s", board, period)
+	}
+	return fmt.Sprintf("leaderboard:%s:%s:%s", board, period, periodId)
+}
+
+// AddRound 当局结算后更新日榜、周榜及总榜,netChips 为当局玩家的输赢筹码。
+// 周期按当局结算时间 settleAt 计算,周期交界处结算的当局计入结算时所在的周期
+func (l *Leaderboard) AddRound(ctx context.Context, settleAt time.Time, winUserId int64, pot int64, netChips map[int64]int64) error {
+	_, err := l.redisCli.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, period := range []string{PeriodDaily, PeriodWeekly, PeriodAll} {
+			id := periodId(period, settleAt)
+			for userId, chips := range netChips {
+				pipe.ZIncrBy(ctx, leaderboardKey(BoardNet, period, id), float64(chips), strconv.FormatInt(userId, 10))
+			}
+			winMember := strconv.FormatInt(winUserId, 10)
+			pipe.ZIncrBy(ctx, leaderboardKey(BoardWins, period, id), 1, winMember)
+			pipe.ZAddGT(ctx, leaderboardKey(BoardPot, period, id), redis.Z{Score: float64(pot), Member: winMember})
+
+			if expiration, ok := leaderboardExpiration[period]; ok {
+				for _, board := range leaderboardBoards {
+					pipe.Expire(ctx, leaderboardKey(board, period, id), expiration)
+				}
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Archive 归档已结束周期的日榜、周榜到数据库并删除redis中的排行榜,返回归档的排行榜数
+func (l *Leaderboard) Archive(ctx context.Context) (int, error) {
+	count := 0
+	now := l.Clock.Now()
+	for _, board := range leaderboardBoards {
+		for _, period := range []string{PeriodDaily, PeriodWeekly} {
+			prefix := leaderboardKey(board, period, "")
+			keys := make([]string, 0)
+			iter := l.redisCli.Scan(ctx, 0, prefix+"*", 100).Iterator()
+			for iter.Next(ctx) {
+				keys = append(keys, iter.Val())
+			}
+			if err := iter.Err(); err != nil {
+				return count, err
+			}
+
+			for _, key := range keys {
+				id := strings.TrimPrefix(key, prefix)
+				if id == periodId(period, now) {
+					continue
+				}
+				if err := l.archiveKey(ctx, key, board, period, id); err != nil {
+					return count, err
+				}
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// archiveKey 保存排行榜快照后删除,保存失败时保留排行榜等待下次归档
+func (l *Leaderboard) archiveKey(ctx context.Context, key string, board string, period string, id string) error {
+	members, err := l.redisCli.ZRevRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	snapshots := make([]db.LeaderboardSnapshot, 0, len(members))
+	for index, member := range members {
+		userId, errs := strconv.ParseInt(fmt.Sprint(member.Member), 10, 64)
+		if errs != nil {
+			log.Printf("leaderboard %s member %v invalid", key, member.Member)
+			continue
+		}
+		snapshots = append(snapshots, db.LeaderboardSnapshot{
+			Board:    board,
+			Period:   period,
+			PeriodId: id,
+			Ranking:  index + 1,
+			UserId:   userId,
+			Score:    int64(member.Score),
+		})
+	}
+	if err = l.boardDB.SaveSnapshot(snapshots); err != nil {
+		return err
+	}
+	return l.redisCli.Del(ctx, key).Err()
+}
+
+// List 排行榜分页及用户名次,名次从1开始
+func (l *Leaderboard) List(ctx context.Context, req LeaderboardReq, userId int64) (LeaderboardPage, error) {
+	page := LeaderboardPage{Board: req.Board, Period: req.Period, PeriodId: req.PeriodId, List: make([]LeaderboardEntry, 0)}
+	current := periodId(req.Period, l.Clock.Now())
+	if len(page.PeriodId) == 0 {
+		page.PeriodId = current
+	}
+
+	// 已结束的周期查询归档快照
+	if page.PeriodId != current {
+		snapshots, total, err := l.boardDB.ListSnapshot(req.Board, req.Period, page.PeriodId, req.Offset, req.Limit)
+		if err != nil {
+			return page, err
+		}
+		page.Total = total
+		for _, snapshot := range snapshots {
+			page.List = append(page.List, LeaderboardEntry{Rank: snapshot.Ranking, UserId: snapshot.UserId, Score: snapshot.Score})
+		}
+		snapshot, ok, err := l.boardDB.GetSnapshotRank(req.Board, req.Period, page.PeriodId, userId)
+		if err != nil {
+			return page, err
+		}
+		if ok {
+			page.Mine = &LeaderboardEntry{Rank: snapshot.Ranking, UserId: userId, Score: snapshot.Score}
+		}
+		return page, nil
+	}
+
+	key := leaderboardKey(req.Board, req.Period, page.PeriodId)
+	total, err := l.redisCli.ZCard(ctx, key).Result()
+	if err != nil {
+		return page, err
+	}
+	page.Total = total
+	members, err := l.redisCli.ZRevRangeWithScores(ctx, key, int64(req.Offset), int64(req.Offset+req.Limit-1)).Result()
+	if err != nil {
+		return page, err
+	}
+	for index, member := range members {
+		memberId, errs := strconv.ParseInt(fmt.Sprint(member.Member), 10, 64)
+		if errs != nil {
+			continue
+		}
+		page.List = append(page.List, LeaderboardEntry{Rank: req.Offset + index + 1, UserId: memberId, Score: int64(member.Score)})
+	}
+
+	member := strconv.FormatInt(userId, 10)
+	rank, err := l.redisCli.ZRevRank(ctx, key, member).Result()
+	if errors.Is(err, redis.Nil) {
+		return page, nil
+	}
+	if err != nil {
+		return page, err
+	}
+	score, err := l.redisCli.ZScore(ctx, key, member).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return page, err
+	}
+	page.Mine = &LeaderboardEntry{Rank: int(rank) + 1, UserId: userId, Score: int64(score)}
+	return page, nil
+}
+
+// ListLeaderboard 排行榜分页,包含上榜用户的地址、头像及当前用户的名次
+func (u *UserService) ListLeaderboard(ctx context.Context, req LeaderboardReq, userId int64) (LeaderboardPage, error) {
+	page, err := u.leaderboard.List(ctx, req, userId)
+	if err != nil {
+		return page, err
+	}
+
+	userIds := make([]int64, 0, len(page.List)+1)
+	for index := range page.List {
+		userIds = append(userIds, page.List[index].UserId)
+	}
+	if page.Mine != nil {
+		userIds = append(userIds, page.Mine.UserId)
+	}
+	if len(userIds) == 0 {
+		return page, nil
+	}
+	users, err := u.GetUsersByIds(userIds)
+	if err != nil {
+		return page, err
+	}
+	for index := range page.List {
+		entry := &page.List[index]
+		entry.Address, entry.HeadPic = users[entry.UserId].Address, users[entry.UserId].HeadPic
+	}
+	if page.Mine != nil {
+		page.Mine.Address, page.Mine.HeadPic = users[page.Mine.UserId].Address, users[page.Mine.UserId].HeadPic
+	}
+	return page, nil
+}
+
+// ArchiveLeaderboards 归档已结束周期的排行榜
+func (u *UserService) ArchiveLeaderboards(ctx context.Context) (int, error) {
+	return u.leaderboard.Archive(ctx)
+}
+
+// ScheduleLeaderboardArchive 按cron表达式周期归档排行榜,多实例部署时每次只由一个实例执行
+func (c *GamePool) ScheduleLeaderboardArchive(spec string) error {
+	return c.jobs.leaderboard.Schedule("leaderboard.archive", spec, LeaderboardMsg{})
+}
+
+// leaderboardHandler 排行榜归档任务,失败时延迟队列重试
+func (c *GamePool) leaderboardHandler(msg LeaderboardMsg, idStr string) bool {
+	count, err := c.UserService.ArchiveLeaderboards(context.Background())
+	if err != nil {
+		log.Println("archive leaderboards error:", err)
+		return false
+	}
+	if count > 0 {
+		log.Printf("archive %d leaderboards", count)
+	}
+	return true
+}
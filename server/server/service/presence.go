@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"log"
+	"time"
+)
+
+// UserOnline 用户建立连接->在线状态
+func (c *Game) UserOnline(ctx context.Context, userId int64) {
+	presence := c.GetPresence(ctx, userId)
+	if presence != nil && presence.State == constant.PRESENCE_ONLINE {
+		return
+	}
+	c.updatePresence(ctx, userId, constant.PRESENCE_ONLINE)
+}
+
+// UserAway 用户所有连接已断开->离开状态,超时未重连则判定离线
+func (c *Game) UserAway(ctx context.Context, userId int64) {
+	presence := c.updatePresence(ctx, userId, constant.PRESENCE_AWAY)
+	if presence == nil || c.jobs == nil {
+		return
+	}
+
+	// 延迟倒计时->(离开超时用户判定离线)
+	delayMsg := DelayMsg{
+		DelayType: constant.DELAY_OFFLINE,
+		GameId:    c.GameId,
+		UserId:    userId,
+		Timestamp: presence.Timestamp,
+	}
+	if _, err := c.jobs.offline.SendDelay(delayMsg, c.AwayTimeout); err != nil {
+		log.Printf("send offline delay message userId=%d error: %s", userId, err)
+	}
+}
+
+// UserOffline 离开超时用户判定离线,期间重连或再次离开则忽略。
+// 局间离线的用户兑回桌上筹码,当局进行中则在下一局开始时兑回,由房间协程执行
+func (c *Game) UserOffline(ctx context.Context, userId int64, timestamp int64) {
+	presence := c.GetPresence(ctx, userId)
+	if presence == nil || presence.State != constant.PRESENCE_AWAY || presence.Timestamp != timestamp {
+		return
+	}
+	c.updatePresence(ctx, userId, constant.PRESENCE_OFFLINE)
+
+	if gameRoom, err := c.GetGameRoom(ctx); err == nil && gameRoom.State == constant.GAME_WAIT {
+		c.cashOutOffline(ctx, gameRoom, []int64{userId})
+	}
+}
+
+// cashOutOffline 离线用户的桌上筹码兑回账户余额,由房间协程执行
+func (c *Game) cashOutOffline(ctx context.Context, gameRoom *GameRoom, userIds []int64) {
+	for _, userId := range userIds {
+		presence := c.GetPresence(ctx, userId)
+		if presence == nil || presence.State != constant.PRESENCE_OFFLINE {
+			continue
+		}
+		joinUser := c.GetJoinUser(ctx, userId, gameRoom.CurrRound)
+		if joinUser == nil || joinUser.Stack <= 0 {
+			continue
+		}
+
+		amount := joinUser.Stack
+		if err := c.cashOut(ctx, gameRoom, joinUser, ""); err != nil {
+			log.Printf("cash out offline userId=%d stack error: %s", userId, err)
+			continue
+		}
+
+		// 广播消息通知所有用户
+		c.BroadcastMsg(ctx, gameRoom, &EventMsg{
+			Type:     constant.EVENT_STACK,
+			UserId:   userId,
+			BetChips: -amount,
+		})
+	}
+}
+
+// GetPresence 获取用户在线状态
+func (c *Game) GetPresence(ctx context.Context, userId int64) *Presence {
+	if c.RedisClient == nil {
+		return nil
+	}
+
+	value, err := c.RedisClient.Get(ctx, fmt.Sprintf("user-presence:%s-%d", c.GameId, userId)).Result()
+	if err == nil && len(value) > 0 {
+		var presence *Presence
+		if errs := json.Unmarshal([]byte(value), &presence); errs == nil {
+			return presence
+		}
+	}
+	return nil
+}
+
+// GetPresences 批量获取用户在线状态,没有记录的用户视为离线
+func (c *Game) GetPresences(ctx context.Context, userIds []int64) map[int64]int {
+	presences := make(map[int64]int, 0)
+	if len(userIds) <= 0 || c.RedisClient == nil {
+		return presences
+	}
+
+	keys := make([]string, 0, len(userIds))
+	for index := range userIds {
+		keys = append(keys, fmt.Sprintf("user-presence:%s-%d", c.GameId, userIds[index]))
+	}
+
+	values, err := c.RedisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Print(err)
+		return presences
+	}
+
+	for index := range values {
+		presences[userIds[index]] = constant.PRESENCE_OFFLINE
+		if value, ok := values[index].(string); ok {
+			var presence Presence
+			if errs := json.Unmarshal([]byte(value), &presence); errs == nil {
+				presences[userIds[index]] = presence.State
+			}
+		}
+	}
+	return presences
+}
+
+// updatePresence 更新用户在线状态并广播通知房间所有用户
+func (c *Game) updatePresence(ctx context.Context, userId int64, state int) *Presence {
+	if c.RedisClient == nil {
+		return nil
+	}
+
+	presence := &Presence{State: state, Timestamp: c.clock.Now().UnixMilli()}
+	presenceJson, err := json.Marshal(presence)
+	if err != nil {
+		return nil
+	}
+
+	if errs := c.RedisClient.Set(ctx, fmt.Sprintf("user-presence:%s-%d", c.GameId, userId), presenceJson, 24*time.Hour).Err(); errs != nil {
+		log.Printf("set userId=%d presence error: %s", userId, errs)
+		return nil
+	}
+
+	// 广播消息通知所有用户
+	if gameRoom, errs := c.GetGameRoom(ctx); errs == nil {
+		c.BroadcastMsg(ctx, gameRoom, &EventMsg{
+			Type:     constant.EVENT_PRESENCE,
+			UserId:   userId,
+			Presence: state,
+		})
+	}
+	return presence
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/daley"
+	"testing"
+	"time"
+)
+
+// restartTestGamePool simulates a crashed server: stops the rooms of the old pool and
+// creates a new pool on the same redis and database
+func restartTestGamePool(t *testing.T, pool *GamePool) *GamePool {
+	t.Helper()
+
+	pool.Mutex.Lock()
+	for gameId := range pool.Conns {
+		pool.Conns[gameId].Stop()
+	}
+	pool.Mutex.Unlock()
+
+	restarted := NewGamePool(pool.RedisClient, pool.Store, pool.UserService, pool.AwayTimeout)
+	restarted.RegisterDelayJobs(daley.NewRegistry("test-delay-queue", pool.RedisClient))
+	t.Cleanup(func() {
+		for gameId := range restarted.Conns {
+			restarted.Conns[gameId].Stop()
+		}
+	})
+	return restarted
+}
+
+func TestGamePool_RecoverMidHand(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 操作倒计时开始前服务宕机,宕机20秒后重启
+	restarted := restartTestGamePool(t, pool)
+	gameRoom, err := game.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gameRoom.CurrTimeStamp -= 20
+	if err = pool.Store.SaveRoom(ctx, gameRoom, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := restarted.Recover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("recovered %d rooms, want 1", count)
+	}
+
+	recovered, err := restarted.GetGame(gameRoom.GameId, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var operateUser *JoinUser
+	for _, user := range users {
+		if joinUser := recovered.GetJoinUser(ctx, user.ID, gameRoom.CurrRound); joinUser.Location == gameRoom.CurrLocation {
+			operateUser = joinUser
+		}
+	}
+	if operateUser == nil {
+		t.Fatalf("no player at location %d", gameRoom.CurrLocation)
+	}
+
+	// 按剩余倒计时重新设置超时放弃
+	pending, err := pool.RedisClient.ZRangeWithScores(ctx, "dp:test-delay-queue:pending", 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var giveUpAt int64
+	for _, z := range pending {
+		payload, _ := pool.RedisClient.Get(ctx, "dp:test-delay-queue:msg:"+z.Member.(string)).Result()
+		var message struct {
+			Kind    string   `json:"kind"`
+			Payload DelayMsg `json:"payload"`
+		}
+		if json.Unmarshal([]byte(payload), &message) == nil && message.Kind == "game.giveup" && message.Payload.UserId == operateUser.UserId {
+			giveUpAt = int64(z.Score)
+		}
+	}
+	want := (gameRoom.CurrTimeStamp + 1 + CountdownSecond) * 1000
+	if giveUpAt < want-2000 || giveUpAt > want+2000 {
+		t.Fatalf("give up delay message at %d, want about %d", giveUpAt, want)
+	}
+
+	// 重启后当前操作用户可以继续下注
+	if err = testBetting(recovered, operateUser.UserId, 40); err != nil {
+		t.Fatal(err)
+	}
+	gameRoom, err = recovered.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gameRoom.State != constant.GAME_PAYING || gameRoom.CurrLocation == operateUser.Location {
+		t.Fatalf("state = %d, location = %d after betting, want next player", gameRoom.State, gameRoom.CurrLocation)
+	}
+}
+
+func TestGamePool_RecoverNextRound(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 非庄家弃牌,庄家获胜,开始下一局前服务宕机
+	if err := game.UserGiveUpCard(users[1].ID, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	restarted := restartTestGamePool(t, pool)
+
+	if _, err := restarted.Recover(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := restarted.GetGame(game.GameId, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gameRoom, errs := recovered.GetGameRoom(ctx)
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if gameRoom.State == constant.GAME_WAIT && gameRoom.CurrRound == 2 {
+			if gameRoom.CurrBankerId != users[0].ID {
+				t.Fatalf("banker = %d, want winner %d", gameRoom.CurrBankerId, users[0].ID)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %d, round = %d, next round not started", gameRoom.State, gameRoom.CurrRound)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestGame_TurnTimerSentOnce(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重复设置同一轮的超时放弃(恢复、重试)
+	timerIds := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		err := game.Do(func() error {
+			gameRoom, err := game.GetGameRoom(ctx)
+			if err != nil {
+				return err
+			}
+			for _, user := range users {
+				if joinUser := game.GetJoinUser(ctx, user.ID, gameRoom.CurrRound); joinUser.Location == gameRoom.CurrLocation {
+					TimeOutGiveUpDelayFunc(game, gameRoom, joinUser)
+					timerIds = append(timerIds, joinUser.TimerId)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(timerIds) != 2 || len(timerIds[0]) <= 0 || timerIds[0] != timerIds[1] {
+		t.Fatalf("timer ids = %v, want the same message", timerIds)
+	}
+	if _, err := pool.RedisClient.ZScore(ctx, "dp:test-delay-queue:pending", timerIds[0]).Result(); err != nil {
+		t.Fatalf("timer not pending: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/daley"
+	"testing"
+	"time"
+)
+
+// failSaveStore simulates a redis failure after the database transaction is committed
+type failSaveStore struct {
+	GameStore
+	fail bool
+}
+
+func (s *failSaveStore) SaveRoom(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser) error {
+	if s.fail {
+		return constant.CacheGetInfoError
+	}
+	return s.GameStore.SaveRoom(ctx, gameRoom, joinUsers)
+}
+
+func TestGamePool_RepairPendingBuyIn(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+
+	// 买入已记账,更新房间失败
+	store := &failSaveStore{GameStore: game.Store, fail: true}
+	game.Store = store
+	if err := game.UserBuyIn(users[1].ID, 500); err != constant.CacheGetInfoError {
+		t.Fatalf("buy in error = %v, want %v", err, constant.CacheGetInfoError)
+	}
+	store.fail = false
+
+	if joinUser := game.GetJoinUser(ctx, users[1].ID, 1); joinUser.Stack != testBuyIn {
+		t.Fatalf("stack = %d before repair, want %d", joinUser.Stack, testBuyIn)
+	}
+	outboxes, err := pool.UserService.PendingOutbox(time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outboxes) != 1 || outboxes[0].UserId != users[1].ID || outboxes[0].Amount != 500 {
+		t.Fatalf("pending outbox = %+v", outboxes)
+	}
+
+	// 未超过等待时间的记录不处理
+	report, err := pool.Repair(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Games != 0 {
+		t.Fatalf("report = %+v, want no game repaired", report)
+	}
+
+	pool.Clock = daley.NewManualClock(time.Now().Add(time.Minute))
+	if report, err = pool.Repair(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Games != 1 || report.Outbox != 1 || report.Seats != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	if joinUser := game.GetJoinUser(ctx, users[1].ID, 1); joinUser.Stack != testBuyIn+500 {
+		t.Fatalf("stack = %d after repair, want %d", joinUser.Stack, testBuyIn+500)
+	}
+	if outboxes, _ = pool.UserService.PendingOutbox(time.Now().Add(time.Hour), 10); len(outboxes) != 0 {
+		t.Fatalf("pending outbox = %+v after repair", outboxes)
+	}
+}
+
+func TestGamePool_RepairSettledRound(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := game.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seats := make(map[int64]*JoinUser, 0)
+	for _, user := range users {
+		seats[user.ID] = game.GetJoinUser(ctx, user.ID, 1)
+	}
+
+	// 弃牌后当局已在数据库结算,房间回退到结算前(更新房间丢失)
+	if err = game.UserGiveUpCard(users[1].ID, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	gameRoom, err := game.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Version = gameRoom.Version
+	if err = pool.Store.SaveRoom(ctx, snapshot, seats); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := pool.Repair(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rounds != 1 || report.Seats != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	if gameRoom, err = game.GetGameRoom(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if gameRoom.State != constant.GAME_ENDED && gameRoom.CurrRound == 1 {
+		t.Fatalf("state = %d after repair, want %d", gameRoom.State, constant.GAME_ENDED)
+	}
+	winner := game.GetJoinUser(ctx, users[0].ID, 1)
+	if winner.State != constant.EVENT_WIN_USER || winner.Stack != testBuyIn+10 {
+		t.Fatalf("winner state = %d, stack = %d", winner.State, winner.Stack)
+	}
+	if loser := game.GetJoinUser(ctx, users[1].ID, 1); loser.Stack != testBuyIn-10 {
+		t.Fatalf("loser stack = %d, want %d", loser.Stack, testBuyIn-10)
+	}
+
+	// 再次核对无须修复
+	if report, err = pool.Repair(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if report.Rounds != 0 || report.Seats != 0 {
+		t.Fatalf("report = %+v after repaired", report)
+	}
+}
+
+func TestGamePool_RepairVoidRound(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 房间已结束当局而数据库未结算
+	gameRoom, err := game.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gameRoom.State = constant.GAME_ENDED
+	if err = pool.Store.SaveRoom(ctx, gameRoom, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := pool.Repair(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rounds != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// 房间回到等待状态,当局重新开始
+	if gameRoom, err = game.GetGameRoom(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if gameRoom.State != constant.GAME_WAIT || gameRoom.CurrRound != 1 || gameRoom.TotalBetChips != 0 || len(gameRoom.History) != 0 {
+		t.Fatalf("state = %d, round = %d, total bet = %d after repair", gameRoom.State, gameRoom.CurrRound, gameRoom.TotalBetChips)
+	}
+	for _, user := range users {
+		joinUser := game.GetJoinUser(ctx, user.ID, 1)
+		if joinUser.State != constant.EVENT_JOIN_USER || joinUser.Stack != testBuyIn || joinUser.TotalBetChips != 0 {
+			t.Fatalf("userId=%d state = %d, stack = %d, bet = %d", user.ID, joinUser.State, joinUser.Stack, joinUser.TotalBetChips)
+		}
+	}
+
+	if err = game.UserJoinRoom(users[1], true, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if gameRoom, err = game.GetGameRoom(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if gameRoom.State != constant.GAME_PAYING || gameRoom.CurrRound != 1 {
+		t.Fatalf("state = %d, round = %d after restart", gameRoom.State, gameRoom.CurrRound)
+	}
+}
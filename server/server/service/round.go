@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"gorm.io/gorm"
+	"log"
+	"time"
+)
+
+// GameListReq 用户参与过的游戏列表请求
+type GameListReq struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// RoundDetailReq 已结算当局详情请求
+type RoundDetailReq struct {
+	GameId  string `json:"gameId" valid:"required"`
+	RoundID int    `json:"roundID" valid:"required"`
+}
+
+// RoundDetail 已结算当局详情,底牌按结算时的可见规则返回
+type RoundDetail struct {
+	db.GameRound
+	Actions []RoundAction  `json:"actions"`
+	Seats   []db.RoundSeat `json:"seats"`
+}
+
+// addHistory 记录当局玩家操作,now 为房间时钟的当前时间
+func (g *GameRoom) addHistory(action RoundAction, now time.Time) {
+	action.Timestamp = now.UnixMilli()
+	g.History = append(g.History, action)
+}
+
+// visibleCardUsers 每局结束时，玩家只能看见自己比过或跟自己比过的玩家的手牌,没有PK记录的玩家看不到手牌
+func visibleCardUsers(records map[int64][]int64, userId int64) []int64 {
+	compareIds, ok := records[userId]
+	if !ok {
+		return nil
+	}
+	return append([]int64{userId}, compareIds...)
+}
+
+// roundArchive 当局结算记录,compareAll 表示封顶全部开牌(其他游戏中玩家为PK输家)
+func (c *Game) roundArchive(ctx context.Context, gameRoom *GameRoom, joinUsers []*JoinUser, winJoinUser *JoinUser, pkRecords map[int64][]int64, compareAll bool) *db.RoundArchive {
+	records, _ := json.Marshal(pkRecords)
+	actions, _ := json.Marshal(gameRoom.History)
+
+	archive := &db.RoundArchive{
+		Game: db.Game{
+			GameId:      gameRoom.GameId,
+			CreateUser:  gameRoom.CreateUser,
+			Minimum:     gameRoom.Minimum,
+			TotalRounds: gameRoom.TotalRounds,
+			Rounds:      gameRoom.CurrRound,
+			LowBetChips: gameRoom.LowBetChips,
+			TopBetChips: gameRoom.TopBetChips,
+			MinBuyIn:    gameRoom.MinBuyIn,
+			MaxBuyIn:    gameRoom.MaxBuyIn,
+			CreateAt:    gameRoom.CreateAt,
+		},
+		Round: db.GameRound{
+			GameId:        gameRoom.GameId,
+			RoundID:       gameRoom.CurrRound,
+			BankerId:      gameRoom.CurrBankerId,
+			WinUserId:     winJoinUser.UserId,
+			LowBetChips:   gameRoom.LowBetChips,
+			TotalBetChips: gameRoom.TotalBetChips,
+			Records:       string(records),
+			Actions:       string(actions),
+		},
+		Seats: make([]db.RoundSeat, 0, len(joinUsers)),
+	}
+
+	// 当局比牌次数及获胜次数
+	compares := make(map[int64]int, 0)
+	compareWins := make(map[int64]int, 0)
+	for _, action := range gameRoom.History {
+		if action.Type != constant.EVENT_COMPARE_LOSE_USER {
+			continue
+		}
+		compares[action.UserId]++
+		compares[action.CompareId]++
+		compareWins[action.WinUserId]++
+	}
+
+	for index := range joinUsers {
+		joinUser := joinUsers[index]
+		// 当局未参与(未准备)的用户
+		if joinUser.TotalBetChips <= 0 {
+			continue
+		}
+
+		state := joinUser.State
+		if joinUser.UserId == winJoinUser.UserId {
+			state = constant.EVENT_WIN_USER
+		} else if compareAll && state == constant.EVENT_PLAYING_USER {
+			state = constant.EVENT_COMPARE_LOSE_USER
+		}
+
+		seat := db.RoundSeat{
+			GameId:        gameRoom.GameId,
+			RoundID:       gameRoom.CurrRound,
+			UserId:        joinUser.UserId,
+			Address:       joinUser.Address,
+			HeadPic:       joinUser.HeadPic,
+			Location:      joinUser.Location,
+			IsBanker:      joinUser.IsBanker,
+			IsLookCard:    joinUser.IsLookCard,
+			State:         state,
+			TotalBetChips: joinUser.TotalBetChips,
+			Stack:         joinUser.Stack,
+			Compares:      compares[joinUser.UserId],
+			CompareWins:   compareWins[joinUser.UserId],
+		}
+		if userPoker, err := c.GetUserPokerCache(ctx, gameRoom, joinUser.UserId); err == nil {
+			seat.Cards = userPoker.ToString()
+			seat.PokerType = userPoker.getPokerType()
+		} else {
+			log.Printf("Get userId=%d poker cache error: %s", joinUser.UserId, err)
+		}
+		archive.Seats = append(archive.Seats, seat)
+	}
+	archive.Round.Players = len(archive.Seats)
+	return archive
+}
+
+// ListUserGames 用户参与过的游戏,按最近参与倒序
+func (u *UserService) ListUserGames(userId int64, offset int, limit int) ([]db.UserGame, error) {
+	return u.roundDB.ListUserGames(userId, offset, limit)
+}
+
+// GetRoundDetail 已结算当局详情,userId 只能看见自己比过或跟自己比过的玩家的底牌(与结算广播一致);
+// userId 未参与当局时与当局不存在一致,返回 gorm.ErrRecordNotFound
+func (u *UserService) GetRoundDetail(userId int64, gameId string, roundId int) (RoundDetail, error) {
+	round, seats, err := u.roundDB.GetRound(gameId, roundId)
+	if err != nil {
+		return RoundDetail{}, err
+	}
+	seated := false
+	for index := range seats {
+		seated = seated || seats[index].UserId == userId
+	}
+	if !seated {
+		return RoundDetail{}, gorm.ErrRecordNotFound
+	}
+
+	detail := RoundDetail{GameRound: round, Actions: make([]RoundAction, 0), Seats: seats}
+	if len(round.Actions) > 0 {
+		if errs := json.Unmarshal([]byte(round.Actions), &detail.Actions); errs != nil {
+			log.Printf("gameId=%s round=%d parse actions error: %s", gameId, roundId, errs)
+		}
+	}
+
+	pkRecords := make(map[int64][]int64, 0)
+	if len(round.Records) > 0 {
+		if errs := json.Unmarshal([]byte(round.Records), &pkRecords); errs != nil {
+			log.Printf("gameId=%s round=%d parse records error: %s", gameId, roundId, errs)
+		}
+	}
+	visible := make(map[int64]bool, 0)
+	for _, cardUserId := range visibleCardUsers(pkRecords, userId) {
+		visible[cardUserId] = true
+	}
+	for index := range detail.Seats {
+		if !visible[detail.Seats[index].UserId] {
+			detail.Seats[index].Cards = ""
+			detail.Seats[index].PokerType = 0
+		}
+	}
+	return detail, nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"game-3-card-poker/server/constant"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// testOperateUser the player of the current location
+func testOperateUser(t *testing.T, game *Game) *JoinUser {
+	t.Helper()
+
+	ctx := context.Background()
+	gameRoom, err := game.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for userId := range gameRoom.JoinUsers {
+		if joinUser := game.GetJoinUser(ctx, userId, gameRoom.CurrRound); joinUser != nil && joinUser.Location == gameRoom.CurrLocation {
+			return joinUser
+		}
+	}
+	t.Fatalf("no player at location %d", gameRoom.CurrLocation)
+	return nil
+}
+
+func TestGame_RoundArchive(t *testing.T) {
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 当前玩家与下家比牌获胜,第三个玩家弃牌
+	first := testOperateUser(t, game)
+	var compareId int64
+	for _, user := range users {
+		if user.ID != first.UserId && compareId == 0 {
+			compareId = user.ID
+		}
+	}
+	err := game.UserBetting(first.UserId, compareId, 1, 40, nil, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
+		gameRoom.Records = game.GetGamePkCompareRecord(gameRoom.Records, []int64{first.UserId, compareId})
+		return callUpdateFunc(true, &UserPoker{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	giveUp := testOperateUser(t, game)
+	if giveUp.UserId == first.UserId || giveUp.UserId == compareId {
+		t.Fatalf("next player = %d, want the third player", giveUp.UserId)
+	}
+	if err = game.UserGiveUpCard(giveUp.UserId, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	games, err := pool.UserService.ListUserGames(giveUp.UserId, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 1 || games[0].GameId != game.GameId || games[0].PlayRounds != 1 || games[0].NetChips != -10 {
+		t.Fatalf("games = %+v", games)
+	}
+
+	detail, err := pool.UserService.GetRoundDetail(compareId, game.GameId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.WinUserId != first.UserId || detail.TotalBetChips != 70 || detail.WinChips != 70 || detail.Players != 3 {
+		t.Fatalf("round = %+v", detail.GameRound)
+	}
+	if len(detail.Actions) != 2 || detail.Actions[0].Type != constant.EVENT_COMPARE_LOSE_USER || detail.Actions[1].Type != constant.EVENT_GIVE_UP_USER {
+		t.Fatalf("actions = %+v", detail.Actions)
+	}
+
+	// PK输家看见自己及比过的玩家的底牌,弃牌玩家的底牌不可见
+	for _, seat := range detail.Seats {
+		visible := seat.UserId != giveUp.UserId
+		if (len(seat.Cards) > 0) != visible {
+			t.Fatalf("userId=%d cards = %q, want visible %v", seat.UserId, seat.Cards, visible)
+		}
+		if seat.UserId == first.UserId && (seat.State != constant.EVENT_WIN_USER || seat.WinChips != 70-50) {
+			t.Fatalf("winner seat = %+v", seat)
+		}
+	}
+
+	// 没有PK记录的玩家看不到任何底牌
+	if detail, err = pool.UserService.GetRoundDetail(giveUp.UserId, game.GameId, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, seat := range detail.Seats {
+		if len(seat.Cards) > 0 || seat.PokerType != 0 {
+			t.Fatalf("userId=%d cards = %q visible to the folded player", seat.UserId, seat.Cards)
+		}
+	}
+
+	// 未参与当局的用户查询不到当局详情
+	if _, err = pool.UserService.GetRoundDetail(-1, game.GameId, 1); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("detail error = %v for a user not in the round, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
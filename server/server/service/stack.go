@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"game-3-card-poker/server/constant"
+	"log"
+)
+
+// BuyInRange 房间买入筹码范围,未设置最低买入时为底注,maxBuyIn<=0 表示不限制
+func (g GameRoom) BuyInRange() (int64, int64) {
+	minBuyIn := g.MinBuyIn
+	if minBuyIn < g.LowBetChips {
+		minBuyIn = g.LowBetChips
+	}
+	return minBuyIn, g.MaxBuyIn
+}
+
+// UserBuyIn 局间买入/补充桌上筹码,amount<=0 时补足到最低买入
+func (c *Game) UserBuyIn(userId int64, amount int64, opts ...ActionOption) error {
+	return c.Do(func() error { return c.userBuyIn(userId, amount) }, opts...)
+}
+
+// userBuyIn 由房间协程执行
+func (c *Game) userBuyIn(userId int64, amount int64) error {
+	ctx := context.Background()
+
+	gameRoom, joinUser, err := c.getStackUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	// 未指定买入筹码,补足到最低买入(已足够则无须买入)
+	minBuyIn, maxBuyIn := gameRoom.BuyInRange()
+	if amount <= 0 {
+		amount = minBuyIn - joinUser.Stack
+		if amount <= 0 {
+			return nil
+		}
+	}
+
+	// 买入后桌上筹码需在房间限制范围内
+	if stack := joinUser.Stack + amount; stack < minBuyIn || (maxBuyIn > 0 && stack > maxBuyIn) {
+		return constant.BuyInOutOfRangeError
+	}
+
+	// 整体放入同一个事物中
+	// 账户余额转入桌上筹码-操作数据库
+	err = c.UserService.BuyIn(gameRoom.GameId, userId, amount, c.ledgerKey(), func() error {
+		// 数据库已提交,版本号冲突时不能重新执行命令
+		c.written = true
+		joinUser.Stack += amount
+		return c.setJoinUserCache(ctx, gameRoom, joinUser)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 广播消息通知所有用户
+	c.BroadcastMsg(ctx, gameRoom, &EventMsg{
+		Type:     constant.EVENT_STACK,
+		UserId:   userId,
+		BetChips: amount,
+	})
+	return nil
+}
+
+// UserCashOut 局间兑出全部桌上筹码,离座等待(需重新买入才能准备)
+func (c *Game) UserCashOut(userId int64, opts ...ActionOption) error {
+	return c.Do(func() error { return c.userCashOut(userId) }, opts...)
+}
+
+// userCashOut 由房间协程执行
+func (c *Game) userCashOut(userId int64) error {
+	ctx := context.Background()
+
+	gameRoom, joinUser, err := c.getStackUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	amount := joinUser.Stack
+	if err = c.cashOut(ctx, gameRoom, joinUser, c.ledgerKey()); err != nil {
+		return err
+	}
+
+	// 广播消息通知所有用户
+	c.BroadcastMsg(ctx, gameRoom, &EventMsg{
+		Type:     constant.EVENT_STACK,
+		UserId:   userId,
+		BetChips: -amount,
+	})
+	return nil
+}
+
+// getStackUser 获取局间可以买入/兑出筹码的房间用户
+func (c *Game) getStackUser(ctx context.Context, userId int64) (*GameRoom, *JoinUser, error) {
+	gameRoom, err := c.GetGameRoom(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 当局进行中或者等待开始下一局
+	if gameRoom.State != constant.GAME_WAIT {
+		return gameRoom, nil, constant.StackChangePlayingError
+	}
+
+	joinUser := c.GetJoinUser(ctx, userId, gameRoom.CurrRound)
+	if joinUser == nil {
+		return gameRoom, nil, constant.GameNotInJoinError
+	}
+	return gameRoom, joinUser, nil
+}
+
+// cashOut 桌上筹码兑回账户余额,准备状态的用户恢复为等待状态
+func (c *Game) cashOut(ctx context.Context, gameRoom *GameRoom, joinUser *JoinUser, idempotencyKey string) error {
+	if joinUser.Stack <= 0 {
+		return nil
+	}
+
+	// 整体放入同一个事物中
+	// 桌上筹码转回账户余额-操作数据库
+	return c.UserService.CashOut(gameRoom.GameId, joinUser.UserId, joinUser.Stack, idempotencyKey, func() error {
+		c.written = true
+		joinUser.Stack = 0
+		if joinUser.State == constant.EVENT_READY_USER {
+			joinUser.State = constant.EVENT_JOIN_USER
+		}
+		return c.setJoinUserCache(ctx, gameRoom, joinUser)
+	})
+}
+
+// cashOutAll 游戏结束时所有用户的桌上筹码兑回账户余额
+func (c *Game) cashOutAll(ctx context.Context, gameRoom *GameRoom, joinUsers []*JoinUser) {
+	for index := range joinUsers {
+		if err := c.cashOut(ctx, gameRoom, joinUsers[index], ""); err != nil {
+			log.Printf("cash out userId=%d stack error: %s", joinUsers[index].UserId, err)
+		}
+	}
+}
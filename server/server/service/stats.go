@@ -0,0 +1,112 @@
+package service
+
+import (
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"math"
+)
+
+// ProfileReq 其他玩家的公开资料请求
+type ProfileReq struct {
+	UserId int64 `json:"userId" valid:"required"`
+}
+
+// PlayerStats 玩家对局统计,比率为百分比(保留两位小数)
+type PlayerStats struct {
+	db.UserStats
+	WinRate        float64 `json:"winRate"`        // 胜率
+	BlindRate      float64 `json:"blindRate"`      // 闷牌比例
+	CompareWinRate float64 `json:"compareWinRate"` // 比牌胜率
+}
+
+// PlayerProfile 玩家公开资料,不包含余额
+type PlayerProfile struct {
+	UserId  int64       `json:"userId"`
+	Address string      `json:"address"`
+	HeadPic string      `json:"headPic"`
+	Stats   PlayerStats `json:"stats"`
+}
+
+// percent 百分比,保留两位小数
+func percent(count int, total int) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return math.Round(float64(count)*10000/float64(total)) / 100
+}
+
+// roundStats 当局玩家的统计增量
+func roundStats(archive *db.RoundArchive) []db.UserStats {
+	stats := make([]db.UserStats, 0, len(archive.Seats))
+	for index := range archive.Seats {
+		seat := archive.Seats[index]
+		userStats := db.UserStats{
+			UserId:      seat.UserId,
+			HandsPlayed: 1,
+			NetChips:    seat.WinChips,
+			Compares:    seat.Compares,
+			CompareWins: seat.CompareWins,
+		}
+		if seat.UserId == archive.Round.WinUserId {
+			userStats.HandsWon = 1
+			userStats.WinStreak = 1
+			userStats.BiggestPot = archive.Round.WinChips
+		}
+		if !seat.IsLookCard {
+			userStats.BlindHands = 1
+		}
+
+		switch seat.PokerType {
+		case PokerSingle:
+			userStats.Singles = 1
+		case PokerDouble:
+			userStats.Doubles = 1
+		case PokerStraight:
+			userStats.Straights = 1
+		case PokerFlush:
+			userStats.Flushes = 1
+		case PokerFlushStraight:
+			userStats.FlushStraights = 1
+		case PokerTriple:
+			userStats.Triples = 1
+		}
+		stats = append(stats, userStats)
+	}
+	return stats
+}
+
+// RebuildStats 启用统计前已结算的当局,由当局记录汇总玩家统计
+func (u *UserService) RebuildStats() (int, error) {
+	return u.userStatsDB.Rebuild()
+}
+
+// GetStats 玩家对局统计
+func (u *UserService) GetStats(userId int64) (PlayerStats, error) {
+	stats, err := u.userStatsDB.GetStats(userId)
+	if err != nil {
+		return PlayerStats{}, err
+	}
+	return PlayerStats{
+		UserStats:      stats,
+		WinRate:        percent(stats.HandsWon, stats.HandsPlayed),
+		BlindRate:      percent(stats.BlindHands, stats.HandsPlayed),
+		CompareWinRate: percent(stats.CompareWins, stats.Compares),
+	}, nil
+}
+
+// GetProfile 其他玩家的公开资料及对局统计
+func (u *UserService) GetProfile(userId int64) (PlayerProfile, error) {
+	user, err := u.userDB.QueryById(userId)
+	if err != nil {
+		return PlayerProfile{}, err
+	}
+	if user.ID == 0 {
+		return PlayerProfile{}, constant.UserNotExistError
+	}
+
+	stats, err := u.GetStats(userId)
+	if err != nil {
+		return PlayerProfile{}, err
+	}
+	return PlayerProfile{UserId: user.ID, Address: user.Address, HeadPic: user.HeadPic, Stats: stats}, nil
+}
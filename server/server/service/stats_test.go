@@ -0,0 +1,95 @@
+package service
+
+import (
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestUserService_PlayerStats(t *testing.T) {
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 当前玩家与下家比牌获胜,第三个玩家弃牌
+	first := testOperateUser(t, game)
+	var compareId int64
+	for _, user := range users {
+		if user.ID != first.UserId && compareId == 0 {
+			compareId = user.ID
+		}
+	}
+	err := game.UserBetting(first.UserId, compareId, 1, 40, nil, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
+		gameRoom.Records = game.GetGamePkCompareRecord(gameRoom.Records, []int64{first.UserId, compareId})
+		return callUpdateFunc(true, &UserPoker{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	giveUp := testOperateUser(t, game)
+	if err = game.UserGiveUpCard(giveUp.UserId, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkStats := func() {
+		t.Helper()
+		stats, errs := pool.UserService.GetStats(first.UserId)
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if stats.HandsPlayed != 1 || stats.HandsWon != 1 || stats.NetChips != 20 || stats.BiggestPot != 70 ||
+			stats.Compares != 1 || stats.CompareWins != 1 || stats.WinRate != 100 || stats.BlindRate != 100 || stats.CompareWinRate != 100 {
+			t.Fatalf("winner stats = %+v", stats)
+		}
+		if pokerTypes := stats.Singles + stats.Doubles + stats.Straights + stats.Flushes + stats.FlushStraights + stats.Triples; pokerTypes != 1 {
+			t.Fatalf("winner poker types = %d, want 1", pokerTypes)
+		}
+
+		if stats, errs = pool.UserService.GetStats(compareId); errs != nil {
+			t.Fatal(errs)
+		}
+		if stats.HandsWon != 0 || stats.NetChips != -10 || stats.Compares != 1 || stats.CompareWins != 0 || stats.CompareWinRate != 0 {
+			t.Fatalf("compare loser stats = %+v", stats)
+		}
+
+		if stats, errs = pool.UserService.GetStats(giveUp.UserId); errs != nil {
+			t.Fatal(errs)
+		}
+		if stats.HandsPlayed != 1 || stats.NetChips != -10 || stats.Compares != 0 || stats.BiggestPot != 0 {
+			t.Fatalf("folded stats = %+v", stats)
+		}
+	}
+	checkStats()
+
+	// 由当局记录重新汇总的统计与结算时累加的一致
+	if err = pool.UserService.userDB.Transaction(func(tx *gorm.DB) error {
+		return tx.Where("1 = 1").Delete(&db.UserStats{}).Error
+	}); err != nil {
+		t.Fatal(err)
+	}
+	count, err := pool.UserService.RebuildStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("rebuild %d users, want 3", count)
+	}
+	checkStats()
+	if count, err = pool.UserService.RebuildStats(); err != nil || count != 0 {
+		t.Fatalf("rebuild again = %d, %v", count, err)
+	}
+
+	profile, err := pool.UserService.GetProfile(first.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Address != first.Address || profile.Stats.HandsWon != 1 {
+		t.Fatalf("profile = %+v", profile)
+	}
+	if _, err = pool.UserService.GetProfile(-1); err != constant.UserNotExistError {
+		t.Fatalf("profile error = %v, want %v", err, constant.UserNotExistError)
+	}
+}
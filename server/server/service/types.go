@@ -2,6 +2,7 @@ package service
 
 import (
 	"encoding/json"
+	"game-3-card-poker/server/db"
 	"github.com/google/uuid"
 	"strings"
 	"time"
@@ -12,6 +13,23 @@ const (
 	AnimationSecond = 6
 )
 
+const (
+	roomEventChannel  = "game-event:%s"       // 房间事件发布订阅频道
+	lockExpiration    = 10 * time.Second      // 游戏操作锁过期时间
+	lockWaitTimeout   = 5 * time.Second       // 等待获取游戏操作锁超时
+	lockRetryInterval = 20 * time.Millisecond // 重试获取游戏操作锁间隔
+)
+
+// unlockScript atomically deletes the lock only if it is still held by the given token
+// keys: lockKey
+// argv: token
+const unlockScript = `
+if redis.call('Get', KEYS[1]) == ARGV[1] then
+	return redis.call('Del', KEYS[1])
+end
+return 0
+`
+
 type DelayMsg struct {
 	GameId    string `json:"gameId"`    // 游戏ID
 	DelayType int    `json:"delayType"` // 延迟类型
@@ -31,39 +49,66 @@ func (d *DelayMsg) ToDelayMsg(jsonStr string) error {
 }
 
 type JoinUser struct {
-	UserId          int64  `json:"userId"`          // 用户ID
-	State           int    `json:"state"`           // 用户状态
-	Address         string `json:"address"`         // 钱包地址
-	HeadPic         string `json:"headPic"`         // 用户头像
-	IsBanker        bool   `json:"isBanker"`        // 是否庄家
-	IsLookCard      bool   `json:"isLookCard"`      // 是否看牌
-	IsAutoBet       bool   `json:"isAutoBet"`       // 是否自动跟注
-	Location        int    `json:"location"`        // 当前位置
-	TotalBetChips   int64  `json:"totalBetChips"`   // 总投注筹码
-	AccountBetChips int64  `json:"accountBetChips"` // 账号余额
+	UserId          int64  `json:"userId"`            // 用户ID
+	State           int    `json:"state"`             // 用户状态
+	Address         string `json:"address"`           // 钱包地址
+	HeadPic         string `json:"headPic"`           // 用户头像
+	IsBanker        bool   `json:"isBanker"`          // 是否庄家
+	IsLookCard      bool   `json:"isLookCard"`        // 是否看牌
+	IsAutoBet       bool   `json:"isAutoBet"`         // 是否自动跟注
+	Location        int    `json:"location"`          // 当前位置
+	TotalBetChips   int64  `json:"totalBetChips"`     // 总投注筹码
+	AccountBetChips int64  `json:"accountBetChips"`   // 账号余额(广播时为桌上筹码)
+	Stack           int64  `json:"stack"`             // 桌上筹码,下注从桌上筹码扣除
+	Presence        int    `json:"presence"`          // 在线状态
+	TimerId         string `json:"timerId,omitempty"` // 当前操作倒计时的延迟消息ID
 }
 
 type GameRoom struct {
-	GameId            string            `json:"gameId"`            // 游戏ID
-	JoinUsers         map[int64]int     `json:"joinUsers"`         // 加入用户ID
-	Minimum           int               `json:"minimum"`           // 最低人数
-	State             int               `json:"state"`             // 游戏状态
-	TotalRounds       int               `json:"totalRounds"`       // 总游戏局数
-	CurrRound         int               `json:"currRound"`         // 当前第几局
-	CurrLocation      int               `json:"currLocation"`      // 当前操作用户
-	CurrTimeStamp     int64             `json:"currTimeStamp"`     // 当前操作开始时间戳
-	CurrBetChips      int64             `json:"currBetChips"`      // 当前下注筹码
-	CurrBankerId      int64             `json:"currBankerId"`      // 当前庄家ID
-	TotalBetChips     int64             `json:"totalBetChips"`     // 总下注筹码
-	LowBetChips       int64             `json:"lowBetChips"`       // 最低下注筹码
-	TopBetChips       int64             `json:"topBetChips"`       // 封顶下注筹码
-	ExposedBetChips   int64             `json:"exposedBetChips"`   // 明牌下注筹码
-	ConcealedBetChips int64             `json:"concealedBetChips"` // 隐藏下注筹码
-	SetLocationTime   int64             `json:"setLocationTime"`   // 设置操作用户时间戳
-	Records           map[int64][]int64 `json:"records"`           // PK记录
-	BetChips          []int64           `json:"betChips"`          // 下注筹码记录
-	CreateUser        int64             `json:"createUser"`        // 创建用户
-	CreateAt          time.Time         `json:"createAt"`          // 创建时间
+	GameId            string                  `json:"gameId"`            // 游戏ID
+	JoinUsers         map[int64]int           `json:"joinUsers"`         // 加入用户ID
+	Minimum           int                     `json:"minimum"`           // 最低人数
+	State             int                     `json:"state"`             // 游戏状态
+	TotalRounds       int                     `json:"totalRounds"`       // 总游戏局数
+	CurrRound         int                     `json:"currRound"`         // 当前第几局
+	CurrLocation      int                     `json:"currLocation"`      // 当前操作用户
+	CurrTimeStamp     int64                   `json:"currTimeStamp"`     // 当前操作开始时间戳
+	CurrBetChips      int64                   `json:"currBetChips"`      // 当前下注筹码
+	CurrBankerId      int64                   `json:"currBankerId"`      // 当前庄家ID
+	TotalBetChips     int64                   `json:"totalBetChips"`     // 总下注筹码
+	LowBetChips       int64                   `json:"lowBetChips"`       // 最低下注筹码
+	TopBetChips       int64                   `json:"topBetChips"`       // 封顶下注筹码
+	MinBuyIn          int64                   `json:"minBuyIn"`          // 最低买入筹码
+	MaxBuyIn          int64                   `json:"maxBuyIn"`          // 最高买入筹码(桌上筹码上限)
+	ExposedBetChips   int64                   `json:"exposedBetChips"`   // 明牌下注筹码
+	ConcealedBetChips int64                   `json:"concealedBetChips"` // 隐藏下注筹码
+	SetLocationTime   int64                   `json:"setLocationTime"`   // 设置操作用户时间戳
+	Records           map[int64][]int64       `json:"records"`           // PK记录
+	BetChips          []int64                 `json:"betChips"`          // 下注筹码记录
+	Actions           map[string]ActionRecord `json:"actions,omitempty"` // 当局已处理的客户端操作
+	History           []RoundAction           `json:"history,omitempty"` // 当局操作记录,结算时保存
+	CreateUser        int64                   `json:"createUser"`        // 创建用户
+	CreateAt          time.Time               `json:"createAt"`          // 创建时间
+	Version           int64                   `json:"version"`           // 版本号,每次保存加1
+}
+
+// RoundAction 当局玩家操作: 看牌、弃牌、跟注/加注、比牌
+type RoundAction struct {
+	UserId    int64 `json:"userId"`              // 操作用户
+	Type      int   `json:"type"`                // 事件类型
+	BetChips  int64 `json:"betChips,omitempty"`  // 下注筹码
+	CompareId int64 `json:"compareId,omitempty"` // PK目标用户
+	WinUserId int64 `json:"winUserId,omitempty"` // PK赢家用户ID
+	Timestamp int64 `json:"timestamp"`           // 操作时间戳(毫秒)
+}
+
+type RoomEvent struct {
+	GameId    string          `json:"gameId"`             // 游戏ID
+	UserId    int64           `json:"userId,omitempty"`   // 指定接收用户,为空表示广播
+	Instance  string          `json:"instance,omitempty"` // 指定接收实例,为空表示所有实例
+	State     int             `json:"state"`              // 游戏状态
+	CurrRound int             `json:"currRound"`          // 当前第几局
+	Payload   json.RawMessage `json:"payload"`            // 消息内容
 }
 
 type Message struct {
@@ -80,7 +125,8 @@ func (m *Message) ToJsonStr(msgType int) []byte {
 
 type ErrorMessage struct {
 	Message
-	ErrorMsg string `json:"message"` // 错误消息内容
+	ErrorMsg string `json:"message"`        // 错误消息内容
+	Code     int    `json:"code,omitempty"` // 错误码
 }
 
 func (d *ErrorMessage) ToJsonStr(msgType int) []byte {
@@ -124,19 +170,26 @@ func (a *AutoBetMessage) ToJsonStr(msgType int) []byte {
 }
 
 type EventMsg struct {
-	Type            int             `json:"type"`                      // 事件类型
-	UserId          int64           `json:"userId,omitempty"`          // 事件用户
-	WinUserId       int64           `json:"WinUserId,omitempty"`       // PK赢家用户ID
-	CompareId       int64           `json:"compareId,omitempty"`       // PK目标用户
-	BetChips        int64           `json:"betChips,omitempty"`        // 下注筹码
-	Location        int             `json:"location,omitempty"`        // 当前操作用户
-	TotalSecond     int64           `json:"totalSecond,omitempty"`     // 总计->倒计时秒
-	CountdownSecond int64           `json:"countdownSecond,omitempty"` // 剩余->倒计时秒
-	AnimationSecond int64           `json:"animationSecond,omitempty"` // 动画(pk效果,最终赢家效果)->倒计时秒
-	MyselfCard      string          `json:"myselfCard,omitempty"`      // 用户底牌内容
-	IsGameOver      bool            `json:"isGameOver,omitempty"`      // 是否游戏结束
-	ListBetChips    []int64         `json:"listBetChips,omitempty"`    // 加注筹码列表值
-	Records         []HistoryRecord `json:"records,omitempty"`         // 获取记录
+	Type            int                 `json:"type"`                      // 事件类型
+	UserId          int64               `json:"userId,omitempty"`          // 事件用户
+	WinUserId       int64               `json:"WinUserId,omitempty"`       // PK赢家用户ID
+	CompareId       int64               `json:"compareId,omitempty"`       // PK目标用户
+	BetChips        int64               `json:"betChips,omitempty"`        // 下注筹码
+	Location        int                 `json:"location,omitempty"`        // 当前操作用户
+	TotalSecond     int64               `json:"totalSecond,omitempty"`     // 总计->倒计时秒
+	CountdownSecond int64               `json:"countdownSecond,omitempty"` // 剩余->倒计时秒
+	AnimationSecond int64               `json:"animationSecond,omitempty"` // 动画(pk效果,最终赢家效果)->倒计时秒
+	MyselfCard      string              `json:"myselfCard,omitempty"`      // 用户底牌内容
+	IsGameOver      bool                `json:"isGameOver,omitempty"`      // 是否游戏结束
+	ListBetChips    []int64             `json:"listBetChips,omitempty"`    // 加注筹码列表值
+	Records         []HistoryRecord     `json:"records,omitempty"`         // 获取记录
+	Presence        int                 `json:"presence,omitempty"`        // 用户在线状态
+	Achievement     *db.UserAchievement `json:"achievement,omitempty"`     // 解锁的成就
+}
+
+type Presence struct {
+	State     int   `json:"state"`     // 在线状态
+	Timestamp int64 `json:"timestamp"` // 状态变更时间戳(毫秒)
 }
 
 type BroadcastMsg struct {
@@ -153,3 +206,10 @@ type Response struct {
 	Message string `json:"message"`
 	Data    any    `json:"data"`
 }
+
+// DeadLetterReq 延迟队列死信查询、重新投递及清除请求,清除时Ids为空表示清除全部
+type DeadLetterReq struct {
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+	Ids    []string `json:"ids"`
+}
@@ -1,21 +1,32 @@
 package service
 
 import (
+	"context"
 	"game-3-card-poker/server/constant"
 	"game-3-card-poker/server/db"
 	"gorm.io/gorm"
+	"log"
 	"sort"
 	"sync"
 	"time"
 )
 
 type UserService struct {
-	userDB *db.UserDB
-	mux    sync.Mutex
+	userDB        *db.UserDB
+	ledgerDB      *db.LedgerDB
+	outboxDB      *db.OutboxDB
+	roundDB       *db.RoundDB
+	userHistoryDB *db.UserHistoryDB
+	userStatsDB   *db.UserStatsDB
+	leaderboard   *Leaderboard
+	achievementDB *db.AchievementDB
+	mux           sync.Mutex
+
+	achievementRules []AchievementRule // 成就规则,服务启动时由配置文件设置
 }
 
-func NewUserService(userDB *db.UserDB) *UserService {
-	return &UserService{userDB: userDB}
+func NewUserService(userDB *db.UserDB, ledgerDB *db.LedgerDB, outboxDB *db.OutboxDB, roundDB *db.RoundDB, userHistoryDB *db.UserHistoryDB, userStatsDB *db.UserStatsDB, leaderboard *Leaderboard, achievementDB *db.AchievementDB) *UserService {
+	return &UserService{userDB: userDB, ledgerDB: ledgerDB, outboxDB: outboxDB, roundDB: roundDB, userHistoryDB: userHistoryDB, userStatsDB: userStatsDB, leaderboard: leaderboard, achievementDB: achievementDB}
 }
 
 type HistoryRecord struct {
@@ -41,10 +52,41 @@ type RequestHistory struct {
 	GameId string `json:"gameId" valid:"required"`
 }
 
+// TransactionListReq 用户筹码记录请求,时间为毫秒时间戳,cursor 为上一页返回的 nextCursor
+type TransactionListReq struct {
+	States    []int  `json:"states"`
+	GameId    string `json:"gameId"`
+	StartTime int64  `json:"startTime"`
+	EndTime   int64  `json:"endTime"`
+	Cursor    int64  `json:"cursor"`
+	Limit     int    `json:"limit"`
+}
+
+// TransactionList 用户筹码记录,nextCursor 为0表示没有下一页
+type TransactionList struct {
+	List       []db.UserHistory `json:"list"`
+	NextCursor int64            `json:"nextCursor"`
+}
+
 type UserReq struct {
 	Address string `json:"address" valid:"required"`
 }
 
+// OpenLedgerBalances 为启用账本前已有余额的用户记录期初余额
+func (u *UserService) OpenLedgerBalances() (int, error) {
+	return u.ledgerDB.OpenBalances()
+}
+
+// OpenStacks 所有余额不为0的桌上筹码账户
+func (u *UserService) OpenStacks() (map[string]map[int64]int64, error) {
+	return u.ledgerDB.OpenStacks()
+}
+
+// VerifyLedger 校验账本与用户余额
+func (u *UserService) VerifyLedger() (db.LedgerReport, error) {
+	return u.ledgerDB.Verify()
+}
+
 func (u *UserService) GetById(userId int64) (db.User, error) {
 	return u.userDB.QueryById(userId)
 }
@@ -67,109 +109,207 @@ func (u *UserService) GetUsersByIds(userIds []int64) (map[int64]db.User, error)
 	return userMap, nil
 }
 
-func (u *UserService) DeductAnteBetting(gameId string, currRound int, userIds []int64, betChips int64, callUpdateFunc func(map[int64]int64) error) error {
+// BuyIn 账户余额买入桌上筹码,余额不足返回 *constant.InsufficientFundsError。
+// idempotencyKey 已记录过返回 constant.DuplicateActionError,不重复扣除余额
+func (u *UserService) BuyIn(gameId string, userId int64, amount int64, idempotencyKey string, callUpdateFunc func() error) error {
+	outbox := &db.GameOutbox{GameId: gameId, Kind: db.OutboxBuyIn, UserId: userId, Amount: amount}
+	return u.commit(outbox, callUpdateFunc, func(tx *gorm.DB) error {
+		if errs := u.checkPosted(tx, idempotencyKey); errs != nil {
+			return errs
+		}
 
-	users, err := u.userDB.GetListByUserIds(userIds)
-	if err != nil {
-		return err
-	}
+		if _, errs := u.userDB.DeductBalance(tx, userId, amount); errs != nil {
+			return errs
+		}
 
-	return u.userDB.Transaction(func(tx *gorm.DB) error {
+		// 账户余额转入桌上筹码
+		journal := db.LedgerJournal{Kind: db.JournalBuyIn, GameId: gameId, IdempotencyKey: db.IdempotencyKey(idempotencyKey)}
+		if errs := u.ledgerDB.Post(tx, journal,
+			db.Posting{Account: db.UserAccount(userId), Amount: -amount},
+			db.Posting{Account: db.StackAccount(gameId, userId), Amount: amount}); errs != nil {
+			return errs
+		}
+		return nil
+	})
+}
 
-		balanceMap := make(map[int64]int64, 0)
-		for index := range users {
-			user := users[index]
-
-			userBetChips := int64(0)
-			userBalances := int64(0)
-			if user.Balance < 0 {
-				userBalances = 0
-				userBetChips = 0
-			} else if user.Balance < betChips {
-				userBalances = 0
-				userBetChips = user.Balance
-			} else {
-				userBalances = user.Balance - betChips
-				userBetChips = betChips
-			}
+// CashOut 桌上筹码兑回账户余额,idempotencyKey 已记录过返回 constant.DuplicateActionError
+func (u *UserService) CashOut(gameId string, userId int64, amount int64, idempotencyKey string, callUpdateFunc func() error) error {
+	outbox := &db.GameOutbox{GameId: gameId, Kind: db.OutboxCashOut, UserId: userId, Amount: amount}
+	return u.commit(outbox, callUpdateFunc, func(tx *gorm.DB) error {
+		if errs := u.checkPosted(tx, idempotencyKey); errs != nil {
+			return errs
+		}
+
+		if _, errs := u.userDB.AddBalance(tx, userId, amount); errs != nil {
+			return errs
+		}
 
-			// 实际用户下注筹码
-			balanceMap[user.ID] = userBetChips
+		// 桌上筹码转回账户余额
+		journal := db.LedgerJournal{Kind: db.JournalCashOut, GameId: gameId, IdempotencyKey: db.IdempotencyKey(idempotencyKey)}
+		if errs := u.ledgerDB.Post(tx, journal,
+			db.Posting{Account: db.StackAccount(gameId, userId), Amount: -amount},
+			db.Posting{Account: db.UserAccount(userId), Amount: amount}); errs != nil {
+			return errs
+		}
+		return nil
+	})
+}
 
-			if errs := tx.Model(&db.User{}).Where("id = ?", user.ID).UpdateColumn("balance", userBalances).Error; errs != nil {
+// ReturnStacks 已过期或已结束房间的桌上筹码兑回账户余额(房间已不能更新),返回兑回的用户数
+func (u *UserService) ReturnStacks(gameId string, userIds []int64) (int, error) {
+	count := 0
+	err := u.userDB.Transaction(func(tx *gorm.DB) error {
+		count = 0
+		for _, userId := range userIds {
+			// 在事务中重新读取桌上筹码,期间可能已兑出
+			amount, errs := u.ledgerDB.Balance(tx, db.StackAccount(gameId, userId))
+			if errs != nil {
+				return errs
+			}
+			returnKey := db.ReturnStackKey(gameId, userId)
+			posted, errs := u.ledgerDB.Posted(tx, returnKey)
+			if errs != nil {
 				return errs
 			}
+			if amount <= 0 || posted {
+				continue
+			}
 
-			// record user history
-			history := db.UserHistory{
-				UserId:        user.ID,
-				Address:       user.Address,
-				GameId:        gameId,
-				RoundID:       currRound,
-				State:         constant.BET_STATE_ANTE,
-				Amount:        userBetChips,
-				BalanceBefore: user.Balance,
+			if _, errs = u.userDB.AddBalance(tx, userId, amount); errs != nil {
+				return errs
 			}
-			if errs := tx.Model(&db.UserHistory{}).Create(&history).Error; errs != nil {
+			if errs = u.ledgerDB.Post(tx, db.LedgerJournal{Kind: db.JournalCashOut, GameId: gameId, IdempotencyKey: &returnKey},
+				db.Posting{Account: db.StackAccount(gameId, userId), Amount: -amount},
+				db.Posting{Account: db.UserAccount(userId), Amount: amount}); errs != nil {
 				return errs
 			}
+			count++
 		}
-		return callUpdateFunc(balanceMap)
+		return nil
 	})
+	return count, err
 }
 
-func (u *UserService) DeductRaiseBetting(gameId string, currRound int, userId int64, betChips int64, callUpdateFunc func(int64) error) error {
-
-	user, err := u.userDB.QueryById(userId)
+// commit 账本与待同步记录在同一事务中提交,提交后再更新房间状态(redis)。
+// 房间更新失败时待同步记录保留,由修复任务以数据库为准恢复房间,不会出现房间已更新而账本回滚
+func (u *UserService) commit(outbox *db.GameOutbox, callUpdateFunc func() error, next func(tx *gorm.DB) error) error {
+	err := u.userDB.Transaction(func(tx *gorm.DB) error {
+		if errs := next(tx); errs != nil {
+			return errs
+		}
+		return u.outboxDB.Add(tx, outbox)
+	})
 	if err != nil {
 		return err
 	}
 
-	// 用户筹码不足
-	if user.Balance < betChips {
-		return constant.UserNotEnoughBetError
+	if err = callUpdateFunc(); err != nil {
+		log.Printf("gameId=%s outbox id=%d %s apply error: %s", outbox.GameId, outbox.ID, outbox.Kind, err)
+		return err
+	}
+	if err = u.outboxDB.MarkApplied(outbox.ID); err != nil {
+		// 房间已更新,修复任务核对后会重新标记
+		log.Printf("gameId=%s outbox id=%d mark applied error: %s", outbox.GameId, outbox.ID, err)
 	}
+	return nil
+}
 
-	return u.userDB.Transaction(func(tx *gorm.DB) error {
+// checkPosted 幂等key已记录过时返回 constant.DuplicateActionError
+func (u *UserService) checkPosted(tx *gorm.DB, idempotencyKey string) error {
+	posted, err := u.ledgerDB.Posted(tx, idempotencyKey)
+	if err != nil {
+		return err
+	}
+	if posted {
+		return constant.DuplicateActionError
+	}
+	return nil
+}
 
-		userBalances := user.Balance - betChips
-		if userBalances < 0 {
-			betChips = user.Balance
-			userBalances = 0
+// UpateWinBetting 当局结算: 记录所有玩家的底注、下注,奖池筹码转入赢家桌上筹码
+// lowBetChips 为底注,玩家当局下注中不超过底注的部分记为底注
+// archive 不为空时同一事务中保存当局记录(房间配置、玩家底牌、操作、赢家及奖池)、累加玩家对局统计并解锁成就。
+// 结算提交后调用 callUpdateFunc 更新房间,参数为赢家获得的筹码。当局已结算返回 constant.DuplicateActionError
+func (u *UserService) UpateWinBetting(gameId string, currRound int, lowBetChips int64, joinUsers []*JoinUser, winUserId int64, totalBetChips int64, archive *db.RoundArchive, callUpdateFunc func(int64) error) (records []HistoryRecord, err error) {
+	outbox := &db.GameOutbox{GameId: gameId, RoundID: currRound, Kind: db.OutboxSettle, UserId: winUserId}
+	netChips := make(map[int64]int64, 0)
+	applyFunc := func() error {
+		// 结算已提交,排行榜更新失败不影响房间更新
+		if errs := u.leaderboard.AddRound(context.Background(), outbox.CreateAt, winUserId, outbox.Amount, netChips); errs != nil {
+			log.Printf("gameId=%s round=%d update leaderboard error: %s", gameId, currRound, errs)
 		}
+		return callUpdateFunc(outbox.Amount)
+	}
 
-		if errs := tx.Model(&db.User{}).Where("id = ?", user.ID).UpdateColumn("balance", userBalances).Error; errs != nil {
-			return errs
-		}
+	return records, u.commit(outbox, applyFunc, func(tx *gorm.DB) error {
+		// 结算时间,排行榜按结算时间计入周期
+		outbox.CreateAt = u.leaderboard.Clock.Now()
 
-		// record user history
-		history := db.UserHistory{
-			UserId:        user.ID,
-			Address:       user.Address,
-			GameId:        gameId,
-			RoundID:       currRound,
-			State:         constant.BET_STATE_RAISE,
-			Amount:        betChips,
-			BalanceBefore: user.Balance,
-		}
-		if errs := tx.Model(&db.UserHistory{}).Create(&history).Error; errs != nil {
+		// 当局已结算(房间状态更新失败后重复判赢),不重复记账
+		settleKey := db.SettleKey(gameId, currRound)
+		if errs := u.checkPosted(tx, settleKey); errs != nil {
 			return errs
 		}
-		return callUpdateFunc(betChips)
-	})
-}
 
-func (u *UserService) UpateWinBetting(gameId string, currRound int, userId int64, totalBetChips int64, callUpdateFunc func(int64) error) (records []HistoryRecord, err error) {
+		potAccount := db.PotAccount(gameId, currRound)
+		antePostings := make([]db.Posting, 0, len(joinUsers)+1)
+		raisePostings := make([]db.Posting, 0, len(joinUsers)+1)
+		antePotChips, raisePotChips := int64(0), int64(0)
 
-	user, err := u.userDB.QueryById(userId)
-	if err != nil {
-		return records, err
-	}
+		var winUser *JoinUser
+		for index := range joinUsers {
+			joinUser := joinUsers[index]
+			if joinUser.UserId == winUserId {
+				winUser = joinUser
+			}
+			if joinUser.TotalBetChips <= 0 {
+				continue
+			}
+
+			anteChips := joinUser.TotalBetChips
+			if anteChips > lowBetChips {
+				anteChips = lowBetChips
+			}
+			raiseChips := joinUser.TotalBetChips - anteChips
+
+			// record user history,下注前桌上筹码
+			balanceBefore := joinUser.Stack + joinUser.TotalBetChips
+			for _, history := range []db.UserHistory{
+				{State: constant.BET_STATE_ANTE, Amount: anteChips, BalanceBefore: balanceBefore},
+				{State: constant.BET_STATE_RAISE, Amount: raiseChips, BalanceBefore: balanceBefore - anteChips},
+			} {
+				if history.Amount <= 0 {
+					continue
+				}
+				history.UserId = joinUser.UserId
+				history.Address = joinUser.Address
+				history.GameId = gameId
+				history.RoundID = currRound
+				if errs := tx.Model(&db.UserHistory{}).Create(&history).Error; errs != nil {
+					return errs
+				}
+			}
+
+			netChips[joinUser.UserId] = -joinUser.TotalBetChips
+			stackAccount := db.StackAccount(gameId, joinUser.UserId)
+			antePostings = append(antePostings, db.Posting{Account: stackAccount, Amount: -anteChips})
+			raisePostings = append(raisePostings, db.Posting{Account: stackAccount, Amount: -raiseChips})
+			antePotChips += anteChips
+			raisePotChips += raiseChips
+		}
+		if winUser == nil {
+			return constant.GameNotInJoinError
+		}
 
-	return records, u.userDB.Transaction(func(tx *gorm.DB) error {
-		userBalances := user.Balance
-		if userBalances < 0 {
-			userBalances = 0
+		// 底注、下注转入当局奖池
+		antePostings = append(antePostings, db.Posting{Account: potAccount, Amount: antePotChips})
+		if errs := u.ledgerDB.Post(tx, db.LedgerJournal{Kind: db.JournalAnte, GameId: gameId, RoundID: currRound}, antePostings...); errs != nil {
+			return errs
+		}
+		raisePostings = append(raisePostings, db.Posting{Account: potAccount, Amount: raisePotChips})
+		if errs := u.ledgerDB.Post(tx, db.LedgerJournal{Kind: db.JournalRaise, GameId: gameId, RoundID: currRound}, raisePostings...); errs != nil {
+			return errs
 		}
 
 		// 实际用户下注筹码
@@ -189,7 +329,7 @@ func (u *UserService) UpateWinBetting(gameId string, currRound int, userId int64
 				record := historys[index]
 				countBetChips += record.Amount
 
-				if record.UserId != user.ID {
+				if record.UserId != winUser.UserId {
 					records = append(records, HistoryRecord{
 						UserId:  record.UserId,
 						Address: record.Address,
@@ -203,8 +343,8 @@ func (u *UserService) UpateWinBetting(gameId string, currRound int, userId int64
 			}
 
 			records = append(records, HistoryRecord{
-				UserId:  user.ID,
-				Address: user.Address,
+				UserId:  winUser.UserId,
+				Address: winUser.Address,
 				Amount:  totalBetChips,
 			})
 
@@ -214,29 +354,87 @@ func (u *UserService) UpateWinBetting(gameId string, currRound int, userId int64
 			})
 		}
 
-		userBalances += totalBetChips
-		if errs := tx.Model(&db.User{}).Where("id = ?", user.ID).UpdateColumn("balance", userBalances).Error; errs != nil {
-			return errs
-		}
-
 		// record user history
 		history := db.UserHistory{
-			UserId:        user.ID,
-			Address:       user.Address,
+			UserId:        winUser.UserId,
+			Address:       winUser.Address,
 			GameId:        gameId,
 			RoundID:       currRound,
 			State:         constant.BET_STATE_WIN,
 			Amount:        totalBetChips,
-			BalanceBefore: user.Balance,
+			BalanceBefore: winUser.Stack,
 		}
 
 		if errs := tx.Model(&db.UserHistory{}).Create(&history).Error; errs != nil {
 			return errs
 		}
-		return callUpdateFunc(totalBetChips)
+
+		// 奖池结算: 赢家桌上筹码获得奖池,剩余筹码归入庄家(不足时由庄家补足)
+		potBetChips, errs := u.ledgerDB.Balance(tx, potAccount)
+		if errs != nil {
+			return errs
+		}
+		if errs = u.ledgerDB.Post(tx, db.LedgerJournal{Kind: db.JournalWin, GameId: gameId, RoundID: currRound, IdempotencyKey: &settleKey},
+			db.Posting{Account: potAccount, Amount: -potBetChips},
+			db.Posting{Account: db.StackAccount(gameId, winUser.UserId), Amount: totalBetChips},
+			db.Posting{Account: db.HouseAccount, Amount: potBetChips - totalBetChips}); errs != nil {
+			return errs
+		}
+		outbox.Amount = totalBetChips
+		netChips[winUser.UserId] += totalBetChips
+
+		if archive == nil {
+			return nil
+		}
+		archive.Round.WinChips = totalBetChips
+		for index := range archive.Seats {
+			seat := &archive.Seats[index]
+			seat.WinChips = -seat.TotalBetChips
+			if seat.UserId == winUser.UserId {
+				seat.WinChips += totalBetChips
+				seat.Stack += totalBetChips
+			}
+		}
+		if errs = u.roundDB.SaveRound(tx, archive); errs != nil {
+			return errs
+		}
+		if errs = u.userStatsDB.AddStats(tx, roundStats(archive)); errs != nil {
+			return errs
+		}
+		archive.Achievements, errs = u.unlockAchievements(tx, archive)
+		return errs
 	})
 }
 
+// SettledWinner 当局已在数据库结算的赢家及获得的筹码,未结算返回 ok=false
+func (u *UserService) SettledWinner(gameId string, currRound int) (winUserId int64, amount int64, ok bool, err error) {
+	histories := make([]db.UserHistory, 0)
+	err = u.userDB.Transaction(func(tx *gorm.DB) error {
+		return tx.Model(&db.UserHistory{}).
+			Where("game_id = ? and round_id = ? and state = ?", gameId, currRound, constant.BET_STATE_WIN).
+			Limit(1).Find(&histories).Error
+	})
+	if err != nil || len(histories) == 0 {
+		return 0, 0, false, err
+	}
+	return histories[0].UserId, histories[0].Amount, true, nil
+}
+
+// StackBalances 房间所有用户账本中的桌上筹码(含当局未结算下注)
+func (u *UserService) StackBalances(gameId string) (map[int64]int64, error) {
+	return u.ledgerDB.StackBalances(gameId)
+}
+
+// PendingOutbox 创建时间早于 before 的待同步记录
+func (u *UserService) PendingOutbox(before time.Time, limit int) ([]db.GameOutbox, error) {
+	return u.outboxDB.Pending(before, limit)
+}
+
+// MarkOutboxApplied 修复任务核对房间后标记已同步
+func (u *UserService) MarkOutboxApplied(ids ...int64) error {
+	return u.outboxDB.MarkApplied(ids...)
+}
+
 func (u *UserService) GetHisotryRecordList(gameId string) []HistoryRecord {
 	historys := make([]HistoryRecord, 0)
 	u.userDB.Transaction(func(tx *gorm.DB) error {
@@ -253,6 +451,29 @@ func (u *UserService) GetHisotryRecordList(gameId string) []HistoryRecord {
 	return historys
 }
 
+// ListTransactions 用户筹码记录(底注、下注、获胜、领取、奖励),按时间倒序
+func (u *UserService) ListTransactions(userId int64, req TransactionListReq) (TransactionList, error) {
+	filter := db.UserHistoryFilter{
+		UserId: userId,
+		States: req.States,
+		GameId: req.GameId,
+		Cursor: req.Cursor,
+		Limit:  req.Limit,
+	}
+	if req.StartTime > 0 {
+		filter.StartTime = time.UnixMilli(req.StartTime)
+	}
+	if req.EndTime > 0 {
+		filter.EndTime = time.UnixMilli(req.EndTime)
+	}
+
+	list, nextCursor, err := u.userHistoryDB.List(filter)
+	if err != nil {
+		return TransactionList{}, err
+	}
+	return TransactionList{List: list, NextCursor: nextCursor}, nil
+}
+
 func (u *UserService) UpdateRecord(id int64, record string) error {
 	user := db.User{
 		ID: id,
@@ -263,9 +484,30 @@ func (u *UserService) UpdateRecord(id int64, record string) error {
 }
 
 func (u *UserService) ReceiveCoin(coinCount int64, user db.User) error {
-	user.Balance += coinCount
-	_, err := u.userDB.Update(user)
-	return err
+	return u.userDB.Transaction(func(tx *gorm.DB) error {
+		// 请求头中的用户余额可能已过期,以数据库为准
+		balance, errs := u.userDB.AddBalance(tx, user.ID, coinCount)
+		if errs != nil {
+			return errs
+		}
+		if errs = u.createFaucetHistory(tx, user.ID, user.Address, coinCount, balance-coinCount); errs != nil {
+			return errs
+		}
+		return u.ledgerDB.Post(tx, db.LedgerJournal{Kind: db.JournalReceive},
+			db.Posting{Account: db.FaucetAccount, Amount: -coinCount},
+			db.Posting{Account: db.UserAccount(user.ID), Amount: coinCount})
+	})
+}
+
+// createFaucetHistory 记录注册赠送、领取的筹码
+func (u *UserService) createFaucetHistory(tx *gorm.DB, userId int64, address string, amount int64, balanceBefore int64) error {
+	return tx.Model(&db.UserHistory{}).Create(&db.UserHistory{
+		UserId:        userId,
+		Address:       address,
+		State:         constant.BET_STATE_FAUCET,
+		Amount:        amount,
+		BalanceBefore: balanceBefore,
+	}).Error
 }
 
 func (u *UserService) SignatureVerify(address string, defaultBalance int64, randHeadPic string) (db.User, error) {
@@ -275,15 +517,28 @@ func (u *UserService) SignatureVerify(address string, defaultBalance int64, rand
 	}
 
 	if user == (db.User{}) {
-		user, err := u.userDB.CreateUser(db.User{
-			Address:  address,
-			HeadPic:  randHeadPic,
-			Balance:  defaultBalance,
-			CreateAt: time.Now(),
-			UpdateAt: time.Now(),
+		errs := u.userDB.Transaction(func(tx *gorm.DB) error {
+			user = db.User{
+				Address:  address,
+				HeadPic:  randHeadPic,
+				Balance:  defaultBalance,
+				CreateAt: time.Now(),
+				UpdateAt: time.Now(),
+			}
+			if err := tx.Model(&db.User{}).Create(&user).Error; err != nil {
+				return err
+			}
+
+			// 注册赠送筹码
+			if err := u.createFaucetHistory(tx, user.ID, address, defaultBalance, 0); err != nil {
+				return err
+			}
+			return u.ledgerDB.Post(tx, db.LedgerJournal{Kind: db.JournalSignup},
+				db.Posting{Account: db.FaucetAccount, Amount: -defaultBalance},
+				db.Posting{Account: db.UserAccount(user.ID), Amount: defaultBalance})
 		})
-		if err != nil {
-			return db.User{}, err
+		if errs != nil {
+			return db.User{}, errs
 		}
 		return user, nil
 	}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"testing"
+)
+
+// testAchievementRound settles a two player round, users[winner] wins with the given cards
+func testAchievementRound(t *testing.T, userService *UserService, users []db.User, round int, winner int, cards string, pokerType int, actions []RoundAction) []db.UserAchievement {
+	t.Helper()
+
+	joinUsers := make([]*JoinUser, 0)
+	archive := &db.RoundArchive{
+		Game:  db.Game{GameId: "achievement", TotalRounds: 100},
+		Round: db.GameRound{GameId: "achievement", RoundID: round, WinUserId: users[winner].ID, WinChips: 20},
+	}
+	history, _ := json.Marshal(actions)
+	archive.Round.Actions = string(history)
+	for index, user := range users {
+		joinUsers = append(joinUsers, &JoinUser{UserId: user.ID, Address: user.Address, Stack: 490, TotalBetChips: 10})
+		seat := db.RoundSeat{GameId: "achievement", RoundID: round, UserId: user.ID, Address: user.Address, IsLookCard: true, TotalBetChips: 10, Cards: "22, 33, 54", PokerType: PokerSingle}
+		if index == winner {
+			seat.Cards, seat.PokerType = cards, pokerType
+		}
+		archive.Seats = append(archive.Seats, seat)
+	}
+	if _, err := userService.UpateWinBetting("achievement", round, 10, joinUsers, users[winner].ID, 20, archive, func(int64) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Achievements
+}
+
+func TestUserService_Achievements(t *testing.T) {
+	userService := newTestUserService(t)
+	err := userService.SetAchievementRules([]AchievementRule{
+		{Id: "a23_straight_win", Event: AchievementWin, PokerTypes: []int{PokerStraight, PokerFlushStraight}, Ranks: []int{14, 2, 3}, Reward: 100},
+		{Id: "blind_compare_win", Event: AchievementCompareWin, Blind: true},
+		{Id: "win_streak_2", Event: AchievementWin, Streak: 2, Reward: 50},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = userService.SetAchievementRules([]AchievementRule{{Id: "streak", Event: AchievementDealt, Streak: 2}}); err == nil {
+		t.Fatal("streak of the dealt event should be rejected")
+	}
+
+	users := make([]db.User, 0)
+	for i := 0; i < 2; i++ {
+		user, errs := userService.SignatureVerify(fmt.Sprintf("aleo-achievement-%d", i), 1000, "")
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		users = append(users, user)
+	}
+
+	// 第一局users[0]以A23顺子获胜,比牌前看过牌
+	unlocks := testAchievementRound(t, userService, users, 1, 0, "143, 21, 34", PokerStraight, []RoundAction{
+		{UserId: users[0].ID, Type: constant.EVENT_LOOK_CARD},
+		{UserId: users[0].ID, Type: constant.EVENT_COMPARE_LOSE_USER, CompareId: users[1].ID, WinUserId: users[0].ID},
+	})
+	if len(unlocks) != 1 || unlocks[0].AchievementId != "a23_straight_win" || unlocks[0].UserId != users[0].ID || unlocks[0].Reward != 100 {
+		t.Fatalf("round 1 unlocks = %+v", unlocks)
+	}
+
+	// 第二局users[0]再次以A23获胜(不重复解锁),连胜2局,闷牌比牌获胜
+	unlocks = testAchievementRound(t, userService, users, 2, 0, "143, 21, 34", PokerStraight, []RoundAction{
+		{UserId: users[1].ID, Type: constant.EVENT_COMPARE_LOSE_USER, CompareId: users[0].ID, WinUserId: users[0].ID},
+	})
+	if len(unlocks) != 2 || unlocks[0].AchievementId != "blind_compare_win" || unlocks[1].AchievementId != "win_streak_2" {
+		t.Fatalf("round 2 unlocks = %+v", unlocks)
+	}
+
+	// 第三局users[1]获胜,users[0]连胜中断
+	if unlocks = testAchievementRound(t, userService, users, 3, 1, "22, 33, 54", PokerSingle, nil); len(unlocks) != 0 {
+		t.Fatalf("round 3 unlocks = %+v", unlocks)
+	}
+	stats, err := userService.GetStats(users[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.WinStreak != 0 {
+		t.Fatalf("win streak = %d after losing", stats.WinStreak)
+	}
+
+	// 奖励筹码转入余额并记账
+	user, _ := userService.GetById(users[0].ID)
+	if user.Balance != 1000+150 {
+		t.Fatalf("balance = %d, want %d", user.Balance, 1000+150)
+	}
+	report, err := userService.VerifyLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Faucet != -2150 {
+		t.Fatalf("report = %+v", report)
+	}
+	bonus, err := userService.ListTransactions(users[0].ID, TransactionListReq{States: []int{constant.BET_STATE_BONUS}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bonus.List) != 2 || bonus.List[0].Amount != 50 || bonus.List[1].BalanceBefore != 1000 {
+		t.Fatalf("bonus history = %+v", bonus.List)
+	}
+
+	views, err := userService.ListAchievements(users[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 3 || !views[0].Unlocked || !views[1].Unlocked || !views[2].Unlocked || views[0].UnlockTime == nil {
+		t.Fatalf("achievements = %+v", views)
+	}
+	if views, err = userService.ListAchievements(users[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 3 || views[0].Unlocked || views[1].Unlocked || views[2].Unlocked {
+		t.Fatalf("achievements = %+v", views)
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"log"
+)
+
+// ActionRecord 当局已处理的客户端操作
+type ActionRecord struct {
+	UserId    int64  `json:"userId"`
+	Type      int    `json:"type"`
+	Timestamp int64  `json:"timestamp"`       // 处理时间戳(毫秒)
+	Error     string `json:"error,omitempty"` // 首次执行返回的错误,为空表示成功
+}
+
+// result 首次执行的结果
+func (r ActionRecord) result() error {
+	if len(r.Error) == 0 {
+		return nil
+	}
+	return constant.ParseActionError(r.Error)
+}
+
+// clientAction 客户端操作,由房间协程读写
+type clientAction struct {
+	userId     int64
+	actionType int
+	actionId   string
+	currRound  int   // 首次执行时的当局
+	err        error // 首次执行返回的业务错误
+}
+
+// key 当局操作记录的key,同一用户同一类型的操作ID只处理一次
+func (a *clientAction) key() string {
+	return fmt.Sprintf("%d-%d-%s", a.userId, a.actionType, a.actionId)
+}
+
+// ActionOption 房间命令选项
+type ActionOption func(*command)
+
+// WithActionId 客户端生成的操作ID,网络重发时ID不变。当局已处理过的操作直接返回首次执行的结果(成功或业务错误),
+// 不会重复下注或重复扣除账户余额。actionId为空时不去重(兼容旧版本客户端)
+func WithActionId(userId int64, actionType int, actionId string) ActionOption {
+	return func(cmd *command) {
+		if len(actionId) > 0 {
+			cmd.action = &clientAction{userId: userId, actionType: actionType, actionId: actionId}
+		}
+	}
+}
+
+// doAction 执行客户端操作,操作记录与操作结果在同一次房间保存中写入
+func (c *Game) doAction(action *clientAction, handler func() error) error {
+	gameRoom, err := c.GetGameRoom(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// 当局已处理,返回首次执行的结果
+	if record, ok := gameRoom.Actions[action.key()]; ok {
+		log.Printf("gameId=%s userId=%d duplicate action %s", c.GameId, action.userId, action.actionId)
+		return record.result()
+	}
+
+	action.currRound = gameRoom.CurrRound
+	c.action = action
+	defer func() { c.action = nil }()
+
+	// 房间操作记录丢失时,账本的幂等key仍能阻止重复扣款
+	if err = handler(); errors.Is(err, constant.DuplicateActionError) {
+		log.Printf("gameId=%s userId=%d action %s already posted", c.GameId, action.userId, action.actionId)
+		return nil
+	}
+
+	// 业务错误同样记录,重复提交时返回相同的错误;未保存任何状态时才记录,服务异常不记录
+	if err != nil && !c.written && constant.IsActionError(err) {
+		c.recordActionError(action, err)
+	}
+	return err
+}
+
+// recordActionError 保存客户端操作首次执行返回的业务错误
+func (c *Game) recordActionError(action *clientAction, err error) {
+	ctx := context.Background()
+	gameRoom, errs := c.GetGameRoom(ctx)
+	if errs != nil || gameRoom.CurrRound != action.currRound {
+		return
+	}
+
+	action.err = err
+	if errs = c.setGameRoomCache(ctx, gameRoom); errs != nil {
+		log.Printf("gameId=%s userId=%d record action %s error: %s", c.GameId, action.userId, action.actionId, errs)
+	}
+}
+
+// recordAction 保存房间前记录当前命令的客户端操作
+func (c *Game) recordAction(gameRoom *GameRoom) {
+	if c.action == nil || gameRoom.CurrRound != c.action.currRound {
+		return
+	}
+	if gameRoom.Actions == nil {
+		gameRoom.Actions = make(map[string]ActionRecord, 0)
+	}
+	record := ActionRecord{
+		UserId:    c.action.userId,
+		Type:      c.action.actionType,
+		Timestamp: c.clock.Now().UnixMilli(),
+	}
+	if c.action.err != nil {
+		record.Error = c.action.err.Error()
+	}
+	gameRoom.Actions[c.action.key()] = record
+}
+
+// ledgerKey 当前客户端操作的账本幂等key,没有操作ID时为空
+func (c *Game) ledgerKey() string {
+	if c.action == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%d-%s", c.GameId, c.action.currRound, c.action.key())
+}
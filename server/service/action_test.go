@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"game-3-card-poker/server/constant"
+	"testing"
+)
+
+func TestGame_DuplicateAction(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 网络重发的下注只处理一次
+	bet := func() error {
+		return game.UserBetting(users[1].ID, 0, 1, 40, nil, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
+			return callUpdateFunc(false, nil)
+		}, WithActionId(users[1].ID, constant.POKER_BET, "bet-1"))
+	}
+	for i := 0; i < 3; i++ {
+		if err := bet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	joinUser := game.GetJoinUser(ctx, users[1].ID, 1)
+	if joinUser.TotalBetChips != 50 || joinUser.Stack != testBuyIn-50 {
+		t.Fatalf("total bet chips = %d, stack = %d after resending", joinUser.TotalBetChips, joinUser.Stack)
+	}
+
+	// 不同操作ID正常处理,轮到其他玩家时返回错误
+	err := game.UserBetting(users[1].ID, 0, 1, 40, nil, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
+		return callUpdateFunc(false, nil)
+	}, WithActionId(users[1].ID, constant.POKER_BET, "bet-2"))
+	if err != constant.NotCurrentOperateError {
+		t.Fatalf("bet error = %v, want %v", err, constant.NotCurrentOperateError)
+	}
+
+	// 轮到该玩家后重发,仍返回首次执行的错误且不下注
+	if err = testBetting(game, users[0].ID, 40); err != nil {
+		t.Fatal(err)
+	}
+	err = game.UserBetting(users[1].ID, 0, 1, 40, nil, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
+		return callUpdateFunc(false, nil)
+	}, WithActionId(users[1].ID, constant.POKER_BET, "bet-2"))
+	if err != constant.NotCurrentOperateError {
+		t.Fatalf("resent bet error = %v, want %v", err, constant.NotCurrentOperateError)
+	}
+	if joinUser = game.GetJoinUser(ctx, users[1].ID, 1); joinUser.TotalBetChips != 50 {
+		t.Fatalf("total bet chips = %d after resending failed bet", joinUser.TotalBetChips)
+	}
+
+	// 带有详细信息的错误还原后仍能判断错误类型
+	fundsError := &constant.InsufficientFundsError{UserId: users[1].ID, Balance: 10, Amount: 40}
+	if err = constant.ParseActionError(fundsError.Error()); !errors.Is(err, constant.UserNotEnoughBetError) || err.Error() != fundsError.Error() {
+		t.Fatalf("parsed error = %v", err)
+	}
+}
+
+func TestGame_DuplicateBuyInLedger(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+
+	buyIn := WithActionId(users[1].ID, constant.POKER_TOP_UP, "top-up-1")
+	if err := game.UserBuyIn(users[1].ID, 500, buyIn); err != nil {
+		t.Fatal(err)
+	}
+
+	// 房间操作记录丢失,账本的幂等key阻止重复扣款
+	err := game.Do(func() error {
+		gameRoom, err := game.GetGameRoom(ctx)
+		if err != nil {
+			return err
+		}
+		gameRoom.Actions = nil
+		return game.setGameRoomCache(ctx, gameRoom)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = game.UserBuyIn(users[1].ID, 500, buyIn); err != nil {
+		t.Fatal(err)
+	}
+
+	if joinUser := game.GetJoinUser(ctx, users[1].ID, 1); joinUser.Stack != testBuyIn+500 {
+		t.Fatalf("stack = %d, want %d", joinUser.Stack, testBuyIn+500)
+	}
+	if dbUser, _ := pool.UserService.GetById(users[1].ID); dbUser.Balance != testBalance-testBuyIn-500 {
+		t.Fatalf("balance = %d, want %d", dbUser.Balance, testBalance-testBuyIn-500)
+	}
+	if report, _ := pool.UserService.VerifyLedger(); !report.OK() {
+		t.Fatalf("report = %+v", report)
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+)
+
+// clientSendBufferSize 连接待发送消息队列长度,队列已满时断开连接
+const clientSendBufferSize = 256
+
+// Client websocket连接,所有写操作(房间事件、错误消息、ping心跳、关闭帧)均由写协程串行执行
+type Client struct {
+	conn         *websocket.Conn
+	send         chan []byte
+	writeWait    time.Duration
+	pingInterval time.Duration
+
+	closeMsg  []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewClient creates a Client and starts its writer goroutine, use Client.Close to stop it
+func NewClient(conn *websocket.Conn, writeWait, pingInterval time.Duration) *Client {
+	client := &Client{
+		conn:         conn,
+		send:         make(chan []byte, clientSendBufferSize),
+		writeWait:    writeWait,
+		pingInterval: pingInterval,
+		closed:       make(chan struct{}),
+	}
+	go client.writer()
+	return client
+}
+
+// Send 消息加入发送队列,连接已关闭返回false;队列已满说明客户端接收过慢,断开连接
+func (c *Client) Send(message []byte) bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- message:
+		return true
+	case <-c.closed:
+		return false
+	default:
+		log.Printf("client %s send buffer full, close connection", c.conn.RemoteAddr())
+		c.Close(websocket.CloseTryAgainLater, "send buffer full")
+		return false
+	}
+}
+
+// Close 发送关闭帧并关闭连接,可重复调用
+func (c *Client) Close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, text)
+		close(c.closed)
+	})
+}
+
+// writer 连接写协程,每次写操作设置写超时,超时或失败后关闭连接
+func (c *Client) writer() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message := <-c.send:
+			if err := c.write(websocket.TextMessage, message); err != nil {
+				c.Close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				c.Close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.closed:
+			// 发送队列中剩余的消息后发送关闭帧
+			for len(c.send) > 0 {
+				if err := c.write(websocket.TextMessage, <-c.send); err != nil {
+					return
+				}
+			}
+			c.write(websocket.CloseMessage, c.closeMsg)
+			return
+		}
+	}
+}
+
+// write 写超时内完成写操作
+func (c *Client) write(messageType int, data []byte) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeWait)); err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(messageType, data)
+}
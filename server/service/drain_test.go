@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"game-3-card-poker/server/constant"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGamePool_DrainWaitsForHand(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭期间玩家弃牌,当局结束
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		game.UserGiveUpCard(users[1].ID, 1, nil)
+	}()
+
+	start := time.Now()
+	pool.Drain(ctx, 10*time.Second)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("drain took %s, want to return when the hand finished", elapsed)
+	}
+
+	gameRoom, err := game.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gameRoom.State != constant.GAME_ENDED {
+		t.Fatalf("state = %d, want %d", gameRoom.State, constant.GAME_ENDED)
+	}
+	if err = game.Do(func() error { return nil }); err != constant.GameStoppedError {
+		t.Fatalf("Do after drain error = %v, want %v", err, constant.GameStoppedError)
+	}
+}
+
+func TestGamePool_DrainTimeoutKeepsHand(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Drain(ctx, time.Second)
+	if !pool.IsDraining() {
+		t.Fatal("pool is not draining")
+	}
+
+	// 未结束的当局保留在Redis中,重启后恢复
+	restarted := restartTestGamePool(t, pool)
+	count, err := restarted.Recover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("recovered %d rooms, want 1", count)
+	}
+}
+
+func TestGame_StartGameWhileDraining(t *testing.T) {
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	atomic.StoreInt32(&pool.draining, 1)
+
+	if err := testStartGame(game, users[0].ID); err != constant.ServerShuttingDownError {
+		t.Fatalf("StartGame error = %v, want %v", err, constant.ServerShuttingDownError)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"game-3-card-poker/server/daley"
 	"game-3-card-poker/server/db"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 	"github.com/jinzhu/copier"
 	"github.com/redis/go-redis/v9"
 	"log"
@@ -22,17 +21,29 @@ import (
 // Game key is gameID
 type Game struct {
 	GameId  string
-	Clients map[int64]map[string]*websocket.Conn
+	Clients map[int64]map[string]*Client
 
-	Mutex       sync.Mutex
 	RedisClient *redis.Client
-	DelayQueue  *daley.DelayQueue
+	Store       GameStore
+	DelayQueue  daley.Scheduler
 	UserService *UserService
+	AwayTimeout time.Duration
+
+	jobs       *delayJobs
+	clock      daley.Clock
+	isDraining func() bool
+	deliver    func(context.Context, RoomEvent)
+	written    bool          // 当前命令是否已保存房间状态,由房间协程读写
+	action     *clientAction // 当前命令的客户端操作,由房间协程读写
+	commands   chan command
+	stopped    chan struct{}
+	stopOnce   sync.Once
+	pending    sync.WaitGroup // 尚未执行的延迟命令
 }
 
 // AutoBetDelayFunc 自动下注延迟队列
-var AutoBetDelayFunc = func(c Game, gameRoom *GameRoom, joinUser *JoinUser) {
-	if gameRoom.CurrLocation == joinUser.Location && joinUser.IsAutoBet {
+var AutoBetDelayFunc = func(c *Game, gameRoom *GameRoom, joinUser *JoinUser) {
+	if c.jobs != nil && gameRoom.CurrLocation == joinUser.Location && joinUser.IsAutoBet {
 		// 下注最低筹码
 		lowBetChips, _ := c.GetCurrentLowBetChips(gameRoom, joinUser, nil)
 
@@ -45,14 +56,19 @@ var AutoBetDelayFunc = func(c Game, gameRoom *GameRoom, joinUser *JoinUser) {
 			Timestamp: gameRoom.SetLocationTime,
 			BetChips:  lowBetChips,
 		}
-		c.DelayQueue.SendDelayMsg(autBetMsg.ToJsonStr(), time.Second, daley.WithRetryCount(5))
+		msgId, err := c.jobs.autoBet.SendDelay(autBetMsg, time.Second, daley.WithIdempotencyKey(turnTimerKey("autobet", gameRoom, joinUser)))
+		if err != nil {
+			log.Printf("send auto bet delay message userId=%d error: %s", joinUser.UserId, err)
+			return
+		}
+		c.setTimer(gameRoom, joinUser, msgId)
 	}
 }
 
 // TimeOutGiveUpDelayFunc 超时用户自动放弃
-var TimeOutGiveUpDelayFunc = func(c Game, gameRoom *GameRoom, joinUser *JoinUser) {
-	if gameRoom.CurrLocation == joinUser.Location {
-		// 延迟30秒倒计时->(超时用户自动放弃)
+var TimeOutGiveUpDelayFunc = func(c *Game, gameRoom *GameRoom, joinUser *JoinUser) {
+	if c.jobs != nil && gameRoom.CurrLocation == joinUser.Location {
+		// 剩余倒计时->(超时用户自动放弃)
 		delayMsg := DelayMsg{
 			DelayType: constant.DELAY_GIVEUP,
 			GameId:    gameRoom.GameId,
@@ -60,12 +76,58 @@ var TimeOutGiveUpDelayFunc = func(c Game, gameRoom *GameRoom, joinUser *JoinUser
 			CurrRound: gameRoom.CurrRound,
 			Timestamp: gameRoom.SetLocationTime,
 		}
-		c.DelayQueue.SendDelayMsg(delayMsg.ToJsonStr(), CountdownSecond*time.Second, daley.WithRetryCount(5))
+		msgId, err := c.jobs.giveUp.SendDelay(delayMsg, time.Duration(c.turnCountdown(gameRoom))*time.Second, daley.WithIdempotencyKey(turnTimerKey("giveup", gameRoom, joinUser)))
+		if err != nil {
+			log.Printf("send give up delay message userId=%d error: %s", joinUser.UserId, err)
+			return
+		}
+		c.setTimer(gameRoom, joinUser, msgId)
 	}
 }
 
+// turnTimerKey 同一轮操作的倒计时只发送一次(重试发送、服务重启恢复)
+func turnTimerKey(name string, gameRoom *GameRoom, joinUser *JoinUser) string {
+	return fmt.Sprintf("%s:%s-%d-%d-%d", name, gameRoom.GameId, gameRoom.CurrRound, joinUser.UserId, gameRoom.SetLocationTime)
+}
+
+// turnCountdown 当前操作用户剩余倒计时秒(设置操作用户后延迟1秒开始倒计时)
+func (c *Game) turnCountdown(gameRoom *GameRoom) int64 {
+	countdownSecond := gameRoom.CurrTimeStamp + 1 + CountdownSecond - c.clock.Now().Unix()
+	if countdownSecond < 0 {
+		return 0
+	}
+	if countdownSecond > CountdownSecond {
+		return CountdownSecond
+	}
+	return countdownSecond
+}
+
+// setTimer 记录座位当前的操作倒计时消息,并取消之前的倒计时
+func (c *Game) setTimer(gameRoom *GameRoom, joinUser *JoinUser, msgId string) {
+	if joinUser.TimerId == msgId {
+		// 倒计时已发送
+		return
+	}
+	c.cancelTimer(joinUser)
+	joinUser.TimerId = msgId
+	if err := c.setJoinUserCache(context.Background(), gameRoom, joinUser); err != nil {
+		log.Printf("save userId=%d timer error: %s", joinUser.UserId, err)
+	}
+}
+
+// cancelTimer 取消座位的操作倒计时(超时放弃/自动下注),已开始处理的消息仍由 SetLocationTime 校验
+func (c *Game) cancelTimer(joinUser *JoinUser) {
+	if joinUser == nil || len(joinUser.TimerId) <= 0 || c.DelayQueue == nil {
+		return
+	}
+	if _, err := c.DelayQueue.Cancel(joinUser.TimerId); err != nil {
+		log.Printf("cancel userId=%d timer error: %s", joinUser.UserId, err)
+	}
+	joinUser.TimerId = ""
+}
+
 // CheckAvailability 检查用户是否在当前游戏局中
-func (c Game) CheckAvailability(ctx context.Context, userId int64) (*GameRoom, error) {
+func (c *Game) CheckAvailability(ctx context.Context, userId int64) (*GameRoom, error) {
 	gameRoom, err := c.GetGameRoom(ctx)
 	if err != nil {
 		return nil, err
@@ -90,7 +152,7 @@ func (c Game) CheckAvailability(ctx context.Context, userId int64) (*GameRoom, e
 }
 
 // CheckPlaying 检查用户是否在当前游戏局中
-func (c Game) CheckPlaying(ctx context.Context, userId int64, currRound int) (*GameRoom, error) {
+func (c *Game) CheckPlaying(ctx context.Context, userId int64, currRound int) (*GameRoom, error) {
 	// 检查用户是否当前局游戏中
 	gameRoom, err := c.CheckAvailability(ctx, userId)
 	if err != nil {
@@ -113,7 +175,7 @@ func (c Game) CheckPlaying(ctx context.Context, userId int64, currRound int) (*G
 }
 
 // GetBroadcastMsg 获取广播消息
-func (c Game) GetBroadcastMsg(ctx context.Context, gameRoom *GameRoom, eventMsg *EventMsg) ([]byte, error) {
+func (c *Game) GetBroadcastMsg(ctx context.Context, gameRoom *GameRoom, eventMsg *EventMsg) ([]byte, error) {
 
 	// 广播消息通知所有用户
 	userIds := make([]int64, 0)
@@ -125,17 +187,10 @@ func (c Game) GetBroadcastMsg(ctx context.Context, gameRoom *GameRoom, eventMsg
 		}
 	}
 
-	// 从数据库中当前用户的账号筹码
-	if userIds != nil && len(userIds) > 0 {
-		userMap, err := c.UserService.GetUsersByIds(userIds)
-		if err == nil && userMap != nil && len(userMap) > 0 {
-			for index := range joinUsers {
-				user := joinUsers[index]
-				if dbUser, ok := userMap[user.UserId]; ok {
-					user.AccountBetChips = dbUser.Balance
-					user.HeadPic = dbUser.HeadPic
-				}
-			}
+	// 用户在线状态
+	if presences := c.GetPresences(ctx, userIds); len(presences) > 0 {
+		for index := range joinUsers {
+			joinUsers[index].Presence = presences[joinUsers[index].UserId]
 		}
 	}
 
@@ -147,11 +202,13 @@ func (c Game) GetBroadcastMsg(ctx context.Context, gameRoom *GameRoom, eventMsg
 	if &room != nil {
 		room.BetChips = make([]int64, 0)
 		room.Records = make(map[int64][]int64, 0)
+		room.Actions = nil
+		room.History = nil
 	}
 
 	// 广播json字符串数组对象
 	msgJsonByte, err := json.Marshal(&BroadcastMsg{
-		Timestamp: time.Now().Unix(),
+		Timestamp: c.clock.Now().Unix(),
 		Message:   Message{constant.EVENT_JOIN_USER, strings.ReplaceAll(uuid.New().String(), "-", "")},
 		Event:     eventMsg,
 		Room:      &room,
@@ -162,27 +219,19 @@ func (c Game) GetBroadcastMsg(ctx context.Context, gameRoom *GameRoom, eventMsg
 }
 
 // BroadcastWinMsg 广播游戏状态->(每局结束时，所有玩家只能看见自己比过或跟自己比过的玩家的手牌)
-func (c Game) BroadcastWinMsg(ctx context.Context, gameRoom *GameRoom, eventMsg *EventMsg) {
-	if gameRoom == nil || c.Clients == nil || len(c.Clients) <= 0 {
+func (c *Game) BroadcastWinMsg(ctx context.Context, gameRoom *GameRoom, eventMsg *EventMsg) {
+	if gameRoom == nil {
 		return
 	}
 
 	// 每局结束时，所有玩家只能看见自己比过或跟自己比过的玩家的手牌
 	if gameRoom.Records != nil && len(gameRoom.Records) > 0 {
-		for userId, records := range gameRoom.Records {
+		for userId := range gameRoom.Records {
 			cardList := make(map[int64]string, 0)
-			userPoker, _ := c.GetUserPokerCache(context.Background(), gameRoom, userId)
-			if userPoker != nil {
-				cardList[userId] = userPoker.ToString()
-			}
-
-			if records != nil && len(records) > 0 {
-				for index := range records {
-					otherUserId := records[index]
-					otherPoker, _ := c.GetUserPokerCache(context.Background(), gameRoom, otherUserId)
-					if otherPoker != nil {
-						cardList[otherUserId] = otherPoker.ToString()
-					}
+			for _, cardUserId := range visibleCardUsers(gameRoom.Records, userId) {
+				userPoker, _ := c.GetUserPokerCache(context.Background(), gameRoom, cardUserId)
+				if userPoker != nil {
+					cardList[cardUserId] = userPoker.ToString()
 				}
 			}
 
@@ -196,58 +245,98 @@ func (c Game) BroadcastWinMsg(ctx context.Context, gameRoom *GameRoom, eventMsg
 	c.BroadcastMsg(ctx, gameRoom, eventMsg)
 }
 
-// BroadcastMsg 广播游戏状态->所有在线用户
-func (c Game) BroadcastMsg(ctx context.Context, gameRoom *GameRoom, eventMsg *EventMsg) {
-	if gameRoom == nil || c.Clients == nil || len(c.Clients) <= 0 {
+// BroadcastMsg 广播游戏状态->所有实例的在线用户
+func (c *Game) BroadcastMsg(ctx context.Context, gameRoom *GameRoom, eventMsg *EventMsg) {
+	if gameRoom == nil {
 		return
 	}
 
 	// 广播消息
-	msgJsonByte, _ := c.GetBroadcastMsg(ctx, gameRoom, eventMsg)
-	for userId := range c.Clients {
-		joinUser := c.GetJoinUser(ctx, userId, gameRoom.CurrRound)
-		if joinUser == nil {
-			continue
-		}
+	msgJsonByte, err := c.GetBroadcastMsg(ctx, gameRoom, eventMsg)
+	if err != nil {
+		log.Println("get broadcast message error:", err)
+		return
+	}
 
-		// 游戏等待中(没ready状态不主动推送消息)
-		if gameRoom.State == constant.GAME_WAIT && gameRoom.CurrRound > 1 {
-			if joinUser.State == constant.EVENT_JOIN_USER {
-				// 上局加入过游戏
-				lastJoinUser := c.GetJoinUser(ctx, userId, gameRoom.CurrRound-1)
-				if lastJoinUser != nil && lastJoinUser.State > constant.EVENT_JOIN_USER {
-					continue
-				}
-			}
-		}
+	c.publishEvent(ctx, RoomEvent{
+		GameId:    gameRoom.GameId,
+		State:     gameRoom.State,
+		CurrRound: gameRoom.CurrRound,
+		Payload:   msgJsonByte,
+	})
+}
 
-		clients := c.Clients[userId]
-		for token := range clients {
-			clients[token].WriteMessage(websocket.TextMessage, msgJsonByte)
-		}
+// SendMsgByUserId 发送消息->指定用户(所有实例的连接)
+func (c *Game) SendMsgByUserId(ctx context.Context, gameRoom *GameRoom, userId int64, msgJsonByte []byte) {
+	if gameRoom == nil {
+		return
 	}
-}
 
-// SendMsgByUserId 发送消息->指定用户
-func (c Game) SendMsgByUserId(ctx context.Context, gameRoom *GameRoom, userId int64, msgJsonByte []byte) {
+	c.publishEvent(ctx, RoomEvent{
+		GameId:    gameRoom.GameId,
+		UserId:    userId,
+		State:     gameRoom.State,
+		CurrRound: gameRoom.CurrRound,
+		Payload:   msgJsonByte,
+	})
+}
 
-	if gameRoom == nil || c.Clients == nil || c.Clients[userId] == nil || len(c.Clients[userId]) <= 0 {
+// publishEvent 发布房间事件,由所有实例投递到各自的连接
+func (c *Game) publishEvent(ctx context.Context, event RoomEvent) {
+	// 单机部署(未配置Redis)直接投递到本实例的连接
+	if c.RedisClient == nil {
+		if c.deliver != nil {
+			c.deliver(ctx, event)
+		}
 		return
 	}
 
-	joinUser := c.GetJoinUser(ctx, userId, gameRoom.CurrRound)
-	if joinUser == nil {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		log.Println("room event to json error:", err)
 		return
 	}
 
-	clients := c.Clients[userId]
-	for token := range clients {
-		clients[token].WriteMessage(websocket.TextMessage, msgJsonByte)
+	if errs := c.RedisClient.Publish(ctx, fmt.Sprintf(roomEventChannel, event.GameId), eventJson).Err(); errs != nil {
+		log.Printf("publish gameId=%s room event error: %s", event.GameId, errs)
+	}
+}
+
+// lockGame 游戏房间加分布式锁->多实例间串行处理游戏操作,返回解锁方法
+func (c *Game) lockGame(ctx context.Context) (func(), error) {
+	// 单机部署由房间协程串行即可
+	if c.RedisClient == nil {
+		return func() {}, nil
+	}
+
+	key := fmt.Sprintf("game-lock:%s", c.GameId)
+	token := strings.ReplaceAll(uuid.New().String(), "-", "")
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		ok, err := c.RedisClient.SetNX(ctx, key, token, lockExpiration).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return func() {
+				// 仅释放自己持有的锁
+				if errs := c.RedisClient.Eval(ctx, unlockScript, []string{key}, token).Err(); errs != nil && errs != redis.Nil {
+					log.Printf("unlock gameId=%s error: %s", c.GameId, errs)
+				}
+			}, nil
+		}
+
+		// 游戏操作繁忙
+		if time.Now().After(deadline) {
+			return nil, constant.GameBusyError
+		}
+		time.Sleep(lockRetryInterval)
 	}
 }
 
 // GetGamePkCompareRecord 游戏过程中PK记录(每局结束时，所有玩家只能看见自己比过或跟自己比过的玩家的手牌)
-func (c Game) GetGamePkCompareRecord(records map[int64][]int64, userIds []int64) map[int64][]int64 {
+func (c *Game) GetGamePkCompareRecord(records map[int64][]int64, userIds []int64) map[int64][]int64 {
 	if records == nil {
 		records = make(map[int64][]int64, 0)
 	}
@@ -286,7 +375,7 @@ func (c Game) GetGamePkCompareRecord(records map[int64][]int64, userIds []int64)
 }
 
 // CheckGameWinUser 最终赢家用户
-func (c Game) CheckGameWinUser(ctx context.Context, gameRoom *GameRoom, joinUsers []*JoinUser) bool {
+func (c *Game) CheckGameWinUser(ctx context.Context, gameRoom *GameRoom, joinUsers []*JoinUser) bool {
 
 	// 游戏中玩家列表
 	payingUsers := func() []*JoinUser {
@@ -353,12 +442,27 @@ func (c Game) CheckGameWinUser(ctx context.Context, gameRoom *GameRoom, joinUser
 		return false
 	}
 
+	// 取消所有玩家未触发的倒计时
+	for index := range joinUsers {
+		c.cancelTimer(joinUsers[index])
+	}
+
 	// todo 最终赢家数据上链
 	//go c.SaveRound(gameRoom, winJoinUser.UserId, gameRoom.TotalBetChips)
 
+	// 游戏过程中PK记录(每局结束时，所有玩家只能看见自己比过或跟自己比过的玩家的手牌)
+	pkRecords := gameRoom.Records
+	if len(topRecordUserIdArr) > 0 {
+		pkRecords = c.GetGamePkCompareRecord(gameRoom.Records, topRecordUserIdArr)
+	}
+
 	// 整体放入同一个事物中
-	// 总筹码提现到最终赢家账户-操作数据库
-	records, err := c.UserService.UpateWinBetting(gameRoom.GameId, gameRoom.CurrRound, winJoinUser.UserId, gameRoom.TotalBetChips, func(betChips int64) error {
+	// 当局下注统一记账,总筹码转入最终赢家桌上筹码,保存当局记录-操作数据库
+	archive := c.roundArchive(ctx, gameRoom, joinUsers, winJoinUser, pkRecords, len(topRecordUserIdArr) > 0)
+	records, err := c.UserService.UpateWinBetting(gameRoom.GameId, gameRoom.CurrRound, gameRoom.LowBetChips, joinUsers, winJoinUser.UserId, gameRoom.TotalBetChips, archive, func(betChips int64) error {
+		// 数据库已提交,版本号冲突时不能重新执行命令
+		c.written = true
+		winJoinUser.Stack += betChips
 		winJoinUser.State = constant.EVENT_WIN_USER
 		gameRoom.State = constant.GAME_ENDED
 
@@ -366,9 +470,9 @@ func (c Game) CheckGameWinUser(ctx context.Context, gameRoom *GameRoom, joinUser
 		users := make(map[int64]*JoinUser, 0)
 		users[winJoinUser.UserId] = winJoinUser
 
-		// 游戏过程中PK记录(每局结束时，所有玩家只能看见自己比过或跟自己比过的玩家的手牌)
+		// 封顶全部开牌,其他游戏中玩家为PK输家
 		if topRecordUserIdArr != nil && len(topRecordUserIdArr) > 0 {
-			gameRoom.Records = c.GetGamePkCompareRecord(gameRoom.Records, topRecordUserIdArr)
+			gameRoom.Records = pkRecords
 			for index := range payingUsers {
 				payUser := payingUsers[index]
 				if payUser.UserId != winJoinUser.UserId {
@@ -382,16 +486,32 @@ func (c Game) CheckGameWinUser(ctx context.Context, gameRoom *GameRoom, joinUser
 		return c.setBatchCache(ctx, gameRoom, users)
 	})
 
+	if errors.Is(err, constant.DuplicateActionError) {
+		// 当局已在数据库结算而房间未更新,以数据库为准修复房间
+		log.Printf("gameId=%s round=%d already settled, repair room", gameRoom.GameId, gameRoom.CurrRound)
+		if _, errs := c.repairGame(); errs != nil {
+			log.Println("Repair settled game error", errs)
+		}
+		return true
+	}
 	if err != nil {
 		log.Println("Update win game user error", err)
 		return true
 	}
 
+	c.broadcastAchievements(ctx, gameRoom, archive.Achievements)
+	c.endRound(ctx, gameRoom, winJoinUser, joinUsers, records)
+	return true
+}
+
+// endRound 当局结算后: 游戏结束时兑出所有桌上筹码,广播获胜消息,未结束时开始下一局
+func (c *Game) endRound(ctx context.Context, gameRoom *GameRoom, winJoinUser *JoinUser, joinUsers []*JoinUser, records []HistoryRecord) {
 	//  检查游戏是否结束
 	isGameOver := false
 	if gameRoom.TotalRounds <= gameRoom.CurrRound {
-		// 游戏结束
+		// 游戏结束,所有桌上筹码兑回账户
 		isGameOver = true
+		c.cashOutAll(ctx, gameRoom, joinUsers)
 		records = c.UserService.GetHisotryRecordList(gameRoom.GameId)
 		if records != nil && len(records) > 0 {
 			// 降序
@@ -412,84 +532,119 @@ func (c Game) CheckGameWinUser(ctx context.Context, gameRoom *GameRoom, joinUser
 
 	// 下一局开始,获胜者成为新庄家
 	if !isGameOver {
-		// 默认自动加入下一局用户
-		otherUsers := make([]*JoinUser, 0)
-		for i := range joinUsers {
-			user := joinUsers[i]
-			// 其他非等待用户
-			if user.State != constant.EVENT_JOIN_USER {
-				otherUsers = append(otherUsers, user)
-			}
-		}
+		c.scheduleNextRound(ctx, gameRoom, winJoinUser, joinUsers)
+	}
+}
 
-		// 延迟2秒执行
-		go func() {
-			timer := time.NewTimer(2 * time.Second)
-			<-timer.C
-
-			// 重置游戏设置
-			gameRoom.CurrLocation = 0
-			gameRoom.CurrTimeStamp = 0
-			gameRoom.CurrBetChips = 0
-			gameRoom.State = constant.GAME_WAIT
-			gameRoom.CurrBankerId = winJoinUser.UserId
-			gameRoom.CurrRound = gameRoom.CurrRound + 1
-			gameRoom.ExposedBetChips = gameRoom.LowBetChips
-			gameRoom.ConcealedBetChips = gameRoom.LowBetChips
-			gameRoom.JoinUsers = make(map[int64]int, 0)
-			gameRoom.Records = make(map[int64][]int64, 0)
-			gameRoom.BetChips = make([]int64, 0)
-
-			callFunc := func(room *GameRoom, joinUser map[int64]*JoinUser) {
-				// 将当前获取赢家排第一位
-				newUsers := make([]*JoinUser, 0)
-				for index := range otherUsers {
-					newUser := otherUsers[index]
-					if newUser.UserId == winJoinUser.UserId {
-						// 游戏赢家作为庄家排除在排序中
-						continue
-					}
+// scheduleNextRound 延迟2秒由房间协程开始下一局
+func (c *Game) scheduleNextRound(ctx context.Context, gameRoom *GameRoom, winJoinUser *JoinUser, joinUsers []*JoinUser) {
+	// 默认自动加入下一局用户
+	otherUsers := make([]*JoinUser, 0)
+	for i := range joinUsers {
+		user := joinUsers[i]
+		// 其他非等待用户,以及已买入桌上筹码的等待用户
+		if user.State != constant.EVENT_JOIN_USER || user.Stack > 0 {
+			otherUsers = append(otherUsers, user)
+		}
+	}
 
-					// 赢家排第一位,赢家之前通过+100000对应追加到尾部
-					if newUser.Location < winJoinUser.Location {
-						newUser.Location += 100000
-					}
+	endRound := gameRoom.CurrRound
+	c.after(2*time.Second, func() error {
+		return c.startNextRound(ctx, endRound, winJoinUser, otherUsers)
+	})
+}
 
-					newUser.State = constant.EVENT_JOIN_USER
-					newUser.IsBanker = false
-					newUser.IsLookCard = false
-					newUser.TotalBetChips = 0
-					newUser.IsAutoBet = false
-					newUsers = append(newUsers, newUser)
-				}
+// startNextRound 开始下一局,由房间协程执行
+func (c *Game) startNextRound(ctx context.Context, endRound int, winJoinUser *JoinUser, otherUsers []*JoinUser) error {
+	// 重新获取房间,确认仍是刚结束的当局
+	gameRoom, err := c.GetGameRoom(ctx)
+	if err != nil {
+		return err
+	}
+	if gameRoom.State != constant.GAME_ENDED || gameRoom.CurrRound != endRound {
+		return nil
+	}
 
-				// 升序
-				sort.Slice(newUsers, func(i, j int) bool { return newUsers[i].Location < newUsers[j].Location })
+	// 重置游戏设置
+	gameRoom.CurrLocation = 0
+	gameRoom.CurrTimeStamp = 0
+	gameRoom.CurrBetChips = 0
+	gameRoom.State = constant.GAME_WAIT
+	gameRoom.CurrBankerId = winJoinUser.UserId
+	gameRoom.CurrRound = gameRoom.CurrRound + 1
+	gameRoom.ExposedBetChips = gameRoom.LowBetChips
+	gameRoom.ConcealedBetChips = gameRoom.LowBetChips
+	gameRoom.JoinUsers = make(map[int64]int, 0)
+	gameRoom.Records = make(map[int64][]int64, 0)
+	gameRoom.BetChips = make([]int64, 0)
+	gameRoom.Actions = make(map[string]ActionRecord, 0)
+	gameRoom.History = make([]RoundAction, 0)
+
+	callFunc := func(room *GameRoom, joinUser map[int64]*JoinUser) {
+		// 赢家桌上筹码带入下一局
+		if banker, ok := joinUser[winJoinUser.UserId]; ok {
+			banker.Stack = winJoinUser.Stack
+		}
 
-				// 重新排序(Location=0表示庄家,其他从Location=+1开始)
-				for index := range newUsers {
-					newUser := newUsers[index]
-					newUser.Location = index + 1
-					joinUser[newUser.UserId] = newUser
+		// 将当前获取赢家排第一位
+		newUsers := make([]*JoinUser, 0)
+		for index := range otherUsers {
+			newUser := otherUsers[index]
+			if newUser.UserId == winJoinUser.UserId {
+				// 游戏赢家作为庄家排除在排序中
+				continue
+			}
 
-					// 加入房间
-					room.JoinUsers[newUser.UserId] = room.CurrRound
-				}
+			// 赢家排第一位,赢家之前通过+100000对应追加到尾部
+			if newUser.Location < winJoinUser.Location {
+				newUser.Location += 100000
 			}
 
-			c.CreateGames(gameRoom, db.User{
-				ID:      winJoinUser.UserId,
-				Address: winJoinUser.Address,
-				HeadPic: winJoinUser.HeadPic,
-			}, callFunc)
-		}()
+			newUser.State = constant.EVENT_JOIN_USER
+			newUser.IsBanker = false
+			newUser.IsLookCard = false
+			newUser.TotalBetChips = 0
+			newUser.IsAutoBet = false
+			newUsers = append(newUsers, newUser)
+		}
+
+		// 升序
+		sort.Slice(newUsers, func(i, j int) bool { return newUsers[i].Location < newUsers[j].Location })
+
+		// 重新排序(Location=0表示庄家,其他从Location=+1开始)
+		for index := range newUsers {
+			newUser := newUsers[index]
+			newUser.Location = index + 1
+			joinUser[newUser.UserId] = newUser
+
+			// 加入房间
+			room.JoinUsers[newUser.UserId] = room.CurrRound
+		}
 	}
 
-	return true
+	err = c.createGames(gameRoom, db.User{
+		ID:      winJoinUser.UserId,
+		Address: winJoinUser.Address,
+		HeadPic: winJoinUser.HeadPic,
+	}, callFunc)
+	if err != nil {
+		return err
+	}
+
+	// 上局进行中离线的用户兑回桌上筹码
+	if gameRoom, err = c.GetGameRoom(ctx); err != nil {
+		return err
+	}
+	userIds := make([]int64, 0, len(gameRoom.JoinUsers))
+	for userId := range gameRoom.JoinUsers {
+		userIds = append(userIds, userId)
+	}
+	c.cashOutOffline(ctx, gameRoom, userIds)
+	return nil
 }
 
 // SetNextOperateUser 设置下个操作用户
-func (c Game) SetNextOperateUser(ctx context.Context, gameRoom *GameRoom, operateLocation int) {
+func (c *Game) SetNextOperateUser(ctx context.Context, gameRoom *GameRoom, operateLocation int) {
 
 	// 确认是否游戏中
 	if gameRoom.State != constant.GAME_PAYING {
@@ -547,21 +702,44 @@ func (c Game) SetNextOperateUser(ctx context.Context, gameRoom *GameRoom, operat
 		}
 	}
 
+	// 取消上个操作用户未触发的倒计时
+	lastUsers := make(map[int64]*JoinUser, 0)
+	for index := range joinUsers {
+		user := joinUsers[index]
+		if user.Location == gameRoom.CurrLocation && len(user.TimerId) > 0 {
+			c.cancelTimer(user)
+			lastUsers[user.UserId] = user
+		}
+	}
+
 	// 更新游戏房间信息
 	gameRoom.CurrLocation = location
-	gameRoom.CurrTimeStamp = time.Now().Unix()
-	err := c.setGameRoomCache(context.Background(), gameRoom)
+	now := c.clock.Now()
+	gameRoom.CurrTimeStamp = now.Unix()
+	gameRoom.SetLocationTime = now.UnixMilli()
+	err := c.setBatchCache(context.Background(), gameRoom, lastUsers)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	// 延迟1秒执行
-	go func() {
-		timer := time.NewTimer(time.Second)
-		<-timer.C
+	// 延迟1秒由房间协程通知当前操作用户
+	currRound := gameRoom.CurrRound
+	operateUserId := locationUsers[location].UserId
+	c.after(time.Second, func() error {
+		// 重新获取房间,确认当前操作用户未发生变化
+		gameRoom, err := c.GetGameRoom(ctx)
+		if err != nil {
+			return err
+		}
+		if gameRoom.State != constant.GAME_PAYING || gameRoom.CurrRound != currRound || gameRoom.CurrLocation != location {
+			return nil
+		}
 
-		operateUser := locationUsers[location]
+		operateUser := c.GetJoinUser(ctx, operateUserId, currRound)
+		if operateUser == nil || operateUser.State != constant.EVENT_PLAYING_USER {
+			return nil
+		}
 
 		// 用户已设置自动跟注
 		if operateUser.IsAutoBet {
@@ -586,10 +764,11 @@ func (c Game) SetNextOperateUser(ctx context.Context, gameRoom *GameRoom, operat
 			ListBetChips:    c.GetListBetChips(gameRoom, lowBetChips),
 		}
 		c.BroadcastMsg(ctx, gameRoom, &eventMsg)
-	}()
+		return nil
+	})
 }
 
-func (c Game) GetListBetChips(gameRoom *GameRoom, currentBetChips int64) []int64 {
+func (c *Game) GetListBetChips(gameRoom *GameRoom, currentBetChips int64) []int64 {
 
 	listBetChips := make([]int64, 0)
 	if gameRoom.LowBetChips < currentBetChips {
@@ -611,16 +790,23 @@ func (c Game) GetListBetChips(gameRoom *GameRoom, currentBetChips int64) []int64
 }
 
 // CreateGames 创建游戏
-func (c Game) CreateGames(gameRoom *GameRoom, user db.User, callFunc func(*GameRoom, map[int64]*JoinUser)) error {
+func (c *Game) CreateGames(gameRoom *GameRoom, user db.User, callFunc func(*GameRoom, map[int64]*JoinUser)) error {
+	return c.Do(func() error { return c.createGames(gameRoom, user, callFunc) })
+}
+
+// createGames 由房间协程执行
+func (c *Game) createGames(gameRoom *GameRoom, user db.User, callFunc func(*GameRoom, map[int64]*JoinUser)) error {
 	// 更新游戏房间信息
-	c.setGameRoomCache(context.Background(), gameRoom)
+	if err := c.setGameRoomCache(context.Background(), gameRoom); err != nil {
+		return err
+	}
 
 	// UserJoinRoom 庄家默认加入游戏
-	return c.UserJoinRoom(user, false, callFunc, nil)
+	return c.userJoinRoom(user, false, callFunc, nil)
 }
 
 // GetCurrentLowBetChips 获取当前投注最低筹码
-func (c Game) GetCurrentLowBetChips(gameRoom *GameRoom, joinUser *JoinUser, checkFunc func(int64) error) (int64, error) {
+func (c *Game) GetCurrentLowBetChips(gameRoom *GameRoom, joinUser *JoinUser, checkFunc func(int64) error) (int64, error) {
 	if joinUser.IsLookCard {
 		// 已看牌
 		exposedBetChips := gameRoom.ConcealedBetChips * 2
@@ -649,80 +835,67 @@ func (c Game) GetCurrentLowBetChips(gameRoom *GameRoom, joinUser *JoinUser, chec
 	}
 }
 
-// DelayCallback 延迟队列消息
-func (c Game) DelayCallback(delayMsg DelayMsg) bool {
-
-	switch delayMsg.DelayType {
-	case constant.DELAY_AUTOBET:
-		err := c.UserBetting(delayMsg.UserId, 0, delayMsg.CurrRound, delayMsg.BetChips, func(gameRoom *GameRoom, joinUser *JoinUser) error {
-			if gameRoom.CurrLocation != joinUser.Location || gameRoom.SetLocationTime != delayMsg.Timestamp {
-				// 延续消息处理过期
-				return constant.DelayOperateExpiredError
-			}
-			return nil
-		}, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
-			// 整体放入同一个事物中
-			// 扣除用户的跟注/加注筹码-操作数据库
-			return c.UserService.DeductRaiseBetting(gameRoom.GameId, gameRoom.CurrRound, joinUser.UserId, delayMsg.BetChips, func(betChips int64) error {
-				if joinUser.IsLookCard {
-					// 明牌下注筹码
-					gameRoom.ExposedBetChips = betChips
-				} else {
-					// 隐藏下注筹码
-					gameRoom.ConcealedBetChips = betChips
-				}
-
-				// 下注筹码记录
-				gameRoom.BetChips = append(gameRoom.BetChips, betChips)
-
-				joinUser.TotalBetChips += betChips
-				gameRoom.TotalBetChips += betChips
-				return callUpdateFunc(false, nil)
-			})
-		})
+// autoBetTimeout 用户设置自动跟注,倒计时1秒后自动下注,由房间协程执行
+func (c *Game) autoBetTimeout(delayMsg DelayMsg) error {
+	err := c.userBetting(delayMsg.UserId, 0, delayMsg.CurrRound, delayMsg.BetChips, func(gameRoom *GameRoom, joinUser *JoinUser) error {
+		if gameRoom.CurrLocation != joinUser.Location || gameRoom.SetLocationTime != delayMsg.Timestamp {
+			// 延续消息处理过期
+			return constant.DelayOperateExpiredError
+		}
+		return nil
+	}, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
+		return callUpdateFunc(false, nil)
+	})
 
-		if err != nil {
-			if errors.Is(err, constant.GameRaisBetNotEnoughError) {
-				//  下注金额不足取消自动操作
-				c.UserSetAutoBetting(delayMsg.UserId, false, delayMsg.CurrRound)
-			}
-			log.Printf("operate delay userId=%d, auto betting error: %s", delayMsg.UserId, err.Error())
+	if err != nil {
+		if errors.Is(err, constant.GameRaisBetNotEnoughError) || errors.Is(err, constant.UserNotEnoughBetError) {
+			//  下注金额不足取消自动操作
+			c.userSetAutoBetting(delayMsg.UserId, false, delayMsg.CurrRound)
 		}
-		break
-	case constant.DELAY_GIVEUP:
-		// 超时用户自动放弃
-		err := c.UserGiveUpCard(delayMsg.UserId, delayMsg.CurrRound, func(gameRoom *GameRoom, joinUser *JoinUser) error {
-			if gameRoom.CurrLocation != joinUser.Location || gameRoom.SetLocationTime != delayMsg.Timestamp {
-				// 延续消息处理过期
-				return constant.DelayOperateExpiredError
-			}
+		log.Printf("operate delay userId=%d, auto betting error: %s", delayMsg.UserId, err.Error())
+	}
+	return nil
+}
 
-			// 游戏玩家是否设置自动下注
-			if joinUser.IsAutoBet {
-				// 自动下注延迟队列
-				AutoBetDelayFunc(c, gameRoom, joinUser)
+// giveUpTimeout 超时用户自动放弃,由房间协程执行
+func (c *Game) giveUpTimeout(delayMsg DelayMsg) error {
+	err := c.userGiveUpCard(delayMsg.UserId, delayMsg.CurrRound, func(gameRoom *GameRoom, joinUser *JoinUser) error {
+		if gameRoom.CurrLocation != joinUser.Location || gameRoom.SetLocationTime != delayMsg.Timestamp {
+			// 延续消息处理过期
+			return constant.DelayOperateExpiredError
+		}
 
-				// 用户设置自动下注操作
-				return constant.UserSetAutoBettingError
-			}
-			return nil
-		})
+		// 游戏玩家是否设置自动下注
+		if joinUser.IsAutoBet {
+			// 自动下注延迟队列
+			AutoBetDelayFunc(c, gameRoom, joinUser)
 
-		if err != nil {
-			log.Printf("operate delay userId=%d, auto give up card error: %s", delayMsg.UserId, err.Error())
+			// 用户设置自动下注操作
+			return constant.UserSetAutoBettingError
 		}
-		break
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("operate delay userId=%d, auto give up card error: %s", delayMsg.UserId, err.Error())
 	}
-	return true
+	return nil
+}
+
+// offlineTimeout 离开超时用户判定离线,由房间协程执行
+func (c *Game) offlineTimeout(delayMsg DelayMsg) error {
+	c.UserOffline(context.Background(), delayMsg.UserId, delayMsg.Timestamp)
+	return nil
 }
 
 // StartGame 游戏开始并下底注
-func (c Game) StartGame(startUserId int64, handlerFunc func(*GameRoom, map[int64]*JoinUser, func(map[int64]UserPoker) error) error) error {
-	ctx := context.Background()
+func (c *Game) StartGame(startUserId int64, handlerFunc func(*GameRoom, map[int64]*JoinUser, func(map[int64]UserPoker) error) error, opts ...ActionOption) error {
+	return c.Do(func() error { return c.startGame(startUserId, handlerFunc) }, opts...)
+}
 
-	// 全局方法加锁->防止死锁(连接、离线、看牌、弃牌、下注及比较、延迟队列、游戏开始-排除重新开局)
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+// startGame 由房间协程执行
+func (c *Game) startGame(startUserId int64, handlerFunc func(*GameRoom, map[int64]*JoinUser, func(map[int64]UserPoker) error) error) error {
+	ctx := context.Background()
 
 	gameRoom, err := c.GetGameRoom(ctx)
 	if err != nil {
@@ -739,6 +912,11 @@ func (c Game) StartGame(startUserId int64, handlerFunc func(*GameRoom, map[int64
 		return constant.GamePayingError
 	}
 
+	// 服务关闭中不再开始新的一局
+	if c.isDraining != nil && c.isDraining() {
+		return constant.ServerShuttingDownError
+	}
+
 	// 你不是庄家不能开始游戏
 	if gameRoom.CurrBankerId != startUserId {
 		return constant.GameNotAuthorityStartError
@@ -769,14 +947,30 @@ func (c Game) StartGame(startUserId int64, handlerFunc func(*GameRoom, map[int64
 
 	joinUsers := make(map[int64]*JoinUser, 0)
 	for index := range readyUsers {
-		// 设置用户状态
+		// 桌上筹码不足底注(庄家未买入)
 		joinUser := readyUsers[index]
+		if joinUser.Stack < gameRoom.LowBetChips {
+			return &constant.InsufficientFundsError{UserId: joinUser.UserId, Balance: joinUser.Stack, Amount: gameRoom.LowBetChips}
+		}
+
+		// 设置用户状态
 		joinUser.State = constant.EVENT_PLAYING_USER
 		joinUser.IsLookCard = false
 		joinUsers[joinUser.UserId] = joinUser
 	}
 
-	// 自动扣除每个用户的底注
+	// 从桌上筹码扣除每个用户的底注,结算时统一记账
+	gameRoom.TotalBetChips = 0
+	for _, joinUser := range joinUsers {
+		joinUser.Stack -= gameRoom.LowBetChips
+		joinUser.TotalBetChips = gameRoom.LowBetChips
+		gameRoom.TotalBetChips += gameRoom.LowBetChips
+
+		// 下注筹码记录
+		gameRoom.BetChips = append(gameRoom.BetChips, gameRoom.LowBetChips)
+	}
+
+	// 发牌
 	errs := handlerFunc(gameRoom, joinUsers, func(userPokers map[int64]UserPoker) error {
 		// 更新缓存 gameRoom，joinUsers
 		gameRoom.CurrLocation = 0
@@ -801,14 +995,13 @@ func (c Game) StartGame(startUserId int64, handlerFunc func(*GameRoom, map[int64
 }
 
 // UserJoinRoom 加入游戏
-func (c Game) UserJoinRoom(loginUser db.User, isReadJoin bool, callFunc func(*GameRoom, map[int64]*JoinUser), handlerFunc func(gameRoom *GameRoom) error) error {
-	ctx := context.Background()
+func (c *Game) UserJoinRoom(loginUser db.User, isReadJoin bool, callFunc func(*GameRoom, map[int64]*JoinUser), handlerFunc func(gameRoom *GameRoom) error, opts ...ActionOption) error {
+	return c.Do(func() error { return c.userJoinRoom(loginUser, isReadJoin, callFunc, handlerFunc) }, opts...)
+}
 
-	// 全局方法加锁->防止死锁(连接、离线、看牌、弃牌、下注及比较、延迟队列、游戏开始-排除重新开局)
-	if callFunc == nil {
-		c.Mutex.Lock()
-		defer c.Mutex.Unlock()
-	}
+// userJoinRoom 由房间协程执行
+func (c *Game) userJoinRoom(loginUser db.User, isReadJoin bool, callFunc func(*GameRoom, map[int64]*JoinUser), handlerFunc func(gameRoom *GameRoom) error) error {
+	ctx := context.Background()
 
 	// 指定当前用户发现消息
 	sendMsgByIdFunc := func(gameRoom *GameRoom, eventMsg *EventMsg) {
@@ -858,7 +1051,7 @@ func (c Game) UserJoinRoom(loginUser db.User, isReadJoin bool, callFunc func(*Ga
 					lowBetChips, _ := c.GetCurrentLowBetChips(gameRoom, user, nil)
 
 					// 倒计时秒+1
-					diffTimeStamp := time.Now().Unix() - gameRoom.CurrTimeStamp
+					diffTimeStamp := c.clock.Now().Unix() - gameRoom.CurrTimeStamp
 					if diffTimeStamp > 0 {
 						eventMsg.TotalSecond = CountdownSecond
 						if diffTimeStamp >= CountdownSecond {
@@ -925,6 +1118,11 @@ func (c Game) UserJoinRoom(loginUser db.User, isReadJoin bool, callFunc func(*Ga
 		}
 	}
 
+	// 准备开始需先买入,桌上筹码不能低于底注
+	if isReadJoin && joinUser.Stack < gameRoom.LowBetChips {
+		return &constant.InsufficientFundsError{UserId: loginUser.ID, Balance: joinUser.Stack, Amount: gameRoom.LowBetChips}
+	}
+
 	gameRoom.JoinUsers[loginUser.ID] = gameRoom.CurrRound
 	joinUsers := make(map[int64]*JoinUser, 0)
 	joinUser.State = state
@@ -953,12 +1151,13 @@ func (c Game) UserJoinRoom(loginUser db.User, isReadJoin bool, callFunc func(*Ga
 }
 
 // UserLookCard 用户查看自己的底牌
-func (c Game) UserLookCard(userId int64, currRound int, handlerFunc func(*GameRoom) (string, error)) error {
-	ctx := context.Background()
+func (c *Game) UserLookCard(userId int64, currRound int, handlerFunc func(*GameRoom) (string, error), opts ...ActionOption) error {
+	return c.Do(func() error { return c.userLookCard(userId, currRound, handlerFunc) }, opts...)
+}
 
-	// 全局方法加锁->防止死锁(连接、离线、看牌、弃牌、下注及比较、延迟队列、游戏开始-排除重新开局)
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+// userLookCard 由房间协程执行
+func (c *Game) userLookCard(userId int64, currRound int, handlerFunc func(*GameRoom) (string, error)) error {
+	ctx := context.Background()
 
 	// 检查用户是否当前局游戏中
 	gameRoom, err := c.CheckPlaying(ctx, userId, currRound)
@@ -977,6 +1176,7 @@ func (c Game) UserLookCard(userId int64, currRound int, handlerFunc func(*GameRo
 	if !joinUser.IsLookCard {
 		joinUser.IsLookCard = true
 		joinUser.IsAutoBet = false
+		gameRoom.addHistory(RoundAction{UserId: userId, Type: constant.EVENT_LOOK_CARD}, c.clock.Now())
 
 		// 更新缓存 joinUser
 		if errs := c.setJoinUserCache(ctx, gameRoom, joinUser); errs != nil {
@@ -989,25 +1189,31 @@ func (c Game) UserLookCard(userId int64, currRound int, handlerFunc func(*GameRo
 	message := CardMessage{Card: cardStr, BetChips: lowBetChips}
 	c.SendMsgByUserId(context.Background(), gameRoom, userId, message.ToJsonStr(constant.EVENT_LOOK_CARD))
 
-	// 广播消息通知所有用户
-	go func() {
-		time.Sleep(time.Second)
+	// 延迟1秒由房间协程广播消息通知所有用户
+	c.after(time.Second, func() error {
+		gameRoom, err := c.GetGameRoom(ctx)
+		if err != nil {
+			return err
+		}
+
 		c.BroadcastMsg(ctx, gameRoom, &EventMsg{
 			Type:   constant.EVENT_LOOK_CARD,
 			UserId: userId,
 		})
-	}()
+		return nil
+	})
 
 	return nil
 }
 
 // UserGiveUpCard 用户弃牌
-func (c Game) UserGiveUpCard(userId int64, currRound int, autoDelayFunc func(*GameRoom, *JoinUser) error) error {
-	ctx := context.Background()
+func (c *Game) UserGiveUpCard(userId int64, currRound int, autoDelayFunc func(*GameRoom, *JoinUser) error, opts ...ActionOption) error {
+	return c.Do(func() error { return c.userGiveUpCard(userId, currRound, autoDelayFunc) }, opts...)
+}
 
-	// 全局方法加锁->防止死锁(连接、离线、看牌、弃牌、下注及比较、延迟队列、游戏开始-排除重新开局)
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+// userGiveUpCard 由房间协程执行
+func (c *Game) userGiveUpCard(userId int64, currRound int, autoDelayFunc func(*GameRoom, *JoinUser) error) error {
+	ctx := context.Background()
 
 	// 检查用户是否当前局游戏中
 	gameRoom, err := c.CheckPlaying(ctx, userId, currRound)
@@ -1031,6 +1237,7 @@ func (c Game) UserGiveUpCard(userId int64, currRound int, autoDelayFunc func(*Ga
 	if joinUser.State != constant.EVENT_GIVE_UP_USER {
 		joinUser.IsAutoBet = false
 		joinUser.State = constant.EVENT_GIVE_UP_USER
+		gameRoom.addHistory(RoundAction{UserId: userId, Type: constant.EVENT_GIVE_UP_USER}, c.clock.Now())
 
 		// 更新缓存 joinUser
 		err = c.setJoinUserCache(ctx, gameRoom, joinUser)
@@ -1063,12 +1270,13 @@ func (c Game) UserGiveUpCard(userId int64, currRound int, autoDelayFunc func(*Ga
 type HandlerCompareFunc func(*GameRoom, *JoinUser, func(bool, *UserPoker) error) error
 
 // UserBetting 用户跟注\加注
-func (c Game) UserBetting(userId, compareId int64, currRound int, betChips int64, autoDelayFunc func(*GameRoom, *JoinUser) error, handlerFunc HandlerCompareFunc) error {
-	ctx := context.Background()
+func (c *Game) UserBetting(userId, compareId int64, currRound int, betChips int64, autoDelayFunc func(*GameRoom, *JoinUser) error, handlerFunc HandlerCompareFunc, opts ...ActionOption) error {
+	return c.Do(func() error { return c.userBetting(userId, compareId, currRound, betChips, autoDelayFunc, handlerFunc) }, opts...)
+}
 
-	// 全局方法加锁->防止死锁(连接、离线、看牌、弃牌、下注及比较、延迟队列、游戏开始-排除重新开局)
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+// userBetting 由房间协程执行
+func (c *Game) userBetting(userId, compareId int64, currRound int, betChips int64, autoDelayFunc func(*GameRoom, *JoinUser) error, handlerFunc HandlerCompareFunc) error {
+	ctx := context.Background()
 
 	// 检查用户是否当前局游戏中
 	gameRoom, err := c.CheckPlaying(ctx, userId, currRound)
@@ -1112,6 +1320,11 @@ func (c Game) UserBetting(userId, compareId int64, currRound int, betChips int64
 		return err
 	}
 
+	// 桌上筹码不足
+	if joinUser.Stack < betChips {
+		return &constant.InsufficientFundsError{UserId: joinUser.UserId, Balance: joinUser.Stack, Amount: betChips}
+	}
+
 	// 下注并找用户比较大小(达到封顶则直接进入全部比牌)
 	isPkRequest := false
 	var compareUser *JoinUser
@@ -1137,20 +1350,32 @@ func (c Game) UserBetting(userId, compareId int64, currRound int, betChips int64
 		// 记录比牌结果值
 		pkResult = isPkSuccess
 
+		// 从桌上筹码下注,结算时统一记账
+		c.betFromStack(gameRoom, joinUser, betChips)
+
 		switch isPkRequest {
 		case true:
 			// 设置默认pk失败的用户
 			pkFailUserId := userId
+			pkWinUserId := compareId
 
 			// PK类型的请求
 			if isPkSuccess {
 				// 设置对方PK失败
 				compareUser.State = constant.EVENT_COMPARE_LOSE_USER
 				pkFailUserId = compareUser.UserId
+				pkWinUserId = userId
 			} else {
 				// 设置自己PK失败
 				joinUser.State = constant.EVENT_COMPARE_LOSE_USER
 			}
+			gameRoom.addHistory(RoundAction{
+				UserId:    userId,
+				Type:      constant.EVENT_COMPARE_LOSE_USER,
+				BetChips:  betChips,
+				CompareId: compareId,
+				WinUserId: pkWinUserId,
+			}, c.clock.Now())
 
 			// 更新缓存 gameRoom,joinUser
 			joinUsers := make(map[int64]*JoinUser, 0)
@@ -1165,6 +1390,7 @@ func (c Game) UserBetting(userId, compareId int64, currRound int, betChips int64
 
 			return errs
 		default:
+			gameRoom.addHistory(RoundAction{UserId: userId, Type: constant.EVENT_BET_CHIPS, BetChips: betChips}, c.clock.Now())
 			return c.setJoinUserCache(ctx, gameRoom, joinUser)
 		}
 	})
@@ -1201,13 +1427,33 @@ func (c Game) UserBetting(userId, compareId int64, currRound int, betChips int64
 	return err
 }
 
+// betFromStack 从桌上筹码扣除跟注/加注筹码
+func (c *Game) betFromStack(gameRoom *GameRoom, joinUser *JoinUser, betChips int64) {
+	// 记录全局下注最大值
+	if joinUser.IsLookCard {
+		// 明牌下注筹码
+		gameRoom.ExposedBetChips = betChips
+	} else {
+		// 隐藏下注筹码
+		gameRoom.ConcealedBetChips = betChips
+	}
+
+	// 下注筹码记录
+	gameRoom.BetChips = append(gameRoom.BetChips, betChips)
+
+	joinUser.Stack -= betChips
+	joinUser.TotalBetChips += betChips
+	gameRoom.TotalBetChips += betChips
+}
+
 // UserSetAutoBetting 用户设置自动下注
-func (c Game) UserSetAutoBetting(userId int64, isAutoBet bool, currRound int) error {
-	ctx := context.Background()
+func (c *Game) UserSetAutoBetting(userId int64, isAutoBet bool, currRound int, opts ...ActionOption) error {
+	return c.Do(func() error { return c.userSetAutoBetting(userId, isAutoBet, currRound) }, opts...)
+}
 
-	// 全局方法加锁->防止死锁(连接、离线、看牌、弃牌、下注及比较、延迟队列、游戏开始-排除重新开局)
-	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
+// userSetAutoBetting 由房间协程执行
+func (c *Game) userSetAutoBetting(userId int64, isAutoBet bool, currRound int) error {
+	ctx := context.Background()
 
 	gameRoom, err := c.CheckAvailability(ctx, userId)
 	if err != nil {
@@ -1231,8 +1477,13 @@ func (c Game) UserSetAutoBetting(userId int64, isAutoBet bool, currRound int) er
 		return errs
 	}
 
-	// 自动下注延迟队列
-	AutoBetDelayFunc(c, gameRoom, joinUser)
+	if isAutoBet {
+		// 自动下注延迟队列
+		AutoBetDelayFunc(c, gameRoom, joinUser)
+	} else if gameRoom.State == constant.GAME_PAYING && joinUser.State == constant.EVENT_PLAYING_USER {
+		// 取消自动下注->恢复剩余倒计时超时自动放弃
+		TimeOutGiveUpDelayFunc(c, gameRoom, joinUser)
+	}
 
 	// 发送消息->指定用户
 	message := AutoBetMessage{IsAutoBet: isAutoBet}
@@ -1241,148 +1492,58 @@ func (c Game) UserSetAutoBetting(userId int64, isAutoBet bool, currRound int) er
 }
 
 // GetJoinUser 获取房间当前用户信息
-func (c Game) GetJoinUser(ctx context.Context, userId int64, currRound int) *JoinUser {
-	value, err := c.RedisClient.Get(ctx, fmt.Sprintf("join-user:%s-%d-%d", c.GameId, userId, currRound)).Result()
-	if err == nil && len(value) > 0 {
-		var joinUser *JoinUser
-		if errs := json.Unmarshal([]byte(value), &joinUser); errs == nil {
-			// TODO 不使用缓存中账户余额,每次实时获取数据库值
-			joinUser.AccountBetChips = 0
-			return joinUser
-		}
-	}
-	return nil
-}
-
-// GetGameRoom 获取房间
-func (c Game) GetGameRoom(ctx context.Context) (*GameRoom, error) {
-	value, err := c.RedisClient.Get(ctx, fmt.Sprintf("game-room:%s", c.GameId)).Result()
+func (c *Game) GetJoinUser(ctx context.Context, userId int64, currRound int) *JoinUser {
+	joinUser, err := c.Store.LoadSeat(ctx, c.GameId, userId, currRound)
 	if err != nil {
-		log.Print(err)
-		// 获取服务数据内部异常
-		return nil, constant.CacheGetInfoError
-	}
-
-	// 获取游戏数据不存在
-	if len(value) <= 0 {
-		return nil, constant.GamePareError
+		return nil
 	}
 
-	var gameRoom GameRoom
-	err = json.Unmarshal([]byte(value), &gameRoom)
-	if err != nil {
-		return nil, constant.GamePareError
-	}
+	// 账号筹码展示为桌上筹码,无须每次查询数据库
+	joinUser.AccountBetChips = joinUser.Stack
+	joinUser.Presence = 0
+	return joinUser
+}
 
-	return &gameRoom, nil
+// GetGameRoom 获取房间
+func (c *Game) GetGameRoom(ctx context.Context) (*GameRoom, error) {
+	return c.Store.LoadRoom(ctx, c.GameId)
 }
 
 // setGameRoomCache 更新游戏房间信息
-func (c Game) setGameRoomCache(ctx context.Context, gameRoom *GameRoom) error {
-	gameJson, err := json.Marshal(gameRoom)
-	if err != nil {
-		return err
-	}
-
-	// 更新到缓存
-	c.RedisClient.Set(ctx, fmt.Sprintf("game-room:%s", gameRoom.GameId), gameJson, 24*time.Hour)
-	return nil
+func (c *Game) setGameRoomCache(ctx context.Context, gameRoom *GameRoom) error {
+	c.recordAction(gameRoom)
+	return c.saved(c.Store.SaveRoom(ctx, gameRoom, nil))
 }
 
 // setBatchCache 批量更新缓存
-func (c Game) setBatchCache(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser) error {
-	// 更新缓存
+func (c *Game) setBatchCache(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser) error {
 	// gameRoom，joinUser
-	pipeline := c.RedisClient.TxPipeline()
-
-	gameJson, err := json.Marshal(gameRoom)
-	if err != nil {
-		return err
-	}
-	pipeline.Set(ctx, fmt.Sprintf("game-room:%s", gameRoom.GameId), gameJson, 24*time.Hour)
-
-	for userId := range joinUsers {
-		joinUser := joinUsers[userId]
-		userJson, err := json.Marshal(joinUser)
-		if err != nil {
-			return err
-		}
-		pipeline.Set(ctx, fmt.Sprintf("join-user:%s-%d-%d", gameRoom.GameId, userId, gameRoom.CurrRound), userJson, 24*time.Hour)
-	}
-
-	// Execute all queued commands in a single round trip
-	_, err2 := pipeline.Exec(ctx)
-	if err2 != nil {
-		return err2
-	}
-
-	return nil
+	c.recordAction(gameRoom)
+	return c.saved(c.Store.SaveRoom(ctx, gameRoom, joinUsers))
 }
 
 // GetUserPokerCache 获取用户底牌
-func (c Game) GetUserPokerCache(ctx context.Context, gameRoom *GameRoom, userId int64) (*UserPoker, error) {
-	value, err := c.RedisClient.Get(ctx, fmt.Sprintf("user-poker:%s-%d-%d", gameRoom.GameId, userId, gameRoom.CurrRound)).Result()
-	if err != nil {
-		log.Print(err)
-		// 获取服务数据内部异常
-		return nil, constant.CacheGetInfoError
-	}
-
-	// 获取游戏数据不存在
-	if len(value) <= 0 {
-		return nil, constant.GamePareError
-	}
-
-	var userPoker *UserPoker
-	err = json.Unmarshal([]byte(value), &userPoker)
-	if err != nil {
-		return nil, constant.GamePareError
-	}
-
-	return userPoker, nil
+func (c *Game) GetUserPokerCache(ctx context.Context, gameRoom *GameRoom, userId int64) (*UserPoker, error) {
+	return c.Store.LoadCards(ctx, gameRoom.GameId, userId, gameRoom.CurrRound)
 }
 
 // setPokerBatchCache 批量更新缓存
-func (c Game) setPokerBatchCache(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser, userPokers map[int64]UserPoker) error {
-	// 更新缓存
-	// gameRoom，joinUser
-	pipeline := c.RedisClient.TxPipeline()
-
-	gameJson, err := json.Marshal(gameRoom)
-	if err != nil {
-		return err
-	}
-	pipeline.Set(ctx, fmt.Sprintf("game-room:%s", gameRoom.GameId), gameJson, 24*time.Hour)
-
-	for userId := range joinUsers {
-		joinUser := joinUsers[userId]
-		userJson, errs := json.Marshal(joinUser)
-		if errs != nil {
-			return errs
-		}
-		pipeline.Set(ctx, fmt.Sprintf("join-user:%s-%d-%d", gameRoom.GameId, userId, gameRoom.CurrRound), userJson, 24*time.Hour)
-	}
-
-	for userId := range userPokers {
-		pokerJson, errs := json.Marshal(userPokers[userId])
-		if errs != nil {
-			return errs
-		}
-		pipeline.Set(ctx, fmt.Sprintf("user-poker:%s-%d-%d", gameRoom.GameId, userId, gameRoom.CurrRound), pokerJson, 24*time.Hour)
-	}
-
-	// Execute all queued commands in a single round trip
-	_, err2 := pipeline.Exec(ctx)
-	if err2 != nil {
-		return err2
-	}
+func (c *Game) setPokerBatchCache(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser, userPokers map[int64]UserPoker) error {
+	// gameRoom，joinUser，userPoker
+	c.recordAction(gameRoom)
+	return c.saved(c.Store.SaveCards(ctx, gameRoom, joinUsers, userPokers))
+}
 
-	return nil
+// setJoinUserCache 单个用户信息更新缓存,同时保存房间以校验版本号
+func (c *Game) setJoinUserCache(ctx context.Context, gameRoom *GameRoom, joinUser *JoinUser) error {
+	c.recordAction(gameRoom)
+	return c.saved(c.Store.SaveRoom(ctx, gameRoom, map[int64]*JoinUser{joinUser.UserId: joinUser}))
 }
 
-// setJoinUserCache 单个用户信息更新缓存
-func (c Game) setJoinUserCache(ctx context.Context, gameRoom *GameRoom, joinUser *JoinUser) error {
-	userJson, _ := json.Marshal(joinUser)
-	c.RedisClient.Set(ctx, fmt.Sprintf("join-user:%s-%d-%d", gameRoom.GameId, joinUser.UserId, gameRoom.CurrRound), userJson, 24*time.Hour)
-	return nil
+// saved 记录当前命令已保存过房间状态
+func (c *Game) saved(err error) error {
+	if err == nil {
+		c.written = true
+	}
+	return err
 }
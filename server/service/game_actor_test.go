@@ -0,0 +1,459 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/daley"
+	"game-3-card-poker/server/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testBalance = int64(100000)
+	testBuyIn   = int64(10000)
+)
+
+// newTestGamePool game pool backed by miniredis and an in-memory sqlite database
+func newTestGamePool(t *testing.T) *GamePool {
+	t.Helper()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	pool := NewGamePool(rdb, NewRedisGameStore(rdb), newTestUserService(t), time.Minute)
+	pool.RegisterDelayJobs(daley.NewRegistry("test-delay-queue", rdb))
+	return pool
+}
+
+// newTestUserService user service backed by a file sqlite database with several connections,
+// concurrent transactions run on different connections like a real database
+func newTestUserService(t *testing.T) *UserService {
+	t.Helper()
+
+	// 写事务等待其他连接的写锁,避免 database is locked
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_journal_mode=WAL&_busy_timeout=10000&_sync=OFF"
+	gormDB, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{SingularTable: true},
+		Logger:         logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, _ := gormDB.DB()
+	sqlDB.SetMaxOpenConns(8)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err = gormDB.AutoMigrate(db.User{}, db.UserHistory{}, db.LedgerJournal{}, db.LedgerEntry{}, db.GameOutbox{}, db.Game{}, db.GameRound{}, db.RoundSeat{}, db.UserStats{}, db.LeaderboardSnapshot{}, db.UserAchievement{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewUserService(db.NewUserDB(gormDB), db.NewLedgerDB(gormDB), db.NewOutboxDB(gormDB), db.NewRoundDB(gormDB), db.NewUserHistoryDB(gormDB), db.NewUserStatsDB(gormDB),
+		NewLeaderboard(redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}), db.NewLeaderboardDB(gormDB)), db.NewAchievementDB(gormDB))
+}
+
+// newTestGame creates a room with the given number of ready players
+func newTestGame(t *testing.T, pool *GamePool, players int) (*Game, []db.User) {
+	t.Helper()
+
+	users := make([]db.User, 0, players)
+	for i := 0; i < players; i++ {
+		user, err := pool.UserService.SignatureVerify(fmt.Sprintf("aleo-test-%d", i), testBalance, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+
+	gameRoom := &GameRoom{
+		GameId:       fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		JoinUsers:    make(map[int64]int, 0),
+		Records:      make(map[int64][]int64, 0),
+		BetChips:     make([]int64, 0),
+		Minimum:      players,
+		State:        constant.GAME_WAIT,
+		TotalRounds:  3,
+		CurrRound:    1,
+		LowBetChips:  10,
+		TopBetChips:  1 << 40,
+		CurrBankerId: users[0].ID,
+		CreateUser:   users[0].ID,
+		CreateAt:     time.Now(),
+	}
+
+	game, err := pool.CreateGame(gameRoom, users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(game.Stop)
+	if err := game.UserBuyIn(users[0].ID, testBuyIn); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users[1:] {
+		if err := game.UserJoinRoom(user, false, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := game.UserBuyIn(user.ID, testBuyIn); err != nil {
+			t.Fatal(err)
+		}
+		if err := game.UserJoinRoom(user, true, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return game, users
+}
+
+// testStartGame deals the cards, same as the websocket start handler
+func testStartGame(game *Game, userId int64) error {
+	return game.StartGame(userId, func(gameRoom *GameRoom, joinUsers map[int64]*JoinUser, next func(map[int64]UserPoker) error) error {
+		userIds := make([]int64, 0)
+		for id := range joinUsers {
+			userIds = append(userIds, id)
+		}
+
+		cardPoker := CardPoker{}
+		cardPoker.InitShufflePoker()
+		return next(cardPoker.LicenseCardPoker(userIds))
+	})
+}
+
+// testBetting raises the bet of the current player, same as the websocket betting handler
+func testBetting(game *Game, userId int64, betChips int64) error {
+	return game.UserBetting(userId, 0, 1, betChips, nil, func(gameRoom *GameRoom, joinUser *JoinUser, callUpdateFunc func(bool, *UserPoker) error) error {
+		return callUpdateFunc(false, nil)
+	})
+}
+
+func TestGame_DoSerializesCommands(t *testing.T) {
+	pool := newTestGamePool(t)
+	game := newGame("test-serialize", pool)
+	defer game.Stop()
+
+	counter := 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				game.Do(func() error {
+					counter++
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter != 1000 {
+		t.Fatalf("counter = %d, want 1000", counter)
+	}
+}
+
+func TestGame_DoAfterStop(t *testing.T) {
+	pool := newTestGamePool(t)
+	game := newGame("test-stop", pool)
+	game.Stop()
+
+	if err := game.Do(func() error { return nil }); err != constant.GameStoppedError {
+		t.Fatalf("Do after Stop error = %v, want %v", err, constant.GameStoppedError)
+	}
+}
+
+func TestGame_ConcurrentActions(t *testing.T) {
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 所有玩家同时下注、看牌、设置自动下注,以及延迟队列超时消息
+	autoBetTimeout := pool.delayHandler((*Game).autoBetTimeout)
+	wg := sync.WaitGroup{}
+	for _, user := range users {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(userId int64, i int) {
+				defer wg.Done()
+				switch i % 4 {
+				case 0, 1:
+					testBetting(game, userId, 40)
+				case 2:
+					game.UserLookCard(userId, 1, func(*GameRoom) (string, error) { return "", nil })
+				case 3:
+					autoBetTimeout(DelayMsg{DelayType: constant.DELAY_AUTOBET, GameId: game.GameId, UserId: userId, CurrRound: 1, BetChips: 40}, "")
+				}
+			}(user.ID, i)
+		}
+	}
+	wg.Wait()
+
+	// 房间总下注与玩家下注、桌上筹码保持一致,下注不操作数据库余额
+	err := game.Do(func() error {
+		ctx := context.Background()
+		gameRoom, err := game.GetGameRoom(ctx)
+		if err != nil {
+			return err
+		}
+
+		totalBetChips := int64(0)
+		for _, user := range users {
+			joinUser := game.GetJoinUser(ctx, user.ID, gameRoom.CurrRound)
+			dbUser, errs := game.UserService.GetById(user.ID)
+			if errs != nil {
+				return errs
+			}
+			if dbUser.Balance != testBalance-testBuyIn {
+				return fmt.Errorf("userId=%d balance = %d after betting", user.ID, dbUser.Balance)
+			}
+			if testBuyIn-joinUser.Stack != joinUser.TotalBetChips {
+				return fmt.Errorf("userId=%d deducted %d, room recorded %d", user.ID, testBuyIn-joinUser.Stack, joinUser.TotalBetChips)
+			}
+			totalBetChips += joinUser.TotalBetChips
+		}
+
+		if totalBetChips <= int64(len(users))*gameRoom.LowBetChips {
+			return fmt.Errorf("no bet accepted, total bet chips = %d", totalBetChips)
+		}
+
+		if totalBetChips != gameRoom.TotalBetChips {
+			return fmt.Errorf("room total bet chips = %d, players total = %d", gameRoom.TotalBetChips, totalBetChips)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGame_RetryOnVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, _ := newTestGame(t, pool, 2)
+
+	attempts := 0
+	err := game.Do(func() error {
+		attempts++
+		gameRoom, err := game.GetGameRoom(ctx)
+		if err != nil {
+			return err
+		}
+
+		// 第一次执行时房间被其他实例修改
+		if attempts == 1 {
+			other, _ := pool.Store.LoadRoom(ctx, game.GameId)
+			if errs := pool.Store.SaveRoom(ctx, other, nil); errs != nil {
+				return errs
+			}
+		}
+
+		gameRoom.TotalBetChips += 10
+		return game.setGameRoomCache(ctx, gameRoom)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestGame_CancelStaleTurnTimer(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待房间协程通知当前操作用户并设置超时放弃
+	var operateUser *JoinUser
+	deadline := time.Now().Add(3 * time.Second)
+	for operateUser == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("turn timer not armed")
+		}
+		time.Sleep(50 * time.Millisecond)
+		gameRoom, _ := game.GetGameRoom(ctx)
+		for _, user := range users {
+			joinUser := game.GetJoinUser(ctx, user.ID, 1)
+			if joinUser.Location == gameRoom.CurrLocation && len(joinUser.TimerId) > 0 {
+				operateUser = joinUser
+			}
+		}
+	}
+
+	// 玩家操作后倒计时立即取消
+	if err := testBetting(game, operateUser.UserId, 40); err != nil {
+		t.Fatal(err)
+	}
+	if score, err := pool.RedisClient.ZScore(ctx, "dp:test-delay-queue:pending", operateUser.TimerId).Result(); err != redis.Nil {
+		t.Fatalf("stale timer still pending, score = %v, error = %v", score, err)
+	}
+	if joinUser := game.GetJoinUser(ctx, operateUser.UserId, 1); len(joinUser.TimerId) > 0 {
+		t.Fatalf("timer id = %s after acting, want empty", joinUser.TimerId)
+	}
+}
+
+// newTestMemoryGamePool game pool whose delay jobs and room timers are driven by a manual clock
+func newTestMemoryGamePool(t *testing.T) (*GamePool, *daley.ManualClock, *daley.MemoryQueue) {
+	t.Helper()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	// 房间时间均取自时钟,与系统时间无关
+	clock := daley.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local))
+	pool := NewGamePool(rdb, NewRedisGameStore(rdb), newTestUserService(t), time.Minute)
+	pool.Clock = clock
+	pool.RegisterDelayJobs(daley.NewMemoryRegistry(clock))
+	return pool, clock, pool.DelayQueue.(*daley.MemoryQueue)
+}
+
+// waitTurnTimer 推进时钟直到房间协程通知当前操作用户并设置倒计时
+func waitTurnTimer(t *testing.T, game *Game, clock *daley.ManualClock, users []db.User) *JoinUser {
+	t.Helper()
+
+	ctx := context.Background()
+	clock.Advance(time.Second)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		gameRoom, _ := game.GetGameRoom(ctx)
+		for _, user := range users {
+			joinUser := game.GetJoinUser(ctx, user.ID, gameRoom.CurrRound)
+			if joinUser.Location == gameRoom.CurrLocation && len(joinUser.TimerId) > 0 {
+				return joinUser
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("turn timer not armed")
+	return nil
+}
+
+func TestGame_TurnTimeoutWithManualClock(t *testing.T) {
+	ctx := context.Background()
+	pool, clock, queue := newTestMemoryGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	operateUser := waitTurnTimer(t, game, clock, users)
+
+	// 倒计时结束前不处理
+	clock.Advance((CountdownSecond - 5) * time.Second)
+	if count := queue.RunDue(); count != 0 {
+		t.Fatalf("delivered %d msgs before timeout", count)
+	}
+
+	// 倒计时结束超时放弃
+	clock.Advance(10 * time.Second)
+	if count := queue.RunDue(); count != 1 {
+		t.Fatalf("delivered %d msgs, want 1", count)
+	}
+	if joinUser := game.GetJoinUser(ctx, operateUser.UserId, 1); joinUser.State != constant.EVENT_GIVE_UP_USER {
+		t.Fatalf("state = %d after timeout, want give up", joinUser.State)
+	}
+
+	// 操作记录和下一个操作用户的倒计时使用房间时钟
+	gameRoom, err := game.GetGameRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	action := gameRoom.History[len(gameRoom.History)-1]
+	if action.Type != constant.EVENT_GIVE_UP_USER || action.Timestamp != clock.Now().UnixMilli() {
+		t.Fatalf("last action = %+v, want give up at %d", action, clock.Now().UnixMilli())
+	}
+	if gameRoom.CurrTimeStamp != clock.Now().Unix() || game.turnCountdown(gameRoom) != CountdownSecond {
+		t.Fatalf("turn started at %d, countdown = %d", gameRoom.CurrTimeStamp, game.turnCountdown(gameRoom))
+	}
+}
+
+func TestGame_AutoBetWithManualClock(t *testing.T) {
+	ctx := context.Background()
+	pool, clock, queue := newTestMemoryGamePool(t)
+	game, users := newTestGame(t, pool, 3)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	operateUser := waitTurnTimer(t, game, clock, users)
+
+	// 设置自动跟注后取消超时放弃,1秒后自动下注
+	if err := game.UserSetAutoBetting(operateUser.UserId, true, 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	if count := queue.RunDue(); count != 1 {
+		t.Fatalf("delivered %d msgs, want 1", count)
+	}
+
+	joinUser := game.GetJoinUser(ctx, operateUser.UserId, 1)
+	if joinUser.State != constant.EVENT_PLAYING_USER || joinUser.TotalBetChips <= operateUser.TotalBetChips {
+		t.Fatalf("auto bet not applied, state = %d, total bet chips = %d", joinUser.State, joinUser.TotalBetChips)
+	}
+	if queue.Pending() != 0 {
+		t.Fatalf("pending = %d, stale give up timer not canceled", queue.Pending())
+	}
+}
+
+func TestGamePool_EvictIdle(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+
+	// 不存在的房间不创建房间协程
+	if _, err := pool.GetGame("not-exist", true); err != constant.GameNotExistError {
+		t.Fatalf("GetGame not exist error = %v, want %v", err, constant.GameNotExistError)
+	}
+	giveUpTimeout := pool.delayHandler((*Game).giveUpTimeout)
+	if !giveUpTimeout(DelayMsg{DelayType: constant.DELAY_GIVEUP, GameId: "not-exist", CurrRound: 1}, "") {
+		t.Fatal("delay message of an expired room should be dropped")
+	}
+	if len(pool.Conns) != 0 {
+		t.Fatalf("games = %d, want 0", len(pool.Conns))
+	}
+
+	over, users := newTestGame(t, pool, 2)
+	expired, _ := newTestGame(t, pool, 2)
+	if count := pool.EvictIdle(ctx); count != 0 {
+		t.Fatalf("evicted %d active games", count)
+	}
+
+	// 游戏已结束,仍有连接时保留房间协程
+	gameRoom, err := pool.Store.LoadRoom(ctx, over.GameId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gameRoom.State = constant.GAME_ENDED
+	gameRoom.CurrRound = gameRoom.TotalRounds
+	if err = pool.Store.SaveRoom(ctx, gameRoom, nil); err != nil {
+		t.Fatal(err)
+	}
+	pool.Mutex.Lock()
+	over.Clients[users[0].ID] = map[string]*Client{"token": nil}
+	pool.Mutex.Unlock()
+
+	// 房间数据过期
+	if err = pool.RedisClient.Del(ctx, roomKey(expired.GameId)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count := pool.EvictIdle(ctx); count != 1 {
+		t.Fatalf("evicted %d games, want 1", count)
+	}
+	if err = expired.Do(func() error { return nil }); err != constant.GameStoppedError {
+		t.Fatalf("expired game error = %v, want %v", err, constant.GameStoppedError)
+	}
+
+	// 最后一个连接断开后移除
+	pool.ConnOffline(over.GameId, users[0].ID, "token")
+	if _, err = pool.GetGame(over.GameId, false); err == nil {
+		t.Fatal("finished game still in pool")
+	}
+	if err = over.Do(func() error { return nil }); err != constant.GameStoppedError {
+		t.Fatalf("finished game error = %v, want %v", err, constant.GameStoppedError)
+	}
+}
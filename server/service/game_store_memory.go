@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"game-3-card-poker/server/constant"
+	"strings"
+	"sync"
+)
+
+// MemoryGameStore 基于内存的房间状态存储,用于测试和单机开发环境,数据不过期且不在实例间共享
+type MemoryGameStore struct {
+	mutex    sync.RWMutex
+	values   map[string][]byte
+	versions map[string]int64 // 房间版本号
+}
+
+// NewMemoryGameStore creates a GameStore kept in process memory
+func NewMemoryGameStore() *MemoryGameStore {
+	return &MemoryGameStore{values: make(map[string][]byte, 0), versions: make(map[string]int64, 0)}
+}
+
+func (s *MemoryGameStore) get(key string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.values[key]
+	return string(value), ok
+}
+
+func (s *MemoryGameStore) LoadRoom(ctx context.Context, gameId string) (*GameRoom, error) {
+	s.mutex.RLock()
+	value, ok := s.values[roomKey(gameId)]
+	version := s.versions[gameId]
+	s.mutex.RUnlock()
+
+	if !ok {
+		// 与Redis保持一致,房间不存在
+		return nil, constant.GameNotExistError
+	}
+	return parseGameRoom(string(value), version)
+}
+
+func (s *MemoryGameStore) ListRooms(ctx context.Context) ([]*GameRoom, error) {
+	s.mutex.RLock()
+	gameIds := make([]string, 0)
+	for key := range s.values {
+		if strings.HasPrefix(key, roomKey("")) {
+			gameIds = append(gameIds, strings.TrimPrefix(key, roomKey("")))
+		}
+	}
+	s.mutex.RUnlock()
+
+	gameRooms := make([]*GameRoom, 0, len(gameIds))
+	for index := range gameIds {
+		if gameRoom, err := s.LoadRoom(ctx, gameIds[index]); err == nil {
+			gameRooms = append(gameRooms, gameRoom)
+		}
+	}
+	return gameRooms, nil
+}
+
+func (s *MemoryGameStore) SaveRoom(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser) error {
+	return s.SaveCards(ctx, gameRoom, joinUsers, nil)
+}
+
+func (s *MemoryGameStore) LoadSeat(ctx context.Context, gameId string, userId int64, currRound int) (*JoinUser, error) {
+	value, ok := s.get(seatKey(gameId, userId, currRound))
+	if !ok {
+		return nil, constant.CacheGetInfoError
+	}
+	return parseJoinUser(value)
+}
+
+func (s *MemoryGameStore) LoadCards(ctx context.Context, gameId string, userId int64, currRound int) (*UserPoker, error) {
+	value, ok := s.get(cardsKey(gameId, userId, currRound))
+	if !ok {
+		return nil, constant.CacheGetInfoError
+	}
+	return parseUserPoker(value)
+}
+
+func (s *MemoryGameStore) SaveCards(ctx context.Context, gameRoom *GameRoom, joinUsers map[int64]*JoinUser, userPokers map[int64]UserPoker) error {
+	roomJson, values, err := marshalGameRoom(gameRoom, joinUsers, userPokers)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.versions[gameRoom.GameId] != gameRoom.Version {
+		return constant.GameVersionConflictError
+	}
+
+	s.values[roomKey(gameRoom.GameId)] = roomJson
+	for key := range values {
+		s.values[key] = values[key]
+	}
+	s.versions[gameRoom.GameId]++
+	gameRoom.Version = s.versions[gameRoom.GameId]
+	return nil
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"game-3-card-poker/server/daley"
+	"game-3-card-poker/server/db"
+	"testing"
+	"time"
+)
+
+func TestUserService_Leaderboard(t *testing.T) {
+	ctx := context.Background()
+	userService := newTestUserService(t)
+	clock := daley.NewManualClock(time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local))
+	userService.leaderboard.Clock = clock
+
+	users := make([]db.User, 0)
+	for i := 0; i < 3; i++ {
+		user, err := userService.SignatureVerify(fmt.Sprintf("aleo-board-%d", i), 1000, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+
+	// 第一局users[0]赢得奖池60,第二局users[1]赢得奖池30
+	rounds := []struct {
+		winner int
+		bets   []int64
+	}{
+		{winner: 0, bets: []int64{10, 50, 0}},
+		{winner: 1, bets: []int64{10, 10, 10}},
+	}
+	for round, item := range rounds {
+		joinUsers := make([]*JoinUser, 0)
+		totalBetChips := int64(0)
+		for index, bet := range item.bets {
+			joinUsers = append(joinUsers, &JoinUser{UserId: users[index].ID, Address: users[index].Address, Stack: 500 - bet, TotalBetChips: bet})
+			totalBetChips += bet
+		}
+		if _, err := userService.UpateWinBetting("board", round+1, 10, joinUsers, users[item.winner].ID, totalBetChips, nil, func(int64) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// net: users[0] +50-10=40, users[2] -10, users[1] -50+20=-30
+	page, err := userService.ListLeaderboard(ctx, LeaderboardReq{Board: BoardNet, Period: PeriodDaily, Limit: 1}, users[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || page.PeriodId != "20261019" || len(page.List) != 1 || page.List[0].UserId != users[0].ID || page.List[0].Score != 40 || page.List[0].Address != users[0].Address {
+		t.Fatalf("net page = %+v", page)
+	}
+	if page.Mine == nil || page.Mine.Rank != 3 || page.Mine.Score != -30 {
+		t.Fatalf("mine = %+v, want rank 3 outside the page", page.Mine)
+	}
+
+	if page, err = userService.ListLeaderboard(ctx, LeaderboardReq{Board: BoardPot, Period: PeriodAll, Limit: 10}, users[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.List) != 2 || page.List[0].Score != 60 || page.List[1].Score != 30 || page.Mine != nil {
+		t.Fatalf("pot page = %+v", page)
+	}
+
+	// 次日归档日榜,周榜及总榜保留
+	clock.Advance(24 * time.Hour)
+
+	// 上次归档保存快照后删除排行榜失败
+	snapshots := make([]db.LeaderboardSnapshot, 0)
+	for rank, item := range []struct {
+		user  int
+		score int64
+	}{{user: 0, score: 40}, {user: 2, score: -10}, {user: 1, score: -30}} {
+		snapshots = append(snapshots, db.LeaderboardSnapshot{Board: BoardNet, Period: PeriodDaily, PeriodId: "20261019", Ranking: rank + 1, UserId: users[item.user].ID, Score: item.score})
+	}
+	if err = userService.leaderboard.boardDB.SaveSnapshot(snapshots); err != nil {
+		t.Fatal(err)
+	}
+	// 前一日结束前结算的当局次日才更新排行榜,计入结算日: users[2]赢得奖池20,net users[2] 0, users[1] -40
+	settleAt := time.Date(2026, 10, 19, 23, 59, 59, 0, time.Local)
+	if err = userService.leaderboard.AddRound(ctx, settleAt, users[2].ID, 20, map[int64]int64{users[2].ID: 10, users[1].ID: -10}); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := userService.ArchiveLeaderboards(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(leaderboardBoards) {
+		t.Fatalf("archive %d leaderboards, want %d", count, len(leaderboardBoards))
+	}
+	if page, err = userService.ListLeaderboard(ctx, LeaderboardReq{Board: BoardWins, Period: PeriodDaily, Limit: 10}, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 0 || page.Mine != nil {
+		t.Fatalf("daily page after reset = %+v", page)
+	}
+	if page, err = userService.ListLeaderboard(ctx, LeaderboardReq{Board: BoardWins, Period: PeriodWeekly, Limit: 10}, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 {
+		t.Fatalf("weekly page = %+v", page)
+	}
+
+	// 归档快照,重复归档时更新已保存的名次及分数
+	page, err = userService.ListLeaderboard(ctx, LeaderboardReq{Board: BoardNet, Period: PeriodDaily, PeriodId: "20261019", Offset: 1, Limit: 1}, users[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.List) != 1 || page.List[0].Rank != 2 || page.List[0].UserId != users[2].ID || page.List[0].Score != 0 || page.List[0].Address != users[2].Address {
+		t.Fatalf("snapshot page = %+v", page)
+	}
+	if page.Mine == nil || page.Mine.Rank != 3 || page.Mine.Score != -40 {
+		t.Fatalf("snapshot mine = %+v", page.Mine)
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"game-3-card-poker/server/constant"
+	"log"
+)
+
+// Recover 服务启动时恢复进行中的游戏房间,重建房间协程并恢复操作倒计时
+func (c *GamePool) Recover(ctx context.Context) (int, error) {
+	gameRooms, err := c.Store.ListRooms(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for index := range gameRooms {
+		gameRoom := gameRooms[index]
+
+		// 仅恢复游戏中或等待下一局的房间,其他房间用户连接时再创建
+		if !gameRoom.IsActive() {
+			continue
+		}
+
+		game, errs := c.GetGame(gameRoom.GameId, true)
+		if errs != nil {
+			log.Printf("recover gameId=%s error: %s", gameRoom.GameId, errs)
+			continue
+		}
+
+		if errs = game.Recover(); errs != nil {
+			log.Printf("recover gameId=%s error: %s", gameRoom.GameId, errs)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// IsActive 游戏中或者当局已结束等待开始下一局
+func (g GameRoom) IsActive() bool {
+	return g.State == constant.GAME_PAYING || (g.State == constant.GAME_ENDED && g.CurrRound < g.TotalRounds)
+}
+
+// IsOver 最后一局已结束,游戏结束
+func (g GameRoom) IsOver() bool {
+	return g.State == constant.GAME_ENDED && g.CurrRound >= g.TotalRounds
+}
+
+// Recover 恢复服务重启前进行中的当局
+func (c *Game) Recover() error {
+	return c.Do(c.recoverGame)
+}
+
+// recoverGame 由房间协程执行
+func (c *Game) recoverGame() error {
+	ctx := context.Background()
+	gameRoom, err := c.GetGameRoom(ctx)
+	if err != nil {
+		return err
+	}
+
+	joinUsers := c.roundJoinUsers(ctx, gameRoom)
+	switch gameRoom.State {
+	case constant.GAME_ENDED:
+		// 当局已结算,下一局定时器随服务重启丢失
+		for index := range joinUsers {
+			if joinUsers[index].State == constant.EVENT_WIN_USER && gameRoom.CurrRound < gameRoom.TotalRounds {
+				c.scheduleNextRound(ctx, gameRoom, joinUsers[index], joinUsers)
+				return nil
+			}
+		}
+		return nil
+	case constant.GAME_PAYING:
+		var operateUser *JoinUser
+		for index := range joinUsers {
+			if joinUsers[index].Location == gameRoom.CurrLocation {
+				operateUser = joinUsers[index]
+			}
+		}
+
+		// 尚未设置操作用户(开局时重启),或者当前操作用户已弃牌/比牌输->切换下个操作用户
+		if gameRoom.CurrTimeStamp <= 0 || operateUser == nil || operateUser.State != constant.EVENT_PLAYING_USER {
+			c.SetNextOperateUser(ctx, gameRoom, gameRoom.CurrLocation)
+			return nil
+		}
+
+		// 判定是否检查到玩家判赢条件(结算前重启)
+		if c.CheckGameWinUser(ctx, gameRoom, joinUsers) {
+			return nil
+		}
+
+		c.rearmOperateUser(ctx, gameRoom, operateUser)
+	}
+	return nil
+}
+
+// roundJoinUsers 当局加入房间的用户
+func (c *Game) roundJoinUsers(ctx context.Context, gameRoom *GameRoom) []*JoinUser {
+	joinUsers := make([]*JoinUser, 0)
+	for userId := range gameRoom.JoinUsers {
+		if gameRoom.JoinUsers[userId] == gameRoom.CurrRound {
+			if joinUser := c.GetJoinUser(ctx, userId, gameRoom.CurrRound); joinUser != nil {
+				joinUsers = append(joinUsers, joinUser)
+			}
+		}
+	}
+	return joinUsers
+}
+
+// rearmOperateUser 根据当前操作开始时间戳恢复操作倒计时,并通知重连用户
+func (c *Game) rearmOperateUser(ctx context.Context, gameRoom *GameRoom, operateUser *JoinUser) {
+	// 重新设置倒计时同时取消重启前的倒计时
+	if operateUser.IsAutoBet {
+		// 自动下注延迟队列
+		AutoBetDelayFunc(c, gameRoom, operateUser)
+	} else {
+		// 超时自动放弃
+		TimeOutGiveUpDelayFunc(c, gameRoom, operateUser)
+	}
+
+	// 下注最低筹码
+	lowBetChips, _ := c.GetCurrentLowBetChips(gameRoom, operateUser, nil)
+
+	// 广播消息通知所有用户
+	c.BroadcastMsg(ctx, gameRoom, &EventMsg{
+		Type:            constant.EVENT_CURRENT_USER,
+		UserId:          operateUser.UserId,
+		Location:        operateUser.Location,
+		TotalSecond:     CountdownSecond,
+		CountdownSecond: c.turnCountdown(gameRoom),
+		BetChips:        lowBetChips,
+		ListBetChips:    c.GetListBetChips(gameRoom, lowBetChips),
+	})
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"log"
+	"time"
+)
+
+// repairGrace 待同步记录创建后等待房间协程自行更新的时间,修复任务只处理超过该时间的记录
+const repairGrace = 30 * time.Second
+
+// repairBatchSize 修复任务每次处理的待同步记录数
+const repairBatchSize = 1000
+
+// RepairMsg 修复任务消息
+type RepairMsg struct {
+	All bool `json:"all"` // 核对所有房间,否则仅核对有待同步记录的房间
+}
+
+// RepairReport 修复结果
+type RepairReport struct {
+	Games  int `json:"games"`  // 核对的房间
+	Outbox int `json:"outbox"` // 标记为已同步的记录
+	Seats  int `json:"seats"`  // 修正桌上筹码的用户
+	Rounds int `json:"rounds"` // 修正结算状态的当局
+	Stacks int `json:"stacks"` // 兑回已过期、已结束房间桌上筹码的用户
+}
+
+// ScheduleRepair 周期执行修复任务,多实例部署时每次只由一个实例执行
+func (c *GamePool) ScheduleRepair(interval time.Duration) error {
+	return c.jobs.repair.Schedule("game.repair", fmt.Sprintf("@every %s", interval), RepairMsg{})
+}
+
+// repairHandler 修复任务,失败时延迟队列重试
+func (c *GamePool) repairHandler(msg RepairMsg, idStr string) bool {
+	report, err := c.Repair(context.Background(), msg.All)
+	if err != nil {
+		log.Println("repair game rooms error:", err)
+		return false
+	}
+	if report.Outbox > 0 || report.Seats > 0 || report.Rounds > 0 || report.Stacks > 0 {
+		log.Printf("repair game rooms: %+v", report)
+	}
+	return true
+}
+
+// Repair 以数据库(账本、user_history)为准修复房间状态。
+// 房间状态更新失败或服务宕机时,数据库已提交的买入、兑出及当局结算保留为待同步记录,由修复任务恢复房间
+func (c *GamePool) Repair(ctx context.Context, all bool) (RepairReport, error) {
+	report := RepairReport{}
+
+	outboxes, err := c.UserService.PendingOutbox(c.Clock.Now().Add(-repairGrace), repairBatchSize)
+	if err != nil {
+		return report, err
+	}
+	gameOutboxes := make(map[string][]db.GameOutbox, 0)
+	for index := range outboxes {
+		outbox := outboxes[index]
+		gameOutboxes[outbox.GameId] = append(gameOutboxes[outbox.GameId], outbox)
+	}
+
+	// 服务启动时核对所有房间,包括升级前没有待同步记录的房间
+	if all {
+		gameRooms, errs := c.Store.ListRooms(ctx)
+		if errs != nil {
+			return report, errs
+		}
+		for index := range gameRooms {
+			if _, ok := gameOutboxes[gameRooms[index].GameId]; !ok {
+				gameOutboxes[gameRooms[index].GameId] = nil
+			}
+		}
+	}
+
+	for gameId, outboxes := range gameOutboxes {
+		ids := make([]int64, 0, len(outboxes))
+		for index := range outboxes {
+			ids = append(ids, outboxes[index].ID)
+		}
+
+		game, release, errs := c.borrowGame(gameId)
+		if errs != nil {
+			// 房间数据已过期,无法再同步
+			if len(outboxes) > 0 && c.Clock.Now().Sub(outboxes[len(outboxes)-1].CreateAt) > gameCacheExpiration {
+				log.Printf("repair gameId=%s room expired, skip %d outbox", gameId, len(ids))
+				c.markOutboxApplied(gameId, ids, &report)
+				continue
+			}
+			log.Printf("repair gameId=%s error: %s", gameId, errs)
+			continue
+		}
+
+		result, errs := game.Repair()
+		release()
+		if errs != nil {
+			log.Printf("repair gameId=%s error: %s", gameId, errs)
+			continue
+		}
+		report.Games++
+		report.Seats += result.Seats
+		report.Rounds += result.Rounds
+		c.markOutboxApplied(gameId, ids, &report)
+	}
+
+	c.returnStacks(ctx, &report)
+	return report, nil
+}
+
+// returnStacks 房间数据已过期或游戏已结束,仍留在桌上筹码账户的筹码(玩家离开、兑出失败)兑回账户余额
+func (c *GamePool) returnStacks(ctx context.Context, report *RepairReport) {
+	stacks, err := c.UserService.OpenStacks()
+	if err != nil {
+		log.Println("repair open stacks error:", err)
+		return
+	}
+
+	for gameId := range stacks {
+		userIds := make([]int64, 0, len(stacks[gameId]))
+		for userId := range stacks[gameId] {
+			userIds = append(userIds, userId)
+		}
+
+		count, errs := c.returnGameStacks(ctx, gameId, userIds)
+		if errs != nil {
+			log.Printf("repair gameId=%s return stacks error: %s", gameId, errs)
+			continue
+		}
+		report.Stacks += count
+	}
+}
+
+// returnGameStacks 房间已过期时直接兑回;游戏已结束时由房间协程兑回,与结束时的兑出串行
+func (c *GamePool) returnGameStacks(ctx context.Context, gameId string, userIds []int64) (int, error) {
+	gameRoom, err := c.Store.LoadRoom(ctx, gameId)
+	if errors.Is(err, constant.GameNotExistError) {
+		return c.UserService.ReturnStacks(gameId, userIds)
+	}
+	if err != nil || !gameRoom.IsOver() {
+		return 0, err
+	}
+
+	game, release, err := c.borrowGame(gameId)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	count := 0
+	err = game.Do(func() error {
+		gameRoom, errs := game.GetGameRoom(ctx)
+		if errs != nil || !gameRoom.IsOver() {
+			return errs
+		}
+		count, errs = c.UserService.ReturnStacks(gameId, userIds)
+		return errs
+	})
+	return count, err
+}
+
+// markOutboxApplied 房间已核对,标记待同步记录
+func (c *GamePool) markOutboxApplied(gameId string, ids []int64, report *RepairReport) {
+	if err := c.UserService.MarkOutboxApplied(ids...); err != nil {
+		log.Printf("repair gameId=%s mark outbox error: %s", gameId, err)
+		return
+	}
+	report.Outbox += len(ids)
+}
+
+// Repair 以数据库为准修复房间状态
+func (c *Game) Repair() (RepairReport, error) {
+	var report RepairReport
+	err := c.Do(func() (err error) {
+		report, err = c.repairGame()
+		return err
+	})
+	return report, err
+}
+
+// repairGame 由房间协程执行
+func (c *Game) repairGame() (RepairReport, error) {
+	ctx := context.Background()
+	report := RepairReport{}
+
+	gameRoom, err := c.GetGameRoom(ctx)
+	if err != nil {
+		return report, err
+	}
+	joinUsers := c.roundJoinUsers(ctx, gameRoom)
+
+	// 当局是否结算以 user_history 中的赢家记录为准
+	var winJoinUser *JoinUser
+	voided := false
+	if gameRoom.State == constant.GAME_PAYING || gameRoom.State == constant.GAME_ENDED {
+		winUserId, _, settled, errs := c.UserService.SettledWinner(gameRoom.GameId, gameRoom.CurrRound)
+		if errs != nil {
+			return report, errs
+		}
+
+		switch {
+		case settled && gameRoom.State == constant.GAME_PAYING:
+			// 数据库已结算而房间仍在游戏中,结束当局
+			for index := range joinUsers {
+				joinUser := joinUsers[index]
+				c.cancelTimer(joinUser)
+				if joinUser.UserId == winUserId {
+					joinUser.State = constant.EVENT_WIN_USER
+					winJoinUser = joinUser
+				} else if joinUser.State == constant.EVENT_PLAYING_USER {
+					joinUser.State = constant.EVENT_COMPARE_LOSE_USER
+				}
+			}
+			if winJoinUser == nil {
+				return report, constant.GameNotInJoinError
+			}
+			gameRoom.State = constant.GAME_ENDED
+			report.Rounds++
+			log.Printf("repair gameId=%s round=%d settled, winner userId=%d", gameRoom.GameId, gameRoom.CurrRound, winUserId)
+		case !settled && gameRoom.State == constant.GAME_ENDED:
+			// 房间已结算而数据库未记账(升级前先更新房间后提交事务),当局作废,桌上筹码恢复为账本余额。
+			// 房间回到等待状态,玩家重新准备后再次开始当局
+			c.voidRound(gameRoom, joinUsers)
+			voided = true
+			report.Rounds++
+			log.Printf("repair gameId=%s round=%d not settled, void round", gameRoom.GameId, gameRoom.CurrRound)
+		}
+	}
+
+	// 桌上筹码以账本为准,游戏中的当局下注尚未记账
+	balances, err := c.UserService.StackBalances(gameRoom.GameId)
+	if err != nil {
+		return report, err
+	}
+	users := make(map[int64]*JoinUser, 0)
+	for index := range joinUsers {
+		joinUser := joinUsers[index]
+		if winJoinUser != nil || voided {
+			users[joinUser.UserId] = joinUser
+		}
+
+		stack := balances[joinUser.UserId]
+		if gameRoom.State == constant.GAME_PAYING {
+			stack -= joinUser.TotalBetChips
+		}
+		if joinUser.Stack != stack {
+			log.Printf("repair gameId=%s userId=%d stack %d -> %d", gameRoom.GameId, joinUser.UserId, joinUser.Stack, stack)
+			joinUser.Stack = stack
+			users[joinUser.UserId] = joinUser
+			report.Seats++
+		}
+
+		// 兑出后桌上筹码不足,恢复为等待状态
+		if joinUser.State == constant.EVENT_READY_USER && joinUser.Stack < gameRoom.LowBetChips {
+			joinUser.State = constant.EVENT_JOIN_USER
+			users[joinUser.UserId] = joinUser
+		}
+	}
+
+	if len(users) > 0 {
+		if err = c.setBatchCache(ctx, gameRoom, users); err != nil {
+			return report, err
+		}
+	}
+
+	if winJoinUser != nil {
+		// 继续当局结算后的流程
+		c.endRound(ctx, gameRoom, winJoinUser, joinUsers, nil)
+	} else if voided {
+		// 广播消息通知所有用户当局已作废
+		c.BroadcastMsg(ctx, gameRoom, &EventMsg{Type: constant.EVENT_JOIN_USER})
+	} else if gameRoom.State == constant.GAME_ENDED && gameRoom.CurrRound >= gameRoom.TotalRounds {
+		// 游戏已结束,兑出剩余的桌上筹码
+		c.cashOutAll(ctx, gameRoom, joinUsers)
+	}
+	return report, nil
+}
+
+// voidRound 作废未记账的当局,房间回到等待状态,玩家恢复为加入状态
+func (c *Game) voidRound(gameRoom *GameRoom, joinUsers []*JoinUser) {
+	gameRoom.State = constant.GAME_WAIT
+	gameRoom.CurrLocation = 0
+	gameRoom.CurrTimeStamp = 0
+	gameRoom.CurrBetChips = 0
+	gameRoom.TotalBetChips = 0
+	gameRoom.ExposedBetChips = gameRoom.LowBetChips
+	gameRoom.ConcealedBetChips = gameRoom.LowBetChips
+	gameRoom.Records = make(map[int64][]int64, 0)
+	gameRoom.BetChips = make([]int64, 0)
+	gameRoom.Actions = make(map[string]ActionRecord, 0)
+	gameRoom.History = make([]RoundAction, 0)
+
+	for index := range joinUsers {
+		joinUser := joinUsers[index]
+		c.cancelTimer(joinUser)
+		joinUser.State = constant.EVENT_JOIN_USER
+		joinUser.IsLookCard = false
+		joinUser.IsAutoBet = false
+		joinUser.TotalBetChips = 0
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"game-3-card-poker/server/constant"
+	"testing"
+)
+
+func TestGame_BuyInRange(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+
+	err := game.Do(func() error {
+		gameRoom, err := game.GetGameRoom(ctx)
+		if err != nil {
+			return err
+		}
+		gameRoom.MinBuyIn, gameRoom.MaxBuyIn = 100, testBuyIn+500
+		return game.setGameRoomCache(ctx, gameRoom)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 补充后超过最高买入
+	if err = game.UserBuyIn(users[1].ID, 1000); !errors.Is(err, constant.BuyInOutOfRangeError) {
+		t.Fatalf("buy in error = %v, want %v", err, constant.BuyInOutOfRangeError)
+	}
+	if err = game.UserBuyIn(users[1].ID, 500); err != nil {
+		t.Fatal(err)
+	}
+
+	// 兑出后恢复等待状态,需重新买入才能准备
+	if err = game.UserCashOut(users[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	joinUser := game.GetJoinUser(ctx, users[1].ID, 1)
+	if joinUser.Stack != 0 || joinUser.State != constant.EVENT_JOIN_USER {
+		t.Fatalf("stack = %d, state = %d after cash out", joinUser.Stack, joinUser.State)
+	}
+	if err = game.UserJoinRoom(users[1], true, nil, nil); !errors.Is(err, constant.UserNotEnoughBetError) {
+		t.Fatalf("ready error = %v, want %v", err, constant.UserNotEnoughBetError)
+	}
+
+	// 未指定买入筹码时补足到最低买入
+	if err = game.UserBuyIn(users[1].ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if joinUser = game.GetJoinUser(ctx, users[1].ID, 1); joinUser.Stack != 100 {
+		t.Fatalf("stack = %d, want 100", joinUser.Stack)
+	}
+	if dbUser, _ := game.UserService.GetById(users[1].ID); dbUser.Balance != testBalance-100 {
+		t.Fatalf("balance = %d, want %d", dbUser.Balance, testBalance-100)
+	}
+}
+
+func TestGame_SettleToStack(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	if err := testStartGame(game, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 当局进行中不能买入或兑出
+	if err := game.UserCashOut(users[1].ID); !errors.Is(err, constant.StackChangePlayingError) {
+		t.Fatalf("cash out error = %v, want %v", err, constant.StackChangePlayingError)
+	}
+
+	// 未结算前下注只扣除桌上筹码
+	if report, _ := pool.UserService.VerifyLedger(); !report.OK() || report.Pots != 0 || report.Stacks != 2*testBuyIn {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// 弃牌后剩余玩家获胜,奖池转入赢家桌上筹码
+	loser := users[1]
+	if err := game.UserGiveUpCard(loser.ID, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	winner := game.GetJoinUser(ctx, users[0].ID, 1)
+	if winner.State != constant.EVENT_WIN_USER || winner.Stack != testBuyIn+10 {
+		t.Fatalf("winner state = %d, stack = %d", winner.State, winner.Stack)
+	}
+	if joinUser := game.GetJoinUser(ctx, loser.ID, 1); joinUser.Stack != testBuyIn-10 {
+		t.Fatalf("loser stack = %d, want %d", joinUser.Stack, testBuyIn-10)
+	}
+
+	report, err := pool.UserService.VerifyLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Pots != 0 || report.House != 0 || report.Stacks != 2*testBuyIn {
+		t.Fatalf("report = %+v", report)
+	}
+	for _, user := range users {
+		if dbUser, _ := pool.UserService.GetById(user.ID); dbUser.Balance != testBalance-testBuyIn {
+			t.Fatalf("userId=%d balance = %d, want %d", user.ID, dbUser.Balance, testBalance-testBuyIn)
+		}
+	}
+}
+
+func TestGame_CashOutOffline(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+
+	// 用户所有连接断开,离开超时后判定离线
+	game.UserAway(ctx, users[1].ID)
+	presence := game.GetPresence(ctx, users[1].ID)
+	if presence == nil {
+		t.Fatal("presence not saved")
+	}
+	offlineTimeout := pool.delayHandler((*Game).offlineTimeout)
+	offlineTimeout(DelayMsg{DelayType: constant.DELAY_OFFLINE, GameId: game.GameId, UserId: users[1].ID, Timestamp: presence.Timestamp}, "")
+
+	// 局间离线的用户桌上筹码兑回账户余额
+	if joinUser := game.GetJoinUser(ctx, users[1].ID, 1); joinUser.Stack != 0 || joinUser.State != constant.EVENT_JOIN_USER {
+		t.Fatalf("stack = %d, state = %d after offline", joinUser.Stack, joinUser.State)
+	}
+	if dbUser, _ := game.UserService.GetById(users[1].ID); dbUser.Balance != testBalance {
+		t.Fatalf("balance = %d, want %d", dbUser.Balance, testBalance)
+	}
+	if joinUser := game.GetJoinUser(ctx, users[0].ID, 1); joinUser.Stack != testBuyIn {
+		t.Fatalf("online user stack = %d, want %d", joinUser.Stack, testBuyIn)
+	}
+}
+
+func TestGamePool_RepairReturnsExpiredStacks(t *testing.T) {
+	ctx := context.Background()
+	pool := newTestGamePool(t)
+	game, users := newTestGame(t, pool, 2)
+	active, _ := newTestGame(t, pool, 2)
+
+	// 房间数据过期,桌上筹码仍在账本中
+	if err := pool.RedisClient.Del(ctx, roomKey(game.GameId)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := pool.Repair(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Stacks != 2 {
+		t.Fatalf("report = %+v, want 2 stacks returned", report)
+	}
+	// 两个房间为同一批用户,进行中房间的买入仍在桌上
+	for _, user := range users {
+		if dbUser, _ := pool.UserService.GetById(user.ID); dbUser.Balance != testBalance-testBuyIn {
+			t.Fatalf("userId=%d balance = %d after return", user.ID, dbUser.Balance)
+		}
+	}
+
+	// 进行中房间的桌上筹码保留,再次修复无须兑回
+	if report, err = pool.Repair(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Stacks != 0 {
+		t.Fatalf("report = %+v after returned", report)
+	}
+	stacks, err := pool.UserService.OpenStacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stacks) != 1 || len(stacks[active.GameId]) != 2 {
+		t.Fatalf("open stacks = %+v, want stacks of %s", stacks, active.GameId)
+	}
+	if ledger, _ := pool.UserService.VerifyLedger(); !ledger.OK() {
+		t.Fatalf("ledger report = %+v", ledger)
+	}
+}
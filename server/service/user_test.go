@@ -0,0 +1,258 @@
+package service
+
+import (
+	"errors"
+	"game-3-card-poker/server/constant"
+	"game-3-card-poker/server/db"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUserService_LedgerBalanced(t *testing.T) {
+	userService := newTestUserService(t)
+
+	users := make([]db.User, 0)
+	for _, address := range []string{"aleo-ledger-0", "aleo-ledger-1"} {
+		user, err := userService.SignatureVerify(address, 1000, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+
+	// 买入桌上筹码
+	for _, user := range users {
+		if err := userService.BuyIn("ledger", user.ID, 500, "", func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := userService.VerifyLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Stacks != 1000 || report.Users != 1000 {
+		t.Fatalf("report = %+v, want stacks 1000", report)
+	}
+
+	// 底注10,第二个玩家下注40,结算时统一记账,奖池转入赢家桌上筹码
+	joinUsers := []*JoinUser{
+		{UserId: users[0].ID, Address: users[0].Address, Stack: 490, TotalBetChips: 10},
+		{UserId: users[1].ID, Address: users[1].Address, Stack: 450, TotalBetChips: 50},
+	}
+	if _, err = userService.UpateWinBetting("ledger", 1, 10, joinUsers, users[0].ID, 60, nil, func(int64) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	report, err = userService.VerifyLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Pots != 0 || report.House != 0 || report.Stacks != 1000 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// 兑出桌上筹码
+	for index, stack := range []int64{550, 450} {
+		if err = userService.CashOut("ledger", users[index].ID, stack, "", func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = userService.ReceiveCoin(100, users[1]); err != nil {
+		t.Fatal(err)
+	}
+	report, err = userService.VerifyLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Stacks != 0 || report.House != 0 || report.Users != 2100 || report.Faucet != -2100 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	winner, _ := userService.GetById(users[0].ID)
+	if winner.Balance != 1050 {
+		t.Fatalf("winner balance = %d, want 1050", winner.Balance)
+	}
+}
+
+func TestUserService_ConcurrentDeduct(t *testing.T) {
+	userService := newTestUserService(t)
+	user, err := userService.SignatureVerify("aleo-concurrent", 1000, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 买入期间余额任何时刻都不能为负
+	done := make(chan struct{})
+	monitor := make(chan int64, 1)
+	go func() {
+		lowest := int64(1000)
+		for {
+			select {
+			case <-done:
+				monitor <- lowest
+				return
+			default:
+			}
+			if dbUser, errs := userService.GetById(user.ID); errs == nil && dbUser.Balance < lowest {
+				lowest = dbUser.Balance
+			}
+		}
+	}()
+
+	// 多个协程同时买入,余额不能为负且不能丢失更新
+	var succeeded, insufficient int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs := userService.BuyIn("concurrent", user.ID, 30, "", func() error { return nil })
+			var fundsError *constant.InsufficientFundsError
+			switch {
+			case errs == nil:
+				atomic.AddInt64(&succeeded, 1)
+			case errors.As(errs, &fundsError) && errors.Is(errs, constant.UserNotEnoughBetError):
+				if fundsError.UserId != user.ID || fundsError.Amount != 30 || fundsError.Balance >= 30 {
+					t.Errorf("insufficient funds error = %+v", fundsError)
+				}
+				atomic.AddInt64(&insufficient, 1)
+			default:
+				t.Error(errs)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+
+	if lowest := <-monitor; lowest < 0 {
+		t.Fatalf("lowest balance = %d during buy in", lowest)
+	}
+	if succeeded != 33 || insufficient != 17 {
+		t.Fatalf("succeeded = %d, insufficient = %d, want 33 and 17", succeeded, insufficient)
+	}
+	dbUser, _ := userService.GetById(user.ID)
+	if dbUser.Balance != 10 {
+		t.Fatalf("balance = %d, want 10", dbUser.Balance)
+	}
+	if report, _ := userService.VerifyLedger(); !report.OK() || report.Stacks != 990 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestUserService_ConcurrentMixed(t *testing.T) {
+	userService := newTestUserService(t)
+	users := make([]db.User, 0)
+	for _, address := range []string{"aleo-mixed-0", "aleo-mixed-1"} {
+		user, err := userService.SignatureVerify(address, 100, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+
+	// 买入、补充筹码、领取金币同时修改同一账户
+	wg := sync.WaitGroup{}
+	for i := 0; i < 60; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 3 {
+			case 0:
+				for _, user := range users {
+					userService.BuyIn("mixed", user.ID, 20, "", func() error { return nil })
+				}
+			case 1:
+				userService.BuyIn("mixed", users[0].ID, 15, "", func() error { return nil })
+			case 2:
+				if errs := userService.ReceiveCoin(10, users[0]); errs != nil {
+					t.Error(errs)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	report, err := userService.VerifyLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Users+report.Stacks != 400 {
+		t.Fatalf("report = %+v, want 400 chips of users and stacks", report)
+	}
+	for _, user := range users {
+		if dbUser, _ := userService.GetById(user.ID); dbUser.Balance < 0 {
+			t.Fatalf("userId=%d balance = %d", user.ID, dbUser.Balance)
+		}
+	}
+}
+
+func TestUserService_ListTransactions(t *testing.T) {
+	userService := newTestUserService(t)
+
+	users := make([]db.User, 0)
+	for _, address := range []string{"aleo-history-0", "aleo-history-1"} {
+		user, err := userService.SignatureVerify(address, 1000, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	for _, gameId := range []string{"history-a", "history-b"} {
+		joinUsers := []*JoinUser{
+			{UserId: users[0].ID, Address: users[0].Address, Stack: 490, TotalBetChips: 10},
+			{UserId: users[1].ID, Address: users[1].Address, Stack: 450, TotalBetChips: 50},
+		}
+		if _, err := userService.UpateWinBetting(gameId, 1, 10, joinUsers, users[0].ID, 60, nil, func(int64) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := userService.ReceiveCoin(100, users[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// 注册赠送、两局的底注和下注、领取,按时间倒序
+	states := make([]int, 0)
+	cursor := int64(0)
+	for page := 0; page < 10; page++ {
+		result, err := userService.ListTransactions(users[1].ID, TransactionListReq{Cursor: cursor, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, history := range result.List {
+			if history.UserId != users[1].ID {
+				t.Fatalf("history = %+v, want userId %d", history, users[1].ID)
+			}
+			states = append(states, history.State)
+		}
+		if cursor = result.NextCursor; cursor == 0 {
+			break
+		}
+	}
+	want := []int{constant.BET_STATE_FAUCET, constant.BET_STATE_RAISE, constant.BET_STATE_ANTE, constant.BET_STATE_RAISE, constant.BET_STATE_ANTE, constant.BET_STATE_FAUCET}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for index := range want {
+		if states[index] != want[index] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+
+	// 按类型、游戏筛选
+	result, err := userService.ListTransactions(users[0].ID, TransactionListReq{States: []int{constant.BET_STATE_WIN}, GameId: "history-a", Limit: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.List) != 1 || result.List[0].Amount != 60 || result.NextCursor != 0 {
+		t.Fatalf("win list = %+v", result)
+	}
+
+	// 结束时间早于所有记录
+	if result, err = userService.ListTransactions(users[0].ID, TransactionListReq{EndTime: users[0].CreateAt.Add(-time.Hour).UnixMilli(), Limit: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.List) != 0 {
+		t.Fatalf("list = %+v, want empty", result.List)
+	}
+}